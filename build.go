@@ -4,12 +4,14 @@ import (
 	"database/sql"
 	"fmt"
 	"html/template"
+	"math"
 	"path"
 	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/brandur/deathguild/modules/dgassets"
+	"github.com/brandur/deathguild/modules/dgchart"
 	"github.com/brandur/deathguild/modules/dgcommon"
 	"github.com/brandur/deathguild/modules/dgquery"
 	"github.com/brandur/modulir"
@@ -137,7 +139,7 @@ func build(c *modulir.Context) []error {
 		}
 	}
 
-	playlistYears, err := dgquery.PlaylistYears(txn)
+	playlistYears, err := dgquery.PlaylistYears(txn, source.Name())
 	if err != nil {
 		return []error{err}
 	}
@@ -315,7 +317,7 @@ func renderIndex(c *modulir.Context, playlistYears []*dgquery.PlaylistYear) (boo
 		viewsChanged,
 		map[string]interface{}{
 			"PlaylistYears": playlistYears,
-			"Title":         "Death Guild Spotify Playlists",
+			"Title":         source.Title() + " Spotify Playlists",
 		},
 	)
 	return true, err
@@ -412,17 +414,22 @@ func renderStatistics(c *modulir.Context, db *sql.DB,
 func renderStatisticsInTransaction(c *modulir.Context, txn *sql.Tx, viewsChanged bool,
 	years []int, target string) error {
 
-	artistRankingsByPlays, err := dgquery.ArtistRankingsByPlays(txn, years, 15)
+	artistRankingsByPlays, err := dgquery.ArtistRankingsByPlays(txn, source.Name(), years, 15)
 	if err != nil {
 		return err
 	}
 
-	artistRankingsBySongs, err := dgquery.ArtistRankingsBySongs(txn, years, 15)
+	artistRankingsBySongs, err := dgquery.ArtistRankingsBySongs(txn, source.Name(), years, 15)
 	if err != nil {
 		return err
 	}
 
-	songRankings, err := dgquery.SongRankings(txn, years, 20, false)
+	songRankings, err := dgquery.SongRankings(txn, source.Name(), years, 20, false)
+	if err != nil {
+		return err
+	}
+
+	audioFeaturesByYear, err := dgquery.AudioFeaturesByYear(txn, source.Name(), years)
 	if err != nil {
 		return err
 	}
@@ -434,7 +441,7 @@ func renderStatisticsInTransaction(c *modulir.Context, txn *sql.Tx, viewsChanged
 		slug = "all-time"
 	}
 
-	spotifyID, err := dgquery.SpecialPlaylistSpotifyID(txn, slug)
+	spotifyID, err := dgquery.SpecialPlaylistSpotifyID(txn, source.Name(), slug)
 	if err != nil {
 		return err
 	}
@@ -442,6 +449,7 @@ func renderStatisticsInTransaction(c *modulir.Context, txn *sql.Tx, viewsChanged
 	locals := map[string]interface{}{
 		"ArtistRankingsByPlays": artistRankingsByPlays,
 		"ArtistRankingsBySongs": artistRankingsBySongs,
+		"AudioFeaturesByYear":   audioFeaturesByYear,
 		"SongRankings":          songRankings,
 		"SpotifyID":             spotifyID,
 		"ViewportWidth":         "800",
@@ -480,7 +488,12 @@ func renderStatisticsInTransaction(c *modulir.Context, txn *sql.Tx, viewsChanged
 
 var templateFuncMap = template.FuncMap{
 	"Add":                 add,
+	"AudioFeaturesChart":  audioFeaturesChart,
+	"Duration":            duration,
+	"Genres":              genres,
+	"Percent":             percent,
 	"PlaylistInfo":        playlistInfo,
+	"RunningTime":         runningTime,
 	"SpotifyPlaylistLink": spotifyPlaylistLink,
 	"SpotifySongLink":     spotifySongLink,
 	"VerboseDate":         verboseDate,
@@ -492,6 +505,74 @@ func add(x, y int) int {
 	return x + y
 }
 
+// The range of tempos shown on audio feature charts. It's fixed rather than
+// fit to each night so that charts for different nights can be compared.
+const (
+	chartMaxTempo = 200
+	chartMinTempo = 60
+)
+
+// Renders a playlist's tempo and energy from song to song as an inline SVG
+// chart. Returns an empty string if fewer than two of its songs have audio
+// features because there's no curve to speak of.
+func audioFeaturesChart(playlist *dgcommon.Playlist) template.HTML {
+	tempo := &dgchart.Series{
+		Class: "tempo",
+		Label: "Tempo (BPM)",
+		Max:   chartMaxTempo,
+		Min:   chartMinTempo,
+	}
+	energy := &dgchart.Series{
+		Class: "energy",
+		Label: "Energy",
+		Max:   1,
+		Min:   0,
+	}
+
+	var numWithFeatures int
+	for _, song := range playlist.Songs {
+		features := song.SpotifyAudioFeatures
+		if features == nil {
+			tempo.Values = append(tempo.Values, math.NaN())
+			energy.Values = append(energy.Values, math.NaN())
+			continue
+		}
+
+		numWithFeatures++
+		tempo.Values = append(tempo.Values, features.Tempo)
+		energy.Values = append(energy.Values, features.Energy)
+	}
+
+	if numWithFeatures < 2 {
+		return ""
+	}
+
+	return dgchart.Lines("Tempo and energy over the night", 800, 200, tempo, energy)
+}
+
+// Formats the length of a track like "5:54".
+func duration(d time.Duration) string {
+	seconds := int(d.Round(time.Second) / time.Second)
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
+
+// The most genres shown for an artist. Spotify gives some artists a long
+// list of them.
+const maxGenres = 3
+
+// Lists an artist's first few genres.
+func genres(genres []string) string {
+	if len(genres) > maxGenres {
+		genres = genres[:maxGenres]
+	}
+	return strings.Join(genres, ", ")
+}
+
+// Turns a fraction into a percentage.
+func percent(f float64) float64 {
+	return f * 100
+}
+
 // Returns some basic length information about the playlist.
 func playlistInfo(playlist *dgcommon.Playlist) string {
 	var numWithSpotifyID int
@@ -507,6 +588,40 @@ func playlistInfo(playlist *dgcommon.Playlist) string {
 		numWithSpotifyID, len(playlist.Songs), percent)
 }
 
+// Describes how long a playlist's songs run for according to Spotify, or
+// returns an empty string if we don't know the length of any of them.
+func runningTime(playlist *dgcommon.Playlist) string {
+	var numWithTrack int
+	for _, song := range playlist.Songs {
+		if song.SpotifyTrack != nil {
+			numWithTrack++
+		}
+	}
+
+	if numWithTrack == 0 {
+		return ""
+	}
+
+	minutes := int(playlist.RunningTime().Round(time.Minute) / time.Minute)
+
+	var length string
+	switch {
+	case minutes < 60:
+		length = fmt.Sprintf("%v minutes", minutes)
+	case minutes < 120:
+		length = fmt.Sprintf("1 hour %v minutes", minutes%60)
+	default:
+		length = fmt.Sprintf("%v hours %v minutes", minutes/60, minutes%60)
+	}
+
+	if numWithTrack == len(playlist.Songs) {
+		return fmt.Sprintf("Its songs run for %v.", length)
+	}
+
+	return fmt.Sprintf("The %v songs whose length we know run for %v.",
+		numWithTrack, length)
+}
+
 func spotifyPlaylistLink(spotifyID string) string {
 	return "https://open.spotify.com/user/" + conf.SpotifyUser +
 		"/playlist/" + spotifyID
@@ -564,6 +679,8 @@ func renderTemplate(c *modulir.Context, view, target string, dynamicReload bool,
 		"GoogleAnalyticsID": conf.GoogleAnalyticsID,
 		"LocalFonts":        conf.LocalFonts,
 		"Release":           Release,
+		"SourceTitle":       source.Title(),
+		"SourceURL":         source.URL(),
 		"ViewportWidth":     "device-width, initial-scale=1",
 	}
 
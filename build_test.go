@@ -1,12 +1,68 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/brandur/deathguild/modules/dgcommon"
 	assert "github.com/stretchr/testify/require"
+	"github.com/yosssi/gcss"
 )
 
+func TestAudioFeaturesChart(t *testing.T) {
+	song := func(tempo, energy float64) *dgcommon.Song {
+		return &dgcommon.Song{SpotifyAudioFeatures: &dgcommon.AudioFeatures{
+			Energy: energy,
+			Tempo:  tempo,
+		}}
+	}
+
+	// Not enough to draw a curve.
+	assert.Equal(t, "", string(audioFeaturesChart(&dgcommon.Playlist{
+		Songs: []*dgcommon.Song{song(120, 0.5), {}},
+	})))
+
+	chart := string(audioFeaturesChart(&dgcommon.Playlist{
+		Songs: []*dgcommon.Song{song(120, 0.5), {}, song(140, 0.9), song(130, 0.8)},
+	}))
+	assert.Contains(t, chart, `<polyline class="tempo"`)
+	assert.Contains(t, chart, `<polyline class="energy"`)
+}
+
+func TestCompileStylesheets(t *testing.T) {
+	paths, err := filepath.Glob("content/stylesheets/*.sass")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, paths)
+
+	for _, path := range paths {
+		f, err := os.Open(path)
+		assert.NoError(t, err)
+
+		_, err = gcss.Compile(ioutil.Discard, f)
+		f.Close()
+		assert.NoError(t, err, path)
+	}
+}
+
+func TestDuration(t *testing.T) {
+	assert.Equal(t, "5:54", duration(5*time.Minute+54*time.Second))
+	assert.Equal(t, "0:07", duration(7*time.Second))
+	assert.Equal(t, "1:00", duration(59*time.Second+600*time.Millisecond))
+}
+
+func TestGenres(t *testing.T) {
+	assert.Equal(t, "", genres(nil))
+	assert.Equal(t, "darkwave, ebm, synthpop",
+		genres([]string{"darkwave", "ebm", "synthpop", "futurepop"}))
+}
+
+func TestPercent(t *testing.T) {
+	assert.Equal(t, 25.0, percent(0.25))
+}
+
 func TestPlaylistInfo(t *testing.T) {
 	playlist := &dgcommon.Playlist{
 		Songs: []*dgcommon.Song{
@@ -20,6 +76,29 @@ func TestPlaylistInfo(t *testing.T) {
 		playlistInfo(playlist))
 }
 
+func TestRunningTime(t *testing.T) {
+	song := func(d time.Duration) *dgcommon.Song {
+		return &dgcommon.Song{SpotifyTrack: &dgcommon.SpotifyTrack{Duration: d}}
+	}
+
+	assert.Equal(t, "", runningTime(&dgcommon.Playlist{
+		Songs: []*dgcommon.Song{{}},
+	}))
+
+	assert.Equal(t, "Its songs run for 45 minutes.", runningTime(&dgcommon.Playlist{
+		Songs: []*dgcommon.Song{song(20 * time.Minute), song(25 * time.Minute)},
+	}))
+
+	assert.Equal(t, "Its songs run for 1 hour 5 minutes.", runningTime(&dgcommon.Playlist{
+		Songs: []*dgcommon.Song{song(60 * time.Minute), song(5 * time.Minute)},
+	}))
+
+	assert.Equal(t, "The 2 songs whose length we know run for 3 hours 2 minutes.",
+		runningTime(&dgcommon.Playlist{
+			Songs: []*dgcommon.Song{song(2 * time.Hour), song(62 * time.Minute), {}},
+		}))
+}
+
 func TestSpotifyPlaylistLink(t *testing.T) {
 	conf.SpotifyUser = "fyrerise"
 
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/brandur/deathguild/modules/dgcommon"
+	"github.com/brandur/deathguild/modules/dgmatch"
+	"github.com/brandur/deathguild/modules/dgstore"
+	"github.com/brandur/modulir"
+	"github.com/joeshaw/envdecode"
+	_ "github.com/lib/pq"
+	"github.com/spf13/cobra"
+	"github.com/zmb3/spotify"
+)
+
+// The number of tracks that we ask Spotify for at once. It's the most that
+// its tracks endpoint will take.
+const batchSize = 50
+
+// Conf contains configuration information for the command. It's extracted from
+// environment variables.
+type Conf struct {
+	// ClientID is our Spotify applicaton's client ID.
+	ClientID string `env:"CLIENT_ID,required"`
+
+	// ClientSecret is our Spotify applicaton's client secret.
+	ClientSecret string `env:"CLIENT_SECRET,required"`
+
+	// DatabaseURL is a connection string for a database used to store playlist
+	// and song information.
+	DatabaseURL string `env:"DATABASE_URL,required"`
+
+	// Limit is the most songs that will be audited in one run. The most
+	// played songs are audited first.
+	Limit int `env:"LIMIT,default=1000"`
+
+	// RefreshToken is our Spotify refresh token.
+	RefreshToken string `env:"REFRESH_TOKEN,required"`
+
+	// SpotifyMaxRetries is the number of times that a request rate limited
+	// by Spotify is retried before giving up.
+	SpotifyMaxRetries int `env:"SPOTIFY_MAX_RETRIES,default=10"`
+
+	// SpotifyRequestsPerSecond is the rate that requests to Spotify are
+	// held to. The rate drops on its own when Spotify rate limits us and
+	// climbs back up as requests go through.
+	SpotifyRequestsPerSecond float64 `env:"SPOTIFY_REQUESTS_PER_SECOND,default=2"`
+}
+
+var client *dgcommon.SpotifyClient
+var conf Conf
+var db *sql.DB
+var log modulir.LoggerInterface = &modulir.Logger{Level: modulir.LevelInfo}
+
+// The columns of an audit written as CSV, in order.
+var csvHeader = []string{"song_id", "artist", "title", "spotify_id",
+	"spotify_artist", "spotify_title", "score", "num_plays", "cleared"}
+
+// auditEntry is a song along with how well the Spotify track that it's
+// matched to scores against it.
+type auditEntry struct {
+	SongID    int    `json:"song_id"`
+	Artist    string `json:"artist"`
+	Title     string `json:"title"`
+	SpotifyID string `json:"spotify_id"`
+
+	// SpotifyArtist and SpotifyTitle are what Spotify has for the track.
+	// SpotifyArtist joins the track's artists with commas.
+	SpotifyArtist string `json:"spotify_artist"`
+	SpotifyTitle  string `json:"spotify_title"`
+
+	// Score is how well the track matches the song from 0 to 1, scored the
+	// same way as when dg-enrich-songs searches for songs.
+	Score float64 `json:"score"`
+
+	// NumPlays is the number of times that the song was played.
+	NumPlays int `json:"num_plays"`
+
+	// Cleared is set if the song lost its Spotify ID because it scored too
+	// low.
+	Cleared bool `json:"cleared"`
+}
+
+// auditOptions are the options that an audit was run with from the command
+// line.
+type auditOptions struct {
+	all        bool
+	clearBelow float64
+	format     string
+	output     string
+}
+
+func main() {
+	opts := &auditOptions{}
+
+	rootCmd := &cobra.Command{
+		Use:   "dg-audit-spotify-matches",
+		Short: "Find songs that were matched to the wrong Spotify tracks",
+		Long: strings.TrimSpace(`
+Fetches the Spotify tracks that songs are matched to and scores each
+one against its song the same way that dg-enrich-songs scores search
+results. Songs are written out worst match first as a list to review.
+
+By default only songs that were matched before match scores were
+stored are audited. Songs pinned to a track by hand are left alone.
+With --clear-below, songs scoring under the threshold lose their
+Spotify IDs and are queued to be searched for again.`),
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			audit(opts)
+		},
+	}
+	rootCmd.Flags().BoolVar(&opts.all, "all", false,
+		"Include songs that already have a match score")
+	rootCmd.Flags().Float64Var(&opts.clearBelow, "clear-below", 0,
+		"Clear the Spotify IDs of songs scoring under this (0 to 1)")
+	rootCmd.Flags().StringVar(&opts.format, "format", "csv",
+		"Format to write the audit in (csv or json)")
+	rootCmd.Flags().StringVar(&opts.output, "output", "",
+		"File to write the audit to instead of stdout")
+
+	if err := rootCmd.Execute(); err != nil {
+		dgcommon.ExitWithError(err)
+	}
+}
+
+func audit(opts *auditOptions) {
+	if opts.clearBelow < 0 || opts.clearBelow > 1 {
+		dgcommon.ExitWithError(fmt.Errorf("--clear-below must be between 0 and 1"))
+	}
+
+	var write func(io.Writer, []*auditEntry) error
+	switch opts.format {
+	case "csv":
+		write = writeCSV
+	case "json":
+		write = writeJSON
+	default:
+		dgcommon.ExitWithError(fmt.Errorf("Unknown format: %v (must be csv or json)", opts.format))
+	}
+
+	err := envdecode.Decode(&conf)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	db, err = sql.Open("postgres", conf.DatabaseURL)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	client = dgcommon.GetSpotifyClient(
+		conf.ClientID, conf.ClientSecret, conf.RefreshToken,
+		dgcommon.NewRateLimiter(conf.SpotifyRequestsPerSecond), conf.SpotifyMaxRetries, log)
+
+	txn, err := db.Begin()
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	entries, err := songsToAudit(txn, opts.all, conf.Limit)
+	txn.Rollback()
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	tracks, err := fetchTracks(entries)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	entries, numMissing := scoreEntries(entries, tracks)
+	if numMissing > 0 {
+		log.Infof("Skipped %v song(s) whose tracks Spotify didn't return; "+
+			"run dg-verify-spotify-ids to requeue them", numMissing)
+	}
+
+	// The output is opened and the audit written to it before anything that
+	// was cleared is committed so that there's always a record of what was
+	// cleared.
+	var f *os.File
+	w := io.Writer(os.Stdout)
+	if opts.output != "" {
+		f, err = os.Create(opts.output)
+		if err != nil {
+			dgcommon.ExitWithError(err)
+		}
+		w = f
+	}
+
+	txn, err = db.Begin()
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+	defer txn.Rollback()
+
+	if opts.clearBelow > 0 {
+		err = clearMismatches(txn, entries, opts.clearBelow)
+		if err != nil {
+			dgcommon.ExitWithError(err)
+		}
+	}
+
+	err = write(w, entries)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	if f != nil {
+		err = f.Close()
+		if err != nil {
+			dgcommon.ExitWithError(err)
+		}
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	if opts.output != "" {
+		log.Infof("Wrote audit of %v song(s) to %v", len(entries), opts.output)
+	}
+}
+
+// clearMismatches takes the Spotify IDs away from every song in entries that
+// scored under threshold so that dg-enrich-songs searches for it again, and
+// marks the entries of the songs that were cleared. A song is only cleared if
+// it's still matched to the track that was audited. Playlists containing the
+// songs are flagged to be synced.
+func clearMismatches(txn *sql.Tx, entries []*auditEntry, threshold float64) error {
+	spotifyIDs := make(map[int]string)
+	for _, entry := range entries {
+		if entry.Score < threshold {
+			spotifyIDs[entry.SongID] = entry.SpotifyID
+		}
+	}
+
+	if len(spotifyIDs) == 0 {
+		return nil
+	}
+
+	clearedIDs, err := dgstore.RequeueMismatchedSongs(txn, spotifyIDs)
+	if err != nil {
+		return err
+	}
+
+	cleared := make(map[int]bool, len(clearedIDs))
+	for _, id := range clearedIDs {
+		cleared[id] = true
+	}
+
+	for _, entry := range entries {
+		entry.Cleared = cleared[entry.SongID]
+	}
+
+	log.Infof("Cleared the Spotify IDs of %v song(s) scoring under %.2f",
+		len(clearedIDs), threshold)
+
+	return dgstore.MarkPlaylistsForSync(txn, clearedIDs)
+}
+
+// fetchTracks fetches the Spotify tracks for every distinct Spotify ID in
+// entries, batchSize at a time. Tracks that Spotify doesn't have are left
+// out.
+func fetchTracks(entries []*auditEntry) (map[string]*spotify.FullTrack, error) {
+	tracks := make(map[string]*spotify.FullTrack)
+
+	var ids []spotify.ID
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		if !seen[entry.SpotifyID] {
+			seen[entry.SpotifyID] = true
+			ids = append(ids, spotify.ID(entry.SpotifyID))
+		}
+	}
+
+	for start := 0; start < len(ids); start += batchSize {
+		end := start + batchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		log.Debugf("Fetching tracks %v to %v of %v", start+1, end, len(ids))
+
+		batch, err := client.GetTracks(ids[start:end]...)
+		if err != nil {
+			return nil, fmt.Errorf("Error fetching tracks from Spotify: %v", err)
+		}
+
+		// Tracks come back at the same position as the IDs that were asked
+		// for. They're keyed by the ID asked for since Spotify may have
+		// relinked them to another ID.
+		for i, track := range batch {
+			if track != nil && start+i < end {
+				tracks[string(ids[start+i])] = track
+			}
+		}
+	}
+
+	return tracks, nil
+}
+
+// scoreEntries scores every entry against the track that its song is matched
+// to and ranks them with the worst matches first. Ties go to the songs that
+// were played the most since those matter the most. Entries whose tracks
+// aren't in tracks are dropped and counted.
+func scoreEntries(entries []*auditEntry, tracks map[string]*spotify.FullTrack) ([]*auditEntry, int) {
+	var scored []*auditEntry
+	var numMissing int
+
+	for _, entry := range entries {
+		track, ok := tracks[entry.SpotifyID]
+		if !ok {
+			numMissing++
+			continue
+		}
+
+		candidate := &dgmatch.Candidate{Album: track.Album.Name, Title: track.Name}
+		for _, artist := range track.Artists {
+			candidate.Artists = append(candidate.Artists, artist.Name)
+		}
+
+		entry.SpotifyArtist = strings.Join(candidate.Artists, ", ")
+		entry.SpotifyTitle = track.Name
+		entry.Score = dgmatch.Score(entry.Artist, entry.Title, candidate)
+		scored = append(scored, entry)
+	}
+
+	sort.SliceStable(scored, func(i, j int) bool {
+		a, b := scored[i], scored[j]
+		if a.Score != b.Score {
+			return a.Score < b.Score
+		}
+		if a.NumPlays != b.NumPlays {
+			return a.NumPlays > b.NumPlays
+		}
+		return a.SongID < b.SongID
+	})
+
+	return scored, numMissing
+}
+
+// songsToAudit finds up to limit songs matched to a Spotify track, the most
+// played first. Unless all is set, only songs without a match score (those
+// matched before scores were stored) are included. Songs pinned to a track
+// by hand are left to whoever pinned them.
+func songsToAudit(txn *sql.Tx, all bool, limit int) ([]*auditEntry, error) {
+	rows, err := txn.Query(`
+		SELECT s.id, s.artist, s.title, s.spotify_id,
+			COALESCE(plays.num_plays, 0)
+		FROM songs s
+			LEFT JOIN (
+				SELECT songs_id, count(*) AS num_plays
+				FROM playlists_songs
+				GROUP BY songs_id
+			) plays
+				ON plays.songs_id = s.id
+		WHERE s.spotify_id IS NOT NULL
+			AND ($1 OR s.spotify_match_score IS NULL)
+			AND NOT EXISTS (
+				SELECT 1
+				FROM song_spotify_overrides o
+				WHERE o.normalized_key = s.normalized_key
+					AND o.kind = 'pin'
+			)
+		ORDER BY COALESCE(plays.num_plays, 0) DESC, s.id
+		LIMIT $2`,
+		all,
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []*auditEntry
+
+	for rows.Next() {
+		var entry auditEntry
+		err = rows.Scan(
+			&entry.SongID,
+			&entry.Artist,
+			&entry.Title,
+			&entry.SpotifyID,
+			&entry.NumPlays,
+		)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, &entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// writeCSV writes an audit as CSV with a header row.
+func writeCSV(w io.Writer, entries []*auditEntry) error {
+	cw := csv.NewWriter(w)
+
+	err := cw.Write(csvHeader)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		err = cw.Write([]string{
+			strconv.Itoa(entry.SongID),
+			entry.Artist,
+			entry.Title,
+			entry.SpotifyID,
+			entry.SpotifyArtist,
+			entry.SpotifyTitle,
+			strconv.FormatFloat(entry.Score, 'f', 3, 64),
+			strconv.Itoa(entry.NumPlays),
+			strconv.FormatBool(entry.Cleared),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeJSON writes an audit as a JSON array.
+func writeJSON(w io.Writer, entries []*auditEntry) error {
+	// Make sure that an empty audit comes out as `[]` instead of `null`.
+	if entries == nil {
+		entries = []*auditEntry{}
+	}
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/brandur/deathguild/modules/dgcommon"
+	"github.com/brandur/deathguild/modules/dgstore"
+	"github.com/brandur/deathguild/modules/dgtesting"
+	assert "github.com/stretchr/testify/require"
+	"github.com/zmb3/spotify"
+)
+
+func init() {
+	db = dgtesting.DB
+}
+
+func track(artist, title string) *spotify.FullTrack {
+	return &spotify.FullTrack{
+		SimpleTrack: spotify.SimpleTrack{
+			Artists: []spotify.SimpleArtist{{Name: artist}},
+			Name:    title,
+		},
+	}
+}
+
+func TestScoreEntries(t *testing.T) {
+	entries := []*auditEntry{
+		{SongID: 1, Artist: "The Cure", Title: "A Forest", SpotifyID: "forest-id", NumPlays: 10},
+		{SongID: 2, Artist: "Ikon", Title: "Ghost", SpotifyID: "karaoke-id", NumPlays: 1},
+		{SongID: 3, Artist: "Covenant", Title: "Dead Stars", SpotifyID: "gone-id", NumPlays: 5},
+		{SongID: 4, Artist: "Panic Lift", Title: "The Path", SpotifyID: "wrong-id", NumPlays: 1},
+		{SongID: 5, Artist: "Panic Lift", Title: "The Path", SpotifyID: "wrong-id", NumPlays: 3},
+	}
+
+	tracks := map[string]*spotify.FullTrack{
+		"forest-id":  track("The Cure", "A Forest"),
+		"karaoke-id": track("Karaoke Hits", "Ghost (Karaoke Version)"),
+		"wrong-id":   track("Someone Else", "Something Else"),
+	}
+
+	scored, numMissing := scoreEntries(entries, tracks)
+	assert.Equal(t, 1, numMissing)
+
+	// Worst first, with the most played first among songs that score the
+	// same. The karaoke version is penalized down to nothing.
+	var songIDs []int
+	for _, entry := range scored {
+		songIDs = append(songIDs, entry.SongID)
+	}
+	assert.Equal(t, []int{2, 5, 4, 1}, songIDs)
+	assert.Equal(t, 0.0, scored[0].Score)
+	assert.Equal(t, scored[1].Score, scored[2].Score)
+
+	assert.Equal(t, "The Cure", scored[3].SpotifyArtist)
+	assert.Equal(t, "A Forest", scored[3].SpotifyTitle)
+	assert.True(t, scored[3].Score > 0.9)
+}
+
+func TestWriteCSV(t *testing.T) {
+	var buf bytes.Buffer
+	err := writeCSV(&buf, []*auditEntry{
+		{SongID: 1, Artist: "Ikon", Title: "Ghost", SpotifyID: "karaoke-id",
+			SpotifyArtist: "Karaoke Hits, Ikon", SpotifyTitle: "Ghost", Score: 0.25,
+			NumPlays: 3, Cleared: true},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t,
+		"song_id,artist,title,spotify_id,spotify_artist,spotify_title,score,num_plays,cleared\n"+
+			"1,Ikon,Ghost,karaoke-id,\"Karaoke Hits, Ikon\",Ghost,0.250,3,true\n",
+		buf.String())
+}
+
+func TestWriteJSON(t *testing.T) {
+	var buf bytes.Buffer
+	err := writeJSON(&buf, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "[]\n", buf.String())
+
+	buf.Reset()
+	err = writeJSON(&buf, []*auditEntry{
+		{SongID: 1, Artist: "Ikon", Title: "Ghost", SpotifyID: "karaoke-id", Score: 0.25},
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, buf.String(), `"spotify_id": "karaoke-id"`)
+	assert.Contains(t, buf.String(), `"score": 0.25`)
+}
+
+func TestSongsToAudit(t *testing.T) {
+	txn, err := db.Begin()
+	assert.NoError(t, err)
+	defer func() {
+		err := txn.Rollback()
+		assert.NoError(t, err)
+	}()
+
+	_, err = dgstore.UpsertPlaylistAndSongs(txn, "deathguild", "2016-01-01", []*dgcommon.Song{
+		{Artist: "Ikon", Title: "Ghost"},
+		{Artist: "Covenant", Title: "Dead Stars"},
+	})
+	assert.NoError(t, err)
+
+	for _, song := range []struct{ artist, title, spotifyID string }{
+		{"Ikon", "Ghost", "ghost-id"},
+		{"Covenant", "Dead Stars", "dead-stars-id"},
+	} {
+		_, err = dgstore.SetSongSpotifyID(txn, song.artist, song.title, song.spotifyID)
+		assert.NoError(t, err)
+	}
+	dgtesting.InsertSong(t, txn, &dgcommon.Song{
+		Artist: "The Cure", Title: "A Forest", SpotifyID: "forest-id"})
+	dgtesting.InsertSong(t, txn, &dgcommon.Song{Artist: "Panic Lift", Title: "The Path"})
+
+	// Songs matched by a search that was scored are only audited with all.
+	_, err = txn.Exec(`
+		UPDATE songs
+		SET spotify_match_score = 0.9
+		WHERE title = 'Dead Stars'`,
+	)
+	assert.NoError(t, err)
+
+	// Songs pinned by hand are left alone.
+	err = dgstore.UpsertSpotifyOverride(txn, &dgstore.SpotifyOverride{
+		Kind:      dgstore.OverridePin,
+		Artist:    "The Cure",
+		Title:     "A Forest",
+		SpotifyID: "forest-id",
+	})
+	assert.NoError(t, err)
+
+	entries, err := songsToAudit(txn, false, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, "Ghost", entries[0].Title)
+	assert.Equal(t, "ghost-id", entries[0].SpotifyID)
+	assert.Equal(t, 1, entries[0].NumPlays)
+
+	entries, err = songsToAudit(txn, true, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(entries))
+
+	entries, err = songsToAudit(txn, true, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(entries))
+}
+
+func TestClearMismatches(t *testing.T) {
+	txn, err := db.Begin()
+	assert.NoError(t, err)
+	defer func() {
+		err := txn.Rollback()
+		assert.NoError(t, err)
+	}()
+
+	_, err = dgstore.UpsertPlaylistAndSongs(txn, "deathguild", "2016-01-01", []*dgcommon.Song{
+		{Artist: "The Cure", Title: "A Forest"},
+		{Artist: "Ikon", Title: "Ghost"},
+	})
+	assert.NoError(t, err)
+
+	for _, song := range []struct{ artist, title, spotifyID string }{
+		{"The Cure", "A Forest", "forest-id"},
+		{"Ikon", "Ghost", "karaoke-id"},
+	} {
+		_, err = dgstore.SetSongSpotifyID(txn, song.artist, song.title, song.spotifyID)
+		assert.NoError(t, err)
+	}
+
+	_, err = txn.Exec(`
+		UPDATE playlists
+		SET spotify_needs_sync = false`,
+	)
+	assert.NoError(t, err)
+
+	entries, err := songsToAudit(txn, false, 10)
+	assert.NoError(t, err)
+	// Both songs score badly, but "A Forest" was matched to another track
+	// after it was audited.
+	for _, entry := range entries {
+		entry.Score = 0.25
+		if entry.Title == "A Forest" {
+			entry.SpotifyID = "audited-forest-id"
+		}
+	}
+
+	err = clearMismatches(txn, entries, 0.5)
+	assert.NoError(t, err)
+
+	for _, entry := range entries {
+		assert.Equal(t, entry.Title == "Ghost", entry.Cleared)
+	}
+
+	var numWithID int
+	var needsSync bool
+	err = txn.QueryRow(`
+		SELECT
+			(SELECT count(*) FROM songs WHERE spotify_id IS NOT NULL),
+			(SELECT spotify_needs_sync FROM playlists WHERE day = '2016-01-01')`,
+	).Scan(&numWithID, &needsSync)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, numWithID)
+	assert.True(t, needsSync)
+}
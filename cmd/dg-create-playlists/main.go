@@ -6,6 +6,7 @@ import (
 
 	"github.com/brandur/deathguild/modules/dgcommon"
 	"github.com/brandur/deathguild/modules/dgquery"
+	"github.com/brandur/deathguild/modules/dgsource"
 	"github.com/brandur/modulir"
 	"github.com/joeshaw/envdecode"
 	_ "github.com/lib/pq"
@@ -13,16 +14,18 @@ import (
 	"github.com/zmb3/spotify"
 )
 
-// Format for the names and descriptions of Death Guild playlists.
+// Format for the names and descriptions of playlists. Each takes the title of
+// the source (e.g. "Death Guild") as its first argument, and descriptions link
+// back to the site at SiteURL.
 const (
-	playlistAllTimeName        = "Death Guild — Top of all-time"
-	playlistAllTimeDescription = `A compliation playlist of the top songs played at Death Guild for all time. See: https://deathguild.brandur.org/statistics`
+	playlistAllTimeNameFormat        = "%v — Top of all-time"
+	playlistAllTimeDescriptionFormat = `A compliation playlist of the top songs played at %v for all time. See: %v/statistics`
 
-	playlistDayNameFormat        = "Death Guild — %v"
-	playlistDayDescriptionFormat = `A playlist played at the Death Guild event of %v. See: https://deathguild.brandur.org/playlists/%v.`
+	playlistDayNameFormat        = "%v — %v"
+	playlistDayDescriptionFormat = `A playlist played at the %v event of %v. See: %v/playlists/%v.`
 
-	playlistYearNameFormat        = "Death Guild — Top of %v"
-	playlistYearDescriptionFormat = `A compliation playlist of the top songs played at Death Guild in %v. See: https://deathguild.brandur.org/statistics/%v.`
+	playlistYearNameFormat        = "%v — Top of %v"
+	playlistYearDescriptionFormat = `A compliation playlist of the top songs played at %v in %v. See: %v/statistics/%v.`
 )
 
 // Maximum number of playlists to try and handle in a single run.
@@ -50,13 +53,30 @@ type Conf struct {
 
 	// RefreshToken is our Spotify refresh token.
 	RefreshToken string `env:"REFRESH_TOKEN,required"`
+
+	// SiteURL is the URL of the site built for the source. It's linked to
+	// from playlist descriptions.
+	SiteURL string `env:"SITE_URL,default=https://deathguild.brandur.org"`
+
+	// Source is the name of the source to create playlists for.
+	Source string `env:"SOURCE,default=deathguild"`
+
+	// SpotifyMaxRetries is the number of times that a request rate limited
+	// by Spotify is retried before giving up.
+	SpotifyMaxRetries int `env:"SPOTIFY_MAX_RETRIES,default=10"`
+
+	// SpotifyRequestsPerSecond is the rate that requests to Spotify are
+	// held to across all workers. The rate drops on its own when Spotify
+	// rate limits us and climbs back up as requests go through.
+	SpotifyRequestsPerSecond float64 `env:"SPOTIFY_REQUESTS_PER_SECOND,default=2"`
 }
 
-var client *spotify.Client
+var client *dgcommon.SpotifyClient
 var conf Conf
 var db *sql.DB
 var log modulir.LoggerInterface = &modulir.Logger{Level: modulir.LevelInfo}
 var playlistMap map[string]spotify.ID
+var source dgsource.Source
 var userID string
 
 func main() {
@@ -70,12 +90,17 @@ func main() {
 		dgcommon.ExitWithError(err)
 	}
 
+	source, err = dgsource.Get(conf.Source)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
 	txn, err := db.Begin()
 	if err != nil {
 		dgcommon.ExitWithError(err)
 	}
 
-	playlistYears, err := dgquery.PlaylistYears(txn)
+	playlistYears, err := dgquery.PlaylistYears(txn, source.Name())
 	if err != nil {
 		dgcommon.ExitWithError(err)
 	}
@@ -94,7 +119,8 @@ func main() {
 	pool.StartRound()
 
 	client = dgcommon.GetSpotifyClient(
-		conf.ClientID, conf.ClientSecret, conf.RefreshToken)
+		conf.ClientID, conf.ClientSecret, conf.RefreshToken,
+		dgcommon.NewRateLimiter(conf.SpotifyRequestsPerSecond), conf.SpotifyMaxRetries, log)
 
 	// A user is needed for some API operations, so just cache one for the
 	// whole set of requests.
@@ -118,8 +144,8 @@ func main() {
 		pool.Jobs <- modulir.NewJob("playlist: all-time", func() (bool, error) {
 			return createPlaylistForYear(
 				allYears,
-				playlistAllTimeName,
-				playlistAllTimeDescription,
+				fmt.Sprintf(playlistAllTimeNameFormat, source.Title()),
+				fmt.Sprintf(playlistAllTimeDescriptionFormat, source.Title(), conf.SiteURL),
 			)
 		})
 	}
@@ -133,8 +159,9 @@ func main() {
 			pool.Jobs <- modulir.NewJob(name, func() (bool, error) {
 				return createPlaylistForYear(
 					[]int{playlistYear.Year},
-					fmt.Sprintf(playlistYearNameFormat, playlistYear.Year),
-					fmt.Sprintf(playlistYearDescriptionFormat, playlistYear.Year, playlistYear.Year),
+					fmt.Sprintf(playlistYearNameFormat, source.Title(), playlistYear.Year),
+					fmt.Sprintf(playlistYearDescriptionFormat, source.Title(),
+						playlistYear.Year, conf.SiteURL, playlistYear.Year),
 				)
 			})
 		}
@@ -183,9 +210,9 @@ func createPlaylistForDay(playlist *dgcommon.Playlist) (bool, error) {
 		return false, err
 	}
 
-	name := fmt.Sprintf(playlistDayNameFormat, playlist.FormattedDay())
-	description := fmt.Sprintf(playlistDayDescriptionFormat,
-		playlist.FormattedDay(), playlist.FormattedDay())
+	name := fmt.Sprintf(playlistDayNameFormat, source.Title(), playlist.FormattedDay())
+	description := fmt.Sprintf(playlistDayDescriptionFormat, source.Title(),
+		playlist.FormattedDay(), conf.SiteURL, playlist.FormattedDay())
 
 	spotifyIDs := make([]spotify.ID, len(playlist.Songs))
 	for i, song := range playlist.Songs {
@@ -217,7 +244,7 @@ func createPlaylistForYear(years []int, name, description string) (bool, error)
 		return false, err
 	}
 
-	songRankings, err := dgquery.SongRankings(txn, years, 50, true)
+	songRankings, err := dgquery.SongRankings(txn, source.Name(), years, 50, true)
 	if err != nil {
 		return false, err
 	}
@@ -239,7 +266,7 @@ func createPlaylistForYear(years []int, name, description string) (bool, error)
 		slug = "all-time"
 	}
 
-	err = updatePlaylistSpecial(txn, slug, playlistID)
+	err = updatePlaylistSpecial(txn, source.Name(), slug, playlistID)
 	if err != nil {
 		return true, errors.Wrapf(err,
 			"Error updating special playlist '%v' spotify ID", slug)
@@ -354,17 +381,23 @@ func getPlaylists(pool *modulir.Pool) ([]*dgcommon.Playlist, error) {
 
 	// Do work in batches so we don't have to keep everything in memory
 	// at once.
-	return getPlaylistsInTransaction(txn, maxPlaylists)
+	return getPlaylistsInTransaction(txn, source.Name(), maxPlaylists)
 }
 
-func getPlaylistsInTransaction(txn *sql.Tx, limit int) ([]*dgcommon.Playlist, error) {
+func getPlaylistsInTransaction(txn *sql.Tx, sourceName string, limit int) ([]*dgcommon.Playlist, error) {
 	rows, err := txn.Query(`
-		SELECT id, day
+		SELECT id, source, day
 		FROM playlists
-		WHERE spotify_id IS NULL
+		WHERE source = $1
+			-- quarantined playlists are held back until reviewed
+			AND status = 'published'
+			AND (spotify_id IS NULL
+				-- playlists whose songs changed since they were last synced
+				OR spotify_needs_sync)
 		-- create the most recent first
 		ORDER BY day DESC
-		LIMIT $1`,
+		LIMIT $2`,
+		sourceName,
 		limit,
 	)
 	if err != nil {
@@ -378,6 +411,7 @@ func getPlaylistsInTransaction(txn *sql.Tx, limit int) ([]*dgcommon.Playlist, er
 		var playlist dgcommon.Playlist
 		err = rows.Scan(
 			&playlist.ID,
+			&playlist.Source,
 			&playlist.Day,
 		)
 		if err != nil {
@@ -406,7 +440,8 @@ func updatePlaylist(txn *sql.Tx, playlist *dgcommon.Playlist) error {
 
 	_, err := txn.Exec(`
 		UPDATE playlists
-		SET spotify_id = $1
+		SET spotify_id = $1,
+			spotify_needs_sync = false
 		WHERE id = $2`,
 		spotifyID,
 		playlist.ID,
@@ -414,15 +449,16 @@ func updatePlaylist(txn *sql.Tx, playlist *dgcommon.Playlist) error {
 	return err
 }
 
-func updatePlaylistSpecial(txn *sql.Tx, slug string, spotifyID spotify.ID) error {
+func updatePlaylistSpecial(txn *sql.Tx, sourceName, slug string, spotifyID spotify.ID) error {
 	_, err := txn.Exec(`
 		INSERT INTO special_playlists
-			(spotify_id, slug)
+			(spotify_id, source, slug)
 		VALUES
-			($1, $2)
-		ON CONFLICT (slug)
+			($1, $2, $3)
+		ON CONFLICT (source, slug)
 			DO UPDATE SET spotify_id = EXCLUDED.spotify_id`,
 		string(spotifyID),
+		sourceName,
 		slug,
 	)
 	return err
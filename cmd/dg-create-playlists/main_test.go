@@ -2,6 +2,7 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
 	"testing"
 	"time"
 
@@ -14,6 +15,22 @@ func init() {
 	db = dgtesting.DB
 }
 
+func TestPlaylistNameFormats(t *testing.T) {
+	// Existing playlists are found in Spotify by name, so these must not
+	// change for Death Guild.
+	assert.Equal(t, "Death Guild — Top of all-time",
+		fmt.Sprintf(playlistAllTimeNameFormat, "Death Guild"))
+	assert.Equal(t, "Death Guild — 2016-09-26",
+		fmt.Sprintf(playlistDayNameFormat, "Death Guild", "2016-09-26"))
+	assert.Equal(t, "Death Guild — Top of 2016",
+		fmt.Sprintf(playlistYearNameFormat, "Death Guild", 2016))
+
+	assert.Equal(t,
+		"A playlist played at the Death Guild event of 2016-09-26. See: https://deathguild.brandur.org/playlists/2016-09-26.",
+		fmt.Sprintf(playlistDayDescriptionFormat, "Death Guild", "2016-09-26",
+			"https://deathguild.brandur.org", "2016-09-26"))
+}
+
 func TestGetPlaylistsInTransaction(t *testing.T) {
 	txn, err := db.Begin()
 	assert.NoError(t, err)
@@ -25,17 +42,38 @@ func TestGetPlaylistsInTransaction(t *testing.T) {
 	playlists := []*dgcommon.Playlist{
 		{Day: time.Now(), SpotifyID: "spotify-id"},
 		{Day: time.Now().Add(30 * 24 * time.Hour)},
+		{Day: time.Now().Add(-30 * 24 * time.Hour), SpotifyID: "spotify-id-stale"},
+		{Day: time.Now().Add(-60 * 24 * time.Hour)},
 	}
 
 	for _, playlist := range playlists {
 		dgtesting.InsertPlaylist(t, txn, playlist)
 	}
 
-	actualPlaylist, err := getPlaylistsInTransaction(txn, 1000)
+	// Songs in this playlist changed after it was synced to Spotify.
+	_, err = txn.Exec(`
+		UPDATE playlists
+		SET spotify_needs_sync = true
+		WHERE id = $1`,
+		playlists[2].ID,
+	)
+	assert.NoError(t, err)
+
+	// And this one is quarantined so it shouldn't be created yet.
+	_, err = txn.Exec(`
+		UPDATE playlists
+		SET status = 'quarantined'
+		WHERE id = $1`,
+		playlists[3].ID,
+	)
+	assert.NoError(t, err)
+
+	actualPlaylist, err := getPlaylistsInTransaction(txn, "deathguild", 1000)
 	assert.NoError(t, err)
 
-	assert.Equal(t, 1, len(actualPlaylist))
+	assert.Equal(t, 2, len(actualPlaylist))
 	assert.Equal(t, playlists[1].ID, actualPlaylist[0].ID)
+	assert.Equal(t, playlists[2].ID, actualPlaylist[1].ID)
 }
 
 func TestUpdatePlaylist(t *testing.T) {
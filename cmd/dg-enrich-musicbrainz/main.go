@@ -0,0 +1,299 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/brandur/deathguild/modules/dgcommon"
+	"github.com/brandur/deathguild/modules/dgmatch"
+	"github.com/brandur/deathguild/modules/dgmusicbrainz"
+	"github.com/brandur/deathguild/modules/dgstore"
+	"github.com/brandur/modulir"
+	"github.com/joeshaw/envdecode"
+	_ "github.com/lib/pq"
+)
+
+// The number of songs that we pull out of the database at a time and try to
+// find on MusicBrainz. Each batch is committed at once, so at MusicBrainz's
+// rate limit it's kept small enough that an interrupted run doesn't lose
+// much.
+const batchSize = 20
+
+// The number of recordings asked for with every search. dgmatch picks the
+// best of them rather than trusting MusicBrainz's order.
+const searchLimit = 10
+
+// Conf contains configuration information for the command. It's extracted from
+// environment variables.
+type Conf struct {
+	// DatabaseURL is a connection string for a database used to store playlist
+	// and song information.
+	DatabaseURL string `env:"DATABASE_URL,required"`
+
+	// Limit is the most songs that will be looked up in one run. Songs are
+	// looked up one request at a time at MusicBrainz's rate limit, so a
+	// backfill is best spread out over several runs.
+	Limit int `env:"LIMIT,default=1000"`
+
+	// MatchThreshold is the lowest score (see dgmatch) that a recording
+	// returned by a search can have and still be taken as the song.
+	MatchThreshold float64 `env:"MATCH_THRESHOLD,default=0.8"`
+
+	// MusicBrainzBaseURL is the base URL of MusicBrainz's web service. It
+	// can be pointed at a mirror or a local stand-in.
+	MusicBrainzBaseURL string `env:"MUSICBRAINZ_BASE_URL,default=https://musicbrainz.org/ws/2"`
+
+	// MusicBrainzMaxRetries is the number of times that a request refused by
+	// MusicBrainz for going over its rate limit is retried before giving up.
+	MusicBrainzMaxRetries int `env:"MUSICBRAINZ_MAX_RETRIES,default=10"`
+
+	// MusicBrainzRequestsPerSecond is the rate that requests to MusicBrainz
+	// are held to. MusicBrainz doesn't allow more than one per second.
+	MusicBrainzRequestsPerSecond float64 `env:"MUSICBRAINZ_REQUESTS_PER_SECOND,default=1"`
+
+	// Source optionally restricts enrichment to songs that were played at
+	// the source with the given name. All songs are enriched if it's empty.
+	Source string `env:"SOURCE"`
+
+	// UserAgent is sent with every request. MusicBrainz asks that it
+	// identify the application and how to get in touch with its owner.
+	UserAgent string `env:"USER_AGENT,default=deathguild/1.0 (+https://github.com/brandur/deathguild)"`
+}
+
+var client *dgmusicbrainz.Client
+var conf Conf
+var db *sql.DB
+var log modulir.LoggerInterface = &modulir.Logger{Level: modulir.LevelInfo}
+
+func main() {
+	err := envdecode.Decode(&conf)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	db, err = sql.Open("postgres", conf.DatabaseURL)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	client = dgmusicbrainz.NewClient(conf.MusicBrainzBaseURL, conf.UserAgent,
+		dgcommon.NewRateLimiter(conf.MusicBrainzRequestsPerSecond),
+		conf.MusicBrainzMaxRetries, log)
+
+	var numChecked, numFound int
+
+	for numChecked < conf.Limit {
+		limit := batchSize
+		if conf.Limit-numChecked < limit {
+			limit = conf.Limit - numChecked
+		}
+
+		checked, found, err := runBatch(limit)
+		if err != nil {
+			dgcommon.ExitWithError(err)
+		}
+
+		if checked == 0 {
+			break
+		}
+
+		numChecked += checked
+		numFound += found
+	}
+
+	log.Infof("Found %v of %v song(s) on MusicBrainz", numFound, numChecked)
+}
+
+// findRecording searches MusicBrainz for a song and returns the recording
+// that best matches it along with its score, or nil if none matched well
+// enough. A search for the artist and title together comes first. Failing
+// that, the title is searched for on its own, which finds songs whose artist
+// is spelled differently on MusicBrainz, but only recordings whose artists
+// match the song's well enough on their own are considered.
+func findRecording(song *dgcommon.Song) (*dgmusicbrainz.Recording, float64, error) {
+	for _, search := range []struct {
+		artist        string
+		requireArtist bool
+	}{
+		{song.Artist, false},
+		{"", true},
+	} {
+		query := dgmusicbrainz.RecordingQuery(search.artist, song.Title)
+
+		recordings, err := client.SearchRecordings(query, searchLimit)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		recording, score := bestRecording(song, recordings, search.requireArtist)
+		if recording != nil {
+			return recording, score, nil
+		}
+
+		log.Debugf("No match for query: %v", query)
+	}
+
+	return nil, 0, nil
+}
+
+// bestRecording scores every recording returned by a search against the song
+// and returns the best one along with its score, or nil if none score at
+// least the configured threshold.
+func bestRecording(song *dgcommon.Song, recordings []*dgmusicbrainz.Recording,
+	requireArtist bool) (*dgmusicbrainz.Recording, float64) {
+
+	var candidates []*dgmatch.Candidate
+	var candidateRecordings []*dgmusicbrainz.Recording
+
+	for _, recording := range recordings {
+		candidate := &dgmatch.Candidate{
+			Artists: recording.ArtistNames(),
+			Title:   recording.Title,
+		}
+		if len(recording.Releases) > 0 {
+			candidate.Album = recording.Releases[0].Title
+		}
+
+		if requireArtist &&
+			dgmatch.ArtistScore(song.Artist, candidate.Artists) < conf.MatchThreshold {
+			continue
+		}
+
+		candidates = append(candidates, candidate)
+		candidateRecordings = append(candidateRecordings, recording)
+	}
+
+	i, score := dgmatch.Best(song.Artist, song.Title, candidates)
+	if i == -1 || score < conf.MatchThreshold {
+		return nil, score
+	}
+
+	return candidateRecordings[i], score
+}
+
+// runBatch looks up a batch of up to limit songs on MusicBrainz and commits
+// the results. It returns the number of songs checked and the number found.
+func runBatch(limit int) (int, int, error) {
+	txn, err := db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer txn.Rollback()
+
+	songs, err := songsNeedingRecording(txn, conf.Source, limit)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var numFound int
+
+	for _, song := range songs {
+		song.MusicBrainzCheckedAt = time.Now()
+
+		recording, score, err := findRecording(song)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		if recording == nil {
+			log.Debugf("Song not found: %v - %v", song.Artist, song.Title)
+		} else {
+			log.Debugf("Got recording ID: %v (original: %v - %v) (MusicBrainz: %v - %v) (score: %.2f)",
+				recording.ID,
+				song.Artist, song.Title,
+				recording.Artist(), recording.Title,
+				score)
+
+			err = dgstore.UpsertMusicBrainzRecording(txn, recording)
+			if err != nil {
+				return 0, 0, err
+			}
+
+			song.MusicBrainzMatchScore = score
+			song.MusicBrainzRecordingID = recording.ID
+			numFound++
+		}
+
+		err = updateSong(txn, song)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if len(songs) > 0 {
+		log.Infof("Found %v of %v song(s) in batch", numFound, len(songs))
+	}
+
+	return len(songs), numFound, txn.Commit()
+}
+
+func songsNeedingRecording(txn *sql.Tx, sourceName string, limit int) ([]*dgcommon.Song, error) {
+	rows, err := txn.Query(`
+		SELECT id, artist, title
+		FROM songs
+		WHERE musicbrainz_recording_id IS NULL
+			AND ($1 = ''
+				OR EXISTS (
+					SELECT 1
+					FROM playlists_songs ps
+						INNER JOIN playlists p
+							ON p.id = ps.playlists_id
+					WHERE ps.songs_id = songs.id
+						AND p.source = $1
+				))
+			-- Songs that weren't found are rechecked every so often in case
+			-- somebody has added them since, jittered in the same way as
+			-- Spotify rechecks (see dg-enrich-songs).
+			AND (musicbrainz_checked_at IS NULL
+				OR musicbrainz_checked_at + (random() * '1 week'::interval) <
+					NOW() - '3 months'::interval)
+		ORDER BY id DESC
+		LIMIT $2`,
+		sourceName,
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var songs []*dgcommon.Song
+
+	for rows.Next() {
+		var song dgcommon.Song
+		err = rows.Scan(
+			&song.ID,
+			&song.Artist,
+			&song.Title,
+		)
+		if err != nil {
+			return nil, err
+		}
+		songs = append(songs, &song)
+	}
+
+	return songs, rows.Err()
+}
+
+func updateSong(txn *sql.Tx, song *dgcommon.Song) error {
+	// We want a NULL in these fields if we didn't find a recording.
+	var recordingID *string
+	var matchScore *float64
+	if song.MusicBrainzRecordingID != "" {
+		recordingID = &song.MusicBrainzRecordingID
+		matchScore = &song.MusicBrainzMatchScore
+	}
+
+	_, err := txn.Exec(`
+		UPDATE songs
+		SET musicbrainz_checked_at = $1,
+			musicbrainz_match_score = $2,
+			musicbrainz_recording_id = $3
+		WHERE id = $4`,
+		song.MusicBrainzCheckedAt,
+		matchScore,
+		recordingID,
+		song.ID,
+	)
+	return err
+}
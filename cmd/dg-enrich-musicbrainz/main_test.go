@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brandur/deathguild/modules/dgcommon"
+	"github.com/brandur/deathguild/modules/dgmusicbrainz"
+	"github.com/brandur/deathguild/modules/dgtesting"
+	assert "github.com/stretchr/testify/require"
+)
+
+func init() {
+	db = dgtesting.DB
+}
+
+func TestFindRecording(t *testing.T) {
+	conf.MatchThreshold = 0.8
+
+	body, err := ioutil.ReadFile("../../modules/dgtesting/samples/musicbrainz-recordings.json")
+	assert.NoError(t, err)
+
+	// A stand-in for MusicBrainz that only knows "A Forest", and only knows
+	// it by The Cure.
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query().Get("query")
+		queries = append(queries, query)
+
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(query, `recording:"A Forest"`) &&
+			(!strings.Contains(query, "artist:") || strings.Contains(query, `artist:"The Cure"`)) {
+			w.Write(body)
+			return
+		}
+		w.Write([]byte(`{"recordings": []}`))
+	}))
+	defer server.Close()
+
+	client = dgmusicbrainz.NewClient(server.URL, "test-agent", dgcommon.NewRateLimiter(0), 0, nil)
+
+	// The live version that MusicBrainz puts first isn't taken.
+	recording, score, err := findRecording(&dgcommon.Song{Artist: "The Cure", Title: "A Forest"})
+	assert.NoError(t, err)
+	assert.NotNil(t, recording)
+	assert.Equal(t, "f3b4ac2d-7c3e-4a7a-9f1e-5e1b2a9d4c22", recording.ID)
+	assert.Equal(t, 1.0, score)
+	assert.Equal(t, 1, len(queries))
+
+	// An artist spelled differently is found by searching for the title on
+	// its own.
+	queries = nil
+	recording, _, err = findRecording(&dgcommon.Song{Artist: "Cure", Title: "A Forest"})
+	assert.NoError(t, err)
+	assert.NotNil(t, recording)
+	assert.Equal(t, "f3b4ac2d-7c3e-4a7a-9f1e-5e1b2a9d4c22", recording.ID)
+	assert.Equal(t, []string{
+		`recording:"A Forest" AND artist:"Cure"`,
+		`recording:"A Forest"`,
+	}, queries)
+
+	// But not if the artist doesn't match at all.
+	recording, _, err = findRecording(&dgcommon.Song{Artist: "Ikon", Title: "A Forest"})
+	assert.NoError(t, err)
+	assert.Nil(t, recording)
+}
+
+func TestSongsNeedingRecording(t *testing.T) {
+	txn, err := db.Begin()
+	assert.NoError(t, err)
+	defer func() {
+		err := txn.Rollback()
+		assert.NoError(t, err)
+	}()
+
+	forest := &dgcommon.Song{Artist: "The Cure", Title: "A Forest"}
+	ghost := &dgcommon.Song{Artist: "Ikon", Title: "Ghost"}
+	for _, song := range []*dgcommon.Song{forest, ghost} {
+		dgtesting.InsertSong(t, txn, song)
+	}
+
+	songs, err := songsNeedingRecording(txn, "", batchSize)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(songs))
+
+	// Songs that were found or checked recently aren't looked up again.
+	forest.MusicBrainzCheckedAt = time.Now()
+	forest.MusicBrainzMatchScore = 1.0
+	forest.MusicBrainzRecordingID = "forest-id"
+	err = updateSong(txn, forest)
+	assert.NoError(t, err)
+
+	songs, err = songsNeedingRecording(txn, "", batchSize)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(songs))
+	assert.Equal(t, "Ghost", songs[0].Title)
+
+	ghost.MusicBrainzCheckedAt = time.Now()
+	err = updateSong(txn, ghost)
+	assert.NoError(t, err)
+
+	songs, err = songsNeedingRecording(txn, "", batchSize)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(songs))
+}
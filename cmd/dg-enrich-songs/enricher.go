@@ -0,0 +1,212 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/brandur/deathguild/modules/dgcommon"
+	"github.com/brandur/deathguild/modules/dgstore"
+	"github.com/brandur/modulir"
+)
+
+// The number of results that are committed together. Results are written
+// as they come in rather than all at once at the end of a batch, so keeping
+// this small means that little is lost if a run dies partway through.
+const writeBatchSize = 5
+
+// lookup is a song to look up in Spotify.
+type lookup struct {
+	// rejected are tracks that have been rejected for the song by hand or
+	// that it used to have until they became unavailable.
+	rejected map[string]bool
+
+	song *dgcommon.Song
+}
+
+// lookupResult is the outcome of looking up a song in Spotify.
+type lookupResult struct {
+	// err is set if the lookup failed, in which case nothing is written for
+	// the song.
+	err error
+
+	// match is the track that the song was matched to, or nil if it wasn't
+	// found.
+	match *trackMatch
+
+	song *dgcommon.Song
+}
+
+// batchStats counts the outcomes of the lookups in a batch.
+type batchStats struct {
+	numFailed   int
+	numFound    int
+	numNotFound int
+}
+
+// numSongs is the number of songs that were looked up.
+func (s *batchStats) numSongs() int {
+	return s.numFailed + s.numFound + s.numNotFound
+}
+
+// enricher looks up songs in Spotify with a pool of workers. Workers only
+// look songs up. Their results are handed to a single writer that commits
+// them a few at a time, so the workers never share a transaction and a
+// lookup that fails doesn't affect anybody else's results.
+type enricher struct {
+	// failed are the IDs of songs whose lookups failed during this run.
+	// They're left out of later batches so that a song that keeps failing
+	// doesn't come back over and over again.
+	failed []int
+
+	// inTxn runs a function in a transaction that's committed if it
+	// succeeds. It's inTransaction except in tests, which use one
+	// transaction for everything so that it can be rolled back.
+	inTxn func(fn func(txn *sql.Tx) error) error
+
+	matcher TrackMatcher
+	pool    *modulir.Pool
+
+	// runID is the ID of the run in `enrichment_runs` that songs are marked
+	// as having been searched for by.
+	runID int
+}
+
+// runBatch looks up a batch of up to limit songs (but no more than
+// batchSize) and writes the results. It returns the number of songs that
+// were looked up, which is zero once there are none left.
+func (e *enricher) runBatch(limit int) (*batchStats, error) {
+	if limit > batchSize {
+		limit = batchSize
+	}
+
+	var lookups []*lookup
+	err := e.inTxn(func(txn *sql.Tx) error {
+		songs, err := songsNeedingID(txn, conf.Source, limit, e.failed)
+		if err != nil {
+			return err
+		}
+
+		for _, song := range songs {
+			rejected, err := dgstore.RejectedSpotifyIDs(txn, song.ID)
+			if err != nil {
+				return err
+			}
+			lookups = append(lookups, &lookup{rejected: rejected, song: song})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &batchStats{}
+
+	if len(lookups) == 0 {
+		return stats, nil
+	}
+
+	results := make(chan *lookupResult)
+	writeErr := make(chan error, 1)
+	go func() {
+		writeErr <- e.writeResults(results, stats)
+	}()
+
+	log.Infof("Starting work round")
+	e.pool.StartRound()
+
+	for _, l := range lookups {
+		l := l
+
+		name := fmt.Sprintf("song: %v - %v", l.song.Artist, l.song.Title)
+		e.pool.Jobs <- modulir.NewJob(name, func() (bool, error) {
+			l.song.SpotifyCheckedAt = time.Now()
+			match, err := e.matcher.MatchTrack(l.song, l.rejected)
+			results <- &lookupResult{err: err, match: match, song: l.song}
+			return true, nil
+		})
+	}
+
+	e.pool.Wait()
+	e.pool.LogSlowest()
+
+	close(results)
+	err = <-writeErr
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("Retrieved %v Spotify ID(s); failed to find %v; %v lookup(s) failed",
+		stats.numFound, stats.numNotFound, stats.numFailed)
+
+	return stats, nil
+}
+
+// writeResults stores results as they come in, committing them
+// writeBatchSize at a time, until the channel is closed. Failed lookups are
+// counted but not written so that the songs are tried again on a later run.
+//
+// It keeps reading after a write fails so that workers sending results
+// aren't left blocked, but doesn't write anything else.
+func (e *enricher) writeResults(results <-chan *lookupResult, stats *batchStats) error {
+	var pending []*lookupResult
+	var writeErr error
+
+	flush := func() {
+		if writeErr == nil && len(pending) > 0 {
+			writeErr = e.inTxn(func(txn *sql.Tx) error {
+				for _, result := range pending {
+					err := storeResult(txn, result)
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		}
+		pending = nil
+	}
+
+	for result := range results {
+		switch {
+		case result.err != nil:
+			log.Errorf("Error looking up %v - %v: %v",
+				result.song.Artist, result.song.Title, result.err)
+			stats.numFailed++
+			e.failed = append(e.failed, result.song.ID)
+			continue
+		case result.match == nil:
+			stats.numNotFound++
+		default:
+			stats.numFound++
+		}
+
+		result.song.SpotifyEnrichmentRunID = e.runID
+		pending = append(pending, result)
+		if len(pending) >= writeBatchSize {
+			flush()
+		}
+	}
+
+	flush()
+
+	return writeErr
+}
+
+// inTransaction runs fn in a transaction that's committed if fn succeeds and
+// rolled back otherwise.
+func inTransaction(fn func(txn *sql.Tx) error) error {
+	txn, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	err = fn(txn)
+	if err != nil {
+		return err
+	}
+
+	return txn.Commit()
+}
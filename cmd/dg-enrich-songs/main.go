@@ -5,27 +5,36 @@ import (
 	"fmt"
 	"math/rand"
 	"os"
-	"regexp"
-	"sync/atomic"
+	"strings"
 	"time"
 
 	"github.com/brandur/deathguild/modules/dgcommon"
+	"github.com/brandur/deathguild/modules/dgstore"
 	"github.com/brandur/modulir"
 	"github.com/joeshaw/envdecode"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+	"github.com/spf13/cobra"
 	"github.com/zmb3/spotify"
 )
 
 // The number of songs that we pull out of the database at a time and try to
-// enrich. This essentially represents the size of the set that we'll
-// atomically commit at once. We keep the number pretty small so that even if
-// we encounter rate limiting from Spotify, we'll at least make some forward
-// progress.
+// enrich, one per worker. Their results are committed in smaller groups as
+// they come in (see writeBatchSize) so that even if we encounter rate
+// limiting from Spotify, we'll at least make some forward progress.
 const batchSize = 20
 
 // Concurrency level to run job pool at.
 const poolConcurrency = batchSize
 
+// How long to wait before searching again for a song that wasn't found. The
+// wait starts at minRecheckDelay after the first attempt and doubles with
+// every attempt after that up to maxRecheckDelay, so songs that Spotify will
+// probably never have stop costing us much.
+const (
+	maxRecheckDelay = 365 * 24 * time.Hour
+	minRecheckDelay = 7 * 24 * time.Hour
+)
+
 // Conf contains configuration information for the command. It's extracted from
 // environment variables.
 type Conf struct {
@@ -43,6 +52,11 @@ type Conf struct {
 	// and song information.
 	DatabaseURL string `env:"DATABASE_URL,required"`
 
+	// MatchThreshold is the lowest score (see dgmatch) that a track returned
+	// by a search can have and still be taken as the song. Songs without a
+	// track scoring at least this are treated as not found.
+	MatchThreshold float64 `env:"MATCH_THRESHOLD,default=0.8"`
+
 	// Limit is an optional limit for the number of songs to try and enrich at
 	// any given time. This is useful in CI because if there are too many
 	// songs without IDs then the Spotify rate limits will fail the build
@@ -54,22 +68,85 @@ type Conf struct {
 
 	// RefreshToken is our Spotify refresh token.
 	RefreshToken string `env:"REFRESH_TOKEN,required"`
+
+	// SearchStrategies are the names of the strategies used to search
+	// Spotify for a song, in the order that they're tried. See
+	// searchStrategies for the ones available.
+	SearchStrategies []string `env:"SEARCH_STRATEGIES,default=exact;strip_parentheses;strip_featuring;split_artists;transliterate;title_only"`
+
+	// Source optionally restricts enrichment to songs that were played at
+	// the source with the given name. All songs are enriched if it's empty.
+	Source string `env:"SOURCE"`
+
+	// SpotifyMaxRetries is the number of times that a request rate limited
+	// by Spotify is retried before giving up.
+	SpotifyMaxRetries int `env:"SPOTIFY_MAX_RETRIES,default=10"`
+
+	// SpotifyRequestsPerSecond is the rate that requests to Spotify are
+	// held to across all workers. The rate drops on its own when Spotify
+	// rate limits us and climbs back up as requests go through.
+	SpotifyRequestsPerSecond float64 `env:"SPOTIFY_REQUESTS_PER_SECOND,default=2"`
+}
+
+// ReportConf contains configuration information for the `report`
+// subcommand, which only reads from the database and so doesn't need
+// Spotify credentials. It's extracted from environment variables.
+type ReportConf struct {
+	// DatabaseURL is a connection string for a database used to store playlist
+	// and song information.
+	DatabaseURL string `env:"DATABASE_URL,required"`
 }
 
-var client *spotify.Client
 var conf Conf
 var db *sql.DB
 var log modulir.LoggerInterface = &modulir.Logger{Level: modulir.LevelInfo}
 
-// See trimParenthesis.
-var trimParenthesisRE = regexp.MustCompile(`^(.*?) \(.*\)$`)
-
 func main() {
+	rootCmd := &cobra.Command{
+		Use:   "dg-enrich-songs",
+		Short: "Match songs to tracks on Spotify",
+		Long: strings.TrimSpace(`
+Searches Spotify for songs that don't have a Spotify ID yet and stores
+the best match for each, along with the track and its artists. Every
+run is recorded in enrichment_runs with counts of what it found, which
+the report subcommand summarizes.`),
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			enrich()
+		},
+	}
+
+	var numRuns, numWeeks int
+	reportCommand := &cobra.Command{
+		Use:   "report",
+		Short: "Summarize recent runs and the match rate over time",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			report(numRuns, numWeeks)
+		},
+	}
+	reportCommand.Flags().IntVar(&numRuns, "runs", 10,
+		"Number of recent runs to show")
+	reportCommand.Flags().IntVar(&numWeeks, "weeks", 12,
+		"Number of weeks to show the match rate for")
+	rootCmd.AddCommand(reportCommand)
+
+	if err := rootCmd.Execute(); err != nil {
+		dgcommon.ExitWithError(err)
+	}
+}
+
+func enrich() {
 	err := envdecode.Decode(&conf)
 	if err != nil {
 		dgcommon.ExitWithError(err)
 	}
 
+	strategies, err := parseStrategies(conf.SearchStrategies)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
 	db, err = sql.Open("postgres", conf.DatabaseURL)
 	if err != nil {
 		dgcommon.ExitWithError(err)
@@ -78,183 +155,255 @@ func main() {
 	pool := modulir.NewPool(log, poolConcurrency)
 	defer pool.Stop()
 
-	client = dgcommon.GetSpotifyClient(
-		conf.ClientID, conf.ClientSecret, conf.RefreshToken)
+	limiter := dgcommon.NewRateLimiter(conf.SpotifyRequestsPerSecond)
 
-	for {
-		done, exitCode, err := runLoop(pool)
-		if err != nil {
-			dgcommon.ExitWithError(err)
-		}
-		if done {
-			defer os.Exit(exitCode)
-			break
-		}
+	matcher := &spotifyMatcher{
+		client: dgcommon.GetSpotifyClient(
+			conf.ClientID, conf.ClientSecret, conf.RefreshToken,
+			limiter, conf.SpotifyMaxRetries, log),
+		strategies: strategies,
 	}
-}
 
-func artistsToString(artists []spotify.SimpleArtist) string {
-	var out string
-	for i, artist := range artists {
-		if i != 0 {
-			out += ", "
-		}
-		out += artist.Name
+	err = applyOverrides()
+	if err != nil {
+		dgcommon.ExitWithError(err)
 	}
-	return out
-}
 
-func retrieveID(txn *sql.Tx, song *dgcommon.Song, numNotFound *int64) error {
-	song.SpotifyCheckedAt = time.Now()
+	var run *enrichmentRun
+	err = inTransaction(func(txn *sql.Tx) error {
+		var err error
+		run, err = startRun(txn)
+		return err
+	})
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	e := &enricher{inTxn: inTransaction, matcher: matcher, pool: pool, runID: run.ID}
+
+	runErr := enrichSongs(e, run, limiter)
 
-	searchString := fmt.Sprintf("artist:%v %v",
-		song.Artist, song.Title)
-	res, err := client.Search(searchString, spotify.SearchTypeTrack)
+	// The run is recorded as finished even if it failed so that the failure
+	// shows up in reports.
+	run.NumRateLimited = limiter.NumRateLimited()
+	err = inTransaction(func(txn *sql.Tx) error {
+		return finishRun(txn, run, runErr)
+	})
+	if runErr != nil {
+		dgcommon.ExitWithError(runErr)
+	}
 	if err != nil {
-		return err
+		dgcommon.ExitWithError(err)
 	}
 
-	if len(res.Tracks.Tracks) < 1 {
-		// If we failed to find a result, here we try once more with any thing
-		// in parenthesis at the end of a song title stripped out. So if we had
-		// "Foo (Bar remix)", it's shortened down to just "Foo" and we search
-		// again.
-		alternateSearchString := fmt.Sprintf("artist:%v %v",
-			song.Artist, trimParenthesis(song.Title))
-		if alternateSearchString != searchString {
-			sleepWithJitter()
-
-			res, err = client.Search(searchString, spotify.SearchTypeTrack)
-			if err != nil {
-				return err
-			}
-		}
+	log.Infof("Run %v examined %v song(s): %v matched, %v not found, %v failed; rate limited %v time(s)",
+		run.ID, run.NumExamined, run.NumMatched, run.NumNotFound, run.NumErrors,
+		run.NumRateLimited)
 
-		if len(res.Tracks.Tracks) < 1 {
-			log.Debugf("Song not found: %+v", song)
-			atomic.AddInt64(numNotFound, 1)
+	// Everything else was written, but the run still fails so that lookups
+	// that keep failing get noticed.
+	if len(e.failed) > 0 {
+		dgcommon.ExitWithError(fmt.Errorf("%v lookup(s) failed", len(e.failed)))
+	}
+}
 
-			err = updateSong(txn, song)
-			if err != nil {
-				return err
-			}
+// enrichSongs runs batches until there are no songs left to look up or the
+// configured limit is hit, recording the run's progress after each one.
+func enrichSongs(e *enricher, run *enrichmentRun, limiter *dgcommon.RateLimiter) error {
+	numLeft := conf.Limit
+	for numLeft > 0 {
+		stats, err := e.runBatch(numLeft)
+		if err != nil {
+			return err
+		}
+		if stats.numSongs() == 0 {
+			break
+		}
+		numLeft -= stats.numSongs()
 
-			sleepWithJitter()
-			return nil
+		run.add(stats)
+		run.NumRateLimited = limiter.NumRateLimited()
+		err = inTransaction(func(txn *sql.Tx) error {
+			return updateRun(txn, run)
+		})
+		if err != nil {
+			return err
 		}
 	}
 
-	track := res.Tracks.Tracks[0]
+	if numLeft <= 0 {
+		log.Infof("Hit configured song limit of %v; dying peacefully", conf.Limit)
+	}
 
-	log.Debugf("Got track ID: %v (original: %v - %v) (Spotify: %v - %v)",
-		string(track.ID),
-		song.Artist, song.Title,
-		artistsToString(track.Artists), track.Name)
+	return nil
+}
 
-	song.SpotifyID = string(track.ID)
+func report(numRuns, numWeeks int) {
+	var reportConf ReportConf
+	err := envdecode.Decode(&reportConf)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
 
-	err = updateSong(txn, song)
+	db, err = sql.Open("postgres", reportConf.DatabaseURL)
 	if err != nil {
-		return err
+		dgcommon.ExitWithError(err)
 	}
 
-	sleepWithJitter()
-	return nil
+	txn, err := db.Begin()
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+	defer txn.Rollback()
+
+	runs, err := recentRuns(txn, numRuns)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	rates, err := weeklyMatchRates(txn, numWeeks)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	err = writeReport(os.Stdout, runs, rates)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
 }
 
-func runLoop(pool *modulir.Pool) (bool, int, error) {
+// applyOverrides makes sure that songs match any overrides made by hand
+// before looking for new IDs, which matters after a database restore or an
+// import of overrides.
+func applyOverrides() error {
 	txn, err := db.Begin()
 	if err != nil {
-		return false, 0, err
+		return err
 	}
-	defer func() {
-		err := txn.Commit()
-		if err != nil {
-			panic(err)
-		}
-	}()
+	defer txn.Rollback()
 
-	// Do work in batches so we don't have to keep everything in memory
-	// at once.
-	songs, err := songsNeedingID(txn, batchSize)
+	numChanged, err := dgstore.ApplySpotifyOverrides(txn)
 	if err != nil {
-		return false, 0, err
+		return err
 	}
 
-	if len(songs) == 0 {
-		return true, 0, nil
+	if numChanged > 0 {
+		log.Infof("Applied overrides to %v song(s)", numChanged)
 	}
 
-	var numNotFound int64
+	return txn.Commit()
+}
 
-	log.Infof("Starting work round")
-	pool.StartRound()
+func artistsToString(artists []spotify.SimpleArtist) string {
+	var out string
+	for i, artist := range artists {
+		if i != 0 {
+			out += ", "
+		}
+		out += artist.Name
+	}
+	return out
+}
 
-	for _, s := range songs {
-		song := s
+// storeResult writes the result of looking up a song. A song that was found
+// gets its Spotify ID along with the track and the artists credited on it.
+// One that wasn't is only marked as checked.
+func storeResult(txn *sql.Tx, result *lookupResult) error {
+	song := result.song
 
-		name := fmt.Sprintf("song: %v (%v - %v)",
-			song.SpotifyID, song.Artist, song.Title)
-		pool.Jobs <- modulir.NewJob(name, func() (bool, error) {
-			return true, retrieveID(txn, song, &numNotFound)
-		})
-	}
+	if result.match == nil {
+		log.Debugf("Song not found: %+v", song)
 
-	pool.Wait()
-	pool.LogErrors()
-	pool.LogSlowest()
+		// A random bit of up to a tenth of the wait is added so that songs
+		// first searched for together (like in the initial backfill) don't
+		// all come due together again.
+		song.SpotifyAttempts++
+		delay := recheckDelay(song.SpotifyAttempts)
+		song.SpotifyNextCheckAt = song.SpotifyCheckedAt.Add(
+			delay + time.Duration(rand.Int63n(int64(delay/10)+1)))
 
-	if pool.JobsErrored != nil {
-		return true, 0, fmt.Errorf("%v job(s) errored occurred during last round",
-			len(pool.JobsErrored))
+		return updateSong(txn, song)
 	}
 
-	log.Infof("Retrieved %v Spotify ID(s); failed to find %v",
-		len(songs)-int(numNotFound), numNotFound)
+	match := result.match
+	track := match.track
+
+	log.Debugf("Got track ID: %v (original: %v - %v) (Spotify: %v - %v) (score: %.2f) (strategy: %v)",
+		string(track.ID),
+		song.Artist, song.Title,
+		artistsToString(track.Artists), track.Name,
+		match.score, match.strategy)
 
-	if len(songs) >= conf.Limit {
-		log.Infof("Hit configured song limit of %v; dying peacefully",
-			len(songs))
-		return true, 0, nil
+	song.SpotifyID = string(track.ID)
+	song.SpotifyMatchScore = match.score
+	song.SpotifyMatchStrategy = match.strategy
+	song.SpotifyAttempts = 0
+	song.SpotifyNextCheckAt = time.Time{}
+
+	// The search result already has everything that we keep on the track,
+	// so there's no need to go back for it later.
+	err := dgstore.UpsertSpotifyTrack(txn, dgcommon.NewSpotifyTrack(track))
+	if err != nil {
+		return err
 	}
 
-	return false, 0, nil
-}
+	err = updateSong(txn, song)
+	if err != nil {
+		return err
+	}
 
-// Spotify has an extremely draconian rate limit even for registered apps
-// so sleep between requests.
-func sleepWithJitter() {
-	// This is range of 1 to 2 seconds. This seems to be experimentally
-	// adequate at concurrency one to generally keep us under limit.
-	t := rand.Float32() + 1
-	log.Infof("Sleeping %v seconds", t)
-	time.Sleep(time.Duration(t) * time.Second)
+	// Same for the artists credited on it, but the song has to have its ID
+	// before it can be linked to them.
+	return dgstore.LinkSongArtists(txn, song.SpotifyID, dgcommon.NewArtists(track.Artists))
 }
 
-func songsNeedingID(txn *sql.Tx, limit int) ([]*dgcommon.Song, error) {
+// songsNeedingID finds up to limit songs that are due to be looked up in
+// Spotify, leaving out the songs with IDs in skip. Songs that have been
+// played the most come first because finding them improves the most
+// playlists.
+func songsNeedingID(txn *sql.Tx, sourceName string, limit int, skip []int) ([]*dgcommon.Song, error) {
 	rows, err := txn.Query(`
-		SELECT id, artist, title
-		FROM songs
-		WHERE spotify_id IS NULL
-			AND (spotify_checked_at IS NULL
-				-- Periodically recheck Spotify for information that we failed
-				-- to fill.
-				--
-				-- We jitter from the last check time by a random interval
-				-- between 0 seconds and a week just so that we aren't trying to
-				-- do huge batches with similar check times all at the same time.
-				-- (Basically there was a single massive batch from back when I
-				-- did the initial backfill).
-				OR spotify_checked_at + (random() * '1 week'::interval) <
-					NOW() - '3 months'::interval)
-
-		-- Prefer newer songs because it's more likely that we'll successfully
-		-- find IDs for them. The older stuff tends to be songs that will probably
-		-- never get an ID but have re-entered a check window.
-		ORDER BY id DESC
-
-		LIMIT $1`,
+		SELECT s.id, s.artist, s.title, s.spotify_attempts
+		FROM songs s
+			LEFT JOIN (
+				SELECT songs_id, count(*) AS num_plays
+				FROM playlists_songs
+				GROUP BY songs_id
+			) plays
+				ON plays.songs_id = s.id
+		WHERE s.spotify_id IS NULL
+			-- songs settled by hand are left alone
+			AND NOT EXISTS (
+				SELECT 1
+				FROM song_spotify_overrides o
+				WHERE o.normalized_key = s.normalized_key
+					AND o.kind IN ('not_on_spotify', 'pin')
+			)
+			AND ($1 = ''
+				OR EXISTS (
+					SELECT 1
+					FROM playlists_songs ps
+						INNER JOIN playlists p
+							ON p.id = ps.playlists_id
+					WHERE ps.songs_id = s.id
+						AND p.source = $1
+				))
+			-- songs that haven't been searched for yet are always due
+			AND (s.spotify_next_check_at IS NULL
+				OR s.spotify_next_check_at <= NOW())
+			-- an empty skip list comes through as NULL, which nothing is
+			-- ever <> ALL of
+			AND s.id <> ALL(COALESCE($3::bigint[], '{}'))
+
+		-- Ties (like all of the songs that were only played once) go to
+		-- newer songs because it's more likely that we'll successfully find
+		-- IDs for them.
+		ORDER BY COALESCE(plays.num_plays, 0) DESC, s.id DESC
+
+		LIMIT $2`,
+		sourceName,
 		limit,
+		pq.Array(skip),
 	)
 	if err != nil {
 		return nil, err
@@ -269,6 +418,7 @@ func songsNeedingID(txn *sql.Tx, limit int) ([]*dgcommon.Song, error) {
 			&song.ID,
 			&song.Artist,
 			&song.Title,
+			&song.SpotifyAttempts,
 		)
 		if err != nil {
 			return nil, err
@@ -280,28 +430,70 @@ func songsNeedingID(txn *sql.Tx, limit int) ([]*dgcommon.Song, error) {
 	return songs, nil
 }
 
-// trimParenthesis strips anything in parenthesis at the end of a song title.
-// This is so that we can use a more general name to try and get a match on a
-// song that won't match in its literal state.
-func trimParenthesis(title string) string {
-	return trimParenthesisRE.ReplaceAllString(title, "$1")
+// recheckDelay is how long to wait before searching again for a song that
+// has been searched for the given number of times without being found.
+func recheckDelay(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	// Checked before shifting so that a large number of attempts can't
+	// overflow.
+	if attempts > 1 && minRecheckDelay > maxRecheckDelay>>uint(attempts-1) {
+		return maxRecheckDelay
+	}
+
+	return minRecheckDelay << uint(attempts-1)
 }
 
 func updateSong(txn *sql.Tx, song *dgcommon.Song) error {
-	// We want a NULL in this field with we didn't get an ID.
+	// We want a NULL in these fields with we didn't get an ID.
 	var spotifyID *string
+	var spotifyMatchScore *float64
+	var spotifyMatchStrategy *string
 	if song.SpotifyID != "" {
 		spotifyID = &song.SpotifyID
+		spotifyMatchScore = &song.SpotifyMatchScore
+		spotifyMatchStrategy = &song.SpotifyMatchStrategy
+	}
+
+	// And in these ones if it doesn't need to be checked again or wasn't
+	// checked as part of a recorded run.
+	var spotifyNextCheckAt *time.Time
+	if !song.SpotifyNextCheckAt.IsZero() {
+		spotifyNextCheckAt = &song.SpotifyNextCheckAt
+	}
+	var spotifyEnrichmentRunID *int
+	if song.SpotifyEnrichmentRunID != 0 {
+		spotifyEnrichmentRunID = &song.SpotifyEnrichmentRunID
 	}
 
 	_, err := txn.Exec(`
 		UPDATE songs
-		SET spotify_checked_at = $1,
-			spotify_id = $2
-		WHERE id = $3`,
+		SET spotify_attempts = $1,
+			spotify_checked_at = $2,
+			spotify_enrichment_runs_id = $8,
+			spotify_id = $3,
+			spotify_match_score = $4,
+			spotify_match_strategy = $5,
+			spotify_next_check_at = $6
+		WHERE id = $7
+			-- an override made while we were searching wins
+			AND NOT EXISTS (
+				SELECT 1
+				FROM song_spotify_overrides o
+				WHERE o.normalized_key = songs.normalized_key
+					AND (o.kind IN ('not_on_spotify', 'pin')
+						OR (o.kind = 'reject' AND o.spotify_id = $3))
+			)`,
+		song.SpotifyAttempts,
 		song.SpotifyCheckedAt,
 		spotifyID,
+		spotifyMatchScore,
+		spotifyMatchStrategy,
+		spotifyNextCheckAt,
 		song.ID,
+		spotifyEnrichmentRunID,
 	)
 	return err
 }
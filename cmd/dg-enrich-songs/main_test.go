@@ -2,18 +2,193 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
 	"testing"
 	"time"
 
 	"github.com/brandur/deathguild/modules/dgcommon"
+	"github.com/brandur/deathguild/modules/dgstore"
 	"github.com/brandur/deathguild/modules/dgtesting"
+	"github.com/brandur/modulir"
 	assert "github.com/stretchr/testify/require"
+	"github.com/zmb3/spotify"
 )
 
 func init() {
 	db = dgtesting.DB
 }
 
+func TestRunBatch(t *testing.T) {
+	txn, err := db.Begin()
+	assert.NoError(t, err)
+	defer func() {
+		err := txn.Rollback()
+		assert.NoError(t, err)
+	}()
+
+	songs := []*dgcommon.Song{
+		{Artist: "The Cure", Title: "A Forest"},
+		{Artist: "Covenant", Title: "Dead Stars"},
+		{Artist: "Ikon", Title: "Ghost"},
+	}
+	for _, song := range songs {
+		dgtesting.InsertSong(t, txn, song)
+	}
+
+	matcher := newFakeMatcher()
+	matcher.add("The Cure", "A Forest", "forest-id", "cure-id")
+	matcher.add("Covenant", "Dead Stars", "dead-stars-id", "covenant-id")
+
+	run, err := startRun(txn)
+	assert.NoError(t, err)
+
+	e := newTestEnricher(txn, matcher)
+	e.runID = run.ID
+
+	stats, err := e.runBatch(batchSize)
+	assert.NoError(t, err)
+	assert.Equal(t, &batchStats{numFound: 2, numNotFound: 1}, stats)
+
+	// Found songs get their IDs, tracks, and artists, and every song is
+	// marked as checked by the run.
+	var spotifyID, strategy sql.NullString
+	err = txn.QueryRow(`
+		SELECT spotify_id, spotify_match_strategy
+		FROM songs
+		WHERE id = $1`,
+		songs[0].ID,
+	).Scan(&spotifyID, &strategy)
+	assert.NoError(t, err)
+	assert.Equal(t, "forest-id", spotifyID.String)
+	assert.Equal(t, "fake", strategy.String)
+
+	var numTracks, numLinks, numUnchecked, numInRun int
+	err = txn.QueryRow(`
+		SELECT
+			(SELECT count(*) FROM spotify_tracks),
+			(SELECT count(*) FROM songs_artists),
+			(SELECT count(*) FROM songs WHERE spotify_checked_at IS NULL),
+			(SELECT count(*) FROM songs WHERE spotify_enrichment_runs_id = $1)`,
+		run.ID,
+	).Scan(&numTracks, &numLinks, &numUnchecked, &numInRun)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, numTracks)
+	assert.Equal(t, 2, numLinks)
+	assert.Equal(t, 0, numUnchecked)
+	assert.Equal(t, 3, numInRun)
+
+	// The song that wasn't found is scheduled to be searched for again
+	// after the first wait.
+	var attempts int
+	var nextCheckAt time.Time
+	err = txn.QueryRow(`
+		SELECT spotify_attempts, spotify_next_check_at
+		FROM songs
+		WHERE id = $1`,
+		songs[2].ID,
+	).Scan(&attempts, &nextCheckAt)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, attempts)
+	assert.WithinDuration(t, time.Now().Add(minRecheckDelay), nextCheckAt, minRecheckDelay/10+time.Minute)
+
+	// There's nothing left to do on the next round.
+	stats, err = e.runBatch(batchSize)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, stats.numSongs())
+}
+
+func TestRunBatchFailedLookups(t *testing.T) {
+	txn, err := db.Begin()
+	assert.NoError(t, err)
+	defer func() {
+		err := txn.Rollback()
+		assert.NoError(t, err)
+	}()
+
+	// More songs than fit in one write so that results are written in
+	// several transactions around the failure.
+	var songs []*dgcommon.Song
+	for i := 0; i < writeBatchSize*2; i++ {
+		song := &dgcommon.Song{Artist: "Covenant", Title: fmt.Sprintf("Song %v", i)}
+		dgtesting.InsertSong(t, txn, song)
+		songs = append(songs, song)
+	}
+
+	matcher := newFakeMatcher()
+	matcher.add("Covenant", "Song 0", "song-0-id", "covenant-id")
+	matcher.fail("Covenant", "Song 1")
+
+	e := newTestEnricher(txn, matcher)
+
+	// The failure doesn't stop everybody else's results from being written.
+	stats, err := e.runBatch(batchSize)
+	assert.NoError(t, err)
+	assert.Equal(t, &batchStats{
+		numFailed:   1,
+		numFound:    1,
+		numNotFound: writeBatchSize*2 - 2,
+	}, stats)
+	assert.Equal(t, []int{songs[1].ID}, e.failed)
+
+	var numUnchecked int
+	var uncheckedTitle string
+	err = txn.QueryRow(`
+		SELECT count(*) OVER (), title
+		FROM songs
+		WHERE spotify_checked_at IS NULL`,
+	).Scan(&numUnchecked, &uncheckedTitle)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, numUnchecked)
+	assert.Equal(t, "Song 1", uncheckedTitle)
+
+	// The song that failed isn't tried again during the same run.
+	stats, err = e.runBatch(batchSize)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, stats.numSongs())
+}
+
+func TestRunBatchLimit(t *testing.T) {
+	txn, err := db.Begin()
+	assert.NoError(t, err)
+	defer func() {
+		err := txn.Rollback()
+		assert.NoError(t, err)
+	}()
+
+	for i := 0; i < batchSize+5; i++ {
+		dgtesting.InsertSong(t, txn, &dgcommon.Song{
+			Artist: "Covenant",
+			Title:  fmt.Sprintf("Song %v", i),
+		})
+	}
+
+	e := newTestEnricher(txn, newFakeMatcher())
+
+	// A batch is never bigger than batchSize, nor bigger than what's left
+	// of the limit.
+	stats, err := e.runBatch(batchSize + 100)
+	assert.NoError(t, err)
+	assert.Equal(t, batchSize, stats.numSongs())
+	assert.Equal(t, batchSize, stats.numNotFound)
+
+	stats, err = e.runBatch(2)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, stats.numSongs())
+
+	stats, err = e.runBatch(batchSize)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, stats.numSongs())
+}
+
+func TestRecheckDelay(t *testing.T) {
+	assert.Equal(t, minRecheckDelay, recheckDelay(0))
+	assert.Equal(t, minRecheckDelay, recheckDelay(1))
+	assert.Equal(t, 2*minRecheckDelay, recheckDelay(2))
+	assert.Equal(t, 32*minRecheckDelay, recheckDelay(6))
+	assert.Equal(t, maxRecheckDelay, recheckDelay(7))
+	assert.Equal(t, maxRecheckDelay, recheckDelay(1000))
+}
+
 func TestSongsNeedingID(t *testing.T) {
 	txn, err := db.Begin()
 	assert.NoError(t, err)
@@ -31,17 +206,129 @@ func TestSongsNeedingID(t *testing.T) {
 		dgtesting.InsertSong(t, txn, song)
 	}
 
-	actualSongs, err := songsNeedingID(txn, 1000)
+	actualSongs, err := songsNeedingID(txn, "", 1000, nil)
 	assert.NoError(t, err)
 
 	assert.Equal(t, 1, len(actualSongs))
 	assert.Equal(t, songs[1].ID, actualSongs[0].ID)
+
+	// An empty skip list is the same as none.
+	actualSongs, err = songsNeedingID(txn, "", 1000, []int{})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(actualSongs))
+
+	// Restricted to a source, only songs played there are eligible.
+	actualSongs, err = songsNeedingID(txn, "deathguild", 1000, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(actualSongs))
+
+	playlist := dgcommon.Playlist{Day: time.Now(), Source: "deathguild"}
+	dgtesting.InsertPlaylist(t, txn, &playlist)
+
+	_, err = txn.Exec(`
+		INSERT INTO playlists_songs (playlists_id, songs_id, position)
+		VALUES ($1, $2, 0)`,
+		playlist.ID,
+		songs[1].ID,
+	)
+	assert.NoError(t, err)
+
+	actualSongs, err = songsNeedingID(txn, "deathguild", 1000, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(actualSongs))
+
+	actualSongs, err = songsNeedingID(txn, "other", 1000, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(actualSongs))
+
+	// Songs settled by hand aren't eligible.
+	err = dgstore.UpsertSpotifyOverride(txn, &dgstore.SpotifyOverride{
+		Kind:   dgstore.OverrideNotOnSpotify,
+		Artist: "Imperative Reaction",
+		Title:  "You Remain",
+	})
+	assert.NoError(t, err)
+
+	actualSongs, err = songsNeedingID(txn, "", 1000, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(actualSongs))
 }
 
-func TestTrimParenthesis(t *testing.T) {
-	assert.Equal(t, "Song", trimParenthesis("Song"))
-	assert.Equal(t, "Song", trimParenthesis("Song (So-and-so remix)"))
-	assert.Equal(t, "Song", trimParenthesis("Song (So-and-so remix) (Other)"))
+func TestSongsNeedingIDSchedule(t *testing.T) {
+	txn, err := db.Begin()
+	assert.NoError(t, err)
+	defer func() {
+		err := txn.Rollback()
+		assert.NoError(t, err)
+	}()
+
+	songs := []*dgcommon.Song{
+		{Artist: "The Cure", Title: "A Forest"},
+		{Artist: "Covenant", Title: "Dead Stars"},
+		{Artist: "Ikon", Title: "Ghost"},
+	}
+	for _, song := range songs {
+		dgtesting.InsertSong(t, txn, song)
+	}
+
+	playlist := dgcommon.Playlist{Day: time.Now(), Source: "deathguild"}
+	dgtesting.InsertPlaylist(t, txn, &playlist)
+
+	// "A Forest" is played three times and "Dead Stars" once.
+	for position, song := range []*dgcommon.Song{songs[0], songs[1], songs[0], songs[0]} {
+		_, err = txn.Exec(`
+			INSERT INTO playlists_songs (playlists_id, songs_id, position)
+			VALUES ($1, $2, $3)`,
+			playlist.ID,
+			song.ID,
+			position,
+		)
+		assert.NoError(t, err)
+	}
+
+	// Songs played the most come first, and then the newest.
+	actualSongs, err := songsNeedingID(txn, "", 1000, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(actualSongs))
+	assert.Equal(t, songs[0].ID, actualSongs[0].ID)
+	assert.Equal(t, songs[1].ID, actualSongs[1].ID)
+	assert.Equal(t, songs[2].ID, actualSongs[2].ID)
+
+	// A song isn't due again until its next check, and comes back with its
+	// attempts so far.
+	_, err = txn.Exec(`
+		UPDATE songs
+		SET spotify_attempts = 3,
+			spotify_next_check_at = NOW() + '1 day'::interval
+		WHERE id = $1`,
+		songs[0].ID,
+	)
+	assert.NoError(t, err)
+
+	actualSongs, err = songsNeedingID(txn, "", 1000, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(actualSongs))
+	assert.Equal(t, songs[1].ID, actualSongs[0].ID)
+
+	_, err = txn.Exec(`
+		UPDATE songs
+		SET spotify_next_check_at = NOW() - '1 day'::interval
+		WHERE id = $1`,
+		songs[0].ID,
+	)
+	assert.NoError(t, err)
+
+	actualSongs, err = songsNeedingID(txn, "", 1000, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(actualSongs))
+	assert.Equal(t, songs[0].ID, actualSongs[0].ID)
+	assert.Equal(t, 3, actualSongs[0].SpotifyAttempts)
+
+	// And songs being skipped don't come back at all.
+	actualSongs, err = songsNeedingID(txn, "", 1000, []int{songs[0].ID, songs[2].ID})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(actualSongs))
+	assert.Equal(t, songs[1].ID, actualSongs[0].ID)
 }
 
 func TestUpdateSong(t *testing.T) {
@@ -84,17 +371,110 @@ func TestUpdateSong(t *testing.T) {
 	//
 
 	song.SpotifyID = "spotify-id"
+	song.SpotifyMatchScore = 0.9
 
 	err = updateSong(txn, &song)
 	assert.NoError(t, err)
 
+	var spotifyMatchScore sql.NullFloat64
+
 	err = txn.QueryRow(`
-		SELECT spotify_checked_at, spotify_id
+		SELECT spotify_checked_at, spotify_id, spotify_match_score
 		FROM songs
 		WHERE id = $1`,
 		song.ID,
-	).Scan(&spotifyCheckedAt, &spotifyID)
+	).Scan(&spotifyCheckedAt, &spotifyID, &spotifyMatchScore)
 
 	assert.Equal(t, song.SpotifyCheckedAt.Unix(), spotifyCheckedAt.Unix())
 	assert.Equal(t, "spotify-id", spotifyID.String)
+	assert.InDelta(t, 0.9, spotifyMatchScore.Float64, 0.001)
+
+	//
+	// But not to a track that was rejected by hand in the meantime.
+	//
+
+	err = dgstore.UpsertSpotifyOverride(txn, &dgstore.SpotifyOverride{
+		Kind:      dgstore.OverrideReject,
+		Artist:    song.Artist,
+		Title:     song.Title,
+		SpotifyID: "rejected-id",
+	})
+	assert.NoError(t, err)
+
+	song.SpotifyID = "rejected-id"
+
+	err = updateSong(txn, &song)
+	assert.NoError(t, err)
+
+	err = txn.QueryRow(`
+		SELECT spotify_id
+		FROM songs
+		WHERE id = $1`,
+		song.ID,
+	).Scan(&spotifyID)
+	assert.NoError(t, err)
+	assert.Equal(t, "spotify-id", spotifyID.String)
+}
+
+// fakeMatcher is a TrackMatcher that knows a fixed set of tracks instead of
+// searching Spotify.
+type fakeMatcher struct {
+	// failing are songs whose lookups fail.
+	failing map[string]bool
+
+	tracks map[string]*spotify.FullTrack
+}
+
+func newFakeMatcher() *fakeMatcher {
+	return &fakeMatcher{
+		failing: make(map[string]bool),
+		tracks:  make(map[string]*spotify.FullTrack),
+	}
+}
+
+// add makes a song match a track with the given ID by an artist with the
+// given ID.
+func (m *fakeMatcher) add(artist, title, spotifyID, artistSpotifyID string) {
+	m.tracks[artist+"\t"+title] = &spotify.FullTrack{
+		SimpleTrack: spotify.SimpleTrack{
+			Artists: []spotify.SimpleArtist{{ID: spotify.ID(artistSpotifyID), Name: artist}},
+			ID:      spotify.ID(spotifyID),
+			Name:    title,
+		},
+	}
+}
+
+// fail makes looking up a song fail.
+func (m *fakeMatcher) fail(artist, title string) {
+	m.failing[artist+"\t"+title] = true
+}
+
+// MatchTrack implements TrackMatcher.
+func (m *fakeMatcher) MatchTrack(song *dgcommon.Song, rejected map[string]bool) (*trackMatch, error) {
+	key := song.Artist + "\t" + song.Title
+
+	if m.failing[key] {
+		return nil, fmt.Errorf("Spotify is down")
+	}
+
+	track, ok := m.tracks[key]
+	if !ok || rejected[string(track.ID)] {
+		return nil, nil
+	}
+
+	return &trackMatch{score: 1.0, strategy: "fake", track: track}, nil
+}
+
+// newTestEnricher returns an enricher that does all of its reading and
+// writing in txn.
+func newTestEnricher(txn *sql.Tx, matcher TrackMatcher) *enricher {
+	pool := modulir.NewPool(log, poolConcurrency)
+
+	return &enricher{
+		inTxn: func(fn func(txn *sql.Tx) error) error {
+			return fn(txn)
+		},
+		matcher: matcher,
+		pool:    pool,
+	}
 }
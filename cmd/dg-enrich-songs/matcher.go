@@ -0,0 +1,119 @@
+package main
+
+import (
+	"github.com/brandur/deathguild/modules/dgcommon"
+	"github.com/brandur/deathguild/modules/dgmatch"
+	"github.com/zmb3/spotify"
+)
+
+// TrackMatcher finds the Spotify track that a song should be matched to.
+// Implementations are called from several workers at once and must be safe
+// for concurrent use.
+type TrackMatcher interface {
+	// MatchTrack returns the best track for a song, or nil if there isn't
+	// one that matches well enough. Tracks in rejected have been rejected
+	// for the song (see dgstore.RejectedSpotifyIDs) and are never returned.
+	MatchTrack(song *dgcommon.Song, rejected map[string]bool) (*trackMatch, error)
+}
+
+// trackMatch is a track that a song was matched to along with how it was
+// found.
+type trackMatch struct {
+	// score is how closely the track matched the song (see dgmatch).
+	score float64
+
+	// strategy is the name of the search strategy that found the track.
+	strategy string
+
+	track *spotify.FullTrack
+}
+
+// spotifyMatcher is a TrackMatcher that searches Spotify with each of its
+// strategies in turn until one of them turns up a good enough match.
+type spotifyMatcher struct {
+	client     *dgcommon.SpotifyClient
+	strategies []*searchStrategy
+}
+
+// MatchTrack implements TrackMatcher.
+func (m *spotifyMatcher) MatchTrack(song *dgcommon.Song, rejected map[string]bool) (*trackMatch, error) {
+	// Strategies that don't apply to a song or that would repeat a search
+	// that was already made are skipped.
+	tried := make(map[string]bool)
+
+	for _, strategy := range m.strategies {
+		searchString, searched, ok := strategy.query(song)
+		if !ok || tried[searchString] {
+			continue
+		}
+
+		tried[searchString] = true
+
+		res, err := m.client.SearchTracks(searchString)
+		if err != nil {
+			return nil, err
+		}
+
+		track, score := bestTrack(searched, res.Tracks.Tracks, rejected, strategy.requireArtist)
+		if track == nil {
+			log.Debugf("No match with strategy %v: %v", strategy.name, searchString)
+			continue
+		}
+
+		return &trackMatch{score: score, strategy: strategy.name, track: track}, nil
+	}
+
+	return nil, nil
+}
+
+// bestTrack scores every track returned by a search against the song as it
+// was searched for and returns the best one along with its score. Spotify's first result is often
+// a cover, a karaoke version, or the same title by somebody else, so the
+// order of the results is only used to break ties. It returns nil if no
+// track scores at least the configured threshold.
+//
+// Tracks that have been rejected for the song by hand aren't considered at
+// all, and neither are tracks whose artists don't match the song's well
+// enough on their own if requireArtist is set.
+func bestTrack(song *dgcommon.Song, tracks []spotify.FullTrack,
+	rejected map[string]bool, requireArtist bool) (*spotify.FullTrack, float64) {
+
+	var candidates []*dgmatch.Candidate
+	var candidateTracks []*spotify.FullTrack
+
+	for i, track := range tracks {
+		if rejected[string(track.ID)] {
+			continue
+		}
+
+		candidate := &dgmatch.Candidate{Album: track.Album.Name, Title: track.Name}
+		for _, artist := range track.Artists {
+			candidate.Artists = append(candidate.Artists, artist.Name)
+		}
+
+		if requireArtist &&
+			dgmatch.ArtistScore(song.Artist, candidate.Artists) < conf.MatchThreshold {
+			continue
+		}
+
+		candidates = append(candidates, candidate)
+		candidateTracks = append(candidateTracks, &tracks[i])
+	}
+
+	i, score := dgmatch.Best(song.Artist, song.Title, candidates)
+	if i == -1 {
+		return nil, 0
+	}
+
+	track := candidateTracks[i]
+
+	if score < conf.MatchThreshold {
+		log.Debugf("Best match for %v - %v was too weak: %v - %v (score: %.2f)",
+			song.Artist, song.Title,
+			artistsToString(track.Artists), track.Name,
+			score)
+		return nil, score
+	}
+
+	return track, score
+}
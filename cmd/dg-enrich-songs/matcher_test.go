@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/brandur/deathguild/modules/dgcommon"
+	assert "github.com/stretchr/testify/require"
+	"github.com/zmb3/spotify"
+)
+
+func TestBestTrack(t *testing.T) {
+	conf.MatchThreshold = 0.8
+
+	track := func(artist, title string) spotify.FullTrack {
+		return spotify.FullTrack{SimpleTrack: spotify.SimpleTrack{
+			Artists: []spotify.SimpleArtist{{Name: artist}},
+			Name:    title,
+		}}
+	}
+
+	song := &dgcommon.Song{Artist: "The Cure", Title: "A Forest"}
+
+	// The first result isn't taken just because it came first.
+	best, score := bestTrack(song, []spotify.FullTrack{
+		track("Karaoke Hits Band", "A Forest (Karaoke Version)"),
+		track("The Cure", "A Forest"),
+	}, nil, false)
+	assert.NotNil(t, best)
+	assert.Equal(t, "The Cure", best.Artists[0].Name)
+	assert.Equal(t, 1.0, score)
+
+	// Nothing is taken if none of the results are close enough.
+	best, _ = bestTrack(song, []spotify.FullTrack{
+		track("Nouvelle Vague", "A Forest"),
+	}, nil, false)
+	assert.Nil(t, best)
+
+	best, _ = bestTrack(song, nil, nil, false)
+	assert.Nil(t, best)
+
+	// Requiring the artist rules out tracks by anybody else before they're
+	// scored at all.
+	song = &dgcommon.Song{Artist: "Covenant", Title: "Dead Stars"}
+	best, _ = bestTrack(song, []spotify.FullTrack{
+		track("Covenant Tribute Band", "Dead Stars"),
+		track("Covenant", "Dead Stars - Remastered"),
+	}, nil, true)
+	assert.NotNil(t, best)
+	assert.Equal(t, "Covenant", best.Artists[0].Name)
+
+	// Rejected tracks are never picked, even if they'd match best.
+	tracks := []spotify.FullTrack{
+		track("The Cure", "A Forest"),
+		track("The Cure", "A Forest - Remastered"),
+	}
+	tracks[0].ID = "rejected-id"
+	tracks[1].ID = "other-id"
+	song = &dgcommon.Song{Artist: "The Cure", Title: "A Forest"}
+	best, _ = bestTrack(song, tracks, map[string]bool{"rejected-id": true}, false)
+	assert.NotNil(t, best)
+	assert.Equal(t, "other-id", string(best.ID))
+}
+
+func TestMatchTrackStrategies(t *testing.T) {
+	conf.MatchThreshold = 0.8
+
+	track := func(artist, title string) spotify.FullTrack {
+		return spotify.FullTrack{SimpleTrack: spotify.SimpleTrack{
+			Artists: []spotify.SimpleArtist{{Name: artist}},
+			ID:      spotify.ID(artist + " - " + title),
+			Name:    title,
+		}}
+	}
+
+	// Every strategy finds a track that only matches the song perfectly once
+	// it's been changed the same way as the search.
+	testCases := []struct {
+		strategy string
+		song     *dgcommon.Song
+		query    string
+		tracks   []spotify.FullTrack
+		want     string
+	}{
+		{
+			"exact",
+			&dgcommon.Song{Artist: "Covenant", Title: "Dead Stars"},
+			"artist:Covenant Dead Stars",
+			[]spotify.FullTrack{track("Covenant", "Dead Stars")},
+			"Covenant - Dead Stars",
+		},
+		{
+			"strip_parentheses",
+			&dgcommon.Song{Artist: "Covenant", Title: "Dead Stars (Club Edit)"},
+			"artist:Covenant Dead Stars",
+			[]spotify.FullTrack{track("Covenant", "Dead Stars")},
+			"Covenant - Dead Stars",
+		},
+		{
+			"strip_featuring",
+			&dgcommon.Song{Artist: "Covenant feat. Jan Loamfors", Title: "Dead Stars"},
+			"artist:Covenant Dead Stars",
+			[]spotify.FullTrack{track("Covenant", "Dead Stars")},
+			"Covenant - Dead Stars",
+		},
+		{
+			"split_artists",
+			&dgcommon.Song{Artist: "Covenant & Necro Facility", Title: "Dead Stars"},
+			"artist:Covenant Dead Stars",
+			[]spotify.FullTrack{track("Covenant", "Dead Stars")},
+			"Covenant - Dead Stars",
+		},
+		{
+			"transliterate",
+			&dgcommon.Song{Artist: "Mötley Crüe", Title: "Kickstart My Heart"},
+			"artist:Motley Crue Kickstart My Heart",
+			[]spotify.FullTrack{track("Motley Crue", "Kickstart My Heart")},
+			"Motley Crue - Kickstart My Heart",
+		},
+		{
+			"title_only",
+			&dgcommon.Song{Artist: "Covenant", Title: "Dead Stars (Live)"},
+			"track:Dead Stars",
+			[]spotify.FullTrack{
+				track("Covenant Tribute Band", "Dead Stars"),
+				track("Covenant", "Dead Stars"),
+			},
+			"Covenant - Dead Stars",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.strategy, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, tc.query, r.URL.Query().Get("q"))
+
+				body, err := json.Marshal(&spotify.SearchResult{
+					Tracks: &spotify.FullTrackPage{Tracks: tc.tracks},
+				})
+				assert.NoError(t, err)
+				w.Write(body)
+			}))
+			defer server.Close()
+
+			strategies, err := parseStrategies([]string{tc.strategy})
+			assert.NoError(t, err)
+
+			matcher := &spotifyMatcher{
+				client:     dgcommon.NewSpotifyClient(server.Client(), server.URL+"/v1/"),
+				strategies: strategies,
+			}
+
+			match, err := matcher.MatchTrack(tc.song, nil)
+			assert.NoError(t, err)
+			assert.NotNil(t, match)
+			assert.Equal(t, tc.strategy, match.strategy)
+			assert.Equal(t, tc.want, string(match.track.ID))
+			assert.Equal(t, 1.0, match.score)
+		})
+	}
+}
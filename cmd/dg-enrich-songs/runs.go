@@ -0,0 +1,231 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+// enrichmentRun is a run of the command as recorded in `enrichment_runs`.
+type enrichmentRun struct {
+	ID             int
+	StartedAt      time.Time
+	FinishedAt     *time.Time
+	Error          *string
+	NumErrors      int
+	NumExamined    int
+	NumMatched     int
+	NumNotFound    int
+	NumRateLimited int
+}
+
+// add counts the outcomes of a batch toward the run.
+func (r *enrichmentRun) add(stats *batchStats) {
+	r.NumErrors += stats.numFailed
+	r.NumExamined += stats.numSongs()
+	r.NumMatched += stats.numFound
+	r.NumNotFound += stats.numNotFound
+}
+
+// status describes how the run ended.
+func (r *enrichmentRun) status() string {
+	switch {
+	case r.Error != nil:
+		return "failed: " + *r.Error
+	case r.FinishedAt == nil:
+		return "unfinished"
+	default:
+		return "ok"
+	}
+}
+
+// matchRate is how many of the songs examined by the runs started in a week
+// were matched.
+type matchRate struct {
+	Week        time.Time
+	NumRuns     int
+	NumExamined int
+	NumMatched  int
+}
+
+// rate is the fraction of the songs examined that were matched, or zero if
+// none were.
+func (r *matchRate) rate() float64 {
+	if r.NumExamined == 0 {
+		return 0
+	}
+	return float64(r.NumMatched) / float64(r.NumExamined)
+}
+
+// startRun records the start of a run.
+func startRun(txn *sql.Tx) (*enrichmentRun, error) {
+	run := &enrichmentRun{}
+
+	err := txn.QueryRow(`
+		INSERT INTO enrichment_runs (started_at)
+		VALUES (NOW())
+		RETURNING id, started_at`,
+	).Scan(&run.ID, &run.StartedAt)
+	if err != nil {
+		return nil, fmt.Errorf("Error inserting into `enrichment_runs`: %v", err)
+	}
+
+	return run, nil
+}
+
+// finishRun records the end of a run along with the error that ended it, if
+// any.
+func finishRun(txn *sql.Tx, run *enrichmentRun, runErr error) error {
+	now := time.Now()
+	run.FinishedAt = &now
+
+	if runErr != nil {
+		message := runErr.Error()
+		run.Error = &message
+	}
+
+	return updateRun(txn, run)
+}
+
+// updateRun stores a run's counts so far.
+func updateRun(txn *sql.Tx, run *enrichmentRun) error {
+	_, err := txn.Exec(`
+		UPDATE enrichment_runs
+		SET finished_at = $1,
+			error = $2,
+			num_errors = $3,
+			num_examined = $4,
+			num_matched = $5,
+			num_not_found = $6,
+			num_rate_limited = $7
+		WHERE id = $8`,
+		run.FinishedAt,
+		run.Error,
+		run.NumErrors,
+		run.NumExamined,
+		run.NumMatched,
+		run.NumNotFound,
+		run.NumRateLimited,
+		run.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("Error updating `enrichment_runs`: %v", err)
+	}
+
+	return nil
+}
+
+// recentRuns returns up to limit of the most recently started runs, newest
+// first.
+func recentRuns(txn *sql.Tx, limit int) ([]*enrichmentRun, error) {
+	rows, err := txn.Query(`
+		SELECT id, started_at, finished_at, error,
+			num_errors, num_examined, num_matched, num_not_found,
+			num_rate_limited
+		FROM enrichment_runs
+		ORDER BY started_at DESC, id DESC
+		LIMIT $1`,
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []*enrichmentRun
+
+	for rows.Next() {
+		var run enrichmentRun
+		err = rows.Scan(
+			&run.ID,
+			&run.StartedAt,
+			&run.FinishedAt,
+			&run.Error,
+			&run.NumErrors,
+			&run.NumExamined,
+			&run.NumMatched,
+			&run.NumNotFound,
+			&run.NumRateLimited,
+		)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, &run)
+	}
+
+	return runs, rows.Err()
+}
+
+// weeklyMatchRates returns the match rate of the runs started in each of the
+// last numWeeks weeks (including this one) that had any, newest first.
+func weeklyMatchRates(txn *sql.Tx, numWeeks int) ([]*matchRate, error) {
+	rows, err := txn.Query(`
+		SELECT date_trunc('week', started_at) AS week,
+			count(*),
+			sum(num_examined),
+			sum(num_matched)
+		FROM enrichment_runs
+		WHERE started_at >= date_trunc('week', NOW()) - ($1 - 1) * '1 week'::interval
+		GROUP BY 1
+		ORDER BY 1 DESC`,
+		numWeeks,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rates []*matchRate
+
+	for rows.Next() {
+		var rate matchRate
+		err = rows.Scan(
+			&rate.Week,
+			&rate.NumRuns,
+			&rate.NumExamined,
+			&rate.NumMatched,
+		)
+		if err != nil {
+			return nil, err
+		}
+		rates = append(rates, &rate)
+	}
+
+	return rates, rows.Err()
+}
+
+// writeReport writes a table of runs followed by a table of weekly match
+// rates.
+func writeReport(w io.Writer, runs []*enrichmentRun, rates []*matchRate) error {
+	if len(runs) == 0 {
+		_, err := fmt.Fprintf(w, "No enrichment runs\n")
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "STARTED\tDURATION\tEXAMINED\tMATCHED\tNOT FOUND\tERRORS\tRATE LIMITED\tSTATUS\n")
+
+	for _, run := range runs {
+		duration := "-"
+		if run.FinishedAt != nil {
+			duration = run.FinishedAt.Sub(run.StartedAt).Round(time.Second).String()
+		}
+
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n",
+			run.StartedAt.Format("2006-01-02 15:04"), duration,
+			run.NumExamined, run.NumMatched, run.NumNotFound, run.NumErrors,
+			run.NumRateLimited, run.status())
+	}
+
+	fmt.Fprintf(tw, "\nWEEK\tRUNS\tEXAMINED\tMATCHED\tMATCH RATE\n")
+
+	for _, rate := range rates {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%.1f%%\n",
+			rate.Week.Format("2006-01-02"), rate.NumRuns,
+			rate.NumExamined, rate.NumMatched, rate.rate()*100)
+	}
+
+	return tw.Flush()
+}
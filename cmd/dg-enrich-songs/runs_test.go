@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestEnrichmentRuns(t *testing.T) {
+	txn, err := db.Begin()
+	assert.NoError(t, err)
+	defer func() {
+		err := txn.Rollback()
+		assert.NoError(t, err)
+	}()
+
+	first, err := startRun(txn)
+	assert.NoError(t, err)
+
+	first.add(&batchStats{numFailed: 1, numFound: 3, numNotFound: 6})
+	first.add(&batchStats{numFound: 2, numNotFound: 3})
+	first.NumRateLimited = 4
+	err = finishRun(txn, first, nil)
+	assert.NoError(t, err)
+
+	second, err := startRun(txn)
+	assert.NoError(t, err)
+
+	second.add(&batchStats{numFound: 5, numNotFound: 5})
+	err = finishRun(txn, second, fmt.Errorf("Spotify is down"))
+	assert.NoError(t, err)
+
+	// Counts survive the trip through the database, and the newest run
+	// comes first.
+	runs, err := recentRuns(txn, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(runs))
+
+	assert.Equal(t, second.ID, runs[0].ID)
+	assert.Equal(t, "failed: Spotify is down", runs[0].status())
+
+	run := runs[1]
+	assert.Equal(t, first.ID, run.ID)
+	assert.Equal(t, 15, run.NumExamined)
+	assert.Equal(t, 5, run.NumMatched)
+	assert.Equal(t, 9, run.NumNotFound)
+	assert.Equal(t, 1, run.NumErrors)
+	assert.Equal(t, 4, run.NumRateLimited)
+	assert.Equal(t, "ok", run.status())
+
+	runs, err = recentRuns(txn, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(runs))
+
+	// Both runs started this week, so they're counted together.
+	rates, err := weeklyMatchRates(txn, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(rates))
+	assert.Equal(t, 2, rates[0].NumRuns)
+	assert.Equal(t, 25, rates[0].NumExamined)
+	assert.Equal(t, 10, rates[0].NumMatched)
+	assert.InDelta(t, 0.4, rates[0].rate(), 0.001)
+}
+
+func TestWriteReport(t *testing.T) {
+	var out bytes.Buffer
+	err := writeReport(&out, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "No enrichment runs\n", out.String())
+
+	startedAt := time.Date(2026, 10, 12, 3, 0, 0, 0, time.UTC)
+	finishedAt := startedAt.Add(90 * time.Second)
+
+	out.Reset()
+	err = writeReport(&out,
+		[]*enrichmentRun{
+			{StartedAt: startedAt.Add(24 * time.Hour)},
+			{
+				StartedAt:   startedAt,
+				FinishedAt:  &finishedAt,
+				NumExamined: 8,
+				NumMatched:  2,
+				NumNotFound: 6,
+			},
+		},
+		[]*matchRate{
+			{Week: startedAt, NumRuns: 2, NumExamined: 8, NumMatched: 2},
+		},
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, ""+
+		"STARTED           DURATION  EXAMINED  MATCHED  NOT FOUND  ERRORS  RATE LIMITED  STATUS\n"+
+		"2026-10-13 03:00  -         0         0        0          0       0             unfinished\n"+
+		"2026-10-12 03:00  1m30s     8         2        6          0       0             ok\n"+
+		"\n"+
+		"WEEK        RUNS  EXAMINED  MATCHED  MATCH RATE\n"+
+		"2026-10-12  2     8         2        25.0%\n",
+		out.String())
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/brandur/deathguild/modules/dgcommon"
+	"golang.org/x/text/unicode/norm"
+)
+
+// searchStrategy is one way of searching Spotify for a song. Strategies are
+// tried in order until one of them turns up a good enough match.
+type searchStrategy struct {
+	// name identifies the strategy in configuration and is stored with
+	// songs that it found a match for.
+	name string
+
+	// query produces the search for a song along with the artist and title
+	// that it searches for, which are what the results are scored against
+	// so that a track isn't marked down for lacking what the strategy took
+	// out. It returns false if the strategy doesn't apply to the song, like
+	// one that splits up artists for a song that only has one.
+	query func(song *dgcommon.Song) (string, *dgcommon.Song, bool)
+
+	// requireArtist means that only tracks by the song's artist are
+	// considered. It's set for strategies that don't search by artist.
+	requireArtist bool
+}
+
+// searchStrategies are all strategies in the order that they're tried by
+// default.
+var searchStrategies = []*searchStrategy{
+	{
+		name: "exact",
+		query: func(song *dgcommon.Song) (string, *dgcommon.Song, bool) {
+			return artistQuery(song.Artist, song.Title),
+				searchedSong(song.Artist, song.Title), true
+		},
+	},
+	{
+		name: "strip_parentheses",
+		query: func(song *dgcommon.Song) (string, *dgcommon.Song, bool) {
+			title := trimParenthesis(song.Title)
+			return artistQuery(song.Artist, title), searchedSong(song.Artist, title),
+				title != song.Title
+		},
+	},
+	{
+		name: "strip_featuring",
+		query: func(song *dgcommon.Song) (string, *dgcommon.Song, bool) {
+			artist, title := trimFeaturing(song.Artist), trimFeaturing(song.Title)
+			return artistQuery(artist, title), searchedSong(artist, title),
+				artist != song.Artist || title != song.Title
+		},
+	},
+	{
+		name: "split_artists",
+		query: func(song *dgcommon.Song) (string, *dgcommon.Song, bool) {
+			artist := firstArtist(song.Artist)
+			return artistQuery(artist, song.Title), searchedSong(artist, song.Title),
+				artist != song.Artist
+		},
+	},
+	{
+		name: "transliterate",
+		query: func(song *dgcommon.Song) (string, *dgcommon.Song, bool) {
+			artist, title := transliterate(song.Artist), transliterate(song.Title)
+			return artistQuery(artist, title), searchedSong(artist, title),
+				artist != song.Artist || title != song.Title
+		},
+	},
+	{
+		name: "title_only",
+		query: func(song *dgcommon.Song) (string, *dgcommon.Song, bool) {
+			title := trimParenthesis(song.Title)
+			return fmt.Sprintf("track:%v", title), searchedSong(song.Artist, title), true
+		},
+		requireArtist: true,
+	},
+}
+
+// Matches anything in parenthesis or brackets at the end of a song title.
+var trimParenthesisRE = regexp.MustCompile(`^(.*?) [(\[].*[)\]]$`)
+
+// Matches a credit for a featured artist like "feat. Somebody" along with
+// the parenthesis or brackets around it, if any.
+var featuringRE = regexp.MustCompile(`(?i)\s*[(\[]?\b(?:feat\.?|ft\.|featuring)\s+[^)\]]*[)\]]?`)
+
+// Matches what separates artists that are credited together.
+var artistSeparatorRE = regexp.MustCompile(`(?i)\s+(?:&|\+|and|vs\.?|with)\s+|\s*[,/]\s*`)
+
+// Letters that don't decompose into a base letter and a diacritic but that
+// still have an obvious ASCII equivalent.
+var transliterations = map[rune]string{
+	'æ': "ae",
+	'Æ': "Ae",
+	'ø': "o",
+	'Ø': "O",
+	'ß': "ss",
+	'ł': "l",
+	'Ł': "L",
+	'đ': "d",
+	'Đ': "D",
+}
+
+// artistQuery builds a search for a title by an artist.
+func artistQuery(artist, title string) string {
+	return fmt.Sprintf("artist:%v %v", artist, title)
+}
+
+// searchedSong is the artist and title that a strategy searched for.
+func searchedSong(artist, title string) *dgcommon.Song {
+	return &dgcommon.Song{Artist: artist, Title: title}
+}
+
+// firstArtist returns the first artist of a song credited to several like
+// "Covenant & Necro Facility". A separator followed by "the" is taken to be
+// part of a band's name like "Echo & the Bunnymen" and left alone.
+func firstArtist(artist string) string {
+	for _, loc := range artistSeparatorRE.FindAllStringIndex(artist, -1) {
+		if strings.HasPrefix(strings.ToLower(artist[loc[1]:]), "the ") {
+			continue
+		}
+		return strings.TrimSpace(artist[:loc[0]])
+	}
+	return artist
+}
+
+// parseStrategies looks up strategies by name, keeping the order that
+// they're given in.
+func parseStrategies(names []string) ([]*searchStrategy, error) {
+	var strategies []*searchStrategy
+
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		var found *searchStrategy
+		for _, strategy := range searchStrategies {
+			if strategy.name == name {
+				found = strategy
+				break
+			}
+		}
+
+		if found == nil {
+			var known []string
+			for _, strategy := range searchStrategies {
+				known = append(known, strategy.name)
+			}
+			return nil, fmt.Errorf("unknown search strategy %q (known: %v)",
+				name, strings.Join(known, ", "))
+		}
+
+		strategies = append(strategies, found)
+	}
+
+	if len(strategies) == 0 {
+		return nil, fmt.Errorf("no search strategies configured")
+	}
+
+	return strategies, nil
+}
+
+// transliterate strips diacritics so that a song written up as "Mötley Crüe"
+// can be found even if Spotify has it as "Motley Crue".
+func transliterate(s string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(s) {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+
+		if replacement, ok := transliterations[r]; ok {
+			b.WriteString(replacement)
+			continue
+		}
+
+		b.WriteRune(r)
+	}
+	return norm.NFC.String(b.String())
+}
+
+// trimFeaturing strips credits for featured artists from an artist or title.
+func trimFeaturing(s string) string {
+	return strings.TrimSpace(featuringRE.ReplaceAllString(s, ""))
+}
+
+// trimParenthesis strips anything in parenthesis or brackets at the end of a
+// song title. This is so that we can use a more general name to try and get
+// a match on a song that won't match in its literal state.
+func trimParenthesis(title string) string {
+	return trimParenthesisRE.ReplaceAllString(title, "$1")
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/brandur/deathguild/modules/dgcommon"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestFirstArtist(t *testing.T) {
+	assert.Equal(t, "Covenant", firstArtist("Covenant"))
+	assert.Equal(t, "Covenant", firstArtist("Covenant & Necro Facility"))
+	assert.Equal(t, "Covenant", firstArtist("Covenant vs. Necro Facility"))
+	assert.Equal(t, "Covenant", firstArtist("Covenant, Necro Facility"))
+	assert.Equal(t, "Covenant", firstArtist("Covenant / Necro Facility"))
+	assert.Equal(t, "Siouxsie and the Banshees", firstArtist("Siouxsie and the Banshees"))
+	assert.Equal(t, "Echo & the Bunnymen", firstArtist("Echo & the Bunnymen"))
+	assert.Equal(t, "Nick Cave and the Bad Seeds",
+		firstArtist("Nick Cave and the Bad Seeds & Kylie Minogue"))
+}
+
+func TestParseStrategies(t *testing.T) {
+	strategies, err := parseStrategies([]string{"exact", " title_only"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(strategies))
+	assert.Equal(t, "exact", strategies[0].name)
+	assert.Equal(t, "title_only", strategies[1].name)
+
+	_, err = parseStrategies([]string{"exact", "guess"})
+	assert.Error(t, err)
+
+	_, err = parseStrategies(nil)
+	assert.Error(t, err)
+}
+
+func TestSearchStrategies(t *testing.T) {
+	queries := func(song *dgcommon.Song) map[string]string {
+		queries := make(map[string]string)
+		for _, strategy := range searchStrategies {
+			if query, _, ok := strategy.query(song); ok {
+				queries[strategy.name] = query
+			}
+		}
+		return queries
+	}
+
+	assert.Equal(t, map[string]string{
+		"exact":      "artist:Covenant Dead Stars",
+		"title_only": "track:Dead Stars",
+	}, queries(&dgcommon.Song{Artist: "Covenant", Title: "Dead Stars"}))
+
+	assert.Equal(t, map[string]string{
+		"exact":             "artist:Björk & Funkstörung All Is Full of Love [Remix] (feat. Somebody)",
+		"strip_parentheses": "artist:Björk & Funkstörung All Is Full of Love",
+		"strip_featuring":   "artist:Björk & Funkstörung All Is Full of Love [Remix]",
+		"split_artists":     "artist:Björk All Is Full of Love [Remix] (feat. Somebody)",
+		"transliterate":     "artist:Bjork & Funkstorung All Is Full of Love [Remix] (feat. Somebody)",
+		"title_only":        "track:All Is Full of Love",
+	}, queries(&dgcommon.Song{
+		Artist: "Björk & Funkstörung",
+		Title:  "All Is Full of Love [Remix] (feat. Somebody)",
+	}))
+}
+
+func TestTransliterate(t *testing.T) {
+	assert.Equal(t, "Motley Crue", transliterate("Mötley Crüe"))
+	assert.Equal(t, "Sopor Aeternus", transliterate("Sopor Æternus"))
+	assert.Equal(t, "Rammstein", transliterate("Rammstein"))
+}
+
+func TestTrimFeaturing(t *testing.T) {
+	assert.Equal(t, "Song", trimFeaturing("Song"))
+	assert.Equal(t, "Song", trimFeaturing("Song (feat. Somebody)"))
+	assert.Equal(t, "Song", trimFeaturing("Song [ft. Somebody]"))
+	assert.Equal(t, "Artist", trimFeaturing("Artist featuring Somebody"))
+	assert.Equal(t, "Artist", trimFeaturing("Artist Feat. Somebody"))
+	assert.Equal(t, "Defeat", trimFeaturing("Defeat"))
+}
+
+func TestTrimParenthesis(t *testing.T) {
+	assert.Equal(t, "Song", trimParenthesis("Song"))
+	assert.Equal(t, "Song", trimParenthesis("Song (So-and-so remix)"))
+	assert.Equal(t, "Song", trimParenthesis("Song (So-and-so remix) (Other)"))
+	assert.Equal(t, "Song", trimParenthesis("Song [Remastered]"))
+	assert.Equal(t, "Song", trimParenthesis("Song [Remastered] (Live)"))
+}
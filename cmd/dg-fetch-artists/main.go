@@ -0,0 +1,269 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/brandur/deathguild/modules/dgcommon"
+	"github.com/brandur/deathguild/modules/dgstore"
+	"github.com/brandur/modulir"
+	"github.com/joeshaw/envdecode"
+	"github.com/lib/pq"
+	"github.com/zmb3/spotify"
+)
+
+// The number of tracks or artists that we ask Spotify for at once. It's the
+// most that either of its tracks or artists endpoints will take.
+const batchSize = 50
+
+// Conf contains configuration information for the command. It's extracted from
+// environment variables.
+type Conf struct {
+	// ClientID is our Spotify applicaton's client ID.
+	ClientID string `env:"CLIENT_ID,required"`
+
+	// ClientSecret is our Spotify applicaton's client secret.
+	ClientSecret string `env:"CLIENT_SECRET,required"`
+
+	// DatabaseURL is a connection string for a database used to store playlist
+	// and song information.
+	DatabaseURL string `env:"DATABASE_URL,required"`
+
+	// Limit is the most tracks and the most artists that will be fetched in
+	// one run so that a big backfill can be spread out over several.
+	Limit int `env:"LIMIT,default=10000"`
+
+	// RefreshToken is our Spotify refresh token.
+	RefreshToken string `env:"REFRESH_TOKEN,required"`
+
+	// SpotifyMaxRetries is the number of times that a request rate limited
+	// by Spotify is retried before giving up.
+	SpotifyMaxRetries int `env:"SPOTIFY_MAX_RETRIES,default=10"`
+
+	// SpotifyRequestsPerSecond is the rate that requests to Spotify are
+	// held to. The rate drops on its own when Spotify rate limits us and
+	// climbs back up as requests go through.
+	SpotifyRequestsPerSecond float64 `env:"SPOTIFY_REQUESTS_PER_SECOND,default=2"`
+}
+
+var client *dgcommon.SpotifyClient
+var conf Conf
+var db *sql.DB
+var log modulir.LoggerInterface = &modulir.Logger{Level: modulir.LevelInfo}
+
+func main() {
+	err := envdecode.Decode(&conf)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	db, err = sql.Open("postgres", conf.DatabaseURL)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	client = dgcommon.GetSpotifyClient(
+		conf.ClientID, conf.ClientSecret, conf.RefreshToken,
+		dgcommon.NewRateLimiter(conf.SpotifyRequestsPerSecond), conf.SpotifyMaxRetries, log)
+
+	// Songs first so that the artists that they turn up get their genres
+	// fetched in the same run.
+	numLinked, err := loop(linkBatch)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+	log.Infof("Linked artists for %v Spotify track(s)", numLinked)
+
+	numFetched, err := loop(genresBatch)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+	log.Infof("Fetched genres for %v artist(s)", numFetched)
+}
+
+// loop runs batches until one of them doesn't find anything to do or the
+// configured limit is reached. Batches are given IDs that they've already
+// tried but that Spotify didn't know so that they can skip over them. It
+// returns the total number that the batches handled.
+func loop(batch func(skip []string) (int, []string, error)) (int, error) {
+	var numDone int
+	var missing []string
+
+	for numDone+len(missing) < conf.Limit {
+		done, missingIDs, err := batch(missing)
+		if err != nil {
+			return 0, err
+		}
+
+		if done == 0 && len(missingIDs) == 0 {
+			break
+		}
+
+		numDone += done
+		missing = append(missing, missingIDs...)
+	}
+
+	for _, id := range missing {
+		log.Infof("Not found in Spotify: %v", id)
+	}
+
+	return numDone, nil
+}
+
+// genresBatch fetches one batch of artists that we haven't fetched genres for
+// yet. It returns the number of artists updated and the IDs that Spotify
+// didn't have an artist for.
+func genresBatch(skip []string) (int, []string, error) {
+	txn, err := db.Begin()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer txn.Rollback()
+
+	ids, err := artistsNeedingGenres(txn, skip, batchSize)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if len(ids) == 0 {
+		return 0, nil, nil
+	}
+
+	artists, err := client.GetArtists(toSpotifyIDs(ids)...)
+	if err != nil {
+		return 0, nil, fmt.Errorf("Error fetching artists from Spotify: %v", err)
+	}
+
+	var numUpdated int
+	var missing []string
+
+	for i, id := range ids {
+		if i >= len(artists) || artists[i] == nil {
+			missing = append(missing, id)
+			continue
+		}
+
+		err := dgstore.UpdateArtistGenres(txn, &dgcommon.Artist{
+			Genres:    artists[i].Genres,
+			Name:      artists[i].Name,
+			SpotifyID: id,
+		})
+		if err != nil {
+			return 0, nil, err
+		}
+		numUpdated++
+	}
+
+	return numUpdated, missing, txn.Commit()
+}
+
+// linkBatch fetches one batch of tracks that songs have been matched to but
+// whose artists haven't been linked to them, and links them. It returns the
+// number of tracks linked and the IDs that Spotify didn't have a track for.
+func linkBatch(skip []string) (int, []string, error) {
+	txn, err := db.Begin()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer txn.Rollback()
+
+	ids, err := spotifyIDsNeedingArtists(txn, skip, batchSize)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if len(ids) == 0 {
+		return 0, nil, nil
+	}
+
+	tracks, err := client.GetTracks(toSpotifyIDs(ids)...)
+	if err != nil {
+		return 0, nil, fmt.Errorf("Error fetching tracks from Spotify: %v", err)
+	}
+
+	var numLinked int
+	var missing []string
+
+	for i, id := range ids {
+		if i >= len(tracks) || tracks[i] == nil {
+			missing = append(missing, id)
+			continue
+		}
+
+		err := dgstore.LinkSongArtists(txn, id, dgcommon.NewArtists(tracks[i].Artists))
+		if err != nil {
+			return 0, nil, err
+		}
+		numLinked++
+	}
+
+	return numLinked, missing, txn.Commit()
+}
+
+// artistsNeedingGenres finds the Spotify IDs of artists whose genres haven't
+// been fetched, leaving out those in skip.
+func artistsNeedingGenres(txn *sql.Tx, skip []string, limit int) ([]string, error) {
+	return queryStrings(txn, `
+		SELECT spotify_id
+		FROM artists
+		WHERE genres_fetched_at IS NULL
+			AND spotify_id <> ALL(COALESCE($1::text[], '{}'))
+		ORDER BY spotify_id
+		LIMIT $2`,
+		pq.Array(skip),
+		limit,
+	)
+}
+
+// spotifyIDsNeedingArtists finds Spotify IDs that songs have been matched to
+// but that the songs don't have artists linked from, leaving out those in
+// skip. Songs whose links came from a track that they're no longer matched
+// to count as not having any.
+func spotifyIDsNeedingArtists(txn *sql.Tx, skip []string, limit int) ([]string, error) {
+	return queryStrings(txn, `
+		SELECT DISTINCT s.spotify_id
+		FROM songs s
+		WHERE s.spotify_id IS NOT NULL
+			AND NOT EXISTS (
+				SELECT 1
+				FROM songs_artists sa
+				WHERE sa.songs_id = s.id
+					AND sa.spotify_id = s.spotify_id
+			)
+			AND s.spotify_id <> ALL(COALESCE($1::text[], '{}'))
+		ORDER BY s.spotify_id
+		LIMIT $2`,
+		pq.Array(skip),
+		limit,
+	)
+}
+
+// queryStrings runs a query that returns a single column of strings.
+func queryStrings(txn *sql.Tx, query string, args ...interface{}) ([]string, error) {
+	rows, err := txn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var values []string
+
+	for rows.Next() {
+		var value string
+		err = rows.Scan(&value)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+
+	return values, rows.Err()
+}
+
+func toSpotifyIDs(ids []string) []spotify.ID {
+	spotifyIDs := make([]spotify.ID, len(ids))
+	for i, id := range ids {
+		spotifyIDs[i] = spotify.ID(id)
+	}
+	return spotifyIDs
+}
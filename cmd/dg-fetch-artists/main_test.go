@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/brandur/deathguild/modules/dgcommon"
+	"github.com/brandur/deathguild/modules/dgstore"
+	"github.com/brandur/deathguild/modules/dgtesting"
+	assert "github.com/stretchr/testify/require"
+)
+
+func init() {
+	db = dgtesting.DB
+}
+
+func TestNeedingArtists(t *testing.T) {
+	txn, err := db.Begin()
+	assert.NoError(t, err)
+	defer func() {
+		err := txn.Rollback()
+		assert.NoError(t, err)
+	}()
+
+	for _, song := range []*dgcommon.Song{
+		{Artist: "The Cure", Title: "A Forest", SpotifyID: "forest-id"},
+		{Artist: "Cure", Title: "A Forest", SpotifyID: "forest-id"},
+		{Artist: "Ikon", Title: "Ghost", SpotifyID: "ghost-id"},
+		{Artist: "Covenant", Title: "Dead Stars"},
+	} {
+		dgtesting.InsertSong(t, txn, song)
+	}
+
+	// Every ID comes back once, and IDs being skipped don't at all.
+	ids, err := spotifyIDsNeedingArtists(txn, nil, batchSize)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"forest-id", "ghost-id"}, ids)
+
+	ids, err = spotifyIDsNeedingArtists(txn, []string{"ghost-id"}, batchSize)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"forest-id"}, ids)
+
+	err = dgstore.LinkSongArtists(txn, "forest-id", []*dgcommon.Artist{
+		{Name: "The Cure", SpotifyID: "cure-id"},
+	})
+	assert.NoError(t, err)
+
+	ids, err = spotifyIDsNeedingArtists(txn, nil, batchSize)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ghost-id"}, ids)
+
+	// A song that's been matched to another track since it was linked needs
+	// its artists again.
+	_, err = txn.Exec(`UPDATE songs SET spotify_id = 'other-forest-id' WHERE artist = 'Cure'`)
+	assert.NoError(t, err)
+
+	ids, err = spotifyIDsNeedingArtists(txn, nil, batchSize)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ghost-id", "other-forest-id"}, ids)
+
+	// The artist that was linked hasn't had its genres fetched until it's
+	// been updated.
+	ids, err = artistsNeedingGenres(txn, nil, batchSize)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"cure-id"}, ids)
+
+	err = dgstore.UpdateArtistGenres(txn, &dgcommon.Artist{
+		Name:      "The Cure",
+		SpotifyID: "cure-id",
+	})
+	assert.NoError(t, err)
+
+	ids, err = artistsNeedingGenres(txn, nil, batchSize)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(ids))
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/brandur/deathguild/modules/dgcommon"
+	"github.com/brandur/deathguild/modules/dgtesting"
+	assert "github.com/stretchr/testify/require"
+	"github.com/zmb3/spotify"
+)
+
+func init() {
+	db = dgtesting.DB
+}
+
+func TestFetchAudioFeatures(t *testing.T) {
+	txn, err := db.Begin()
+	assert.NoError(t, err)
+	defer func() {
+		err := txn.Rollback()
+		assert.NoError(t, err)
+	}()
+
+	for _, song := range []*dgcommon.Song{
+		{Artist: "The Cure", Title: "A Forest", SpotifyID: "forest-id"},
+		{Artist: "Cure", Title: "A Forest", SpotifyID: "forest-id"},
+		{Artist: "Ikon", Title: "Ghost", SpotifyID: "ghost-id"},
+		{Artist: "Covenant", Title: "Dead Stars"},
+	} {
+		dgtesting.InsertSong(t, txn, song)
+	}
+
+	// Every ID comes back once, and IDs being skipped don't at all.
+	ids, err := spotifyIDsNeedingAudioFeatures(txn, nil, batchSize)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"forest-id", "ghost-id"}, ids)
+
+	ids, err = spotifyIDsNeedingAudioFeatures(txn, []string{"ghost-id"}, batchSize)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"forest-id"}, ids)
+
+	// Spotify's answer to a request for forest-id and ghost-id, where it
+	// doesn't have features for the latter.
+	numStored, missing, err := storeAudioFeatures(txn,
+		[]string{"forest-id", "ghost-id"},
+		[]*spotify.AudioFeatures{{Energy: 0.7, Key: 4, Tempo: 140}, nil})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, numStored)
+	assert.Equal(t, []string{"ghost-id"}, missing)
+
+	ids, err = spotifyIDsNeedingAudioFeatures(txn, nil, batchSize)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ghost-id"}, ids)
+}
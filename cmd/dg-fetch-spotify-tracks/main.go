@@ -0,0 +1,196 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/brandur/deathguild/modules/dgcommon"
+	"github.com/brandur/deathguild/modules/dgstore"
+	"github.com/brandur/modulir"
+	"github.com/joeshaw/envdecode"
+	"github.com/lib/pq"
+	"github.com/zmb3/spotify"
+)
+
+// The number of tracks that we ask Spotify for at once. It's the most that
+// its tracks endpoint will take.
+const batchSize = 50
+
+// Conf contains configuration information for the command. It's extracted from
+// environment variables.
+type Conf struct {
+	// ClientID is our Spotify applicaton's client ID.
+	ClientID string `env:"CLIENT_ID,required"`
+
+	// ClientSecret is our Spotify applicaton's client secret.
+	ClientSecret string `env:"CLIENT_SECRET,required"`
+
+	// DatabaseURL is a connection string for a database used to store playlist
+	// and song information.
+	DatabaseURL string `env:"DATABASE_URL,required"`
+
+	// Limit is the most tracks that will be fetched in one run so that a big
+	// backfill can be spread out over several.
+	Limit int `env:"LIMIT,default=10000"`
+
+	// RefreshToken is our Spotify refresh token.
+	RefreshToken string `env:"REFRESH_TOKEN,required"`
+
+	// SpotifyMaxRetries is the number of times that a request rate limited
+	// by Spotify is retried before giving up.
+	SpotifyMaxRetries int `env:"SPOTIFY_MAX_RETRIES,default=10"`
+
+	// SpotifyRequestsPerSecond is the rate that requests to Spotify are
+	// held to. The rate drops on its own when Spotify rate limits us and
+	// climbs back up as requests go through.
+	SpotifyRequestsPerSecond float64 `env:"SPOTIFY_REQUESTS_PER_SECOND,default=2"`
+}
+
+var client *dgcommon.SpotifyClient
+var conf Conf
+var db *sql.DB
+var log modulir.LoggerInterface = &modulir.Logger{Level: modulir.LevelInfo}
+
+func main() {
+	err := envdecode.Decode(&conf)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	db, err = sql.Open("postgres", conf.DatabaseURL)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	client = dgcommon.GetSpotifyClient(
+		conf.ClientID, conf.ClientSecret, conf.RefreshToken,
+		dgcommon.NewRateLimiter(conf.SpotifyRequestsPerSecond), conf.SpotifyMaxRetries, log)
+
+	var numFetched, numMissing int
+
+	// IDs that Spotify doesn't have a track for are skipped over so that
+	// they don't come back in every batch.
+	var missing []string
+
+	for numFetched+numMissing < conf.Limit {
+		fetched, missingIDs, err := fetchBatch(missing)
+		if err != nil {
+			dgcommon.ExitWithError(err)
+		}
+
+		if fetched == 0 && len(missingIDs) == 0 {
+			break
+		}
+
+		numFetched += fetched
+		numMissing += len(missingIDs)
+		missing = append(missing, missingIDs...)
+	}
+
+	log.Infof("Fetched %v Spotify track(s); %v weren't found", numFetched, numMissing)
+}
+
+// fetchBatch fetches one batch of tracks and stores them. It returns the
+// number stored and the IDs that Spotify didn't have a track for.
+func fetchBatch(skip []string) (int, []string, error) {
+	txn, err := db.Begin()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer txn.Rollback()
+
+	ids, err := spotifyIDsNeedingTrack(txn, skip, batchSize)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if len(ids) == 0 {
+		return 0, nil, nil
+	}
+
+	spotifyIDs := make([]spotify.ID, len(ids))
+	for i, id := range ids {
+		spotifyIDs[i] = spotify.ID(id)
+	}
+
+	tracks, err := client.GetTracks(spotifyIDs...)
+	if err != nil {
+		return 0, nil, fmt.Errorf("Error fetching tracks from Spotify: %v", err)
+	}
+
+	numFetched, missing, err := storeTracks(txn, ids, tracks)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	for _, id := range missing {
+		log.Infof("No Spotify track for ID: %v", id)
+	}
+
+	return numFetched, missing, txn.Commit()
+}
+
+// spotifyIDsNeedingTrack finds Spotify IDs that songs have been matched to
+// but that we haven't stored a track for, leaving out those in skip.
+func spotifyIDsNeedingTrack(txn *sql.Tx, skip []string, limit int) ([]string, error) {
+	rows, err := txn.Query(`
+		SELECT DISTINCT s.spotify_id
+		FROM songs s
+			LEFT JOIN spotify_tracks t
+				ON t.spotify_id = s.spotify_id
+		WHERE s.spotify_id IS NOT NULL
+			AND t.id IS NULL
+			AND s.spotify_id <> ALL(COALESCE($1::text[], '{}'))
+		ORDER BY s.spotify_id
+		LIMIT $2`,
+		pq.Array(skip),
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// storeTracks stores the tracks that Spotify returned for a batch of IDs.
+// Spotify answers with a track (or nil if it doesn't know the ID) at the same
+// position as each ID that it was asked for. It returns the number stored
+// and the IDs that came back nil.
+func storeTracks(txn *sql.Tx, ids []string, tracks []*spotify.FullTrack) (int, []string, error) {
+	var numStored int
+	var missing []string
+
+	for i, id := range ids {
+		if i >= len(tracks) || tracks[i] == nil {
+			missing = append(missing, id)
+			continue
+		}
+
+		track := dgcommon.NewSpotifyTrack(tracks[i])
+
+		// Spotify sometimes answers with a track that's been relinked to
+		// another ID. Keep it under the ID that our songs refer to.
+		track.ID = id
+
+		err := dgstore.UpsertSpotifyTrack(txn, track)
+		if err != nil {
+			return 0, nil, err
+		}
+		numStored++
+	}
+
+	return numStored, missing, nil
+}
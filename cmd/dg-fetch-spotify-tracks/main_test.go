@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/brandur/deathguild/modules/dgcommon"
+	"github.com/brandur/deathguild/modules/dgtesting"
+	assert "github.com/stretchr/testify/require"
+	"github.com/zmb3/spotify"
+)
+
+func init() {
+	db = dgtesting.DB
+}
+
+func TestFetchTracks(t *testing.T) {
+	txn, err := db.Begin()
+	assert.NoError(t, err)
+	defer func() {
+		err := txn.Rollback()
+		assert.NoError(t, err)
+	}()
+
+	for _, song := range []*dgcommon.Song{
+		{Artist: "The Cure", Title: "A Forest", SpotifyID: "forest-id"},
+		{Artist: "Cure", Title: "A Forest", SpotifyID: "forest-id"},
+		{Artist: "Ikon", Title: "Ghost", SpotifyID: "ghost-id"},
+		{Artist: "Covenant", Title: "Dead Stars"},
+	} {
+		dgtesting.InsertSong(t, txn, song)
+	}
+
+	// Every ID comes back once, and IDs being skipped don't at all.
+	ids, err := spotifyIDsNeedingTrack(txn, nil, batchSize)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"forest-id", "ghost-id"}, ids)
+
+	ids, err = spotifyIDsNeedingTrack(txn, []string{"ghost-id"}, batchSize)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"forest-id"}, ids)
+
+	// Spotify's answer to a request for forest-id and ghost-id, where it
+	// doesn't know the latter and has relinked the former.
+	track := &spotify.FullTrack{
+		SimpleTrack: spotify.SimpleTrack{ID: "relinked-id", Name: "A Forest"},
+	}
+	numStored, missing, err := storeTracks(txn,
+		[]string{"forest-id", "ghost-id"}, []*spotify.FullTrack{track, nil})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, numStored)
+	assert.Equal(t, []string{"ghost-id"}, missing)
+
+	// Only the one that's still missing is left.
+	ids, err = spotifyIDsNeedingTrack(txn, nil, batchSize)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ghost-id"}, ids)
+}
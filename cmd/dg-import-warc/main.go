@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/brandur/deathguild/modules/dgcommon"
+	"github.com/brandur/deathguild/modules/dgsource"
+	"github.com/brandur/deathguild/modules/dgstore"
+	"github.com/brandur/deathguild/modules/dgwarc"
+	"github.com/brandur/modulir"
+	"github.com/joeshaw/envdecode"
+	_ "github.com/lib/pq"
+	"github.com/spf13/cobra"
+)
+
+// Conf contains configuration information for the command. It's extracted from
+// environment variables.
+type Conf struct {
+	// DatabaseURL is a connection string for a database used to store playlist
+	// and song information.
+	DatabaseURL string `env:"DATABASE_URL,required"`
+
+	// Source is the name of the source whose playlist pages should be looked
+	// for in archives.
+	Source string `env:"SOURCE,default=deathguild"`
+}
+
+var conf Conf
+var db *sql.DB
+var log modulir.LoggerInterface = &modulir.Logger{Level: modulir.LevelInfo}
+var source dgsource.Source
+
+func main() {
+	var dryRun bool
+
+	rootCmd := &cobra.Command{
+		Use:   "dg-import-warc FILE...",
+		Short: "Recover playlists from WARC archives of a source's site",
+		Long: strings.TrimSpace(`
+Reads local WARC files (plain or gzipped) for captures of a source's
+playlist pages, like those downloaded from the Wayback Machine, and
+stores the playlists in them for any nights that are missing. Nights
+that are already stored are never touched, and each recovered playlist
+records which archive it came from. No network access is needed.`),
+		Args: cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			importWARCs(args, dryRun)
+		},
+	}
+
+	rootCmd.Flags().BoolVar(&dryRun, "dry-run", false,
+		"Report what would be recovered without saving anything")
+
+	if err := rootCmd.Execute(); err != nil {
+		dgcommon.ExitWithError(err)
+	}
+}
+
+func importWARCs(paths []string, dryRun bool) {
+	err := envdecode.Decode(&conf)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	db, err = sql.Open("postgres", conf.DatabaseURL)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	source, err = dgsource.Get(conf.Source)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	captures := make(map[string]*capture)
+	for _, path := range paths {
+		err := readCapturesFromFile(path, captures)
+		if err != nil {
+			dgcommon.ExitWithError(err)
+		}
+	}
+
+	log.Infof("Found captures of %v playlist(s)", len(captures))
+
+	txn, err := db.Begin()
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+	defer txn.Rollback()
+
+	recovered, err := importCaptures(txn, captures)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	for _, c := range recovered {
+		fmt.Printf("%v: recovered %v song(s) from %v\n", c.Day, len(c.Songs), c.provenance())
+
+		if c.quarantined {
+			fmt.Printf("    quarantined; see `dg-review report`\n")
+		}
+	}
+
+	if dryRun {
+		log.Infof("Dry run; rolling back")
+	} else {
+		err = txn.Commit()
+		if err != nil {
+			dgcommon.ExitWithError(err)
+		}
+	}
+
+	log.Infof("Recovered %v playlist(s); %v were already stored",
+		len(recovered), len(captures)-len(recovered))
+}
+
+// capture is a playlist page found in an archive.
+type capture struct {
+	// CapturedAt is when the archive captured the page.
+	CapturedAt time.Time
+
+	Day string
+
+	// File is the path of the archive that the capture was found in.
+	File string
+
+	// RecordID is the ID of the WARC record containing the capture.
+	RecordID string
+
+	Songs []*dgcommon.Song
+
+	// URI is the address of the page that was captured.
+	URI string
+
+	// quarantined is set once the capture's playlist is stored if it's being
+	// held back for review.
+	quarantined bool
+}
+
+// provenance describes where the capture came from in a form suitable for
+// storing in `playlists.provenance`.
+func (c *capture) provenance() string {
+	return fmt.Sprintf("warc:%v record=%v uri=%v captured=%v",
+		filepath.Base(c.File), c.RecordID, c.URI, c.CapturedAt.Format(time.RFC3339))
+}
+
+func readCapturesFromFile(path string, captures map[string]*capture) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return readCaptures(f, path, captures)
+}
+
+// readCaptures finds every playlist page in a WARC file and parses it with
+// the source's usual parser. When a night was captured more than once, the
+// most recent capture is kept since it'll have any fixes made to the
+// tracklist after the fact.
+//
+// Archives are full of pages that aren't what they look like, like error
+// pages captured with a 200, so pages that can't be parsed or don't have any
+// songs in them are logged and skipped rather than stopping the import.
+func readCaptures(r io.Reader, path string, captures map[string]*capture) error {
+	reader, err := dgwarc.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%v: %v", path, err)
+		}
+
+		if record.Type() != "response" && record.Type() != "resource" {
+			continue
+		}
+
+		uri := record.TargetURI()
+		day, ok := source.PlaylistDay(uri)
+		if !ok {
+			continue
+		}
+
+		status, body, err := record.Payload()
+		if err != nil {
+			log.Errorf("Skipping unreadable capture of %v in %v: %v", uri, path, err)
+			continue
+		}
+
+		if status != 200 {
+			log.Debugf("Skipping capture of %v with status %v", uri, status)
+			continue
+		}
+
+		songs, err := source.ParsePlaylist(bytes.NewReader(body))
+		if err != nil {
+			log.Errorf("Skipping unparseable capture of %v in %v: %v", uri, path, err)
+			continue
+		}
+
+		if len(songs) == 0 {
+			log.Infof("Skipping capture of %v with no songs", uri)
+			continue
+		}
+
+		capturedAt, err := record.Date()
+		if err != nil {
+			return fmt.Errorf("%v: bad date in record %v: %v", path, record.ID(), err)
+		}
+
+		if existing, ok := captures[day]; ok && !capturedAt.After(existing.CapturedAt) {
+			continue
+		}
+
+		captures[day] = &capture{
+			CapturedAt: capturedAt,
+			Day:        day,
+			File:       path,
+			RecordID:   record.ID(),
+			Songs:      songs,
+			URI:        uri,
+		}
+	}
+
+	return nil
+}
+
+// importCaptures stores the playlists of captures for nights that aren't
+// already stored and returns the ones that were, sorted by day.
+func importCaptures(txn *sql.Tx, captures map[string]*capture) ([]*capture, error) {
+	storedDays, err := dgstore.StoredDays(txn, source.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	var days []string
+	for day := range captures {
+		days = append(days, day)
+	}
+	sort.Strings(days)
+
+	var recovered []*capture
+
+	for _, day := range days {
+		if storedDays[day] {
+			log.Debugf("Playlist %v already stored; skipping", day)
+			continue
+		}
+
+		c := captures[day]
+
+		result, err := dgstore.UpsertPlaylistAndSongs(txn, source.Name(), day, c.Songs)
+		if err != nil {
+			return nil, err
+		}
+
+		c.quarantined = result.Status == dgstore.PlaylistStatusQuarantined
+
+		err = dgstore.SetPlaylistProvenance(txn, source.Name(), day, c.provenance())
+		if err != nil {
+			return nil, err
+		}
+
+		recovered = append(recovered, c)
+	}
+
+	return recovered, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/brandur/deathguild/modules/dgcommon"
+	"github.com/brandur/deathguild/modules/dgsource"
+	"github.com/brandur/deathguild/modules/dgstore"
+	"github.com/brandur/deathguild/modules/dgtesting"
+	assert "github.com/stretchr/testify/require"
+)
+
+func init() {
+	db = dgtesting.DB
+	source = dgsource.DeathGuild
+}
+
+// warcResponse renders a WARC response record for a captured page.
+func warcResponse(id, date, uri string, status int, body []byte) string {
+	content := fmt.Sprintf("HTTP/1.1 %v Whatever\r\nContent-Type: text/html\r\n\r\n%s",
+		status, body)
+
+	return fmt.Sprintf("WARC/1.0\r\n"+
+		"WARC-Type: response\r\n"+
+		"WARC-Record-ID: <urn:uuid:%v>\r\n"+
+		"WARC-Date: %v\r\n"+
+		"WARC-Target-URI: %v\r\n"+
+		"Content-Length: %v\r\n"+
+		"\r\n"+
+		"%v\r\n\r\n",
+		id, date, uri, len(content), content)
+}
+
+func TestReadCaptures(t *testing.T) {
+	body, err := ioutil.ReadFile("../../modules/dgtesting/samples/2016-09-26.html")
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+	buf.WriteString(warcResponse("1", "2016-09-27T00:00:00Z",
+		"http://www.deathguild.com/playdates", 200, []byte("<html></html>")))
+	buf.WriteString(warcResponse("2", "2016-09-28T00:00:00Z",
+		"http://www.deathguild.com/playlist/2016-09-26", 200, body))
+	buf.WriteString(warcResponse("3", "2016-09-27T00:00:00Z",
+		"http://www.deathguild.com/playlist/2016-09-26", 200, []byte("<html>Down for maintenance</html>")))
+	buf.WriteString(warcResponse("4", "2016-10-04T00:00:00Z",
+		"http://www.deathguild.com/playlist/2016-10-03", 404, []byte("Not Found")))
+
+	captures := make(map[string]*capture)
+	err = readCaptures(&buf, "/archives/deathguild.warc", captures)
+	assert.NoError(t, err)
+
+	// Only the playlist page with songs in it is kept. The index, the
+	// maintenance page, and the 404 are all skipped.
+	assert.Equal(t, 1, len(captures))
+
+	c := captures["2016-09-26"]
+	assert.Equal(t, time.Date(2016, 9, 28, 0, 0, 0, 0, time.UTC), c.CapturedAt)
+	assert.Equal(t, "<urn:uuid:2>", c.RecordID)
+	assert.Equal(t, &dgcommon.Song{Artist: "Panic Lift", Title: "The Path"},
+		c.Songs[len(c.Songs)-1])
+
+	assert.Equal(t,
+		"warc:deathguild.warc record=<urn:uuid:2> "+
+			"uri=http://www.deathguild.com/playlist/2016-09-26 captured=2016-09-28T00:00:00Z",
+		c.provenance())
+
+	// A later capture of the same night in another file replaces it.
+	buf.Reset()
+	buf.WriteString(warcResponse("5", "2017-01-01T00:00:00Z",
+		"http://web.archive.org/web/20170101000000/http://www.deathguild.com/playlist/2016-09-26",
+		200, body))
+
+	err = readCaptures(&buf, "/archives/wayback.warc", captures)
+	assert.NoError(t, err)
+	assert.Equal(t, "<urn:uuid:5>", captures["2016-09-26"].RecordID)
+}
+
+func TestImportCaptures(t *testing.T) {
+	txn, err := db.Begin()
+	assert.NoError(t, err)
+	defer func() {
+		err := txn.Rollback()
+		assert.NoError(t, err)
+	}()
+
+	songs := []*dgcommon.Song{
+		{Artist: "Depeche Mode", Title: "Two Minute Warning"},
+	}
+
+	_, err = dgstore.UpsertPlaylistAndSongs(txn, source.Name(), "2005-01-24", []*dgcommon.Song{
+		{Artist: "Imperative Reaction", Title: "You Remain"},
+	})
+	assert.NoError(t, err)
+
+	captures := map[string]*capture{
+		"2005-01-24": {Day: "2005-01-24", File: "a.warc", Songs: songs},
+		"2005-01-31": {Day: "2005-01-31", File: "a.warc", Songs: songs},
+	}
+
+	recovered, err := importCaptures(txn, captures)
+	assert.NoError(t, err)
+
+	// Only the missing night is recovered.
+	assert.Equal(t, []*capture{captures["2005-01-31"]}, recovered)
+
+	var provenance *string
+	err = txn.QueryRow(`
+		SELECT provenance
+		FROM playlists
+		WHERE source = $1
+			AND day = $2`,
+		source.Name(),
+		"2005-01-24",
+	).Scan(&provenance)
+	assert.NoError(t, err)
+	assert.Nil(t, provenance)
+
+	err = txn.QueryRow(`
+		SELECT provenance
+		FROM playlists
+		WHERE source = $1
+			AND day = $2`,
+		source.Name(),
+		"2005-01-31",
+	).Scan(&provenance)
+	assert.NoError(t, err)
+	assert.Equal(t, captures["2005-01-31"].provenance(), *provenance)
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brandur/deathguild/modules/dgcommon"
+	"github.com/brandur/deathguild/modules/dgsource"
+	"github.com/brandur/deathguild/modules/dgstore"
+	"github.com/brandur/modulir"
+	"github.com/joeshaw/envdecode"
+	_ "github.com/lib/pq"
+	"github.com/spf13/cobra"
+)
+
+// Conf contains configuration information for the command. It's extracted from
+// environment variables.
+type Conf struct {
+	// DatabaseURL is a connection string for a database used to store playlist
+	// and song information.
+	DatabaseURL string `env:"DATABASE_URL,required"`
+
+	// Source is the name of the source that imported playlists are stored
+	// under.
+	Source string `env:"SOURCE,default=deathguild"`
+}
+
+var conf Conf
+var db *sql.DB
+var log modulir.LoggerInterface = &modulir.Logger{Level: modulir.LevelInfo}
+var source dgsource.Source
+
+// Matches a Spotify track ID, which is 22 base-62 characters.
+var spotifyIDRegexp = regexp.MustCompile(`^[0-9A-Za-z]{22}$`)
+
+func main() {
+	var dryRun bool
+	var format string
+
+	rootCmd := &cobra.Command{
+		Use:   "dg-import FILE...",
+		Short: "Import playlists from CSV or JSON files",
+		Long: strings.TrimSpace(`
+Imports playlists from CSV or JSON files for nights that are missing
+from the source or wrong there. Every record has a day, a position
+(starting from 1), an artist, a title, and optionally a Spotify track
+ID. Files are validated in full before anything is written, and every
+playlist and song that's created or updated is reported.`),
+		Args: cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			importFiles(args, format, dryRun)
+		},
+	}
+
+	rootCmd.Flags().BoolVar(&dryRun, "dry-run", false,
+		"Report what would change without saving anything")
+	rootCmd.Flags().StringVar(&format, "format", "",
+		"Format of the files (csv or json); detected from extension if empty")
+
+	if err := rootCmd.Execute(); err != nil {
+		dgcommon.ExitWithError(err)
+	}
+}
+
+func importFiles(paths []string, format string, dryRun bool) {
+	err := envdecode.Decode(&conf)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	source, err = dgsource.Get(conf.Source)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	var records []*importRecord
+	for _, path := range paths {
+		fileRecords, err := readFile(path, format)
+		if err != nil {
+			dgcommon.ExitWithError(err)
+		}
+		records = append(records, fileRecords...)
+	}
+
+	playlists, errs := buildPlaylists(records)
+	if len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Fprintf(os.Stderr, "invalid: %v\n", err)
+		}
+		dgcommon.ExitWithError(fmt.Errorf("%v problem(s) found; nothing was imported",
+			len(errs)))
+	}
+
+	db, err = sql.Open("postgres", conf.DatabaseURL)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	txn, err := db.Begin()
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+	defer txn.Rollback()
+
+	var sum summary
+	for _, playlist := range playlists {
+		report, err := importPlaylist(txn, playlist)
+		if err != nil {
+			dgcommon.ExitWithError(fmt.Errorf("Error importing %v: %v", playlist.Day, err))
+		}
+
+		report.print(os.Stdout)
+		sum.add(report)
+	}
+
+	if dryRun {
+		log.Infof("Dry run; rolling back")
+	} else {
+		err = txn.Commit()
+		if err != nil {
+			dgcommon.ExitWithError(err)
+		}
+	}
+
+	fmt.Printf("%v\n", sum)
+}
+
+// importRecord is a single play of a song in an imported playlist.
+type importRecord struct {
+	Artist    string `json:"artist"`
+	Day       string `json:"day"`
+	Position  int    `json:"position"`
+	SpotifyID string `json:"spotify_id"`
+	Title     string `json:"title"`
+
+	// location describes where the record came from (e.g. `notes.csv:3`) so
+	// that validation errors can point to it.
+	location string
+}
+
+// readFile reads records from a file. Its format is inferred from its
+// extension unless one is given.
+func readFile(path, format string) ([]*importRecord, error) {
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	switch format {
+	case "csv":
+		return readCSV(f, path)
+	case "json":
+		return readJSON(f, path)
+	default:
+		return nil, fmt.Errorf("%v: unknown format %q (should be csv or json)",
+			path, format)
+	}
+}
+
+// readCSV reads records from CSV. The first row is a header naming the
+// columns, which may come in any order. `spotify_id` is optional.
+func readCSV(r io.Reader, name string) ([]*importRecord, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", name, err)
+	}
+
+	columns := make(map[string]int)
+	for i, column := range header {
+		column = strings.ToLower(strings.TrimSpace(column))
+		switch column {
+		case "artist", "day", "position", "spotify_id", "title":
+		default:
+			return nil, fmt.Errorf("%v: unknown column %q", name, column)
+		}
+		columns[column] = i
+	}
+
+	for _, column := range []string{"artist", "day", "position", "title"} {
+		if _, ok := columns[column]; !ok {
+			return nil, fmt.Errorf("%v: missing column %q", name, column)
+		}
+	}
+
+	field := func(row []string, column string) string {
+		i, ok := columns[column]
+		if !ok {
+			return ""
+		}
+		return row[i]
+	}
+
+	var records []*importRecord
+
+	// Lines are counted by hand since csv.Reader can't report them in the Go
+	// that we build with. This assumes that every record is on a line of its
+	// own after the header.
+	line := 1
+
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", name, err)
+		}
+
+		line++
+		location := fmt.Sprintf("%v:%v", name, line)
+
+		position, err := strconv.Atoi(strings.TrimSpace(field(row, "position")))
+		if err != nil {
+			return nil, fmt.Errorf("%v: bad position %q", location, field(row, "position"))
+		}
+
+		records = append(records, &importRecord{
+			Artist:    field(row, "artist"),
+			Day:       field(row, "day"),
+			Position:  position,
+			SpotifyID: field(row, "spotify_id"),
+			Title:     field(row, "title"),
+			location:  location,
+		})
+	}
+
+	return records, nil
+}
+
+// readJSON reads records from a JSON array of objects.
+func readJSON(r io.Reader, name string) ([]*importRecord, error) {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+
+	var records []*importRecord
+	err := decoder.Decode(&records)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", name, err)
+	}
+
+	for i, record := range records {
+		record.location = fmt.Sprintf("%v[%v]", name, i)
+	}
+
+	return records, nil
+}
+
+// importedPlaylist is a playlist assembled from imported records.
+type importedPlaylist struct {
+	Day string
+
+	// Songs are the playlist's songs in order. Songs with a SpotifyID set
+	// have it stored along with them.
+	Songs []*dgcommon.Song
+}
+
+// buildPlaylists validates records and assembles them into playlists, sorted
+// by day. Every problem found is returned rather than just the first so that
+// a file can be fixed in one pass.
+func buildPlaylists(records []*importRecord) ([]*importedPlaylist, []error) {
+	var errs []error
+
+	byDay := make(map[string]map[int]*importRecord)
+	spotifyIDs := make(map[[2]string]*importRecord)
+
+	for _, record := range records {
+		record.Artist = strings.TrimSpace(record.Artist)
+		record.Day = strings.TrimSpace(record.Day)
+		record.SpotifyID = strings.TrimSpace(record.SpotifyID)
+		record.Title = strings.TrimSpace(record.Title)
+
+		var recordErrs []error
+
+		if _, err := time.Parse("2006-01-02", record.Day); err != nil {
+			recordErrs = append(recordErrs, fmt.Errorf("%v: bad day %q (should look like YYYY-MM-DD)",
+				record.location, record.Day))
+		}
+
+		if record.Position < 1 {
+			recordErrs = append(recordErrs, fmt.Errorf("%v: bad position %v (should start from 1)",
+				record.location, record.Position))
+		}
+
+		if record.Artist == "" {
+			recordErrs = append(recordErrs, fmt.Errorf("%v: empty artist", record.location))
+		}
+
+		if record.Title == "" {
+			recordErrs = append(recordErrs, fmt.Errorf("%v: empty title", record.location))
+		}
+
+		if record.SpotifyID != "" && !spotifyIDRegexp.MatchString(record.SpotifyID) {
+			recordErrs = append(recordErrs, fmt.Errorf("%v: bad Spotify ID %q",
+				record.location, record.SpotifyID))
+		}
+
+		if len(recordErrs) > 0 {
+			errs = append(errs, recordErrs...)
+			continue
+		}
+
+		positions, ok := byDay[record.Day]
+		if !ok {
+			positions = make(map[int]*importRecord)
+			byDay[record.Day] = positions
+		}
+
+		if other, ok := positions[record.Position]; ok {
+			errs = append(errs, fmt.Errorf("%v: position %v on %v already used at %v",
+				record.location, record.Position, record.Day, other.location))
+			continue
+		}
+		positions[record.Position] = record
+
+		// The same song can't be given two different Spotify IDs.
+		if record.SpotifyID != "" {
+			key := [2]string{record.Artist, record.Title}
+			if other, ok := spotifyIDs[key]; ok && other.SpotifyID != record.SpotifyID {
+				errs = append(errs, fmt.Errorf("%v: Spotify ID %q conflicts with %q at %v",
+					record.location, record.SpotifyID, other.SpotifyID, other.location))
+				continue
+			}
+			spotifyIDs[key] = record
+		}
+	}
+
+	var playlists []*importedPlaylist
+
+	for day, positions := range byDay {
+		playlist := &importedPlaylist{Day: day}
+
+		for position := 1; position <= len(positions); position++ {
+			record, ok := positions[position]
+			if !ok {
+				errs = append(errs, fmt.Errorf("%v: position %v is missing", day, position))
+				break
+			}
+
+			playlist.Songs = append(playlist.Songs, &dgcommon.Song{
+				Artist:    record.Artist,
+				SpotifyID: record.SpotifyID,
+				Title:     record.Title,
+			})
+		}
+
+		playlists = append(playlists, playlist)
+	}
+
+	sort.Slice(playlists, func(i, j int) bool {
+		return playlists[i].Day < playlists[j].Day
+	})
+
+	sort.SliceStable(errs, func(i, j int) bool {
+		return errs[i].Error() < errs[j].Error()
+	})
+
+	return playlists, errs
+}
+
+// playlistReport describes what importing a single playlist changed.
+type playlistReport struct {
+	Day string
+
+	// Status is one of `created`, `updated`, or `unchanged`.
+	Status string
+
+	NumSongs int
+
+	// Quarantined is set if the playlist is being held back for review.
+	Quarantined bool
+
+	SongsCreated        []*dgcommon.Song
+	SongsSpotifyUpdated []*dgcommon.Song
+}
+
+func (r *playlistReport) print(w io.Writer) {
+	fmt.Fprintf(w, "%v: %v (%v song(s))\n", r.Day, r.Status, r.NumSongs)
+
+	if r.Quarantined {
+		fmt.Fprintf(w, "    quarantined; see `dg-review report`\n")
+	}
+
+	for _, song := range r.SongsCreated {
+		fmt.Fprintf(w, "    created song: %v - %v\n", song.Artist, song.Title)
+	}
+
+	for _, song := range r.SongsSpotifyUpdated {
+		fmt.Fprintf(w, "    updated song: %v - %v (Spotify ID %v)\n",
+			song.Artist, song.Title, song.SpotifyID)
+	}
+}
+
+// importPlaylist stores a playlist through the same path as the scraper. A
+// playlist whose songs already match what's stored is left alone so that its
+// Spotify playlist isn't needlessly synced again, but any Spotify IDs given
+// for its songs are still applied and every playlist with those songs is
+// flagged to be synced.
+func importPlaylist(txn *sql.Tx, playlist *importedPlaylist) (*playlistReport, error) {
+	report := &playlistReport{Day: playlist.Day, NumSongs: len(playlist.Songs)}
+
+	storedPlaylist, err := dgstore.LookupPlaylist(txn, source.Name(), playlist.Day)
+	if err != nil {
+		return nil, err
+	}
+
+	if storedPlaylist != nil && storedPlaylist.SongsHash == dgstore.SongsHash(playlist.Songs) {
+		report.Status = "unchanged"
+	} else {
+		result, err := dgstore.UpsertPlaylistAndSongs(txn, source.Name(),
+			playlist.Day, playlist.Songs)
+		if err != nil {
+			return nil, err
+		}
+
+		if result.PlaylistCreated {
+			report.Status = "created"
+		} else {
+			report.Status = "updated"
+		}
+		report.Quarantined = result.Status == dgstore.PlaylistStatusQuarantined
+		report.SongsCreated = result.SongsCreated
+	}
+
+	var updatedIDs []int
+
+	for _, song := range playlist.Songs {
+		if song.SpotifyID == "" {
+			continue
+		}
+
+		songIDs, err := dgstore.SetSongSpotifyID(txn, song.Artist, song.Title, song.SpotifyID)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(songIDs) > 0 {
+			report.SongsSpotifyUpdated = append(report.SongsSpotifyUpdated, song)
+			updatedIDs = append(updatedIDs, songIDs...)
+		}
+	}
+
+	// Songs that got new tracks are on other nights' playlists too, and even
+	// an unchanged playlist needs to be synced for them.
+	err = dgstore.MarkPlaylistsForSync(txn, updatedIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// summary totals up the reports for every imported playlist.
+type summary struct {
+	playlistsCreated, playlistsUpdated, playlistsUnchanged int
+	songsCreated, songsUpdated                             int
+}
+
+func (s *summary) add(report *playlistReport) {
+	switch report.Status {
+	case "created":
+		s.playlistsCreated++
+	case "updated":
+		s.playlistsUpdated++
+	case "unchanged":
+		s.playlistsUnchanged++
+	}
+
+	s.songsCreated += len(report.SongsCreated)
+	s.songsUpdated += len(report.SongsSpotifyUpdated)
+}
+
+func (s summary) String() string {
+	return fmt.Sprintf(
+		"Playlists: %v created, %v updated, %v unchanged; songs: %v created, %v updated",
+		s.playlistsCreated, s.playlistsUpdated, s.playlistsUnchanged,
+		s.songsCreated, s.songsUpdated)
+}
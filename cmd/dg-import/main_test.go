@@ -0,0 +1,191 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/brandur/deathguild/modules/dgcommon"
+	"github.com/brandur/deathguild/modules/dgsource"
+	"github.com/brandur/deathguild/modules/dgtesting"
+	assert "github.com/stretchr/testify/require"
+)
+
+func init() {
+	db = dgtesting.DB
+	source = dgsource.DeathGuild
+}
+
+func TestReadCSV(t *testing.T) {
+	records, err := readCSV(strings.NewReader(strings.TrimSpace(`
+position,day,artist,title,spotify_id
+1,2016-09-26,Depeche Mode,Two Minute Warning,6TwdTfAn4YNGYhkWPhgQ6C
+2,2016-09-26,"Simon & Garfunkel","I Am A Rock",
+`)), "notes.csv")
+	assert.NoError(t, err)
+
+	assert.Equal(t, []*importRecord{
+		{
+			Artist:    "Depeche Mode",
+			Day:       "2016-09-26",
+			Position:  1,
+			SpotifyID: "6TwdTfAn4YNGYhkWPhgQ6C",
+			Title:     "Two Minute Warning",
+			location:  "notes.csv:2",
+		},
+		{
+			Artist:   "Simon & Garfunkel",
+			Day:      "2016-09-26",
+			Position: 2,
+			Title:    "I Am A Rock",
+			location: "notes.csv:3",
+		},
+	}, records)
+
+	_, err = readCSV(strings.NewReader("day,artist,title\n"), "notes.csv")
+	assert.EqualError(t, err, `notes.csv: missing column "position"`)
+
+	_, err = readCSV(strings.NewReader("day,position,artist,title,dj\n"), "notes.csv")
+	assert.EqualError(t, err, `notes.csv: unknown column "dj"`)
+
+	_, err = readCSV(strings.NewReader("day,position,artist,title\n2016-09-26,first,a,b\n"),
+		"notes.csv")
+	assert.EqualError(t, err, `notes.csv:2: bad position "first"`)
+}
+
+func TestReadJSON(t *testing.T) {
+	records, err := readJSON(strings.NewReader(`[
+		{"day": "2016-09-26", "position": 1, "artist": "Depeche Mode", "title": "Two Minute Warning"}
+	]`), "notes.json")
+	assert.NoError(t, err)
+
+	assert.Equal(t, []*importRecord{
+		{
+			Artist:   "Depeche Mode",
+			Day:      "2016-09-26",
+			Position: 1,
+			Title:    "Two Minute Warning",
+			location: "notes.json[0]",
+		},
+	}, records)
+
+	_, err = readJSON(strings.NewReader(`[{"day": "2016-09-26", "dj": "Decay"}]`), "notes.json")
+	assert.Error(t, err)
+}
+
+func TestBuildPlaylists(t *testing.T) {
+	playlists, errs := buildPlaylists([]*importRecord{
+		{Day: "2016-10-03", Position: 1, Artist: "Panic Lift", Title: "The Path"},
+		{Day: "2016-09-26", Position: 2, Artist: " Imperative Reaction ", Title: "You Remain"},
+		{Day: "2016-09-26", Position: 1, Artist: "Depeche Mode", Title: "Two Minute Warning",
+			SpotifyID: "6TwdTfAn4YNGYhkWPhgQ6C"},
+	})
+	assert.Empty(t, errs)
+
+	assert.Equal(t, []*importedPlaylist{
+		{
+			Day: "2016-09-26",
+			Songs: []*dgcommon.Song{
+				{Artist: "Depeche Mode", Title: "Two Minute Warning",
+					SpotifyID: "6TwdTfAn4YNGYhkWPhgQ6C"},
+				{Artist: "Imperative Reaction", Title: "You Remain"},
+			},
+		},
+		{
+			Day: "2016-10-03",
+			Songs: []*dgcommon.Song{
+				{Artist: "Panic Lift", Title: "The Path"},
+			},
+		},
+	}, playlists)
+}
+
+func TestBuildPlaylistsInvalid(t *testing.T) {
+	_, errs := buildPlaylists([]*importRecord{
+		{Day: "Monday", Position: 1, Artist: "a", Title: "b", location: "r1"},
+		{Day: "2016-09-26", Position: 0, Artist: "a", Title: "b", location: "r2"},
+		{Day: "2016-09-26", Position: 1, Artist: "", Title: "", location: "r3"},
+		{Day: "2016-09-26", Position: 1, Artist: "a", Title: "b", SpotifyID: "nope", location: "r4"},
+		{Day: "2016-09-26", Position: 1, Artist: "a", Title: "b", location: "r5"},
+		{Day: "2016-09-26", Position: 1, Artist: "a", Title: "c", location: "r6"},
+		{Day: "2016-10-03", Position: 1, Artist: "c", Title: "d",
+			SpotifyID: "6TwdTfAn4YNGYhkWPhgQ6C", location: "r7"},
+		{Day: "2016-10-03", Position: 2, Artist: "c", Title: "d",
+			SpotifyID: "1WNlAC5s4XkXUjXxOmU5Ql", location: "r8"},
+		{Day: "2016-10-10", Position: 2, Artist: "e", Title: "f", location: "r9"},
+	})
+
+	var messages []string
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+
+	assert.Equal(t, []string{
+		`2016-10-10: position 1 is missing`,
+		`r1: bad day "Monday" (should look like YYYY-MM-DD)`,
+		`r2: bad position 0 (should start from 1)`,
+		`r3: empty artist`,
+		`r3: empty title`,
+		`r4: bad Spotify ID "nope"`,
+		`r6: position 1 on 2016-09-26 already used at r5`,
+		`r8: Spotify ID "1WNlAC5s4XkXUjXxOmU5Ql" conflicts with "6TwdTfAn4YNGYhkWPhgQ6C" at r7`,
+	}, messages)
+}
+
+func TestImportPlaylist(t *testing.T) {
+	txn, err := db.Begin()
+	assert.NoError(t, err)
+	defer func() {
+		err := txn.Rollback()
+		assert.NoError(t, err)
+	}()
+
+	playlist := &importedPlaylist{
+		Day: "2016-09-26",
+		Songs: []*dgcommon.Song{
+			{Artist: "Depeche Mode", Title: "Two Minute Warning"},
+			{Artist: "Imperative Reaction", Title: "You Remain"},
+		},
+	}
+
+	report, err := importPlaylist(txn, playlist)
+	assert.NoError(t, err)
+	assert.Equal(t, "created", report.Status)
+	assert.Equal(t, playlist.Songs, report.SongsCreated)
+
+	// Importing the same thing again changes nothing.
+	report, err = importPlaylist(txn, playlist)
+	assert.NoError(t, err)
+	assert.Equal(t, "unchanged", report.Status)
+	assert.Empty(t, report.SongsCreated)
+
+	// Adding a Spotify ID updates the song, but not the playlist, which
+	// still needs to be synced for the song's new track.
+	_, err = txn.Exec(`
+		UPDATE playlists
+		SET spotify_needs_sync = false`,
+	)
+	assert.NoError(t, err)
+
+	playlist.Songs[0].SpotifyID = "6TwdTfAn4YNGYhkWPhgQ6C"
+	report, err = importPlaylist(txn, playlist)
+	assert.NoError(t, err)
+	assert.Equal(t, "unchanged", report.Status)
+	assert.Equal(t, playlist.Songs[0:1], report.SongsSpotifyUpdated)
+
+	var needsSync bool
+	err = txn.QueryRow(`
+		SELECT spotify_needs_sync
+		FROM playlists
+		WHERE day = $1`,
+		playlist.Day,
+	).Scan(&needsSync)
+	assert.NoError(t, err)
+	assert.True(t, needsSync)
+
+	// And a new song updates the playlist.
+	playlist.Songs = append(playlist.Songs, &dgcommon.Song{Artist: "Panic Lift", Title: "The Path"})
+	report, err = importPlaylist(txn, playlist)
+	assert.NoError(t, err)
+	assert.Equal(t, "updated", report.Status)
+	assert.Equal(t, playlist.Songs[2:3], report.SongsCreated)
+}
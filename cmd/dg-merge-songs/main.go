@@ -0,0 +1,490 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/brandur/deathguild/modules/dgcommon"
+	"github.com/brandur/deathguild/modules/dgnormalize"
+	"github.com/brandur/deathguild/modules/dgstore"
+	"github.com/brandur/modulir"
+	"github.com/joeshaw/envdecode"
+	_ "github.com/lib/pq"
+	"github.com/spf13/cobra"
+)
+
+// Conf contains configuration information for the command. It's extracted from
+// environment variables.
+type Conf struct {
+	// DatabaseURL is a connection string for a database used to store playlist
+	// and song information.
+	DatabaseURL string `env:"DATABASE_URL,required"`
+}
+
+var conf Conf
+var db *sql.DB
+var log modulir.LoggerInterface = &modulir.Logger{Level: modulir.LevelInfo}
+
+func main() {
+	var dryRun bool
+
+	rootCmd := &cobra.Command{
+		Use:   "dg-merge-songs",
+		Short: "Fold songs that are spellings of the same song together",
+		Long: strings.TrimSpace(`
+Recomputes the normalized key of every song and merges songs that share
+one, like "The Cure - A Forest" and "Cure - A  forest", so that their
+plays are counted together. The most played spelling is kept, plays of
+the others are moved over to it, and the other spellings are kept as
+aliases. Run it after the rules for normalizing songs change, or to
+clean up a database that was loaded before songs were normalized.`),
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			mergeSongs(dryRun)
+		},
+	}
+
+	rootCmd.Flags().BoolVar(&dryRun, "dry-run", false,
+		"Report what would be merged without saving anything")
+
+	if err := rootCmd.Execute(); err != nil {
+		dgcommon.ExitWithError(err)
+	}
+}
+
+func mergeSongs(dryRun bool) {
+	err := envdecode.Decode(&conf)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	db, err = sql.Open("postgres", conf.DatabaseURL)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	txn, err := db.Begin()
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+	defer txn.Rollback()
+
+	numUpdated, err := updateKeys(txn)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	log.Infof("Updated normalized keys of %v song(s)", numUpdated)
+
+	groups, err := findDuplicates(txn)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	var numMerged int
+	for _, group := range groups {
+		err := mergeGroup(txn, group)
+		if err != nil {
+			dgcommon.ExitWithError(err)
+		}
+
+		group.print(os.Stdout)
+		numMerged += len(group.Duplicates)
+	}
+
+	if dryRun {
+		log.Infof("Dry run; rolling back")
+	} else {
+		err = txn.Commit()
+		if err != nil {
+			dgcommon.ExitWithError(err)
+		}
+	}
+
+	log.Infof("Merged %v song(s) into %v", numMerged, len(groups))
+}
+
+// storedSong is a song along with the information needed to merge it.
+type storedSong struct {
+	ID                   int
+	Artist               string
+	Title                string
+	NormalizedKey        string
+	NumPlays             int
+	SpotifyCheckedAt     *time.Time
+	SpotifyID            *string
+	SpotifyMatchScore    *float64
+	SpotifyMatchStrategy *string
+}
+
+// duplicateGroup is a set of songs that share a normalized key.
+type duplicateGroup struct {
+	// Canonical is the song that the others get merged into.
+	Canonical *storedSong
+
+	// Duplicates are the songs that get merged into Canonical.
+	Duplicates []*storedSong
+}
+
+func (g *duplicateGroup) print(w io.Writer) {
+	fmt.Fprintf(w, "%v - %v (%v play(s))\n",
+		g.Canonical.Artist, g.Canonical.Title, g.Canonical.NumPlays)
+	for _, song := range g.Duplicates {
+		fmt.Fprintf(w, "    <- %v - %v (%v play(s))\n",
+			song.Artist, song.Title, song.NumPlays)
+	}
+}
+
+// updateKeys recomputes the normalized key of every song and stores the ones
+// that changed. It returns the number of songs that were updated.
+func updateKeys(txn *sql.Tx) (int, error) {
+	rows, err := txn.Query(`
+		SELECT id, artist, title, normalized_key
+		FROM songs
+		ORDER BY id`,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	// Read everything before updating anything so that the result set isn't
+	// still open while we run other queries in the same transaction.
+	var songs []*storedSong
+	for rows.Next() {
+		var song storedSong
+		err = rows.Scan(
+			&song.ID,
+			&song.Artist,
+			&song.Title,
+			&song.NormalizedKey,
+		)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		songs = append(songs, &song)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var numUpdated int
+	for _, song := range songs {
+		key := dgnormalize.SongKey(song.Artist, song.Title)
+		if key == song.NormalizedKey {
+			continue
+		}
+
+		_, err := txn.Exec(`
+			UPDATE songs
+			SET normalized_key = $2
+			WHERE id = $1`,
+			song.ID,
+			key,
+		)
+		if err != nil {
+			return 0, fmt.Errorf("Error updating `songs`: %v", err)
+		}
+
+		numUpdated++
+	}
+
+	// Overrides refer to songs by key too, so they need to follow along.
+	err = updateOverrideKeys(txn)
+	if err != nil {
+		return 0, err
+	}
+
+	return numUpdated, nil
+}
+
+// updateOverrideKeys recomputes the normalized key of every Spotify override
+// from the artist and title that it was made with.
+func updateOverrideKeys(txn *sql.Tx) error {
+	rows, err := txn.Query(`
+		SELECT id, artist, title, normalized_key
+		FROM song_spotify_overrides
+		ORDER BY id`,
+	)
+	if err != nil {
+		return err
+	}
+
+	var overrides []*storedSong
+	for rows.Next() {
+		var override storedSong
+		err = rows.Scan(
+			&override.ID,
+			&override.Artist,
+			&override.Title,
+			&override.NormalizedKey,
+		)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		overrides = append(overrides, &override)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, override := range overrides {
+		key := dgnormalize.SongKey(override.Artist, override.Title)
+		if key == override.NormalizedKey {
+			continue
+		}
+
+		_, err := txn.Exec(`
+			UPDATE song_spotify_overrides
+			SET normalized_key = $2
+			WHERE id = $1`,
+			override.ID,
+			key,
+		)
+		if err != nil {
+			return fmt.Errorf("Error updating `song_spotify_overrides`: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// findDuplicates finds every set of songs that share a normalized key. The
+// song in each set that was played the most is picked as the one to keep,
+// with ties going to the one that was stored first.
+func findDuplicates(txn *sql.Tx) ([]*duplicateGroup, error) {
+	rows, err := txn.Query(`
+		WITH song_plays AS (
+			SELECT s.id, s.artist, s.title, s.normalized_key,
+				s.spotify_checked_at, s.spotify_id,
+				s.spotify_match_score, s.spotify_match_strategy,
+				(SELECT count(*) FROM playlists_songs ps WHERE ps.songs_id = s.id) AS num_plays
+			FROM songs s
+			WHERE s.normalized_key IN (
+				SELECT normalized_key
+				FROM songs
+				GROUP BY normalized_key
+				HAVING count(*) > 1
+			)
+		)
+		SELECT *
+		FROM song_plays
+		ORDER BY normalized_key, num_plays DESC, id`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var groups []*duplicateGroup
+	var group *duplicateGroup
+
+	for rows.Next() {
+		var song storedSong
+		err = rows.Scan(
+			&song.ID,
+			&song.Artist,
+			&song.Title,
+			&song.NormalizedKey,
+			&song.SpotifyCheckedAt,
+			&song.SpotifyID,
+			&song.SpotifyMatchScore,
+			&song.SpotifyMatchStrategy,
+			&song.NumPlays,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		if group == nil || group.Canonical.NormalizedKey != song.NormalizedKey {
+			group = &duplicateGroup{Canonical: &song}
+			groups = append(groups, group)
+			continue
+		}
+
+		group.Duplicates = append(group.Duplicates, &song)
+	}
+
+	return groups, rows.Err()
+}
+
+// mergeGroup folds the duplicates of a group into its canonical song. Their
+// plays and aliases are moved over, their spellings become aliases, and
+// they're deleted. If the canonical song doesn't have a Spotify ID or
+// MusicBrainz recording yet it picks up one from a duplicate.
+func mergeGroup(txn *sql.Tx, group *duplicateGroup) error {
+	canonical := group.Canonical
+
+	for _, song := range group.Duplicates {
+		if canonical.SpotifyID == nil && song.SpotifyID != nil {
+			_, err := txn.Exec(`
+				UPDATE songs
+				SET spotify_attempts = 0,
+					spotify_checked_at = $2,
+					spotify_enrichment_runs_id = (
+						SELECT spotify_enrichment_runs_id
+						FROM songs
+						WHERE id = $6
+					),
+					spotify_id = $3,
+					spotify_match_score = $4,
+					spotify_match_strategy = $5,
+					spotify_next_check_at = NULL
+				WHERE id = $1`,
+				canonical.ID,
+				song.SpotifyCheckedAt,
+				song.SpotifyID,
+				song.SpotifyMatchScore,
+				song.SpotifyMatchStrategy,
+				song.ID,
+			)
+			if err != nil {
+				return fmt.Errorf("Error updating `songs`: %v", err)
+			}
+
+			canonical.SpotifyCheckedAt = song.SpotifyCheckedAt
+			canonical.SpotifyID = song.SpotifyID
+			canonical.SpotifyMatchScore = song.SpotifyMatchScore
+			canonical.SpotifyMatchStrategy = song.SpotifyMatchStrategy
+
+			// The canonical song's own playlists now have a track in
+			// Spotify that they didn't before.
+			err = dgstore.MarkPlaylistsForSync(txn, []int{canonical.ID})
+			if err != nil {
+				return err
+			}
+		}
+
+		// Playlists containing a duplicate that was matched to a different
+		// track in Spotify (or that wasn't matched at all) will have
+		// different tracks once it's merged, so they need to be synced.
+		if !sameSpotifyID(canonical.SpotifyID, song.SpotifyID) {
+			err := dgstore.MarkPlaylistsForSync(txn, []int{song.ID})
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err := txn.Exec(`
+			UPDATE playlists_songs
+			SET songs_id = $2
+			WHERE songs_id = $1`,
+			song.ID,
+			canonical.ID,
+		)
+		if err != nil {
+			return fmt.Errorf("Error updating `playlists_songs`: %v", err)
+		}
+
+		_, err = txn.Exec(`
+			UPDATE song_aliases
+			SET songs_id = $2
+			WHERE songs_id = $1`,
+			song.ID,
+			canonical.ID,
+		)
+		if err != nil {
+			return fmt.Errorf("Error updating `song_aliases`: %v", err)
+		}
+
+		_, err = txn.Exec(`
+			UPDATE song_spotify_id_history
+			SET songs_id = $2
+			WHERE songs_id = $1`,
+			song.ID,
+			canonical.ID,
+		)
+		if err != nil {
+			return fmt.Errorf("Error updating `song_spotify_id_history`: %v", err)
+		}
+
+		// Likewise a MusicBrainz recording, which is looked up separately
+		// from Spotify.
+		_, err = txn.Exec(`
+			UPDATE songs c
+			SET musicbrainz_checked_at = d.musicbrainz_checked_at,
+				musicbrainz_match_score = d.musicbrainz_match_score,
+				musicbrainz_recording_id = d.musicbrainz_recording_id
+			FROM songs d
+			WHERE c.id = $2
+				AND d.id = $1
+				AND c.musicbrainz_recording_id IS NULL
+				AND d.musicbrainz_recording_id IS NOT NULL`,
+			song.ID,
+			canonical.ID,
+		)
+		if err != nil {
+			return fmt.Errorf("Error updating `songs`: %v", err)
+		}
+
+		// Artists credited on the duplicate's track carry over if the
+		// canonical song is matched to the same one. Any other links are
+		// dropped along with the duplicate.
+		_, err = txn.Exec(`
+			INSERT INTO songs_artists (songs_id, artists_id, spotify_id, position)
+			SELECT $2, sa.artists_id, sa.spotify_id, sa.position
+			FROM songs_artists sa
+				INNER JOIN songs s
+					ON s.id = $2
+			WHERE sa.songs_id = $1
+				AND sa.spotify_id = s.spotify_id
+			ON CONFLICT (songs_id, artists_id) DO UPDATE
+				SET spotify_id = excluded.spotify_id,
+					position = excluded.position`,
+			song.ID,
+			canonical.ID,
+		)
+		if err != nil {
+			return fmt.Errorf("Error inserting into `songs_artists`: %v", err)
+		}
+
+		_, err = txn.Exec(`
+			DELETE FROM songs_artists
+			WHERE songs_id = $1`,
+			song.ID,
+		)
+		if err != nil {
+			return fmt.Errorf("Error deleting from `songs_artists`: %v", err)
+		}
+
+		_, err = txn.Exec(`
+			DELETE FROM songs
+			WHERE id = $1`,
+			song.ID,
+		)
+		if err != nil {
+			return fmt.Errorf("Error deleting from `songs`: %v", err)
+		}
+
+		// The duplicate's row is gone now, so its spelling won't conflict
+		// with it anymore.
+		_, err = txn.Exec(`
+			INSERT INTO song_aliases (songs_id, artist, title)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (artist, title) DO UPDATE
+				SET songs_id = excluded.songs_id`,
+			canonical.ID,
+			song.Artist,
+			song.Title,
+		)
+		if err != nil {
+			return fmt.Errorf("Error inserting into `song_aliases`: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func sameSpotifyID(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return *a == *b
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brandur/deathguild/modules/dgcommon"
+	"github.com/brandur/deathguild/modules/dgtesting"
+	assert "github.com/stretchr/testify/require"
+)
+
+func init() {
+	db = dgtesting.DB
+}
+
+func TestDuplicateGroupPrint(t *testing.T) {
+	group := &duplicateGroup{
+		Canonical: &storedSong{Artist: "The Cure", Title: "A Forest", NumPlays: 12},
+		Duplicates: []*storedSong{
+			{Artist: "Cure", Title: "A  Forest", NumPlays: 1},
+		},
+	}
+
+	var buf bytes.Buffer
+	group.print(&buf)
+	assert.Equal(t, strings.Join([]string{
+		"The Cure - A Forest (12 play(s))",
+		"    <- Cure - A  Forest (1 play(s))",
+		"",
+	}, "\n"), buf.String())
+}
+
+func TestMergeSongs(t *testing.T) {
+	txn, err := db.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+
+	playlist := &dgcommon.Playlist{Day: time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)}
+	dgtesting.InsertPlaylist(t, txn, playlist)
+
+	songs := []*dgcommon.Song{
+		{Artist: "Cure", Title: "A  Forest", SpotifyID: "1JSLLcD4RKl8TZwBNhV5UX"},
+		{Artist: "The Cure", Title: "A Forest"},
+		{Artist: "New Order", Title: "Blue Monday"},
+	}
+	for _, song := range songs {
+		dgtesting.InsertSong(t, txn, song)
+	}
+
+	// "The Cure" is played twice and "Cure" once, so "The Cure" is kept.
+	for position, song := range []*dgcommon.Song{songs[1], songs[0], songs[2], songs[1]} {
+		insertPlay(t, txn, playlist, song, position)
+	}
+
+	// Pretend that the keys were produced by older rules that didn't match
+	// the two spellings up.
+	_, err = txn.Exec(`
+		UPDATE songs
+		SET normalized_key = artist || '/' || title`)
+	assert.NoError(t, err)
+
+	_, err = txn.Exec(`
+		UPDATE songs
+		SET musicbrainz_checked_at = NOW(),
+			musicbrainz_recording_id = 'forest-mbid'
+		WHERE id = $1`,
+		songs[0].ID,
+	)
+	assert.NoError(t, err)
+
+	_, err = txn.Exec(`
+		INSERT INTO song_spotify_id_history (songs_id, spotify_id, reason)
+		VALUES ($1, 'gone-id', 'unavailable')`,
+		songs[0].ID,
+	)
+	assert.NoError(t, err)
+
+	numUpdated, err := updateKeys(txn)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, numUpdated)
+
+	groups, err := findDuplicates(txn)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(groups))
+	assert.Equal(t, songs[1].ID, groups[0].Canonical.ID)
+	assert.Equal(t, 2, groups[0].Canonical.NumPlays)
+	assert.Equal(t, 1, len(groups[0].Duplicates))
+	assert.Equal(t, songs[0].ID, groups[0].Duplicates[0].ID)
+
+	err = mergeGroup(txn, groups[0])
+	assert.NoError(t, err)
+
+	// All plays now point to the kept song, which picked up the Spotify ID.
+	var numPlays int
+	var spotifyID string
+	err = txn.QueryRow(`
+		SELECT count(*), s.spotify_id
+		FROM playlists_songs ps
+			INNER JOIN songs s
+				ON s.id = ps.songs_id
+		WHERE s.artist = $1
+			AND s.title = $2
+		GROUP BY s.spotify_id`,
+		"The Cure",
+		"A Forest",
+	).Scan(&numPlays, &spotifyID)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, numPlays)
+	assert.Equal(t, "1JSLLcD4RKl8TZwBNhV5UX", spotifyID)
+
+	// Along with the MusicBrainz recording.
+	var recordingID string
+	err = txn.QueryRow(`
+		SELECT musicbrainz_recording_id
+		FROM songs
+		WHERE id = $1`,
+		songs[1].ID,
+	).Scan(&recordingID)
+	assert.NoError(t, err)
+	assert.Equal(t, "forest-mbid", recordingID)
+
+	// And the history of its old Spotify IDs.
+	var historySongID int
+	err = txn.QueryRow(`
+		SELECT songs_id
+		FROM song_spotify_id_history
+		WHERE spotify_id = 'gone-id'`,
+	).Scan(&historySongID)
+	assert.NoError(t, err)
+	assert.Equal(t, songs[1].ID, historySongID)
+
+	// The other spelling is gone but kept as an alias.
+	var numSongs int
+	err = txn.QueryRow(`
+		SELECT count(*)
+		FROM songs
+		WHERE id = $1`,
+		songs[0].ID,
+	).Scan(&numSongs)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, numSongs)
+
+	var aliasSongID int
+	err = txn.QueryRow(`
+		SELECT songs_id
+		FROM song_aliases
+		WHERE artist = $1
+			AND title = $2`,
+		"Cure",
+		"A  Forest",
+	).Scan(&aliasSongID)
+	assert.NoError(t, err)
+	assert.Equal(t, songs[1].ID, aliasSongID)
+
+	var needsSync bool
+	err = txn.QueryRow(`
+		SELECT spotify_needs_sync
+		FROM playlists
+		WHERE id = $1`,
+		playlist.ID,
+	).Scan(&needsSync)
+	assert.NoError(t, err)
+	assert.True(t, needsSync)
+
+	// Nothing is left to merge.
+	groups, err = findDuplicates(txn)
+	assert.NoError(t, err)
+	assert.Empty(t, groups)
+}
+
+func insertPlay(t *testing.T, txn *sql.Tx, playlist *dgcommon.Playlist,
+	song *dgcommon.Song, position int) {
+
+	_, err := txn.Exec(`
+		INSERT INTO playlists_songs (playlists_id, songs_id, position)
+		VALUES ($1, $2, $3)`,
+		playlist.ID,
+		song.ID,
+		position,
+	)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/brandur/deathguild/modules/dgcommon"
+	"github.com/brandur/deathguild/modules/dgsource"
+	"github.com/brandur/deathguild/modules/dgstore"
+	"github.com/brandur/modulir"
+	"github.com/joeshaw/envdecode"
+	_ "github.com/lib/pq"
+)
+
+// Conf contains configuration information for the command. It's extracted from
+// environment variables.
+type Conf struct {
+	// DatabaseURL is a connection string for a database used to store playlist
+	// and song information.
+	DatabaseURL string `env:"DATABASE_URL,required"`
+
+	// Day optionally restricts reparsing to the page of a single night
+	// (e.g. `2016-09-26`). Every archived page is reparsed if it's empty.
+	Day string `env:"DAY"`
+
+	// DryRun reports what would change without writing anything to the
+	// database.
+	DryRun bool `env:"DRY_RUN,default=false"`
+
+	// Source is the name of the source whose archived pages should be
+	// reparsed.
+	Source string `env:"SOURCE,default=deathguild"`
+}
+
+var conf Conf
+var db *sql.DB
+var log modulir.LoggerInterface = &modulir.Logger{Level: modulir.LevelInfo}
+var source dgsource.Source
+
+func main() {
+	err := envdecode.Decode(&conf)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	db, err = sql.Open("postgres", conf.DatabaseURL)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	source, err = dgsource.Get(conf.Source)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	days, err := archivedDays(conf.Day)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	log.Infof("Reparsing %v archived page(s)", len(days))
+
+	var numChanged, numErrored, numUnchanged int
+
+	for _, day := range days {
+		changes, err := reparsePageInTransaction(day, conf.DryRun)
+		if err != nil {
+			log.Errorf("Error reparsing %v: %v", day, err)
+			numErrored++
+			continue
+		}
+
+		if len(changes) == 0 {
+			numUnchanged++
+			continue
+		}
+
+		numChanged++
+
+		fmt.Printf("%v\n", day)
+		for _, change := range changes {
+			fmt.Printf("    %v\n", change)
+		}
+	}
+
+	if conf.DryRun {
+		log.Infof("Dry run; no changes were saved")
+	}
+
+	log.Infof("Reparsed %v page(s): %v changed, %v unchanged, %v errored",
+		len(days), numChanged, numUnchanged, numErrored)
+
+	if numErrored > 0 {
+		dgcommon.ExitWithError(fmt.Errorf("%v page(s) failed to reparse", numErrored))
+	}
+}
+
+// archivedDays lists the days of every archived page for the source, or just
+// the given day if one was set.
+func archivedDays(day string) ([]string, error) {
+	rows, err := db.Query(`
+		SELECT day
+		FROM playlist_pages
+		WHERE source = $1
+			AND ($2 = '' OR day = $2::date)
+		ORDER BY day`,
+		source.Name(),
+		day,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var days []string
+
+	for rows.Next() {
+		var day time.Time
+		err = rows.Scan(&day)
+		if err != nil {
+			return nil, err
+		}
+		days = append(days, day.Format("2006-01-02"))
+	}
+
+	return days, rows.Err()
+}
+
+// diffSongs describes the differences between a playlist's stored songs and
+// its newly parsed ones. Songs are lined up by their longest common
+// subsequence so that a song added or removed near the top of a playlist
+// shows up as one change instead of shifting every song after it. A run of
+// removed songs that's directly replaced by a run of added ones is shown as
+// songs that changed.
+//
+// Positions are 1-indexed to match what's shown on the site. Removed songs
+// are numbered by where they were in the stored playlist, and added and
+// changed songs by where they are in the new one.
+func diffSongs(before, after []*dgcommon.Song) []string {
+	var changes []string
+
+	// lcs[i][j] is the length of the longest common subsequence of
+	// before[i:] and after[j:].
+	lcs := make([][]int, len(before)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(after)+1)
+	}
+	for i := len(before) - 1; i >= 0; i-- {
+		for j := len(after) - 1; j >= 0; j-- {
+			switch {
+			case sameSong(before[i], after[j]):
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	// Indexes of removed and added songs since the last song that was in
+	// both.
+	var removed, added []int
+
+	flush := func() {
+		for k := 0; k < len(removed) || k < len(added); k++ {
+			switch {
+			case k >= len(added):
+				b := before[removed[k]]
+				changes = append(changes, fmt.Sprintf("- #%v %v - %v",
+					removed[k]+1, b.Artist, b.Title))
+
+			case k >= len(removed):
+				a := after[added[k]]
+				changes = append(changes, fmt.Sprintf("+ #%v %v - %v",
+					added[k]+1, a.Artist, a.Title))
+
+			default:
+				b, a := before[removed[k]], after[added[k]]
+				changes = append(changes, fmt.Sprintf("~ #%v %v - %v -> %v - %v",
+					added[k]+1, b.Artist, b.Title, a.Artist, a.Title))
+			}
+		}
+
+		removed, added = nil, nil
+	}
+
+	i, j := 0, 0
+	for i < len(before) || j < len(after) {
+		switch {
+		case i < len(before) && j < len(after) && sameSong(before[i], after[j]):
+			flush()
+			i++
+			j++
+
+		case j >= len(after) || (i < len(before) && lcs[i+1][j] >= lcs[i][j+1]):
+			removed = append(removed, i)
+			i++
+
+		default:
+			added = append(added, j)
+			j++
+		}
+	}
+	flush()
+
+	return changes
+}
+
+// reparsePage runs the source's parser over the archived page for a day and
+// updates the stored playlist if the result differs from it. It returns a
+// description of every change, which is empty if nothing changed.
+func reparsePage(txn *sql.Tx, day string) ([]string, error) {
+	var body []byte
+	err := txn.QueryRow(`
+		SELECT body
+		FROM playlist_pages
+		WHERE source = $1
+			AND day = $2`,
+		source.Name(),
+		day,
+	).Scan(&body)
+	if err != nil {
+		return nil, err
+	}
+
+	songs, err := source.ParsePlaylist(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	// Same as in the scraper: no songs almost certainly means a broken
+	// parser, and we don't want it to wipe out a good playlist.
+	if len(songs) == 0 {
+		return nil, fmt.Errorf(
+			"found zero-length playlist; this probably means that parsing logic is broken",
+		)
+	}
+
+	storedPlaylist, err := dgstore.LookupPlaylist(txn, source.Name(), day)
+	if err != nil {
+		return nil, err
+	}
+
+	var storedSongs []*dgcommon.Song
+	if storedPlaylist != nil {
+		if storedPlaylist.SongsHash == dgstore.SongsHash(songs) {
+			return nil, nil
+		}
+
+		storedSongs, err = dgstore.FetchStoredSongs(txn, storedPlaylist.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result, err := dgstore.UpsertPlaylistAndSongs(txn, source.Name(), day, songs)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := diffSongs(storedSongs, songs)
+
+	if result.Status == dgstore.PlaylistStatusQuarantined {
+		changes = append(changes, fmt.Sprintf("! quarantined (score %v)",
+			result.Validation.Score))
+	}
+
+	return changes, nil
+}
+
+// reparsePageInTransaction wraps reparsePage in its own transaction so that a
+// failure on one night doesn't affect any others. On a dry run the
+// transaction is always rolled back.
+func reparsePageInTransaction(day string, dryRun bool) ([]string, error) {
+	txn, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer txn.Rollback()
+
+	changes, err := reparsePage(txn, day)
+	if err != nil {
+		return nil, err
+	}
+
+	if dryRun {
+		return changes, nil
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+// sameSong determines whether two songs have the same artist and title.
+func sameSong(a, b *dgcommon.Song) bool {
+	return a.Artist == b.Artist && a.Title == b.Title
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/brandur/deathguild/modules/dgcommon"
+	"github.com/brandur/deathguild/modules/dgsource"
+	"github.com/brandur/deathguild/modules/dgstore"
+	"github.com/brandur/deathguild/modules/dgtesting"
+	assert "github.com/stretchr/testify/require"
+)
+
+func init() {
+	db = dgtesting.DB
+	source = dgsource.DeathGuild
+}
+
+func TestDiffSongs(t *testing.T) {
+	before := []*dgcommon.Song{
+		{Artist: "Depeche Mode", Title: "Never Let Me Down Again"},
+		{Artist: "New Order", Title: "Blue Monday"},
+		{Artist: "The Cure", Title: "A Forest"},
+	}
+
+	assert.Empty(t, diffSongs(before, before))
+
+	assert.Equal(t,
+		[]string{
+			"~ #2 New Order - Blue Monday -> New Order - Bizarre Love Triangle",
+			"- #3 The Cure - A Forest",
+		},
+		diffSongs(before, []*dgcommon.Song{
+			{Artist: "Depeche Mode", Title: "Never Let Me Down Again"},
+			{Artist: "New Order", Title: "Bizarre Love Triangle"},
+		}),
+	)
+
+	assert.Equal(t,
+		[]string{
+			"+ #1 The Cure - A Forest",
+		},
+		diffSongs(nil, []*dgcommon.Song{
+			{Artist: "The Cure", Title: "A Forest"},
+		}),
+	)
+
+	// A song added at the top doesn't shift every song after it.
+	assert.Equal(t,
+		[]string{
+			"+ #1 Joy Division - Disorder",
+		},
+		diffSongs(before, []*dgcommon.Song{
+			{Artist: "Joy Division", Title: "Disorder"},
+			{Artist: "Depeche Mode", Title: "Never Let Me Down Again"},
+			{Artist: "New Order", Title: "Blue Monday"},
+			{Artist: "The Cure", Title: "A Forest"},
+		}),
+	)
+
+	// Neither does one removed from the middle.
+	assert.Equal(t,
+		[]string{
+			"- #2 New Order - Blue Monday",
+		},
+		diffSongs(before, []*dgcommon.Song{
+			{Artist: "Depeche Mode", Title: "Never Let Me Down Again"},
+			{Artist: "The Cure", Title: "A Forest"},
+		}),
+	)
+
+	// Removed and added songs in separate places are described separately,
+	// each numbered from its own playlist.
+	assert.Equal(t,
+		[]string{
+			"- #1 Depeche Mode - Never Let Me Down Again",
+			"+ #3 Joy Division - Disorder",
+		},
+		diffSongs(before, []*dgcommon.Song{
+			{Artist: "New Order", Title: "Blue Monday"},
+			{Artist: "The Cure", Title: "A Forest"},
+			{Artist: "Joy Division", Title: "Disorder"},
+		}),
+	)
+}
+
+func TestReparsePage(t *testing.T) {
+	body, err := ioutil.ReadFile("../../modules/dgtesting/samples/2018-07-16.html")
+	assert.NoError(t, err)
+
+	txn, err := db.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+
+	err = dgstore.UpsertPlaylistPage(txn, source.Name(), "2018-07-16",
+		"http://www.deathguild.com/playlist/2018-07-16", body)
+	assert.NoError(t, err)
+
+	// The first run finds a playlist that hasn't been stored yet.
+	changes, err := reparsePage(txn, "2018-07-16")
+	assert.NoError(t, err)
+	assert.Equal(t, "+ #1 Simon & Garfunkel - I Am A Rock &", changes[0])
+
+	storedPlaylist, err := dgstore.LookupPlaylist(txn, source.Name(), "2018-07-16")
+	assert.NoError(t, err)
+	assert.NotNil(t, storedPlaylist)
+
+	// And running again finds nothing to change.
+	changes, err = reparsePage(txn, "2018-07-16")
+	assert.NoError(t, err)
+	assert.Empty(t, changes)
+}
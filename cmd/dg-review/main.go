@@ -0,0 +1,204 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/brandur/deathguild/modules/dgcommon"
+	"github.com/brandur/deathguild/modules/dgsource"
+	"github.com/brandur/deathguild/modules/dgstore"
+	"github.com/brandur/modulir"
+	"github.com/joeshaw/envdecode"
+	_ "github.com/lib/pq"
+	"github.com/spf13/cobra"
+)
+
+// Conf contains configuration information for the command. It's extracted from
+// environment variables.
+type Conf struct {
+	// DatabaseURL is a connection string for a database used to store playlist
+	// and song information.
+	DatabaseURL string `env:"DATABASE_URL,required"`
+
+	// Source is the name of the source whose playlists should be reviewed.
+	Source string `env:"SOURCE,default=deathguild"`
+}
+
+var conf Conf
+var db *sql.DB
+var log modulir.LoggerInterface = &modulir.Logger{Level: modulir.LevelInfo}
+var source dgsource.Source
+
+func main() {
+	rootCmd := &cobra.Command{
+		Use:   "dg-review",
+		Short: "Review playlists that were quarantined when they were stored",
+		Long: strings.TrimSpace(`
+Playlists whose songs look like they were scraped wrong (leftover
+HTML, empty artists, header rows, suspiciously short or long nights)
+are quarantined instead of being published. This command reports on
+them and publishes them once they've been checked.`),
+	}
+
+	var all, asJSON bool
+	reportCommand := &cobra.Command{
+		Use:   "report",
+		Short: "Report quarantined playlists and why they were flagged",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			report(all, asJSON)
+		},
+	}
+	reportCommand.Flags().BoolVar(&all, "all", false,
+		"Include published playlists that had issues")
+	reportCommand.Flags().BoolVar(&asJSON, "json", false,
+		"Output JSON instead of a table")
+	rootCmd.AddCommand(reportCommand)
+
+	publishCommand := &cobra.Command{
+		Use:   "publish DAY...",
+		Short: "Publish playlists after reviewing them",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			setStatus(args, dgstore.PlaylistStatusPublished)
+		},
+	}
+	rootCmd.AddCommand(publishCommand)
+
+	quarantineCommand := &cobra.Command{
+		Use:   "quarantine DAY...",
+		Short: "Hold playlists back from publishing by hand",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			setStatus(args, dgstore.PlaylistStatusQuarantined)
+		},
+	}
+	rootCmd.AddCommand(quarantineCommand)
+
+	if err := rootCmd.Execute(); err != nil {
+		dgcommon.ExitWithError(err)
+	}
+}
+
+func setup() {
+	err := envdecode.Decode(&conf)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	db, err = sql.Open("postgres", conf.DatabaseURL)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	source, err = dgsource.Get(conf.Source)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+}
+
+func report(all, asJSON bool) {
+	setup()
+
+	txn, err := db.Begin()
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+	defer txn.Rollback()
+
+	flagged, err := dgstore.FetchFlaggedPlaylists(txn, source.Name(), all)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	if asJSON {
+		err = writeJSON(os.Stdout, flagged)
+	} else {
+		err = writeTable(os.Stdout, flagged)
+	}
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+}
+
+func setStatus(days []string, status string) {
+	setup()
+
+	txn, err := db.Begin()
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+	defer txn.Rollback()
+
+	for _, day := range days {
+		updated, err := dgstore.SetPlaylistStatus(txn, source.Name(), day, status)
+		if err != nil {
+			dgcommon.ExitWithError(err)
+		}
+
+		if !updated {
+			dgcommon.ExitWithError(fmt.Errorf("no playlist for %v", day))
+		}
+
+		log.Infof("Playlist %v is now %v", day, status)
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+}
+
+// writeJSON writes flagged playlists as a JSON array.
+func writeJSON(w io.Writer, flagged []*dgstore.FlaggedPlaylist) error {
+	// Make sure that nothing flagged comes out as `[]` instead of `null`.
+	if flagged == nil {
+		flagged = []*dgstore.FlaggedPlaylist{}
+	}
+
+	data, err := json.MarshalIndent(flagged, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
+
+// writeTable writes flagged playlists as a table with a row for each issue.
+func writeTable(w io.Writer, flagged []*dgstore.FlaggedPlaylist) error {
+	if len(flagged) == 0 {
+		_, err := fmt.Fprintf(w, "No flagged playlists\n")
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "DAY\tSTATUS\tSCORE\tPOSITION\tCHECK\tMESSAGE\n")
+
+	for _, playlist := range flagged {
+		for i, issue := range playlist.ValidationIssues {
+			position := "-"
+			if issue.Position != 0 {
+				position = fmt.Sprintf("%v", issue.Position)
+			}
+
+			// Only show information on the playlist on its first row so
+			// that its issues are easy to pick out.
+			if i == 0 {
+				fmt.Fprintf(tw, "%v\t%v\t%v\t", playlist.Day, playlist.Status,
+					playlist.ValidationScore)
+			} else {
+				fmt.Fprintf(tw, "\t\t\t")
+			}
+
+			fmt.Fprintf(tw, "%v\t%v\t%v\n", position, issue.Check, issue.Message)
+		}
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/brandur/deathguild/modules/dgstore"
+	"github.com/brandur/deathguild/modules/dgvalidate"
+	assert "github.com/stretchr/testify/require"
+)
+
+var testFlagged = []*dgstore.FlaggedPlaylist{
+	{
+		Day:    "2016-09-26",
+		Status: dgstore.PlaylistStatusQuarantined,
+		ValidationIssues: []*dgvalidate.Issue{
+			{Check: "too_short", Message: "only 2 song(s)", Weight: 10},
+			{Check: "header_row", Message: "looks like a table header", Position: 1, Weight: 10},
+		},
+		ValidationScore: 20,
+	},
+}
+
+func TestWriteJSON(t *testing.T) {
+	var buf bytes.Buffer
+	err := writeJSON(&buf, testFlagged)
+	assert.NoError(t, err)
+
+	assert.Equal(t, strings.TrimSpace(`
+[
+  {
+    "day": "2016-09-26",
+    "status": "quarantined",
+    "issues": [
+      {
+        "check": "too_short",
+        "message": "only 2 song(s)",
+        "weight": 10
+      },
+      {
+        "check": "header_row",
+        "message": "looks like a table header",
+        "position": 1,
+        "weight": 10
+      }
+    ],
+    "score": 20
+  }
+]`)+"\n", buf.String())
+
+	buf.Reset()
+	err = writeJSON(&buf, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "[]\n", buf.String())
+}
+
+func TestWriteTable(t *testing.T) {
+	var buf bytes.Buffer
+	err := writeTable(&buf, testFlagged)
+	assert.NoError(t, err)
+
+	assert.Equal(t, strings.Join([]string{
+		"DAY         STATUS       SCORE  POSITION  CHECK       MESSAGE",
+		"2016-09-26  quarantined  20     -         too_short   only 2 song(s)",
+		"                                1         header_row  looks like a table header",
+		"",
+	}, "\n"), buf.String())
+
+	buf.Reset()
+	err = writeTable(&buf, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "No flagged playlists\n", buf.String())
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/brandur/deathguild/modules/dgcommon"
+	"github.com/brandur/deathguild/modules/dgstore"
+)
+
+// Fetcher retrieves the body of the page at a URL. It's the only way that the
+// scraper gets at remote content so that we can swap in a recorded set of
+// pages instead of going to the live site.
+type Fetcher interface {
+	Fetch(url string) ([]byte, error)
+}
+
+// newFetcher returns a fetcher appropriate for the given configuration. By
+// default that's one that goes to the live site, but it may also be one that
+// records everything it retrieves, or one that replays a previous recording.
+func newFetcher(conf *Conf) (Fetcher, error) {
+	if conf.RecordDir != "" && conf.ReplayDir != "" {
+		return nil, fmt.Errorf("RECORD_DIR and REPLAY_DIR can't be used together")
+	}
+
+	if conf.ReplayDir != "" {
+		log.Infof("Replaying pages from: %v", conf.ReplayDir)
+		return &replayFetcher{dir: conf.ReplayDir}, nil
+	}
+
+	var fetcher Fetcher = newHTTPFetcher(conf, &dbResponseCache{})
+
+	if conf.RecordDir != "" {
+		log.Infof("Recording pages to: %v", conf.RecordDir)
+		fetcher = &recordingFetcher{dir: conf.RecordDir, fetcher: fetcher}
+	}
+
+	return fetcher, nil
+}
+
+// httpFetcher fetches pages from the live site over HTTP. It tries to be a
+// polite client: requests across all workers are held to a fixed rate, failed
+// requests are retried with exponential backoff (or after however long the
+// server asks for with `Retry-After`, within reason), and pages that haven't
+// changed since we last fetched them are answered from a cache with a
+// conditional GET.
+type httpFetcher struct {
+	// cache stores responses so that they can be fetched conditionally. It
+	// may be nil, in which case every fetch is unconditional.
+	cache responseCache
+
+	client     *http.Client
+	limiter    *dgcommon.RateLimiter
+	maxRetries int
+	userAgent  string
+
+	// sleep is swappable so that tests don't actually have to wait out
+	// backoffs.
+	sleep func(time.Duration)
+}
+
+// newHTTPFetcher returns an httpFetcher configured from the given
+// configuration.
+func newHTTPFetcher(conf *Conf, cache responseCache) *httpFetcher {
+	dialer := &net.Dialer{Timeout: conf.HTTPConnectTimeout}
+
+	return &httpFetcher{
+		cache: cache,
+		client: &http.Client{
+			Timeout: conf.HTTPTimeout,
+			Transport: &http.Transport{
+				DialContext:         dialer.DialContext,
+				Proxy:               http.ProxyFromEnvironment,
+				TLSHandshakeTimeout: conf.HTTPConnectTimeout,
+			},
+		},
+		limiter:    dgcommon.NewRateLimiter(conf.RequestsPerSecond),
+		maxRetries: conf.MaxRetries,
+		userAgent:  conf.UserAgent,
+		sleep:      time.Sleep,
+	}
+}
+
+func (f *httpFetcher) Fetch(url string) ([]byte, error) {
+	var cached *dgstore.CachedResponse
+	if f.cache != nil {
+		var err error
+		cached, err = f.cache.Get(url)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		f.limiter.Wait()
+
+		body, retryAfter, retryable, err := f.fetchOnce(url, cached)
+		if err == nil {
+			return body, nil
+		}
+
+		if !retryable || attempt >= f.maxRetries {
+			return nil, err
+		}
+
+		// A worker shouldn't be tied up for however long a server says.
+		if retryAfter > dgcommon.MaxRetryAfter {
+			return nil, fmt.Errorf("%v; giving up instead of waiting %v to retry",
+				err, retryAfter)
+		}
+
+		wait := dgcommon.Backoff(attempt)
+		if retryAfter > wait {
+			wait = retryAfter
+		}
+
+		log.Infof("Error requesting %v (attempt %v of %v); retrying in %v: %v",
+			url, attempt+1, f.maxRetries+1, wait, err)
+		f.sleep(wait)
+	}
+}
+
+// fetchOnce makes a single request for a URL. On error it also returns how
+// long the server asked us to wait with `Retry-After` (zero if it didn't) and
+// whether the request is worth retrying.
+func (f *httpFetcher) fetchOnce(url string,
+	cached *dgstore.CachedResponse) ([]byte, time.Duration, bool, error) {
+
+	log.Debugf("Requesting: %v", url)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	if f.userAgent != "" {
+		req.Header.Set("User-Agent", f.userAgent)
+	}
+
+	if cached != nil {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		// Network errors and timeouts are worth another try.
+		return nil, 0, true, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached != nil:
+		log.Debugf("Not modified since last request: %v", url)
+		return cached.Body, 0, false, nil
+
+	case resp.StatusCode == http.StatusOK:
+		// Fall through to below.
+
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		retryAfter, _ := dgcommon.RetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		return nil, retryAfter, true,
+			fmt.Errorf("bad response when requesting: %s (status code = %v)",
+				url, resp.StatusCode)
+
+	default:
+		return nil, 0, false,
+			fmt.Errorf("bad response when requesting: %s (status code = %v)",
+				url, resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, true, err
+	}
+
+	etag := resp.Header.Get("ETag")
+	lastModified := resp.Header.Get("Last-Modified")
+
+	// There's no point caching a response that can't be fetched
+	// conditionally.
+	if f.cache != nil && (etag != "" || lastModified != "") {
+		err = f.cache.Put(url, &dgstore.CachedResponse{
+			Body:         body,
+			ETag:         etag,
+			LastModified: lastModified,
+		})
+		if err != nil {
+			return nil, 0, false, err
+		}
+	}
+
+	return body, 0, false, nil
+}
+
+// responseCache stores the responses for fetched URLs.
+type responseCache interface {
+	Get(url string) (*dgstore.CachedResponse, error)
+	Put(url string, resp *dgstore.CachedResponse) error
+}
+
+// dbResponseCache is a responseCache backed by the database.
+type dbResponseCache struct{}
+
+func (c *dbResponseCache) Get(url string) (*dgstore.CachedResponse, error) {
+	txn, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer txn.Rollback()
+
+	return dgstore.LookupCachedResponse(txn, url)
+}
+
+func (c *dbResponseCache) Put(url string, resp *dgstore.CachedResponse) error {
+	txn, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = dgstore.UpsertCachedResponse(txn, url, resp)
+	if err != nil {
+		txn.Rollback()
+		return err
+	}
+
+	return txn.Commit()
+}
+
+// recordingFetcher wraps another fetcher and writes every page that it
+// retrieves to a directory so that it can be replayed later with
+// replayFetcher.
+type recordingFetcher struct {
+	dir     string
+	fetcher Fetcher
+}
+
+func (f *recordingFetcher) Fetch(url string) ([]byte, error) {
+	body, err := f.fetcher.Fetch(url)
+	if err != nil {
+		return nil, err
+	}
+
+	path, err := recordingPath(f.dir, url)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ioutil.WriteFile(path, body, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("Recorded %v to: %v", url, path)
+	return body, nil
+}
+
+// replayFetcher serves pages out of a directory previously populated by
+// recordingFetcher and never touches the network.
+type replayFetcher struct {
+	dir string
+}
+
+func (f *replayFetcher) Fetch(url string) ([]byte, error) {
+	path, err := recordingPath(f.dir, url)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no recording of %v (expected at: %v)", url, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("Replayed %v from: %v", url, path)
+	return body, nil
+}
+
+// recordingPath maps a URL to the file within a recording directory that its
+// body is stored in. Only the path is used so that a recording made against
+// one host can be replayed against another, so for example
+// `http://www.deathguild.com/playlist/2015-12-21` maps to
+// `playlist/2015-12-21.html`.
+func recordingPath(dir, rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	name := strings.Trim(u.Path, "/")
+	if name == "" {
+		name = "index"
+	}
+
+	if u.RawQuery != "" {
+		name += "?" + u.RawQuery
+	}
+
+	// Don't let a URL like `/../../etc` escape the recording directory.
+	name = filepath.Clean("/" + name)
+
+	return filepath.Join(dir, filepath.FromSlash(name)+".html"), nil
+}
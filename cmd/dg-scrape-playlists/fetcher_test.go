@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/brandur/deathguild/modules/dgcommon"
+	"github.com/brandur/deathguild/modules/dgsource"
+	"github.com/brandur/deathguild/modules/dgstore"
+	assert "github.com/stretchr/testify/require"
+)
+
+// staticFetcher is a Fetcher that returns a fixed body for every URL.
+type staticFetcher struct {
+	body []byte
+}
+
+func (f *staticFetcher) Fetch(url string) ([]byte, error) {
+	return f.body, nil
+}
+
+// memoryResponseCache is a responseCache that keeps responses in a map.
+type memoryResponseCache map[string]*dgstore.CachedResponse
+
+func (c memoryResponseCache) Get(url string) (*dgstore.CachedResponse, error) {
+	return c[url], nil
+}
+
+func (c memoryResponseCache) Put(url string, resp *dgstore.CachedResponse) error {
+	c[url] = resp
+	return nil
+}
+
+// newTestHTTPFetcher returns an httpFetcher that doesn't rate limit and
+// records how long it would have slept instead of sleeping.
+func newTestHTTPFetcher(cache responseCache, slept *[]time.Duration) *httpFetcher {
+	fetcher := newHTTPFetcher(&Conf{MaxRetries: 3, UserAgent: "test-agent"}, cache)
+	fetcher.limiter = dgcommon.NewRateLimiter(0)
+	fetcher.sleep = func(d time.Duration) { *slept = append(*slept, d) }
+	return fetcher
+}
+
+func TestHTTPFetcherConditional(t *testing.T) {
+	var numRequests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		numRequests++
+		assert.Equal(t, "test-agent", r.Header.Get("User-Agent"))
+
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("index"))
+	}))
+	defer server.Close()
+
+	var slept []time.Duration
+	cache := memoryResponseCache{}
+	fetcher := newTestHTTPFetcher(cache, &slept)
+
+	body, err := fetcher.Fetch(server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("index"), body)
+	assert.Equal(t, `"v1"`, cache[server.URL].ETag)
+
+	// The second fetch gets a 304 and the body comes from the cache.
+	body, err = fetcher.Fetch(server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("index"), body)
+	assert.Equal(t, 2, numRequests)
+}
+
+func TestHTTPFetcherNoRetry(t *testing.T) {
+	var numRequests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		numRequests++
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	var slept []time.Duration
+	fetcher := newTestHTTPFetcher(nil, &slept)
+
+	// Client errors aren't going to get better by trying again.
+	_, err := fetcher.Fetch(server.URL)
+	assert.Error(t, err)
+	assert.Equal(t, 1, numRequests)
+	assert.Empty(t, slept)
+}
+
+func TestHTTPFetcherRetry(t *testing.T) {
+	var numRequests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		numRequests++
+		switch numRequests {
+		case 1:
+			w.WriteHeader(http.StatusInternalServerError)
+		case 2:
+			w.Header().Set("Retry-After", "120")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte("page"))
+		}
+	}))
+	defer server.Close()
+
+	var slept []time.Duration
+	fetcher := newTestHTTPFetcher(nil, &slept)
+
+	body, err := fetcher.Fetch(server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("page"), body)
+	assert.Equal(t, 3, numRequests)
+
+	// The first retry uses our own backoff while the second waits as long
+	// as the server asked.
+	assert.Equal(t, 2, len(slept))
+	assert.True(t, slept[0] >= 1*time.Second && slept[0] <= 1500*time.Millisecond)
+	assert.Equal(t, 120*time.Second, slept[1])
+}
+
+func TestHTTPFetcherRetryGivesUp(t *testing.T) {
+	var numRequests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		numRequests++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	var slept []time.Duration
+	fetcher := newTestHTTPFetcher(nil, &slept)
+
+	_, err := fetcher.Fetch(server.URL)
+	assert.Error(t, err)
+	assert.Equal(t, 4, numRequests)
+	assert.Equal(t, 3, len(slept))
+}
+
+func TestHTTPFetcherRetryAfterTooLong(t *testing.T) {
+	var numRequests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		numRequests++
+		w.Header().Set("Retry-After", "86400")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	var slept []time.Duration
+	fetcher := newTestHTTPFetcher(nil, &slept)
+
+	// Nobody's waiting a day for a page.
+	_, err := fetcher.Fetch(server.URL)
+	assert.Error(t, err)
+	assert.Equal(t, 1, numRequests)
+	assert.Empty(t, slept)
+}
+
+func TestNewFetcher(t *testing.T) {
+	_, err := newFetcher(&Conf{RecordDir: "a", ReplayDir: "b"})
+	assert.Error(t, err)
+
+	fetcher, err := newFetcher(&Conf{})
+	assert.NoError(t, err)
+	assert.IsType(t, &httpFetcher{}, fetcher)
+
+	fetcher, err = newFetcher(&Conf{RecordDir: "a"})
+	assert.NoError(t, err)
+	assert.IsType(t, &recordingFetcher{}, fetcher)
+
+	fetcher, err = newFetcher(&Conf{ReplayDir: "b"})
+	assert.NoError(t, err)
+	assert.IsType(t, &replayFetcher{}, fetcher)
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dg-scrape-playlists")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	body, err := ioutil.ReadFile("../../modules/dgtesting/samples/2018-07-16.html")
+	assert.NoError(t, err)
+
+	url := "http://www.deathguild.com/playlist/2018-07-16"
+
+	recorder := &recordingFetcher{dir: dir, fetcher: &staticFetcher{body: body}}
+	recorded, err := recorder.Fetch(url)
+	assert.NoError(t, err)
+	assert.Equal(t, body, recorded)
+
+	replayer := &replayFetcher{dir: dir}
+	replayed, err := replayer.Fetch(url)
+	assert.NoError(t, err)
+	assert.Equal(t, body, replayed)
+
+	// A replayed page should scrape exactly the same as the original.
+	songs, err := dgsource.DeathGuild.ParsePlaylist(bytes.NewReader(replayed))
+	assert.NoError(t, err)
+	assert.Equal(t, "Godspeed", songs[len(songs)-1].Title)
+
+	// Pages that were never recorded are an error rather than a trip to the
+	// network.
+	_, err = replayer.Fetch("http://www.deathguild.com/playlist/2018-07-23")
+	assert.Error(t, err)
+}
+
+func TestRecordingPath(t *testing.T) {
+	path, err := recordingPath("dir", dgsource.DeathGuild.IndexURL())
+	assert.NoError(t, err)
+	assert.Equal(t, "dir/playdates.html", path)
+
+	path, err = recordingPath("dir", "http://www.deathguild.com/playlist/2015-12-21")
+	assert.NoError(t, err)
+	assert.Equal(t, "dir/playlist/2015-12-21.html", path)
+
+	path, err = recordingPath("dir", "http://www.deathguild.com/")
+	assert.NoError(t, err)
+	assert.Equal(t, "dir/index.html", path)
+
+	path, err = recordingPath("dir", "http://www.deathguild.com/../../etc/passwd")
+	assert.NoError(t, err)
+	assert.Equal(t, "dir/etc/passwd.html", path)
+}
@@ -1,36 +1,23 @@
 package main
 
 import (
+	"bytes"
 	"database/sql"
 	"fmt"
-	"html"
-	"io"
-	"math/rand"
-	"net/http"
-	"regexp"
 	"strings"
 	"time"
 
-	"github.com/PuerkitoBio/goquery"
 	"github.com/brandur/deathguild/modules/dgcommon"
+	"github.com/brandur/deathguild/modules/dgsource"
+	"github.com/brandur/deathguild/modules/dgstore"
 	"github.com/brandur/modulir"
 	"github.com/joeshaw/envdecode"
 	_ "github.com/lib/pq"
+	"github.com/spf13/cobra"
 )
 
-const (
-	// Base URL of the site with playlist index and playlist information. It's
-	// sort of terrible to hardcode this, but we rate limit to make sure that
-	// the site isn't hit very hard, and only need to retrieve any given
-	// playlist one time.
-	baseURL = "http://www.deathguild.com"
-
-	// The location of the playlist index.
-	indexURL = baseURL + "/playdates"
-
-	// Concurrency level to run job pool at.
-	poolConcurrency = 20
-)
+// Concurrency level to run job pool at.
+const poolConcurrency = 20
 
 // Conf contains configuration information for the command. It's extracted from
 // environment variables.
@@ -42,17 +29,90 @@ type Conf struct {
 	// DatabaseURL is a connection string for a database used to store playlist
 	// and song information.
 	DatabaseURL string `env:"DATABASE_URL,required"`
-}
 
-// PlaylistLink is simply a URL to a playlist that we've pulled from the index.
-type PlaylistLink string
+	// HTTPConnectTimeout is the maximum amount of time to wait while
+	// establishing a connection to the site (including a TLS handshake).
+	HTTPConnectTimeout time.Duration `env:"HTTP_CONNECT_TIMEOUT,default=10s"`
+
+	// HTTPTimeout is the maximum amount of time that a single request may
+	// take from start to finish, including reading its body.
+	HTTPTimeout time.Duration `env:"HTTP_TIMEOUT,default=30s"`
+
+	// MaxRetries is the number of times that a request is retried after a
+	// network error or 5xx response before giving up.
+	MaxRetries int `env:"MAX_RETRIES,default=3"`
+
+	// RecordDir is an optional directory to which every page fetched from
+	// the live site will be written so that it can be replayed later.
+	RecordDir string `env:"RECORD_DIR"`
+
+	// RecheckDays is the number of days back from today within which
+	// playlists that we've already scraped will be fetched again and checked
+	// for changes. DJs sometimes fix up a tracklist in the days following a
+	// night, and this is how those fixes reach us.
+	RecheckDays int `env:"RECHECK_DAYS,default=14"`
+
+	// ReplayDir is an optional directory of pages previously written by
+	// RecordDir. When set, pages are read from it instead of from the live
+	// site and no network requests are made.
+	ReplayDir string `env:"REPLAY_DIR"`
+
+	// RequestsPerSecond is the maximum rate at which requests are made to
+	// the site. It's shared across all of the pool's workers.
+	RequestsPerSecond float64 `env:"REQUESTS_PER_SECOND,default=1"`
+
+	// Source is the name of the source to scrape playlists from.
+	Source string `env:"SOURCE,default=deathguild"`
+
+	// UserAgent is sent with every request so that the site's operators can
+	// tell who we are.
+	UserAgent string `env:"USER_AGENT,default=deathguild-scraper (+https://github.com/brandur/deathguild)"`
+}
 
 var conf Conf
 var db *sql.DB
+var fetcher Fetcher
+var source dgsource.Source
 var log modulir.LoggerInterface = &modulir.Logger{Level: modulir.LevelInfo}
 
 func main() {
-	err := envdecode.Decode(&conf)
+	var sel selection
+
+	rootCmd := &cobra.Command{
+		Use:   "dg-scrape-playlists",
+		Short: "Scrape playlists from a source into the database",
+		Long: strings.TrimSpace(`
+Fetches a source's index of playlists and stores every one that
+hasn't been stored yet, along with any recent ones that have
+changed. Flags restrict the scrape to a range of nights or to
+specific ones, which is useful for repairs.`),
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			scrape(&sel)
+		},
+	}
+
+	rootCmd.Flags().StringArrayVar(&sel.days, "day", nil,
+		"Scrape only the given night (YYYY-MM-DD), even if already stored; may be repeated")
+	rootCmd.Flags().StringVar(&sel.since, "since", "",
+		"Scrape only nights on or after the given day (YYYY-MM-DD)")
+	rootCmd.Flags().BoolVar(&sel.stopAtStored, "stop-at-stored", false,
+		"Stop walking the index at the newest night already stored")
+	rootCmd.Flags().StringVar(&sel.until, "until", "",
+		"Scrape only nights on or before the given day (YYYY-MM-DD)")
+
+	if err := rootCmd.Execute(); err != nil {
+		dgcommon.ExitWithError(err)
+	}
+}
+
+func scrape(sel *selection) {
+	err := sel.validate()
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	err = envdecode.Decode(&conf)
 	if err != nil {
 		dgcommon.ExitWithError(err)
 	}
@@ -62,30 +122,50 @@ func main() {
 		dgcommon.ExitWithError(err)
 	}
 
-	log.Infof("Requesting index at: %v", indexURL)
-	resp, err := http.Get(indexURL)
+	source, err = dgsource.Get(conf.Source)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	fetcher, err = newFetcher(&conf)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	log.Infof("Requesting index at: %v", source.IndexURL())
+	body, err := fetcher.Fetch(source.IndexURL())
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	refs, err := source.ParseIndex(bytes.NewReader(body))
 	if err != nil {
 		dgcommon.ExitWithError(err)
 	}
-	defer resp.Body.Close()
 
-	links, err := scrapeIndex(resp.Body)
+	log.Infof("Found %v playlist(s) in index", len(refs))
+
+	storedDays, err := fetchStoredDays()
 	if err != nil {
 		dgcommon.ExitWithError(err)
 	}
 
+	refs = selectRefs(refs, sel, storedDays, time.Now(), conf.RecheckDays)
+
+	log.Infof("Selected %v playlist(s) to scrape", len(refs))
+
 	pool := modulir.NewPool(log, poolConcurrency)
 	defer pool.Stop()
 
 	log.Infof("Starting work round")
 	pool.StartRound()
 
-	for _, l := range links {
-		link := l
+	for _, r := range refs {
+		ref := r
 
-		name := fmt.Sprintf("playlist: %v", link)
+		name := fmt.Sprintf("playlist: %v", ref.Day)
 		pool.Jobs <- modulir.NewJob(name, func() (bool, error) {
-			return handlePlaylist(link)
+			return handlePlaylist(ref)
 		})
 	}
 
@@ -99,42 +179,22 @@ func main() {
 	}
 }
 
-func scrapeIndex(r io.Reader) ([]PlaylistLink, error) {
-	doc, err := goquery.NewDocumentFromReader(r)
+// fetchStoredDays loads the days of every playlist already stored for the
+// source in a single query so that we don't have to make one for every link
+// in the index.
+func fetchStoredDays() (map[string]bool, error) {
+	txn, err := db.Begin()
 	if err != nil {
 		return nil, err
 	}
+	defer txn.Rollback()
 
-	var outErr error
-	var links []PlaylistLink
-
-	doc.Find("#playlist table a").EachWithBreak(func(i int, s *goquery.Selection) bool {
-		link, ok := s.Attr("href")
-		if !ok {
-			outErr = fmt.Errorf("No href attribute for link: %v", s.Text())
-			return false
-		}
-
-		links = append(links, PlaylistLink(link))
-
-		return true
-	})
-	if outErr != nil {
-		return nil, outErr
-	}
-
-	log.Infof("Found %v playlist(s) in index", len(links))
-	return links, nil
-}
-
-func extractDay(link PlaylistLink) string {
-	parts := strings.Split(string(link), "/")
-	return parts[len(parts)-1]
+	return dgstore.StoredDays(txn, source.Name())
 }
 
-func handlePlaylist(link PlaylistLink) (bool, error) {
+func handlePlaylist(ref *dgsource.PlaylistRef) (bool, error) {
 	var retErr error
-	day := extractDay(link)
+	day := ref.Day
 
 	txn, err := db.Begin()
 	if err != nil {
@@ -154,41 +214,35 @@ func handlePlaylist(link PlaylistLink) (bool, error) {
 		}
 	}()
 
-	var playlistID int
-	err = txn.QueryRow(`
-		SELECT id
-		FROM playlists
-		WHERE day = $1`,
-		day,
-	).Scan(&playlistID)
-
-	if playlistID != 0 {
-		log.Infof("Playlist %v already handled; skipping", day)
-		retErr = nil
-		return true, retErr
+	storedPlaylist, err := dgstore.LookupPlaylist(txn, source.Name(), day)
+	if err != nil {
+		retErr = err
+		return false, retErr
 	}
 
-	playlistURL := string(baseURL + link)
-	log.Debugf("Requesting playlist at: %v", playlistURL)
-	resp, err := http.Get(playlistURL)
+	body, err := fetcher.Fetch(ref.URL)
 	if err != nil {
 		retErr = err
 		return true, retErr
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		retErr = fmt.Errorf("bad response when requesting: %s (status code = %v)",
-			playlistURL, resp.StatusCode)
+	// Archive the page before trying to parse it so that if parsing goes
+	// wrong, we can fix the parser and reparse the page later without going
+	// back to the site.
+	err = archivePage(ref, body)
+	if err != nil {
+		retErr = err
 		return true, retErr
 	}
 
-	songs, err := scrapePlaylist(resp.Body)
+	songs, err := source.ParsePlaylist(bytes.NewReader(body))
 	if err != nil {
 		retErr = err
 		return true, retErr
 	}
 
+	log.Infof("Found playlist of %v song(s)", len(songs))
+
 	// If we got a playlist of zero songs, that probably means our DOM/HTML
 	// selectors aren't working anymore because the site has changed its
 	// format. Error and tell somebody.
@@ -199,136 +253,64 @@ func handlePlaylist(link PlaylistLink) (bool, error) {
 		return true, retErr
 	}
 
-	err = upsertPlaylistAndSongs(txn, day, songs)
+	if storedPlaylist != nil {
+		if storedPlaylist.SongsHash == dgstore.SongsHash(songs) {
+			log.Infof("Playlist %v unchanged since last scrape; skipping", day)
+			retErr = nil
+			return true, retErr
+		}
+
+		log.Infof("Playlist %v changed since last scrape; rewriting", day)
+	}
+
+	result, err := dgstore.UpsertPlaylistAndSongs(txn, source.Name(), day, songs)
 	if err != nil {
 		retErr = err
 		return true, retErr
 	}
 
-	// be kind and rate limit our requests
-	t := 1 + rand.Float32()
-	log.Debugf("Sleeping %v seconds", t)
-	time.Sleep(time.Duration(t) * time.Second)
+	log.Infof("Inserted records for %v song(s) (%v new)",
+		len(songs), len(result.SongsCreated))
+
+	if result.Status == dgstore.PlaylistStatusQuarantined {
+		log.Errorf("Playlist %v is quarantined (score %v); "+
+			"see `dg-review report`", day, result.Validation.Score)
+	}
 
 	retErr = nil
 	return true, nil
 }
 
-func upsertPlaylistAndSongs(txn *sql.Tx, day string,
-	songs []*dgcommon.Song) error {
-
-	var playlistID int
-	err := txn.QueryRow(`
-		INSERT INTO playlists (day)
-		VALUES ($1)
-		ON CONFLICT (day) DO UPDATE
-			SET day = excluded.day
-		RETURNING id`,
-		day,
-	).Scan(&playlistID)
+// inRecheckWindow determines whether a playlist for the given day is recent
+// enough that it should be fetched again to look for changes even though
+// we've already scraped it.
+func inRecheckWindow(day string, now time.Time, recheckDays int) bool {
+	t, err := time.Parse("2006-01-02", day)
 	if err != nil {
-		return fmt.Errorf("Error inserting into `playlists`: %v", err)
+		// If we can't make sense of the day, err on the side of not hitting
+		// the site again.
+		return false
 	}
 
-	for i, song := range songs {
-		var songID int
-		err := txn.QueryRow(`
-			INSERT INTO songs (artist, title)
-			VALUES ($1, $2)
-			ON CONFLICT (artist, title) DO UPDATE
-				-- no-op
-				SET artist = excluded.artist
-			RETURNING id`,
-			song.Artist,
-			song.Title,
-		).Scan(&songID)
-		if err != nil {
-			return fmt.Errorf("Error inserting into `songs`: %v", err)
-		}
-
-		_, err = txn.Exec(`
-			INSERT INTO playlists_songs (playlists_id, songs_id, position)
-			VALUES ($1, $2, $3)
-			ON CONFLICT (playlists_id, songs_id) DO UPDATE
-				SET position = excluded.position`,
-			playlistID,
-			songID,
-			i,
-		)
-		if err != nil {
-			return fmt.Errorf("Error inserting into `xplaylist_songs`: %v", err)
-		}
-	}
-
-	log.Infof("Inserted records for %v song(s)", len(songs))
-	return nil
+	// Compare whole days so the time of day that we happen to run at doesn't
+	// matter.
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	return !t.Before(today.AddDate(0, 0, -recheckDays))
 }
 
-func scrapePlaylist(r io.Reader) ([]*dgcommon.Song, error) {
-	doc, err := goquery.NewDocumentFromReader(r)
+// archivePage stores the raw body of a playlist's page. It's done in its own
+// transaction so that the page is kept even if handling the playlist fails.
+func archivePage(ref *dgsource.PlaylistRef, body []byte) error {
+	txn, err := db.Begin()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	var outErr error
-	var songs []*dgcommon.Song
-
-	// Old style playlists
-	doc.Find("table.Normal tr").EachWithBreak(func(i int, s *goquery.Selection) bool {
-		artist := s.Find("td:nth-child(1)").Text()
-		title := s.Find("td:nth-child(2)").Text()
-
-		// Ignore headers
-		if artist == "Artist" && title == "Title" {
-			return true
-		}
-
-		songs = append(songs, &dgcommon.Song{Artist: artist, Title: title})
-		return true
-	})
-	if outErr != nil {
-		return nil, outErr
-	}
-
-	// New style playlists
-	doc.Find("div#playlist em").EachWithBreak(func(i int, s *goquery.Selection) bool {
-		artist := s.Text()
-
-		allContent, err := s.Parent().Html()
-		if err != nil {
-			outErr = err
-			return false
-		}
-
-		// Unfortunately we're trying to parse Very Bad HTML which carries no
-		// semantic data whatsoever, so rather than traverse the DOM, we need
-		// to depend on a regexp hack to get titles out of the document.
-		//
-		// Be careful to:
-		//
-		//     1. Escape any HTML specific characters in the string (the call
-		//        to `Text` above will have unescaped them).
-		//     2. Escape any characters that are meaningful to a regexp (e.g., `+`).
-		rx := regexp.MustCompile(fmt.Sprintf(`<em>%s</em> - (.*?)<`,
-			regexp.QuoteMeta(html.EscapeString(artist))))
-
-		matches := rx.FindStringSubmatch(allContent)
-
-		if len(matches) < 2 {
-			outErr = fmt.Errorf("Failed to find title match for: %s", artist)
-			return false
-		}
-
-		// First index is the entire match, the second is our capture group.
-		title := html.UnescapeString(matches[1])
-
-		songs = append(songs, &dgcommon.Song{Artist: artist, Title: title})
-		return true
-	})
-	if outErr != nil {
-		return nil, outErr
+	err = dgstore.UpsertPlaylistPage(txn, source.Name(), ref.Day, ref.URL, body)
+	if err != nil {
+		txn.Rollback()
+		return err
 	}
 
-	log.Infof("Found playlist of %v song(s)", len(songs))
-	return songs, nil
+	return txn.Commit()
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/brandur/deathguild/modules/dgsource"
+)
+
+// selection restricts which of the playlists found in a source's index get
+// scraped. It's populated from command line flags.
+type selection struct {
+	// days are specific nights to scrape. If any are given, only they are
+	// scraped, and they're fetched again even if already stored.
+	days []string
+
+	// since is the earliest night to scrape, inclusive.
+	since string
+
+	// stopAtStored stops walking the index (newest first) at the newest
+	// night that's already stored. Nights in the recheck window are still
+	// checked for changes.
+	stopAtStored bool
+
+	// until is the latest night to scrape, inclusive.
+	until string
+}
+
+// validate checks that all days in the selection are well-formed.
+func (s *selection) validate() error {
+	for _, day := range s.days {
+		if _, err := time.Parse("2006-01-02", day); err != nil {
+			return fmt.Errorf("bad --day %q: should look like YYYY-MM-DD", day)
+		}
+	}
+
+	if s.since != "" {
+		if _, err := time.Parse("2006-01-02", s.since); err != nil {
+			return fmt.Errorf("bad --since %q: should look like YYYY-MM-DD", s.since)
+		}
+	}
+
+	if s.until != "" {
+		if _, err := time.Parse("2006-01-02", s.until); err != nil {
+			return fmt.Errorf("bad --until %q: should look like YYYY-MM-DD", s.until)
+		}
+	}
+
+	if s.since != "" && s.until != "" && s.since > s.until {
+		return fmt.Errorf("--since (%v) is after --until (%v)", s.since, s.until)
+	}
+
+	return nil
+}
+
+// selectRefs narrows playlists found in the index down to the ones that
+// should be scraped, newest first. Playlists that are already stored are left
+// out unless they're still in the recheck window or were asked for
+// explicitly.
+//
+// Days are compared as strings, which works because they're all formatted
+// as YYYY-MM-DD.
+func selectRefs(refs []*dgsource.PlaylistRef, sel *selection,
+	storedDays map[string]bool, now time.Time, recheckDays int) []*dgsource.PlaylistRef {
+
+	explicitDays := make(map[string]bool)
+	for _, day := range sel.days {
+		explicitDays[day] = true
+	}
+
+	var newestStored string
+	for day := range storedDays {
+		if day > newestStored {
+			newestStored = day
+		}
+	}
+
+	// Don't depend on the source listing its index in any particular order.
+	sorted := make([]*dgsource.PlaylistRef, len(refs))
+	copy(sorted, refs)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Day > sorted[j].Day
+	})
+
+	var selected []*dgsource.PlaylistRef
+
+	for _, ref := range sorted {
+		recheck := inRecheckWindow(ref.Day, now, recheckDays)
+
+		if sel.stopAtStored && newestStored != "" &&
+			ref.Day <= newestStored && !recheck {
+			log.Infof("Reached newest stored playlist %v; stopping", newestStored)
+			break
+		}
+
+		if len(explicitDays) > 0 && !explicitDays[ref.Day] {
+			continue
+		}
+
+		if sel.since != "" && ref.Day < sel.since {
+			continue
+		}
+
+		if sel.until != "" && ref.Day > sel.until {
+			continue
+		}
+
+		if storedDays[ref.Day] && !recheck && !explicitDays[ref.Day] {
+			log.Debugf("Playlist %v already handled; skipping", ref.Day)
+			continue
+		}
+
+		selected = append(selected, ref)
+	}
+
+	return selected
+}
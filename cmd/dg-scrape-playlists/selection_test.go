@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/brandur/deathguild/modules/dgsource"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestSelectionValidate(t *testing.T) {
+	assert.NoError(t, (&selection{}).validate())
+	assert.NoError(t, (&selection{
+		days:  []string{"2018-07-16"},
+		since: "2018-01-01",
+		until: "2018-12-31",
+	}).validate())
+
+	assert.Error(t, (&selection{days: []string{"last-monday"}}).validate())
+	assert.Error(t, (&selection{since: "2018"}).validate())
+	assert.Error(t, (&selection{until: "2018-13-01"}).validate())
+	assert.Error(t, (&selection{since: "2018-02-01", until: "2018-01-01"}).validate())
+}
+
+func TestSelectRefs(t *testing.T) {
+	now := time.Date(2018, 7, 20, 12, 0, 0, 0, time.UTC)
+
+	// In the order that Death Guild lists them (newest first), except for
+	// one out of place to make sure that order isn't depended on.
+	refs := []*dgsource.PlaylistRef{
+		{Day: "2018-07-16"},
+		{Day: "2018-07-09"},
+		{Day: "2018-06-25"},
+		{Day: "2018-07-02"},
+		{Day: "2018-06-18"},
+	}
+
+	days := func(refs []*dgsource.PlaylistRef) []string {
+		var days []string
+		for _, ref := range refs {
+			days = append(days, ref.Day)
+		}
+		return days
+	}
+
+	// With nothing stored, everything is selected.
+	assert.Equal(t,
+		[]string{"2018-07-16", "2018-07-09", "2018-07-02", "2018-06-25", "2018-06-18"},
+		days(selectRefs(refs, &selection{}, nil, now, 14)),
+	)
+
+	stored := map[string]bool{
+		"2018-07-02": true,
+		"2018-06-25": true,
+		"2018-06-18": true,
+	}
+
+	// Stored playlists are skipped unless they're in the recheck window.
+	assert.Equal(t,
+		[]string{"2018-07-16", "2018-07-09", "2018-07-02"},
+		days(selectRefs(refs, &selection{}, stored, now, 20)),
+	)
+	assert.Equal(t,
+		[]string{"2018-07-16", "2018-07-09"},
+		days(selectRefs(refs, &selection{}, stored, now, 14)),
+	)
+
+	// Date range
+	assert.Equal(t,
+		[]string{"2018-07-09", "2018-07-02", "2018-06-25"},
+		days(selectRefs(refs, &selection{since: "2018-06-20", until: "2018-07-10"}, nil, now, 14)),
+	)
+
+	// Explicit days are selected even when already stored.
+	assert.Equal(t,
+		[]string{"2018-07-09", "2018-06-18"},
+		days(selectRefs(refs, &selection{days: []string{"2018-06-18", "2018-07-09"}}, stored, now, 14)),
+	)
+
+	// Stopping at the newest stored night still checks the ones in the
+	// recheck window.
+	assert.Equal(t,
+		[]string{"2018-07-16", "2018-07-09", "2018-07-02"},
+		days(selectRefs(refs, &selection{stopAtStored: true}, stored, now, 20)),
+	)
+	assert.Equal(t,
+		[]string{"2018-07-16", "2018-07-09"},
+		days(selectRefs(refs, &selection{stopAtStored: true}, stored, now, 14)),
+	)
+
+	// Without stopping, a gap in older playlists gets filled in, but
+	// stopping never gets that far.
+	gappy := map[string]bool{"2018-07-02": true}
+	assert.Equal(t,
+		[]string{"2018-07-16", "2018-07-09", "2018-06-25", "2018-06-18"},
+		days(selectRefs(refs, &selection{}, gappy, now, 14)),
+	)
+	assert.Equal(t,
+		[]string{"2018-07-16", "2018-07-09"},
+		days(selectRefs(refs, &selection{stopAtStored: true}, gappy, now, 14)),
+	)
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/brandur/deathguild/modules/dgcommon"
+	"github.com/brandur/deathguild/modules/dgstore"
+	"github.com/brandur/modulir"
+	"github.com/joeshaw/envdecode"
+	_ "github.com/lib/pq"
+	"github.com/spf13/cobra"
+)
+
+// Conf contains configuration information for the command. It's extracted from
+// environment variables.
+type Conf struct {
+	// DatabaseURL is a connection string for a database used to store playlist
+	// and song information.
+	DatabaseURL string `env:"DATABASE_URL,required"`
+}
+
+var conf Conf
+var db *sql.DB
+var log modulir.LoggerInterface = &modulir.Logger{Level: modulir.LevelInfo}
+
+// The columns of an exported overrides file, in order.
+var csvHeader = []string{"kind", "artist", "title", "spotify_id", "note"}
+
+// The file that overrides are kept in, relative to the root of the project
+// (where the Makefile runs commands from).
+const overridesFile = "db/spotify_overrides.csv"
+
+const fileUsage = "CSV file to write all overrides to after the change " +
+	"(empty to skip)"
+
+func main() {
+	rootCmd := &cobra.Command{
+		Use:   "dg-spotify-overrides",
+		Short: "Decide by hand which Spotify tracks songs get",
+		Long: strings.TrimSpace(`
+Overrides the Spotify tracks that dg-enrich-songs picks for songs. A
+song can be pinned to a track, marked as not being on Spotify so that
+it's never searched for again, or have tracks rejected so that they're
+never used for it. Songs are updated to match right away and
+dg-enrich-songs respects overrides from then on.
+
+Overrides are kept in db/spotify_overrides.csv as well so that they
+survive database restores. Every change made with pin, not-on-spotify,
+reject, or remove is written out to it, and export and import move
+overrides between the file and the database by hand.`),
+	}
+
+	var file string
+	var note string
+
+	pinCommand := &cobra.Command{
+		Use:   "pin ARTIST TITLE SPOTIFY_ID",
+		Short: "Pin a song to a Spotify track",
+		Args:  cobra.ExactArgs(3),
+		Run: func(cmd *cobra.Command, args []string) {
+			upsert(file, &dgstore.SpotifyOverride{
+				Kind:      dgstore.OverridePin,
+				Artist:    args[0],
+				Title:     args[1],
+				SpotifyID: args[2],
+				Note:      note,
+			})
+		},
+	}
+	pinCommand.Flags().StringVar(&note, "note", "", "Why the override was made")
+	pinCommand.Flags().StringVar(&file, "file", overridesFile, fileUsage)
+	rootCmd.AddCommand(pinCommand)
+
+	notOnSpotifyCommand := &cobra.Command{
+		Use:   "not-on-spotify ARTIST TITLE",
+		Short: "Mark a song as not being on Spotify",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			upsert(file, &dgstore.SpotifyOverride{
+				Kind:   dgstore.OverrideNotOnSpotify,
+				Artist: args[0],
+				Title:  args[1],
+				Note:   note,
+			})
+		},
+	}
+	notOnSpotifyCommand.Flags().StringVar(&note, "note", "", "Why the override was made")
+	notOnSpotifyCommand.Flags().StringVar(&file, "file", overridesFile, fileUsage)
+	rootCmd.AddCommand(notOnSpotifyCommand)
+
+	rejectCommand := &cobra.Command{
+		Use:   "reject ARTIST TITLE SPOTIFY_ID",
+		Short: "Never use a Spotify track for a song",
+		Args:  cobra.ExactArgs(3),
+		Run: func(cmd *cobra.Command, args []string) {
+			upsert(file, &dgstore.SpotifyOverride{
+				Kind:      dgstore.OverrideReject,
+				Artist:    args[0],
+				Title:     args[1],
+				SpotifyID: args[2],
+				Note:      note,
+			})
+		},
+	}
+	rejectCommand.Flags().StringVar(&note, "note", "", "Why the override was made")
+	rejectCommand.Flags().StringVar(&file, "file", overridesFile, fileUsage)
+	rootCmd.AddCommand(rejectCommand)
+
+	removeCommand := &cobra.Command{
+		Use:   "remove ARTIST TITLE [SPOTIFY_ID]",
+		Short: "Remove a song's overrides, or only those for one track",
+		Args:  cobra.RangeArgs(2, 3),
+		Run: func(cmd *cobra.Command, args []string) {
+			var spotifyID string
+			if len(args) > 2 {
+				spotifyID = args[2]
+			}
+			remove(file, args[0], args[1], spotifyID)
+		},
+	}
+	removeCommand.Flags().StringVar(&file, "file", overridesFile, fileUsage)
+	rootCmd.AddCommand(removeCommand)
+
+	listCommand := &cobra.Command{
+		Use:   "list",
+		Short: "List all overrides",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			list()
+		},
+	}
+	rootCmd.AddCommand(listCommand)
+
+	exportCommand := &cobra.Command{
+		Use:   "export [FILE]",
+		Short: "Export all overrides as CSV to a file or stdout",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			var path string
+			if len(args) > 0 {
+				path = args[0]
+			}
+			exportOverrides(path)
+		},
+	}
+	rootCmd.AddCommand(exportCommand)
+
+	importCommand := &cobra.Command{
+		Use:   "import FILE",
+		Short: "Import overrides from CSV and apply them",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			importOverrides(args[0])
+		},
+	}
+	rootCmd.AddCommand(importCommand)
+
+	if err := rootCmd.Execute(); err != nil {
+		dgcommon.ExitWithError(err)
+	}
+}
+
+func setup() {
+	err := envdecode.Decode(&conf)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	db, err = sql.Open("postgres", conf.DatabaseURL)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+}
+
+// inTransaction runs fn in a transaction that's committed if it succeeds.
+// Overrides are applied to songs before committing so that they take effect
+// right away.
+func inTransaction(fn func(txn *sql.Tx) error) {
+	setup()
+
+	txn, err := db.Begin()
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+	defer txn.Rollback()
+
+	err = fn(txn)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	numChanged, err := dgstore.ApplySpotifyOverrides(txn)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	log.Infof("Updated %v song(s) to match overrides", numChanged)
+}
+
+// upsert stores an override and then writes every override out to path so
+// that the change is kept in the repository without a separate export.
+func upsert(path string, override *dgstore.SpotifyOverride) {
+	checkOverridesFile(path)
+	inTransaction(func(txn *sql.Tx) error {
+		return dgstore.UpsertSpotifyOverride(txn, override)
+	})
+	saveOverrides(path)
+}
+
+// remove deletes a song's overrides and then writes the ones left out to
+// path like upsert.
+func remove(path, artist, title, spotifyID string) {
+	checkOverridesFile(path)
+	inTransaction(func(txn *sql.Tx) error {
+		numRemoved, err := dgstore.DeleteSpotifyOverrides(txn, artist, title, spotifyID)
+		if err != nil {
+			return err
+		}
+
+		if numRemoved == 0 {
+			return fmt.Errorf("no overrides for %v - %v", artist, title)
+		}
+
+		log.Infof("Removed %v override(s)", numRemoved)
+		return nil
+	})
+	saveOverrides(path)
+}
+
+// checkOverridesFile makes sure that the overrides can be written out to path
+// before anything is changed in the database. An empty path is never written.
+func checkOverridesFile(path string) {
+	if path == "" {
+		return
+	}
+
+	_, err := os.Stat(filepath.Dir(path))
+	if err != nil {
+		dgcommon.ExitWithError(fmt.Errorf(
+			"can't write overrides to %v (run from the project root or pass --file): %v",
+			path, err))
+	}
+}
+
+// saveOverrides exports every override to path after a change has been
+// committed. It does nothing if path is empty.
+func saveOverrides(path string) {
+	if path == "" {
+		return
+	}
+
+	exportOverrides(path)
+}
+
+func list() {
+	setup()
+
+	txn, err := db.Begin()
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+	defer txn.Rollback()
+
+	overrides, err := dgstore.FetchSpotifyOverrides(txn)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	err = writeTable(os.Stdout, overrides)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+}
+
+func exportOverrides(path string) {
+	setup()
+
+	txn, err := db.Begin()
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+	defer txn.Rollback()
+
+	overrides, err := dgstore.FetchSpotifyOverrides(txn)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	w := io.Writer(os.Stdout)
+	if path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			dgcommon.ExitWithError(err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	err = writeCSV(w, overrides)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	if path != "" {
+		log.Infof("Exported %v override(s) to %v", len(overrides), path)
+	}
+}
+
+func importOverrides(path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+	defer f.Close()
+
+	overrides, err := readCSV(f)
+	if err != nil {
+		dgcommon.ExitWithError(fmt.Errorf("%v: %v", path, err))
+	}
+
+	inTransaction(func(txn *sql.Tx) error {
+		for _, override := range overrides {
+			err := dgstore.UpsertSpotifyOverride(txn, override)
+			if err != nil {
+				return err
+			}
+		}
+
+		log.Infof("Imported %v override(s) from %v", len(overrides), path)
+		return nil
+	})
+}
+
+// readCSV reads overrides in the format written by writeCSV. Every override
+// is validated before any are returned.
+func readCSV(r io.Reader) ([]*dgstore.SpotifyOverride, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = len(csvHeader)
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("empty file; expected a header of %v",
+			strings.Join(csvHeader, ","))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.Join(header, ",") != strings.Join(csvHeader, ",") {
+		return nil, fmt.Errorf("bad header %q; expected %v",
+			strings.Join(header, ","), strings.Join(csvHeader, ","))
+	}
+
+	var overrides []*dgstore.SpotifyOverride
+
+	// The header is line 1 and every override is on a line of its own after
+	// it. csv.Reader can't report lines itself in the Go that we build with.
+	line := 1
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		line++
+
+		override := &dgstore.SpotifyOverride{
+			Kind:      record[0],
+			Artist:    record[1],
+			Title:     record[2],
+			SpotifyID: record[3],
+			Note:      record[4],
+		}
+
+		err = override.Validate()
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", line, err)
+		}
+
+		overrides = append(overrides, override)
+	}
+
+	return overrides, nil
+}
+
+// writeCSV writes overrides as CSV with a header.
+func writeCSV(w io.Writer, overrides []*dgstore.SpotifyOverride) error {
+	writer := csv.NewWriter(w)
+
+	err := writer.Write(csvHeader)
+	if err != nil {
+		return err
+	}
+
+	for _, override := range overrides {
+		err := writer.Write([]string{
+			override.Kind,
+			override.Artist,
+			override.Title,
+			override.SpotifyID,
+			override.Note,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// writeTable writes overrides as a table.
+func writeTable(w io.Writer, overrides []*dgstore.SpotifyOverride) error {
+	if len(overrides) == 0 {
+		_, err := fmt.Fprintf(w, "No overrides\n")
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "KIND\tARTIST\tTITLE\tSPOTIFY ID\tNOTE\n")
+
+	for _, override := range overrides {
+		spotifyID := override.SpotifyID
+		if spotifyID == "" {
+			spotifyID = "-"
+		}
+
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\n", override.Kind, override.Artist,
+			override.Title, spotifyID, override.Note)
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/brandur/deathguild/modules/dgstore"
+	assert "github.com/stretchr/testify/require"
+)
+
+var testOverrides = []*dgstore.SpotifyOverride{
+	{
+		Kind:   dgstore.OverrideNotOnSpotify,
+		Artist: "Ikon",
+		Title:  "Ghost, Life",
+	},
+	{
+		Kind:      dgstore.OverridePin,
+		Artist:    "The Cure",
+		Title:     "A Forest",
+		SpotifyID: "1JSLLcD4RKl8TZwBNhV5UX",
+		Note:      "album version",
+	},
+}
+
+func TestReadWriteCSV(t *testing.T) {
+	var buf bytes.Buffer
+	err := writeCSV(&buf, testOverrides)
+	assert.NoError(t, err)
+
+	assert.Equal(t, strings.Join([]string{
+		"kind,artist,title,spotify_id,note",
+		`not_on_spotify,Ikon,"Ghost, Life",,`,
+		"pin,The Cure,A Forest,1JSLLcD4RKl8TZwBNhV5UX,album version",
+		"",
+	}, "\n"), buf.String())
+
+	overrides, err := readCSV(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, testOverrides, overrides)
+}
+
+func TestReadCSVErrors(t *testing.T) {
+	_, err := readCSV(strings.NewReader(""))
+	assert.Error(t, err)
+
+	_, err = readCSV(strings.NewReader("artist,title\n"))
+	assert.Error(t, err)
+
+	_, err = readCSV(strings.NewReader(strings.Join([]string{
+		"kind,artist,title,spotify_id,note",
+		"pin,The Cure,A Forest,1JSLLcD4RKl8TZwBNhV5UX,",
+		"pin,The Cure,Lullaby,,",
+	}, "\n")))
+	assert.EqualError(t, err, "line 3: pin override needs a Spotify ID")
+
+	_, err = readCSV(strings.NewReader(strings.Join([]string{
+		"kind,artist,title,spotify_id,note",
+		"favorite,The Cure,A Forest,,",
+	}, "\n")))
+	assert.EqualError(t, err, `line 2: unknown override kind "favorite"`)
+}
+
+func TestWriteTable(t *testing.T) {
+	var buf bytes.Buffer
+	err := writeTable(&buf, testOverrides)
+	assert.NoError(t, err)
+
+	assert.Equal(t, strings.Join([]string{
+		"KIND            ARTIST    TITLE        SPOTIFY ID              NOTE",
+		"not_on_spotify  Ikon      Ghost, Life  -                       ",
+		"pin             The Cure  A Forest     1JSLLcD4RKl8TZwBNhV5UX  album version",
+		"",
+	}, "\n"), buf.String())
+
+	buf.Reset()
+	err = writeTable(&buf, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "No overrides\n", buf.String())
+}
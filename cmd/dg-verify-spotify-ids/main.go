@@ -0,0 +1,344 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/brandur/deathguild/modules/dgcommon"
+	"github.com/brandur/deathguild/modules/dgstore"
+	"github.com/brandur/modulir"
+	"github.com/joeshaw/envdecode"
+	_ "github.com/lib/pq"
+	"github.com/zmb3/spotify"
+)
+
+// The number of tracks that we ask Spotify for at once. It's the most that
+// its tracks endpoint will take.
+const batchSize = 50
+
+// Conf contains configuration information for the command. It's extracted from
+// environment variables.
+type Conf struct {
+	// ClientID is our Spotify applicaton's client ID.
+	ClientID string `env:"CLIENT_ID,required"`
+
+	// ClientSecret is our Spotify applicaton's client secret.
+	ClientSecret string `env:"CLIENT_SECRET,required"`
+
+	// DatabaseURL is a connection string for a database used to store playlist
+	// and song information.
+	DatabaseURL string `env:"DATABASE_URL,required"`
+
+	// Limit is the most tracks that will be verified in one run so that
+	// verifying everything can be spread out over several.
+	Limit int `env:"LIMIT,default=1000"`
+
+	// Market is the country (as an ISO 3166-1 alpha-2 code like `US`) that
+	// tracks are checked in. Spotify only relinks tracks when it's asked for
+	// them in a market, and tracks that can't be played there are treated as
+	// unavailable.
+	Market string `env:"MARKET,default=US"`
+
+	// RefreshToken is our Spotify refresh token.
+	RefreshToken string `env:"REFRESH_TOKEN,required"`
+
+	// SpotifyMaxRetries is the number of times that a request rate limited
+	// by Spotify is retried before giving up.
+	SpotifyMaxRetries int `env:"SPOTIFY_MAX_RETRIES,default=10"`
+
+	// SpotifyRequestsPerSecond is the rate that requests to Spotify are
+	// held to. The rate drops on its own when Spotify rate limits us and
+	// climbs back up as requests go through.
+	SpotifyRequestsPerSecond float64 `env:"SPOTIFY_REQUESTS_PER_SECOND,default=2"`
+
+	// VerifyInterval is how long a track goes after being verified before
+	// it's verified again.
+	VerifyInterval time.Duration `env:"VERIFY_INTERVAL,default=720h"`
+}
+
+var client *http.Client
+var conf Conf
+var db *sql.DB
+var log modulir.LoggerInterface = &modulir.Logger{Level: modulir.LevelInfo}
+
+// The Web API endpoint that tracks are fetched from. It's a variable so that
+// tests can point it elsewhere.
+var tracksURL = "https://api.spotify.com/v1/tracks"
+
+// marketTrack is a track as Spotify returns it when asked for it in a market.
+// The Spotify client doesn't support markets, so tracks are fetched directly
+// and decoded with the two fields that only come back when there's one.
+type marketTrack struct {
+	spotify.FullTrack
+
+	// IsPlayable is whether the track can be played in the market.
+	IsPlayable *bool `json:"is_playable"`
+
+	// LinkedFrom is set if Spotify relinked the track that was asked for to
+	// this one, and identifies the original.
+	LinkedFrom *struct {
+		ID string `json:"id"`
+	} `json:"linked_from"`
+}
+
+// verification is what Spotify had to say about a track that songs have been
+// matched to.
+type verification struct {
+	spotifyID string
+
+	// relinkedTo is the track that Spotify answered with in place of the one
+	// asked for, if it relinked it to another one.
+	relinkedTo *spotify.FullTrack
+
+	// unavailable is set if Spotify doesn't have the track anymore, or has
+	// it but won't play it in the market.
+	unavailable bool
+}
+
+// verifyStats counts the outcomes of verifying tracks.
+type verifyStats struct {
+	numRelinked    int
+	numRequeued    int
+	numUnavailable int
+	numVerified    int
+}
+
+func main() {
+	err := envdecode.Decode(&conf)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	db, err = sql.Open("postgres", conf.DatabaseURL)
+	if err != nil {
+		dgcommon.ExitWithError(err)
+	}
+
+	client = dgcommon.GetSpotifyHTTPClient(
+		conf.ClientID, conf.ClientSecret, conf.RefreshToken,
+		dgcommon.NewRateLimiter(conf.SpotifyRequestsPerSecond), conf.SpotifyMaxRetries, log)
+
+	total := &verifyStats{}
+
+	for total.numVerified+total.numRelinked+total.numUnavailable < conf.Limit {
+		stats, err := verifyBatch(time.Now().Add(-conf.VerifyInterval))
+		if err != nil {
+			dgcommon.ExitWithError(err)
+		}
+
+		if stats.numVerified+stats.numRelinked+stats.numUnavailable == 0 {
+			break
+		}
+
+		total.numRelinked += stats.numRelinked
+		total.numRequeued += stats.numRequeued
+		total.numUnavailable += stats.numUnavailable
+		total.numVerified += stats.numVerified
+	}
+
+	log.Infof("Verified %v Spotify track(s); %v were relinked and %v unavailable; %v song(s) requeued",
+		total.numVerified, total.numRelinked, total.numUnavailable, total.numRequeued)
+}
+
+// checkTracks compares the tracks that Spotify returned for a batch of IDs
+// against what was asked for. Spotify answers with a track (or nil if it
+// doesn't know the ID) at the same position as each ID that it was asked
+// for. A track that it relinked has a different ID and the original in
+// LinkedFrom.
+func checkTracks(ids []string, tracks []*marketTrack) []*verification {
+	verifications := make([]*verification, len(ids))
+
+	for i, id := range ids {
+		v := &verification{spotifyID: id}
+		verifications[i] = v
+
+		var track *marketTrack
+		if i < len(tracks) {
+			track = tracks[i]
+		}
+
+		switch {
+		case track == nil || (track.IsPlayable != nil && !*track.IsPlayable):
+			v.unavailable = true
+		case track.LinkedFrom != nil && string(track.ID) != id:
+			v.relinkedTo = &track.FullTrack
+		}
+	}
+
+	return verifications
+}
+
+// fetchTracks fetches the tracks with the given IDs (at most batchSize of
+// them) as they are in market.
+func fetchTracks(ids []string, market string) ([]*marketTrack, error) {
+	query := url.Values{}
+	query.Set("ids", strings.Join(ids, ","))
+	query.Set("market", market)
+
+	resp, err := client.Get(tracksURL + "?" + query.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("Error fetching tracks from Spotify: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Error fetching tracks from Spotify: %v", resp.Status)
+	}
+
+	var body struct {
+		Tracks []*marketTrack `json:"tracks"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding tracks from Spotify: %v", err)
+	}
+
+	return body.Tracks, nil
+}
+
+// spotifyIDsNeedingVerification finds up to limit Spotify IDs that songs have
+// been matched to and that haven't been verified since verifiedBefore, those
+// that have gone the longest first. Songs pinned to a track by hand are left
+// to whoever pinned them.
+func spotifyIDsNeedingVerification(txn *sql.Tx, verifiedBefore time.Time, limit int) ([]string, error) {
+	rows, err := txn.Query(`
+		SELECT s.spotify_id
+		FROM songs s
+		WHERE s.spotify_id IS NOT NULL
+			AND (s.spotify_verified_at IS NULL
+				OR s.spotify_verified_at < $1)
+			AND NOT EXISTS (
+				SELECT 1
+				FROM song_spotify_overrides o
+				WHERE o.normalized_key = s.normalized_key
+					AND o.kind = 'pin'
+			)
+		GROUP BY s.spotify_id
+		ORDER BY min(s.spotify_verified_at) NULLS FIRST, s.spotify_id
+		LIMIT $2`,
+		verifiedBefore,
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// storeVerifications writes the outcomes of verifying a batch of tracks.
+// Songs whose tracks were relinked are moved over to the new track, which is
+// stored along with its artists. Songs whose tracks are unavailable are
+// queued to be searched for again. Playlists containing songs that changed
+// either way are flagged to be synced.
+func storeVerifications(txn *sql.Tx, verifications []*verification) (*verifyStats, error) {
+	stats := &verifyStats{}
+
+	var changedSongIDs []int
+	var verifiedIDs []string
+
+	for _, v := range verifications {
+		switch {
+		case v.unavailable:
+			songIDs, err := dgstore.RequeueSpotifyID(txn, v.spotifyID)
+			if err != nil {
+				return nil, err
+			}
+
+			log.Infof("Spotify track unavailable: %v; requeued %v song(s)",
+				v.spotifyID, len(songIDs))
+
+			changedSongIDs = append(changedSongIDs, songIDs...)
+			stats.numRequeued += len(songIDs)
+			stats.numUnavailable++
+
+		case v.relinkedTo != nil:
+			newID := string(v.relinkedTo.ID)
+
+			songIDs, err := dgstore.RelinkSpotifyID(txn, v.spotifyID, newID)
+			if err != nil {
+				return nil, err
+			}
+
+			err = dgstore.UpsertSpotifyTrack(txn, dgcommon.NewSpotifyTrack(v.relinkedTo))
+			if err != nil {
+				return nil, err
+			}
+
+			err = dgstore.LinkSongArtists(txn, newID, dgcommon.NewArtists(v.relinkedTo.Artists))
+			if err != nil {
+				return nil, err
+			}
+
+			log.Infof("Spotify track relinked: %v -> %v; moved %v song(s)",
+				v.spotifyID, newID, len(songIDs))
+
+			changedSongIDs = append(changedSongIDs, songIDs...)
+			stats.numRelinked++
+
+		default:
+			verifiedIDs = append(verifiedIDs, v.spotifyID)
+			stats.numVerified++
+		}
+	}
+
+	err := dgstore.MarkSpotifyIDsVerified(txn, verifiedIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	err = dgstore.MarkPlaylistsForSync(txn, changedSongIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// verifyBatch verifies one batch of tracks that haven't been verified since
+// verifiedBefore and commits the results.
+func verifyBatch(verifiedBefore time.Time) (*verifyStats, error) {
+	txn, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer txn.Rollback()
+
+	ids, err := spotifyIDsNeedingVerification(txn, verifiedBefore, batchSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ids) == 0 {
+		return &verifyStats{}, nil
+	}
+
+	tracks, err := fetchTracks(ids, conf.Market)
+	if err != nil {
+		return nil, err
+	}
+
+	stats, err := storeVerifications(txn, checkTracks(ids, tracks))
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, txn.Commit()
+}
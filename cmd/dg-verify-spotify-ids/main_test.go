@@ -0,0 +1,253 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/brandur/deathguild/modules/dgcommon"
+	"github.com/brandur/deathguild/modules/dgstore"
+	"github.com/brandur/deathguild/modules/dgtesting"
+	assert "github.com/stretchr/testify/require"
+	"github.com/zmb3/spotify"
+)
+
+func init() {
+	db = dgtesting.DB
+}
+
+func TestCheckTracks(t *testing.T) {
+	playable, unplayable := true, false
+
+	track := func(id string, isPlayable *bool, linkedFrom string) *marketTrack {
+		track := &marketTrack{IsPlayable: isPlayable}
+		track.ID = spotify.ID(id)
+		if linkedFrom != "" {
+			track.LinkedFrom = &struct {
+				ID string `json:"id"`
+			}{linkedFrom}
+		}
+		return track
+	}
+
+	ids := []string{"ok-id", "old-id", "gone-id", "unplayable-id"}
+	tracks := []*marketTrack{
+		track("ok-id", &playable, ""),
+		track("new-id", &playable, "old-id"),
+		nil,
+		track("unplayable-id", &unplayable, ""),
+	}
+
+	verifications := checkTracks(ids, tracks)
+	assert.Equal(t, 4, len(verifications))
+
+	assert.False(t, verifications[0].unavailable)
+	assert.Nil(t, verifications[0].relinkedTo)
+
+	assert.False(t, verifications[1].unavailable)
+	assert.Equal(t, spotify.ID("new-id"), verifications[1].relinkedTo.ID)
+
+	assert.True(t, verifications[2].unavailable)
+	assert.True(t, verifications[3].unavailable)
+}
+
+func TestFetchTracks(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "old-id,gone-id", r.URL.Query().Get("ids"))
+		assert.Equal(t, "US", r.URL.Query().Get("market"))
+
+		// Trimmed down from a real response for a relinked track.
+		fmt.Fprint(w, `{
+			"tracks": [
+				{
+					"artists": [{"id": "ikon-id", "name": "Ikon"}],
+					"id": "new-id",
+					"is_playable": true,
+					"linked_from": {
+						"id": "old-id",
+						"type": "track",
+						"uri": "spotify:track:old-id"
+					},
+					"name": "Ghost"
+				},
+				null
+			]
+		}`)
+	}))
+	defer server.Close()
+
+	oldClient, oldURL := client, tracksURL
+	client, tracksURL = server.Client(), server.URL
+	defer func() { client, tracksURL = oldClient, oldURL }()
+
+	tracks, err := fetchTracks([]string{"old-id", "gone-id"}, "US")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(tracks))
+	assert.Nil(t, tracks[1])
+
+	verifications := checkTracks([]string{"old-id", "gone-id"}, tracks)
+	assert.Equal(t, spotify.ID("new-id"), verifications[0].relinkedTo.ID)
+	assert.Equal(t, "Ikon", verifications[0].relinkedTo.Artists[0].Name)
+	assert.True(t, verifications[1].unavailable)
+}
+
+func TestSpotifyIDsNeedingVerification(t *testing.T) {
+	txn, err := db.Begin()
+	assert.NoError(t, err)
+	defer func() {
+		err := txn.Rollback()
+		assert.NoError(t, err)
+	}()
+
+	for _, song := range []*dgcommon.Song{
+		{Artist: "The Cure", Title: "A Forest", SpotifyID: "forest-id"},
+		{Artist: "Cure", Title: "A Forest", SpotifyID: "forest-id"},
+		{Artist: "Ikon", Title: "Ghost", SpotifyID: "ghost-id"},
+		{Artist: "Covenant", Title: "Dead Stars", SpotifyID: "dead-stars-id"},
+		{Artist: "Panic Lift", Title: "The Path"},
+	} {
+		dgtesting.InsertSong(t, txn, song)
+	}
+
+	// Every ID comes back once.
+	ids, err := spotifyIDsNeedingVerification(txn, time.Now(), batchSize)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"dead-stars-id", "forest-id", "ghost-id"}, ids)
+
+	// IDs verified recently don't come back, and those verified longest ago
+	// come after those never verified.
+	_, err = txn.Exec(`
+		UPDATE songs
+		SET spotify_verified_at = CASE spotify_id
+			WHEN 'forest-id' THEN NOW()
+			ELSE NOW() - '60 days'::interval
+		END
+		WHERE spotify_id IN ('forest-id', 'dead-stars-id')`,
+	)
+	assert.NoError(t, err)
+
+	ids, err = spotifyIDsNeedingVerification(txn, time.Now().Add(-30*24*time.Hour), batchSize)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ghost-id", "dead-stars-id"}, ids)
+
+	// Songs pinned by hand are left alone.
+	err = dgstore.UpsertSpotifyOverride(txn, &dgstore.SpotifyOverride{
+		Kind:      dgstore.OverridePin,
+		Artist:    "Ikon",
+		Title:     "Ghost",
+		SpotifyID: "ghost-id",
+	})
+	assert.NoError(t, err)
+
+	ids, err = spotifyIDsNeedingVerification(txn, time.Now().Add(-30*24*time.Hour), batchSize)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"dead-stars-id"}, ids)
+}
+
+func TestStoreVerifications(t *testing.T) {
+	txn, err := db.Begin()
+	assert.NoError(t, err)
+	defer func() {
+		err := txn.Rollback()
+		assert.NoError(t, err)
+	}()
+
+	_, err = dgstore.UpsertPlaylistAndSongs(txn, "deathguild", "2016-01-01", []*dgcommon.Song{
+		{Artist: "The Cure", Title: "A Forest"},
+		{Artist: "Ikon", Title: "Ghost"},
+		{Artist: "Covenant", Title: "Dead Stars"},
+	})
+	assert.NoError(t, err)
+
+	for _, song := range []struct{ artist, title, spotifyID string }{
+		{"The Cure", "A Forest", "forest-id"},
+		{"Ikon", "Ghost", "old-ghost-id"},
+		{"Covenant", "Dead Stars", "gone-id"},
+	} {
+		_, err = dgstore.SetSongSpotifyID(txn, song.artist, song.title, song.spotifyID)
+		assert.NoError(t, err)
+	}
+
+	_, err = txn.Exec(`
+		UPDATE playlists
+		SET spotify_needs_sync = false`,
+	)
+	assert.NoError(t, err)
+
+	stats, err := storeVerifications(txn, []*verification{
+		{spotifyID: "forest-id"},
+		{spotifyID: "old-ghost-id", relinkedTo: &spotify.FullTrack{
+			SimpleTrack: spotify.SimpleTrack{
+				Artists: []spotify.SimpleArtist{{ID: "ikon-id", Name: "Ikon"}},
+				ID:      "ghost-id",
+				Name:    "Ghost",
+			},
+		}},
+		{spotifyID: "gone-id", unavailable: true},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, &verifyStats{
+		numRelinked:    1,
+		numRequeued:    1,
+		numUnavailable: 1,
+		numVerified:    1,
+	}, stats)
+
+	song := func(title string) (sql.NullString, bool) {
+		var spotifyID sql.NullString
+		var verified bool
+		err := txn.QueryRow(`
+			SELECT spotify_id, spotify_verified_at IS NOT NULL
+			FROM songs
+			WHERE title = $1`,
+			title,
+		).Scan(&spotifyID, &verified)
+		assert.NoError(t, err)
+		return spotifyID, verified
+	}
+
+	id, verified := song("A Forest")
+	assert.Equal(t, "forest-id", id.String)
+	assert.True(t, verified)
+
+	// The relinked song gets the new track along with its artists.
+	id, verified = song("Ghost")
+	assert.Equal(t, "ghost-id", id.String)
+	assert.True(t, verified)
+
+	var numTracks, numLinks int
+	err = txn.QueryRow(`
+		SELECT
+			(SELECT count(*) FROM spotify_tracks WHERE spotify_id = 'ghost-id'),
+			(SELECT count(*) FROM songs_artists WHERE spotify_id = 'ghost-id')`,
+	).Scan(&numTracks, &numLinks)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, numTracks)
+	assert.Equal(t, 1, numLinks)
+
+	id, verified = song("Dead Stars")
+	assert.False(t, id.Valid)
+	assert.False(t, verified)
+
+	// Both old IDs are kept.
+	var numHistory int
+	err = txn.QueryRow(`
+		SELECT count(*)
+		FROM song_spotify_id_history`,
+	).Scan(&numHistory)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, numHistory)
+
+	var needsSync bool
+	err = txn.QueryRow(`
+		SELECT spotify_needs_sync
+		FROM playlists
+		WHERE day = $1`,
+		"2016-01-01",
+	).Scan(&needsSync)
+	assert.NoError(t, err)
+	assert.True(t, needsSync)
+}
@@ -0,0 +1,5 @@
+-- Track when a playlist's songs change after it's been stored so that its
+-- Spotify playlist can be synced.
+ALTER TABLE playlists
+    ADD COLUMN IF NOT EXISTS songs_hash TEXT,
+    ADD COLUMN IF NOT EXISTS spotify_needs_sync BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1,6 @@
+-- Allow a song to be played more than once in the same night by making
+-- songs unique by position instead of by playlist.
+ALTER TABLE playlists_songs
+    DROP CONSTRAINT IF EXISTS unique_playlists_songs,
+    DROP CONSTRAINT IF EXISTS unique_playlists_positions,
+    ADD CONSTRAINT unique_playlists_positions UNIQUE (playlists_id, position);
@@ -0,0 +1,28 @@
+-- Assign playlists to the source that they came from. Everything stored
+-- before there were sources came from Death Guild, and days and slugs are
+-- unique per source rather than overall.
+ALTER TABLE playlists
+    ADD COLUMN IF NOT EXISTS source TEXT;
+
+UPDATE playlists
+SET source = 'deathguild'
+WHERE source IS NULL;
+
+ALTER TABLE playlists
+    ALTER COLUMN source SET NOT NULL,
+    DROP CONSTRAINT IF EXISTS playlists_day_key,
+    DROP CONSTRAINT IF EXISTS unique_playlists_source_day,
+    ADD CONSTRAINT unique_playlists_source_day UNIQUE (source, day);
+
+ALTER TABLE special_playlists
+    ADD COLUMN IF NOT EXISTS source TEXT;
+
+UPDATE special_playlists
+SET source = 'deathguild'
+WHERE source IS NULL;
+
+ALTER TABLE special_playlists
+    ALTER COLUMN source SET NOT NULL,
+    DROP CONSTRAINT IF EXISTS special_playlists_slug_key,
+    DROP CONSTRAINT IF EXISTS unique_special_playlists_source_slug,
+    ADD CONSTRAINT unique_special_playlists_source_slug UNIQUE (source, slug);
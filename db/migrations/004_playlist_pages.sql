@@ -0,0 +1,10 @@
+-- Archive fetched playlist pages so that they can be reparsed.
+CREATE TABLE IF NOT EXISTS playlist_pages (
+    id bigserial PRIMARY KEY,
+    source TEXT NOT NULL,
+    day date NOT NULL,
+    url TEXT NOT NULL,
+    body BYTEA NOT NULL,
+    fetched_at TIMESTAMPTZ NOT NULL,
+    CONSTRAINT unique_playlist_pages_source_day UNIQUE (source, day)
+);
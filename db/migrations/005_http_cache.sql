@@ -0,0 +1,23 @@
+-- Cache responses along with their validators for conditional GETs. Playlist
+-- pages' bodies are left to `playlist_pages` instead of being stored twice.
+CREATE TABLE IF NOT EXISTS http_cache (
+    id bigserial PRIMARY KEY,
+    url TEXT NOT NULL,
+    body BYTEA,
+    etag TEXT NOT NULL,
+    last_modified TEXT NOT NULL,
+    fetched_at TIMESTAMPTZ NOT NULL,
+    CONSTRAINT unique_http_cache_url UNIQUE (url)
+);
+
+ALTER TABLE http_cache
+    ALTER COLUMN body DROP NOT NULL;
+
+CREATE INDEX IF NOT EXISTS playlist_pages_url
+    ON playlist_pages (url);
+
+UPDATE http_cache c
+SET body = NULL
+FROM playlist_pages pp
+WHERE pp.url = c.url
+    AND pp.body = c.body;
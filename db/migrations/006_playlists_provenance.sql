@@ -0,0 +1,3 @@
+-- Record where playlists that weren't scraped from a live site came from.
+ALTER TABLE playlists
+    ADD COLUMN IF NOT EXISTS provenance TEXT;
@@ -0,0 +1,18 @@
+-- Validate playlists and quarantine suspicious ones. Every playlist stored
+-- before validation existed is published so that none drop off the site.
+ALTER TABLE playlists
+    ADD COLUMN IF NOT EXISTS reviewed_at TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS status TEXT,
+    ADD COLUMN IF NOT EXISTS validation_issues JSONB NOT NULL DEFAULT '[]',
+    ADD COLUMN IF NOT EXISTS validation_score INT NOT NULL DEFAULT 0;
+
+UPDATE playlists
+SET status = 'published'
+WHERE status IS NULL;
+
+ALTER TABLE playlists
+    ALTER COLUMN status SET NOT NULL,
+    ALTER COLUMN status SET DEFAULT 'published',
+    DROP CONSTRAINT IF EXISTS playlists_status_check,
+    ADD CONSTRAINT playlists_status_check
+        CHECK (status IN ('published', 'quarantined'));
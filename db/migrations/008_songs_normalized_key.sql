@@ -0,0 +1,19 @@
+-- Match songs on a normalized key and keep their other spellings as aliases.
+-- Keys are filled in by `dg-merge-songs`, which folds songs that turn out to
+-- match together.
+ALTER TABLE songs
+    ADD COLUMN IF NOT EXISTS normalized_key TEXT NOT NULL DEFAULT '';
+
+ALTER TABLE songs
+    ALTER COLUMN normalized_key DROP DEFAULT;
+
+CREATE INDEX IF NOT EXISTS songs_normalized_key
+    ON songs (normalized_key);
+
+CREATE TABLE IF NOT EXISTS song_aliases (
+    id bigserial PRIMARY KEY,
+    songs_id BIGINT NOT NULL REFERENCES songs(id),
+    artist TEXT NOT NULL,
+    title TEXT NOT NULL,
+    CONSTRAINT unique_song_aliases UNIQUE (artist, title)
+);
@@ -0,0 +1,5 @@
+-- Record how well each Spotify match scored and which search strategy found
+-- it.
+ALTER TABLE songs
+    ADD COLUMN IF NOT EXISTS spotify_match_score REAL,
+    ADD COLUMN IF NOT EXISTS spotify_match_strategy TEXT;
@@ -0,0 +1,21 @@
+-- Decisions made by hand about which Spotify track a song gets.
+CREATE TABLE IF NOT EXISTS song_spotify_overrides (
+    id bigserial PRIMARY KEY,
+    normalized_key TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    artist TEXT NOT NULL,
+    title TEXT NOT NULL,
+    spotify_id TEXT,
+    note TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    CHECK (kind IN ('not_on_spotify', 'pin', 'reject')),
+    CHECK ((kind = 'not_on_spotify') = (spotify_id IS NULL))
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS song_spotify_overrides_normalized_key_settled
+    ON song_spotify_overrides (normalized_key)
+    WHERE kind IN ('not_on_spotify', 'pin');
+
+CREATE UNIQUE INDEX IF NOT EXISTS song_spotify_overrides_normalized_key_rejected
+    ON song_spotify_overrides (normalized_key, spotify_id)
+    WHERE kind = 'reject';
@@ -0,0 +1,37 @@
+-- Metadata and audio features of the Spotify tracks that songs are matched
+-- to.
+CREATE TABLE IF NOT EXISTS spotify_tracks (
+    id bigserial PRIMARY KEY,
+    spotify_id TEXT NOT NULL,
+    name TEXT NOT NULL,
+    album_name TEXT NOT NULL,
+    album_release_date TEXT NOT NULL,
+    album_art_url TEXT,
+    duration_ms INT NOT NULL,
+    explicit BOOLEAN NOT NULL,
+    isrc TEXT,
+    popularity INT NOT NULL,
+    fetched_at TIMESTAMPTZ NOT NULL,
+    CHECK (duration_ms >= 0),
+    CHECK (popularity BETWEEN 0 AND 100),
+    CONSTRAINT unique_spotify_tracks_spotify_id UNIQUE (spotify_id)
+);
+
+CREATE TABLE IF NOT EXISTS spotify_audio_features (
+    id bigserial PRIMARY KEY,
+    spotify_id TEXT NOT NULL,
+    tempo REAL NOT NULL,
+    energy REAL NOT NULL,
+    danceability REAL NOT NULL,
+    valence REAL NOT NULL,
+    key SMALLINT NOT NULL,
+    mode SMALLINT NOT NULL,
+    fetched_at TIMESTAMPTZ NOT NULL,
+    CHECK (tempo >= 0),
+    CHECK (energy BETWEEN 0 AND 1),
+    CHECK (danceability BETWEEN 0 AND 1),
+    CHECK (valence BETWEEN 0 AND 1),
+    CHECK (key BETWEEN -1 AND 11),
+    CHECK (mode IN (0, 1)),
+    CONSTRAINT unique_spotify_audio_features_spotify_id UNIQUE (spotify_id)
+);
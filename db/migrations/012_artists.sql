@@ -0,0 +1,19 @@
+-- Artists as Spotify knows them, linked to the songs matched to their tracks.
+CREATE TABLE IF NOT EXISTS artists (
+    id bigserial PRIMARY KEY,
+    spotify_id TEXT NOT NULL,
+    name TEXT NOT NULL,
+    genres TEXT[] NOT NULL DEFAULT '{}',
+    genres_fetched_at TIMESTAMPTZ,
+    CONSTRAINT unique_artists_spotify_id UNIQUE (spotify_id)
+);
+
+CREATE TABLE IF NOT EXISTS songs_artists (
+    id bigserial PRIMARY KEY,
+    songs_id BIGINT NOT NULL REFERENCES songs(id),
+    artists_id BIGINT NOT NULL REFERENCES artists(id),
+    spotify_id TEXT NOT NULL,
+    position INT NOT NULL,
+    CHECK (position >= 0),
+    CONSTRAINT unique_songs_artists UNIQUE (songs_id, artists_id)
+);
@@ -0,0 +1,15 @@
+-- MusicBrainz recordings that songs are matched to.
+ALTER TABLE songs
+    ADD COLUMN IF NOT EXISTS musicbrainz_checked_at TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS musicbrainz_match_score REAL,
+    ADD COLUMN IF NOT EXISTS musicbrainz_recording_id TEXT;
+
+CREATE TABLE IF NOT EXISTS musicbrainz_recordings (
+    id bigserial PRIMARY KEY,
+    musicbrainz_id TEXT NOT NULL,
+    title TEXT NOT NULL,
+    artist TEXT NOT NULL,
+    artist_ids TEXT[] NOT NULL DEFAULT '{}',
+    fetched_at TIMESTAMPTZ NOT NULL,
+    CONSTRAINT unique_musicbrainz_recordings_musicbrainz_id UNIQUE (musicbrainz_id)
+);
@@ -0,0 +1,28 @@
+-- Back off exponentially on songs that Spotify doesn't have. Songs that were
+-- already searched for are scheduled as if they'd been tried once, which is
+-- only done when the columns are first added since plenty of songs have been
+-- searched for without being scheduled since (like those marked as not on
+-- Spotify).
+DO $$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1
+        FROM information_schema.columns
+        WHERE table_name = 'songs'
+            AND column_name = 'spotify_attempts'
+    ) THEN
+        ALTER TABLE songs
+            ADD COLUMN spotify_attempts INT NOT NULL DEFAULT 0,
+            ADD COLUMN spotify_next_check_at TIMESTAMPTZ,
+            ADD CONSTRAINT songs_spotify_attempts_check
+                CHECK (spotify_attempts >= 0);
+
+        UPDATE songs
+        SET spotify_attempts = 1,
+            spotify_next_check_at = spotify_checked_at
+                + '1 week'::interval + random() * '1 day'::interval
+        WHERE spotify_id IS NULL
+            AND spotify_checked_at IS NOT NULL;
+    END IF;
+END
+$$;
@@ -0,0 +1,20 @@
+-- A ledger of `dg-enrich-songs` runs that songs point back to.
+CREATE TABLE IF NOT EXISTS enrichment_runs (
+    id bigserial PRIMARY KEY,
+    started_at TIMESTAMPTZ NOT NULL,
+    finished_at TIMESTAMPTZ,
+    error TEXT,
+    num_examined INT NOT NULL DEFAULT 0,
+    num_matched INT NOT NULL DEFAULT 0,
+    num_not_found INT NOT NULL DEFAULT 0,
+    num_errors INT NOT NULL DEFAULT 0,
+    num_rate_limited INT NOT NULL DEFAULT 0,
+    CHECK (num_examined = num_matched + num_not_found + num_errors),
+    CHECK (num_matched >= 0),
+    CHECK (num_not_found >= 0),
+    CHECK (num_errors >= 0),
+    CHECK (num_rate_limited >= 0)
+);
+
+ALTER TABLE songs
+    ADD COLUMN IF NOT EXISTS spotify_enrichment_runs_id BIGINT REFERENCES enrichment_runs(id);
@@ -0,0 +1,26 @@
+-- Verify stored Spotify IDs and keep the history of the ones that changed.
+ALTER TABLE songs
+    ADD COLUMN IF NOT EXISTS spotify_verified_at TIMESTAMPTZ;
+
+-- Special playlists were briefly flagged for syncing too, but they're rebuilt
+-- on every run anyway.
+ALTER TABLE special_playlists
+    DROP COLUMN IF EXISTS spotify_needs_sync;
+
+CREATE TABLE IF NOT EXISTS song_spotify_id_history (
+    id bigserial PRIMARY KEY,
+    songs_id BIGINT NOT NULL REFERENCES songs(id),
+    spotify_id TEXT NOT NULL,
+    replaced_by TEXT,
+    reason TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    CHECK ((reason = 'relinked') = (replaced_by IS NOT NULL))
+);
+
+ALTER TABLE song_spotify_id_history
+    DROP CONSTRAINT IF EXISTS song_spotify_id_history_reason_check,
+    ADD CONSTRAINT song_spotify_id_history_reason_check
+        CHECK (reason IN ('mismatched', 'relinked', 'unavailable'));
+
+CREATE INDEX IF NOT EXISTS song_spotify_id_history_songs_id
+    ON song_spotify_id_history (songs_id);
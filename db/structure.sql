@@ -10,63 +10,455 @@
 -- For example, use `NOT NULL`, `UNIQUE`, and `REFERENCES` everywhere that it's
 -- possible.
 --
+-- Databases restored from a dump are brought up to date by the migrations in
+-- `db/migrations/`, so every change here needs one there too.
+--
 
 BEGIN;
 
+DROP TABLE IF EXISTS artists CASCADE;
+DROP TABLE IF EXISTS enrichment_runs CASCADE;
+DROP TABLE IF EXISTS http_cache CASCADE;
+DROP TABLE IF EXISTS musicbrainz_recordings CASCADE;
+DROP TABLE IF EXISTS playlist_pages CASCADE;
 DROP TABLE IF EXISTS playlists CASCADE;
 DROP TABLE IF EXISTS playlists_songs CASCADE;
+DROP TABLE IF EXISTS song_aliases CASCADE;
+DROP TABLE IF EXISTS song_spotify_id_history CASCADE;
+DROP TABLE IF EXISTS song_spotify_overrides CASCADE;
 DROP TABLE IF EXISTS songs CASCADE;
+DROP TABLE IF EXISTS songs_artists CASCADE;
 DROP TABLE IF EXISTS special_playlists CASCADE;
+DROP TABLE IF EXISTS spotify_audio_features CASCADE;
+DROP TABLE IF EXISTS spotify_tracks CASCADE;
 
 --
 -- playlists
 --
 -- Each playlist is a list of songs that were played at a single night of Death
--- Guild.
+-- Guild (or another club night, identified by `source`).
+--
+-- `songs_hash` is a hash of the playlist's scraped contents so that we can
+-- tell when a tracklist has been changed after the fact. When one has,
+-- `spotify_needs_sync` is set so that its Spotify playlist gets updated.
+--
+-- `provenance` describes where a playlist came from if it wasn't scraped from
+-- the live site, like the archive that it was recovered from (see
+-- `dg-import-warc`). It's NULL for scraped playlists.
+--
+-- Every time a playlist's songs are stored they're scored against heuristics
+-- for scraping problems (see `dgvalidate`). `validation_score` is the total
+-- and `validation_issues` a JSON array of what was found. Playlists that
+-- score too high have a `status` of `quarantined` and are left off the site
+-- and out of Spotify until somebody reviews them with `dg-review`. Validation
+-- only ever quarantines a playlist. Publishing one that was quarantined takes
+-- a review, and once a playlist has been reviewed (`reviewed_at`) it keeps the
+-- status that it was given.
 --
 CREATE TABLE playlists (
     id bigserial PRIMARY KEY,
-    day date NOT NULL UNIQUE,
-    spotify_id TEXT
+    source TEXT NOT NULL,
+    day date NOT NULL,
+    provenance TEXT,
+    reviewed_at TIMESTAMPTZ,
+    songs_hash TEXT,
+    spotify_id TEXT,
+    spotify_needs_sync BOOLEAN NOT NULL DEFAULT false,
+    status TEXT NOT NULL DEFAULT 'published',
+    validation_issues JSONB NOT NULL DEFAULT '[]',
+    validation_score INT NOT NULL DEFAULT 0,
+    CHECK (status IN ('published', 'quarantined'))
+);
+
+ALTER TABLE playlists
+    ADD CONSTRAINT unique_playlists_source_day
+    UNIQUE (source, day);
+
+--
+-- playlist_pages
+--
+-- The raw body of the most recently fetched page for each playlist. Keeping
+-- these around means that when a parser gets something wrong, it can be fixed
+-- and the pages reparsed (see `dg-reparse`) without going back to the site.
+-- Postgres compresses large values like these on its own.
+--
+CREATE TABLE playlist_pages (
+    id bigserial PRIMARY KEY,
+    source TEXT NOT NULL,
+    day date NOT NULL,
+    url TEXT NOT NULL,
+    body BYTEA NOT NULL,
+    fetched_at TIMESTAMPTZ NOT NULL
+);
+
+ALTER TABLE playlist_pages
+    ADD CONSTRAINT unique_playlist_pages_source_day
+    UNIQUE (source, day);
+
+CREATE INDEX playlist_pages_url
+    ON playlist_pages (url);
+
+--
+-- http_cache
+--
+-- The last response received for each URL that the scraper fetches along
+-- with its `ETag` and `Last-Modified` validators. They're sent back with the
+-- next request for the same URL so the server can answer with a 304 instead
+-- of the whole page, in which case the body stored here is used. Either
+-- validator is an empty string if the server didn't send one.
+--
+-- `body` is NULL for a playlist page that's archived in `playlist_pages` with
+-- the same body, which is used instead so that it isn't stored twice.
+--
+CREATE TABLE http_cache (
+    id bigserial PRIMARY KEY,
+    url TEXT NOT NULL,
+    body BYTEA,
+    etag TEXT NOT NULL,
+    last_modified TEXT NOT NULL,
+    fetched_at TIMESTAMPTZ NOT NULL
 );
 
+ALTER TABLE http_cache
+    ADD CONSTRAINT unique_http_cache_url
+    UNIQUE (url);
+
 --
 -- special_playlists
 --
 -- A table that allows us to track the Spotify IDs of "special" playlists --
--- for example, top songs of the year or top songs of all-time.
+-- for example, top songs of the year or top songs of all-time. Each source
+-- gets its own set.
 --
 CREATE TABLE special_playlists (
     id bigserial PRIMARY KEY,
-    slug TEXT UNIQUE NOT NULL,
+    source TEXT NOT NULL,
+    slug TEXT NOT NULL,
     spotify_id TEXT NOT NULL
 );
 
+ALTER TABLE special_playlists
+    ADD CONSTRAINT unique_special_playlists_source_slug
+    UNIQUE (source, slug);
+
+--
+-- enrichment_runs
+--
+-- A ledger of `dg-enrich-songs` runs. Counts are updated after every batch, so
+-- a run that dies partway through still shows how far it got. `finished_at`
+-- is NULL for a run that's still going (or that was killed), and `error` is
+-- the error that ended a run early, if any.
+--
+-- `num_examined` is the number of songs searched for, each of which was
+-- either matched, not found, or had its lookup fail (`num_errors`).
+-- `num_rate_limited` counts the responses that Spotify rate limited during
+-- the run, including those that were retried successfully.
+--
+CREATE TABLE enrichment_runs (
+    id bigserial PRIMARY KEY,
+    started_at TIMESTAMPTZ NOT NULL,
+    finished_at TIMESTAMPTZ,
+    error TEXT,
+    num_examined INT NOT NULL DEFAULT 0,
+    num_matched INT NOT NULL DEFAULT 0,
+    num_not_found INT NOT NULL DEFAULT 0,
+    num_errors INT NOT NULL DEFAULT 0,
+    num_rate_limited INT NOT NULL DEFAULT 0,
+    CHECK (num_examined = num_matched + num_not_found + num_errors),
+    CHECK (num_matched >= 0),
+    CHECK (num_not_found >= 0),
+    CHECK (num_errors >= 0),
+    CHECK (num_rate_limited >= 0)
+);
+
 --
 -- songs
 --
--- Each song is a single artist/title combination. We can't guarantee that
--- there aren't duplicates in here that may have slightly different lettering
--- or parenthesis combinations, and basically depend on the original Death
--- Guild source for good hygiene.
+-- Each song is a single artist/title combination. The same song is often
+-- written up with slightly different lettering, spacing, quotes, or
+-- parentheses from one night to the next, so songs are matched on
+-- `normalized_key` (see `dgnormalize`) rather than on their exact spelling.
+-- A song keeps the spelling that it was first stored with and others are
+-- recorded in `song_aliases`.
+--
+-- `spotify_match_score` is how closely the Spotify track that `spotify_id`
+-- was taken from matched the song, between 0 and 1 (see `dgmatch`). It's NULL
+-- for IDs that were set by hand or found before matches were scored.
+-- `spotify_match_strategy` is the search strategy that found the track (see
+-- `dg-enrich-songs`) so that we can tell which ones pay off, or `override`
+-- for a song pinned to a track by hand (see `song_spotify_overrides`).
+--
+-- `spotify_attempts` is the number of times in a row that a song has been
+-- searched for on Spotify without being found, and `spotify_next_check_at`
+-- when it's due to be searched for again. The wait doubles with every
+-- attempt. Both are reset when a song is matched. A NULL
+-- `spotify_next_check_at` on a song without a `spotify_id` means that it's
+-- never been searched for.
+--
+-- `spotify_enrichment_runs_id` is the `dg-enrich-songs` run (see
+-- `enrichment_runs`) that last searched for the song. It's NULL for songs
+-- that haven't been searched for since runs were recorded and for those
+-- whose Spotify ID was set by hand.
+--
+-- `spotify_verified_at` is the last time that `dg-verify-spotify-ids` found
+-- the song's track still available on Spotify. It's NULL for songs that have
+-- never been verified.
+--
+-- `musicbrainz_recording_id` is the MusicBrainz recording that
+-- `dg-enrich-musicbrainz` matched the song to (see `musicbrainz_recordings`)
+-- and `musicbrainz_match_score` how closely it matched. They're looked up
+-- independently of Spotify so that songs that Spotify doesn't have can still
+-- be identified.
+--
+-- `normalized_key` isn't unique because a change to how keys are produced
+-- can make songs that were stored separately match. `dg-merge-songs`
+-- recomputes keys and folds any duplicates together.
 --
 CREATE TABLE songs (
     id bigserial PRIMARY KEY,
     artist TEXT NOT NULL,
     title TEXT NOT NULL,
+    normalized_key TEXT NOT NULL,
+    musicbrainz_checked_at TIMESTAMPTZ,
+    musicbrainz_match_score REAL,
+    musicbrainz_recording_id TEXT,
+    spotify_attempts INT NOT NULL DEFAULT 0,
     spotify_checked_at TIMESTAMPTZ,
-    spotify_id TEXT
+    spotify_enrichment_runs_id BIGINT REFERENCES enrichment_runs(id),
+    spotify_id TEXT,
+    spotify_match_score REAL,
+    spotify_match_strategy TEXT,
+    spotify_next_check_at TIMESTAMPTZ,
+    spotify_verified_at TIMESTAMPTZ,
+    CHECK (spotify_attempts >= 0)
 );
 
 ALTER TABLE songs
     ADD CONSTRAINT unique_songs
     UNIQUE (artist, title);
 
+CREATE INDEX songs_normalized_key
+    ON songs (normalized_key);
+
+--
+-- song_aliases
+--
+-- Other spellings that a song has been seen under, either because they
+-- matched an existing song when a playlist was stored or because they were
+-- songs of their own that were merged into another.
+--
+CREATE TABLE song_aliases (
+    id bigserial PRIMARY KEY,
+    songs_id BIGINT NOT NULL REFERENCES songs(id),
+    artist TEXT NOT NULL,
+    title TEXT NOT NULL
+);
+
+ALTER TABLE song_aliases
+    ADD CONSTRAINT unique_song_aliases
+    UNIQUE (artist, title);
+
+--
+-- song_spotify_id_history
+--
+-- Spotify IDs that songs used to have before `dg-verify-spotify-ids` found
+-- that their tracks had changed. A track that Spotify `relinked` to another
+-- one is replaced by it (`replaced_by`), and a song whose track became
+-- `unavailable` loses its ID and is searched for again, never getting the
+-- same track back. Songs whose tracks `dg-audit-spotify-matches` found
+-- `mismatched` lose their IDs too, but can get the same track back if a
+-- search scores it well enough.
+--
+CREATE TABLE song_spotify_id_history (
+    id bigserial PRIMARY KEY,
+    songs_id BIGINT NOT NULL REFERENCES songs(id),
+    spotify_id TEXT NOT NULL,
+    replaced_by TEXT,
+    reason TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    CHECK (reason IN ('mismatched', 'relinked', 'unavailable')),
+    CHECK ((reason = 'relinked') = (replaced_by IS NOT NULL))
+);
+
+CREATE INDEX song_spotify_id_history_songs_id
+    ON song_spotify_id_history (songs_id);
+
+--
+-- song_spotify_overrides
+--
+-- Decisions made by hand about which Spotify track a song gets, made with
+-- `dg-spotify-overrides`. A song can be pinned to a track (`pin`), marked as
+-- not being on Spotify (`not_on_spotify`), or have tracks that must never be
+-- used for it (`reject`). Enrichment respects all of them.
+--
+-- Overrides refer to songs by `normalized_key` rather than by ID so that they
+-- still apply to a song that was merged or stored again from scratch. They're
+-- also exported to `db/spotify_overrides.csv` and imported again whenever the
+-- database is restored so that they survive restoring an older dump.
+--
+CREATE TABLE song_spotify_overrides (
+    id bigserial PRIMARY KEY,
+    normalized_key TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    artist TEXT NOT NULL,
+    title TEXT NOT NULL,
+    spotify_id TEXT,
+    note TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    CHECK (kind IN ('not_on_spotify', 'pin', 'reject')),
+    CHECK ((kind = 'not_on_spotify') = (spotify_id IS NULL))
+);
+
+-- Only one pin or not on Spotify override per song.
+CREATE UNIQUE INDEX song_spotify_overrides_normalized_key_settled
+    ON song_spotify_overrides (normalized_key)
+    WHERE kind IN ('not_on_spotify', 'pin');
+
+CREATE UNIQUE INDEX song_spotify_overrides_normalized_key_rejected
+    ON song_spotify_overrides (normalized_key, spotify_id)
+    WHERE kind = 'reject';
+
+--
+-- spotify_tracks
+--
+-- Metadata on the Spotify tracks that songs have been matched to, stored when
+-- a song is matched by `dg-enrich-songs` or backfilled by
+-- `dg-fetch-spotify-tracks`. Tracks are keyed by Spotify ID rather than
+-- attached to songs because several songs can share a track, and a song's
+-- `spotify_id` may refer to a track that hasn't been fetched yet.
+--
+-- `album_release_date` is as precise as Spotify knows it, so it may be just a
+-- year (`1981`) or a month (`1981-12`). `album_art_url` is a small version of
+-- the album's cover and `isrc` the track's International Standard Recording
+-- Code. Either is NULL if Spotify didn't have one.
+--
+CREATE TABLE spotify_tracks (
+    id bigserial PRIMARY KEY,
+    spotify_id TEXT NOT NULL,
+    name TEXT NOT NULL,
+    album_name TEXT NOT NULL,
+    album_release_date TEXT NOT NULL,
+    album_art_url TEXT,
+    duration_ms INT NOT NULL,
+    explicit BOOLEAN NOT NULL,
+    isrc TEXT,
+    popularity INT NOT NULL,
+    fetched_at TIMESTAMPTZ NOT NULL,
+    CHECK (duration_ms >= 0),
+    CHECK (popularity BETWEEN 0 AND 100)
+);
+
+ALTER TABLE spotify_tracks
+    ADD CONSTRAINT unique_spotify_tracks_spotify_id
+    UNIQUE (spotify_id);
+
+--
+-- spotify_audio_features
+--
+-- Spotify's analysis of how the tracks that songs have been matched to sound,
+-- fetched by `dg-fetch-audio-features` and keyed by Spotify ID like
+-- `spotify_tracks`. `tempo` is in beats per minute, `danceability`, `energy`,
+-- and `valence` (how cheerful a track sounds) are between 0 and 1, `key` is a
+-- pitch class from 0 (C) to 11 (B) or -1 if no key was detected, and `mode`
+-- is 1 for major or 0 for minor.
+--
+CREATE TABLE spotify_audio_features (
+    id bigserial PRIMARY KEY,
+    spotify_id TEXT NOT NULL,
+    tempo REAL NOT NULL,
+    energy REAL NOT NULL,
+    danceability REAL NOT NULL,
+    valence REAL NOT NULL,
+    key SMALLINT NOT NULL,
+    mode SMALLINT NOT NULL,
+    fetched_at TIMESTAMPTZ NOT NULL,
+    CHECK (tempo >= 0),
+    CHECK (energy BETWEEN 0 AND 1),
+    CHECK (danceability BETWEEN 0 AND 1),
+    CHECK (valence BETWEEN 0 AND 1),
+    CHECK (key BETWEEN -1 AND 11),
+    CHECK (mode IN (0, 1))
+);
+
+ALTER TABLE spotify_audio_features
+    ADD CONSTRAINT unique_spotify_audio_features_spotify_id
+    UNIQUE (spotify_id);
+
+--
+-- artists
+--
+-- Artists as Spotify knows them, taken from the tracks that songs have been
+-- matched to. `songs.artist` is free text that can spell the same artist
+-- several ways or credit several of them at once, so rankings by artist go
+-- through these instead wherever a song has been matched.
+--
+-- `genres` come from Spotify's artist endpoint, which `dg-fetch-artists`
+-- calls for artists whose `genres_fetched_at` is NULL. An artist that Spotify
+-- hasn't given any genres has an empty array.
+--
+CREATE TABLE artists (
+    id bigserial PRIMARY KEY,
+    spotify_id TEXT NOT NULL,
+    name TEXT NOT NULL,
+    genres TEXT[] NOT NULL DEFAULT '{}',
+    genres_fetched_at TIMESTAMPTZ
+);
+
+ALTER TABLE artists
+    ADD CONSTRAINT unique_artists_spotify_id
+    UNIQUE (spotify_id);
+
+--
+-- songs_artists
+--
+-- Associates songs with the artists credited on the Spotify track that they
+-- were matched to, in the order that they're credited. `spotify_id` is the
+-- track that a link was made from. A link only counts while it matches the
+-- song's current `spotify_id`, so links left over from a song being matched
+-- to another track are ignored until `dg-fetch-artists` replaces them.
+--
+CREATE TABLE songs_artists (
+    id bigserial PRIMARY KEY,
+    songs_id BIGINT NOT NULL REFERENCES songs(id),
+    artists_id BIGINT NOT NULL REFERENCES artists(id),
+    spotify_id TEXT NOT NULL,
+    position INT NOT NULL,
+    CHECK (position >= 0)
+);
+
+ALTER TABLE songs_artists
+    ADD CONSTRAINT unique_songs_artists
+    UNIQUE (songs_id, artists_id);
+
+--
+-- musicbrainz_recordings
+--
+-- The MusicBrainz recordings that songs have been matched to by
+-- `dg-enrich-musicbrainz`, keyed by the recording's MBID (MusicBrainz
+-- identifier) like `spotify_tracks` are by Spotify ID. `artist` is the
+-- recording's artist credit written out in full and `artist_ids` the MBIDs of
+-- the artists in it, in the order that they're credited.
+--
+CREATE TABLE musicbrainz_recordings (
+    id bigserial PRIMARY KEY,
+    musicbrainz_id TEXT NOT NULL,
+    title TEXT NOT NULL,
+    artist TEXT NOT NULL,
+    artist_ids TEXT[] NOT NULL DEFAULT '{}',
+    fetched_at TIMESTAMPTZ NOT NULL
+);
+
+ALTER TABLE musicbrainz_recordings
+    ADD CONSTRAINT unique_musicbrainz_recordings_musicbrainz_id
+    UNIQUE (musicbrainz_id);
+
 --
 -- playlists_songs
 --
 -- Associates playlists with songs and includes a position to track the order
--- of songs played.
+-- of songs played. Every play gets its own position, so a song that was
+-- played more than once in the same night (an encore for example) has a row
+-- for each time.
 --
 CREATE TABLE playlists_songs (
     id bigserial PRIMARY KEY,
@@ -80,8 +472,4 @@ ALTER TABLE playlists_songs
     ADD CONSTRAINT unique_playlists_positions
     UNIQUE (playlists_id, position);
 
-ALTER TABLE playlists_songs
-    ADD CONSTRAINT unique_playlists_songs
-    UNIQUE (playlists_id, songs_id);
-
 COMMIT;
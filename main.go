@@ -5,6 +5,7 @@ import (
 	"os"
 	"strings"
 
+	"github.com/brandur/deathguild/modules/dgsource"
 	"github.com/brandur/modulir"
 	"github.com/joeshaw/envdecode"
 	"github.com/sirupsen/logrus"
@@ -61,6 +62,13 @@ Runs the build loop one time and places the result in TARGET_DIR
 		os.Exit(1)
 	}
 
+	var err error
+	source, err = dgsource.Get(conf.Source)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error looking up source: %v", err)
+		os.Exit(1)
+	}
+
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Fprintf(os.Stderr, "Error executing command: %v", err)
 		os.Exit(1)
@@ -81,6 +89,10 @@ Runs the build loop one time and places the result in TARGET_DIR
 // very many places and can probably be refactored as a local if desired.
 var conf Conf
 
+// The source that the site is being built for. Derived from conf and kept as
+// a global for the same reasons.
+var source dgsource.Source
+
 //////////////////////////////////////////////////////////////////////////////
 //
 //
@@ -119,6 +131,10 @@ type Conf struct {
 	// Port is the port on which to serve HTTP when looping in development.
 	Port int `env:"PORT,default=5004"`
 
+	// Source is the name of the source whose playlists the site is built
+	// for.
+	Source string `env:"SOURCE,default=deathguild"`
+
 	// SpotifyUser is the name of the Spotify user who owns the Death Guild
 	// playlists. This is used to generate links.
 	SpotifyUser string `env:"SPOTIFY_USER,required"`
@@ -0,0 +1,168 @@
+package dgchart
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"math"
+	"strings"
+)
+
+// Padding around the area that lines are drawn in, leaving room for labels.
+const (
+	paddingBottom = 20
+	paddingLeft   = 40
+	paddingRight  = 40
+	paddingTop    = 20
+)
+
+// Series is a line on a chart.
+type Series struct {
+	// Class is the CSS class given to the line so that it can be styled.
+	Class string
+
+	// Label is shown in the chart's legend.
+	Label string
+
+	// Min and Max are the values that map to the bottom and top of the chart.
+	// Values outside of them are clamped.
+	Min float64
+	Max float64
+
+	// Values are the points on the line, spaced out evenly from left to right.
+	// A value of NaN is a point that's missing, which leaves a gap in the
+	// line.
+	Values []float64
+}
+
+// Lines renders series as lines on an inline SVG chart of the given size.
+// The first series is labeled with its range on the left axis and the second
+// on the right one. It returns an empty string if there's nothing to draw.
+func Lines(title string, width, height int, series ...*Series) template.HTML {
+	var numPoints int
+	for _, s := range series {
+		if len(s.Values) > numPoints {
+			numPoints = len(s.Values)
+		}
+	}
+
+	if numPoints == 0 {
+		return ""
+	}
+
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, `<svg class="chart" xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" role="img">`,
+		width, height)
+	fmt.Fprintf(&b, `<title>%s</title>`, template.HTMLEscapeString(title))
+
+	bottom := float64(height - paddingBottom)
+	fmt.Fprintf(&b, `<line class="axis" x1="%d" y1="%s" x2="%d" y2="%s"/>`,
+		paddingLeft, formatFloat(bottom), width-paddingRight, formatFloat(bottom))
+
+	for i, s := range series {
+		points := s.points(numPoints, width, height)
+
+		for _, run := range runs(points) {
+			if len(run) == 1 {
+				fmt.Fprintf(&b, `<circle class="%s" cx="%s" cy="%s" r="2"/>`,
+					s.Class, formatFloat(run[0][0]), formatFloat(run[0][1]))
+				continue
+			}
+
+			coords := make([]string, len(run))
+			for j, p := range run {
+				coords[j] = formatFloat(p[0]) + "," + formatFloat(p[1])
+			}
+			fmt.Fprintf(&b, `<polyline class="%s" points="%s"/>`,
+				s.Class, strings.Join(coords, " "))
+		}
+
+		switch i {
+		case 0:
+			writeAxisLabels(&b, s, paddingLeft-5, "end", height)
+		case 1:
+			writeAxisLabels(&b, s, width-paddingRight+5, "start", height)
+		}
+
+		fmt.Fprintf(&b, `<text class="legend %s" x="%d" y="%d">%s</text>`,
+			s.Class, paddingLeft+i*100, paddingTop-8, template.HTMLEscapeString(s.Label))
+	}
+
+	b.WriteString(`</svg>`)
+
+	return template.HTML(b.String())
+}
+
+// points returns the position of each of the series' values on a chart of
+// the given size, or nil for missing values.
+func (s *Series) points(numPoints, width, height int) []*[2]float64 {
+	left := float64(paddingLeft)
+	right := float64(width - paddingRight)
+	top := float64(paddingTop)
+	bottom := float64(height - paddingBottom)
+
+	step := 0.0
+	if numPoints > 1 {
+		step = (right - left) / float64(numPoints-1)
+	}
+
+	points := make([]*[2]float64, len(s.Values))
+	for i, v := range s.Values {
+		if math.IsNaN(v) {
+			continue
+		}
+
+		ratio := 0.0
+		if s.Max > s.Min {
+			ratio = (math.Max(s.Min, math.Min(s.Max, v)) - s.Min) / (s.Max - s.Min)
+		}
+
+		points[i] = &[2]float64{left + step*float64(i), bottom - ratio*(bottom-top)}
+	}
+
+	return points
+}
+
+// formatFloat formats a coordinate compactly, with at most one decimal place.
+func formatFloat(f float64) string {
+	s := fmt.Sprintf("%.1f", f)
+	return strings.TrimSuffix(s, ".0")
+}
+
+// runs splits points into runs of consecutive points that aren't missing.
+func runs(points []*[2]float64) [][][2]float64 {
+	var runs [][][2]float64
+	var run [][2]float64
+
+	for _, p := range points {
+		if p == nil {
+			if len(run) > 0 {
+				runs = append(runs, run)
+				run = nil
+			}
+			continue
+		}
+		run = append(run, *p)
+	}
+
+	if len(run) > 0 {
+		runs = append(runs, run)
+	}
+
+	return runs
+}
+
+// writeAxisLabels labels the top and bottom of an axis with a series' range.
+func writeAxisLabels(b *bytes.Buffer, s *Series, x int, anchor string, height int) {
+	for _, label := range []struct {
+		value float64
+		y     int
+	}{
+		{s.Max, paddingTop + 4},
+		{s.Min, height - paddingBottom + 4},
+	} {
+		fmt.Fprintf(b, `<text class="axis-label %s" x="%d" y="%d" text-anchor="%s">%s</text>`,
+			s.Class, x, label.y, anchor, formatFloat(label.value))
+	}
+}
@@ -0,0 +1,61 @@
+package dgchart
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestLines(t *testing.T) {
+	assert.Equal(t, "", string(Lines("Nothing", 200, 100)))
+	assert.Equal(t, "", string(Lines("Nothing", 200, 100, &Series{})))
+
+	chart := string(Lines("Tempo & energy", 200, 100,
+		&Series{
+			Class:  "tempo",
+			Label:  "Tempo",
+			Min:    60,
+			Max:    200,
+			Values: []float64{60, 200, 130},
+		},
+		&Series{
+			Class:  "energy",
+			Label:  "Energy",
+			Min:    0,
+			Max:    1,
+			Values: []float64{0.5, math.NaN(), 2},
+		},
+	))
+
+	assert.True(t, strings.HasPrefix(chart, `<svg class="chart"`))
+	assert.Contains(t, chart, `<title>Tempo &amp; energy</title>`)
+
+	// Values are spread across the chart between its padding and scaled to
+	// the series' range.
+	assert.Contains(t, chart, `<polyline class="tempo" points="40,80 100,20 160,50"/>`)
+
+	// A missing value leaves a gap, so points on their own are drawn as dots
+	// and values past the range are clamped.
+	assert.Contains(t, chart, `<circle class="energy" cx="40" cy="50" r="2"/>`)
+	assert.Contains(t, chart, `<circle class="energy" cx="160" cy="20" r="2"/>`)
+	assert.NotContains(t, chart, `<polyline class="energy"`)
+
+	// The first two series label the left and right axes.
+	assert.Contains(t, chart, `<text class="axis-label tempo" x="35" y="24" text-anchor="end">200</text>`)
+	assert.Contains(t, chart, `<text class="axis-label energy" x="165" y="84" text-anchor="start">0</text>`)
+	assert.Contains(t, chart, `<text class="legend energy" x="140" y="12">Energy</text>`)
+}
+
+func TestRuns(t *testing.T) {
+	p := func(x float64) *[2]float64 { return &[2]float64{x, 0} }
+
+	assert.Equal(t, 0, len(runs(nil)))
+	assert.Equal(t, 0, len(runs([]*[2]float64{nil, nil})))
+
+	assert.Equal(t, [][][2]float64{
+		{{1, 0}, {2, 0}},
+		{{4, 0}},
+	}, runs([]*[2]float64{p(1), p(2), nil, p(4), nil}))
+}
@@ -18,6 +18,10 @@ type Playlist struct {
 	// Songs is an ordered set of songs contained by the playlist.
 	Songs []*Song
 
+	// Source is the name of the source that the playlist was ingested from
+	// (e.g. `deathguild`).
+	Source string
+
 	// SpotifyID is the canonical ID of the playlist that we created in
 	// Spotify.
 	SpotifyID string
@@ -29,16 +33,26 @@ func (p *Playlist) FormattedDay() string {
 }
 
 // FetchSongs populates the playlist's songs collection from the database.
+// Songs come back once for every time that they were played, so a song that
+// was played twice in the same night appears twice at its respective
+// positions. Songs whose Spotify track or audio features have been fetched
+// come with them.
 func (p *Playlist) FetchSongs(txn *sql.Tx) error {
 	// Add one to position to make it 1-indexed as people are more used to
 	// that.
 	rows, err := txn.Query(`
-		SELECT s.id, (position + 1), artist, title, spotify_checked_at, spotify_id
+		SELECT s.id, (ps.position + 1), s.artist, s.title,
+			s.spotify_checked_at, s.spotify_id,
+			t.name, t.album_name, t.album_release_date, t.album_art_url,
+			t.duration_ms, t.explicit, t.isrc, t.popularity,
+			f.danceability, f.energy, f.key, f.mode, f.tempo, f.valence
 		FROM playlists_songs ps
 		INNER JOIN songs s ON ps.songs_id = s.id
+		LEFT JOIN spotify_tracks t ON t.spotify_id = s.spotify_id
+		LEFT JOIN spotify_audio_features f ON f.spotify_id = s.spotify_id
 		WHERE ps.playlists_id = $1
-			AND spotify_id IS NOT NULL
-		ORDER BY position`,
+			AND s.spotify_id IS NOT NULL
+		ORDER BY ps.position`,
 		p.ID,
 	)
 	if err != nil {
@@ -51,6 +65,13 @@ func (p *Playlist) FetchSongs(txn *sql.Tx) error {
 		var spotifyCheckedAt *time.Time
 		var spotifyID *string
 
+		var trackName, albumName, albumReleaseDate, albumArtURL, isrc *string
+		var durationMS, popularity *int
+		var explicit *bool
+
+		var danceability, energy, tempo, valence *float64
+		var key, mode *int
+
 		err = rows.Scan(
 			&song.ID,
 			&song.Position,
@@ -58,6 +79,20 @@ func (p *Playlist) FetchSongs(txn *sql.Tx) error {
 			&song.Title,
 			&spotifyCheckedAt,
 			&spotifyID,
+			&trackName,
+			&albumName,
+			&albumReleaseDate,
+			&albumArtURL,
+			&durationMS,
+			&explicit,
+			&isrc,
+			&popularity,
+			&danceability,
+			&energy,
+			&key,
+			&mode,
+			&tempo,
+			&valence,
 		)
 		if err != nil {
 			return err
@@ -71,12 +106,57 @@ func (p *Playlist) FetchSongs(txn *sql.Tx) error {
 			song.SpotifyID = *spotifyID
 		}
 
+		// The track's name is never NULL, so if it is then there's no track.
+		if trackName != nil {
+			song.SpotifyTrack = &SpotifyTrack{
+				AlbumName:        *albumName,
+				AlbumReleaseDate: *albumReleaseDate,
+				Duration:         time.Duration(*durationMS) * time.Millisecond,
+				Explicit:         *explicit,
+				ID:               song.SpotifyID,
+				Name:             *trackName,
+				Popularity:       *popularity,
+			}
+
+			if albumArtURL != nil {
+				song.SpotifyTrack.AlbumArtURL = *albumArtURL
+			}
+
+			if isrc != nil {
+				song.SpotifyTrack.ISRC = *isrc
+			}
+		}
+
+		// Likewise for audio features and their tempo.
+		if tempo != nil {
+			song.SpotifyAudioFeatures = &AudioFeatures{
+				Danceability: *danceability,
+				Energy:       *energy,
+				Key:          *key,
+				Major:        *mode == 1,
+				Tempo:        *tempo,
+				Valence:      *valence,
+			}
+		}
+
 		p.Songs = append(p.Songs, &song)
 	}
 
 	return nil
 }
 
+// RunningTime is the total length of the playlist's songs according to
+// Spotify. Songs whose track hasn't been fetched don't count toward it.
+func (p *Playlist) RunningTime() time.Duration {
+	var total time.Duration
+	for _, song := range p.Songs {
+		if song.SpotifyTrack != nil {
+			total += song.SpotifyTrack.Duration
+		}
+	}
+	return total
+}
+
 // Song is an artist/title pair that we've extracted from a playlist.
 type Song struct {
 	// Artist is the name of the song's artist.
@@ -85,18 +165,150 @@ type Song struct {
 	// ID is the local database identifier of the song.
 	ID int
 
+	// MusicBrainzCheckedAt is the last time we tried to find the song on
+	// MusicBrainz.
+	MusicBrainzCheckedAt time.Time
+
+	// MusicBrainzMatchScore is how closely the recording that
+	// MusicBrainzRecordingID was taken from matched the song (see dgmatch).
+	MusicBrainzMatchScore float64
+
+	// MusicBrainzRecordingID is the MBID of the song's recording according
+	// to MusicBrainz.
+	MusicBrainzRecordingID string
+
 	// Position is the track number of a song within a playlist.
 	Position int
 
 	// Title is the title of the song.
 	Title string
 
+	// SpotifyAttempts is the number of times in a row that we've searched
+	// Spotify for the song without finding it.
+	SpotifyAttempts int
+
 	// SpotifyCheckedAt is the last time we tried to pull information on the
 	// track from Spotify.
 	SpotifyCheckedAt time.Time
 
+	// SpotifyEnrichmentRunID is the ID of the dg-enrich-songs run that last
+	// searched for the song on Spotify, or zero if none did.
+	SpotifyEnrichmentRunID int
+
 	// SpotifyID is the canonical ID of the song according to Spotify.
 	SpotifyID string
+
+	// SpotifyMatchScore is how closely the track that SpotifyID was taken
+	// from matched the song when it was picked out of Spotify's search
+	// results (see dgmatch).
+	SpotifyMatchScore float64
+
+	// SpotifyMatchStrategy is the name of the search strategy that found the
+	// track that SpotifyID was taken from.
+	SpotifyMatchStrategy string
+
+	// SpotifyNextCheckAt is when the song is due to be searched for on
+	// Spotify again if it wasn't found.
+	SpotifyNextCheckAt time.Time
+
+	// SpotifyAudioFeatures is Spotify's analysis of how the track with the
+	// song's SpotifyID sounds. It's nil if it hasn't been fetched.
+	SpotifyAudioFeatures *AudioFeatures
+
+	// SpotifyTrack is what Spotify has to say about the track with the
+	// song's SpotifyID. It's nil if the track hasn't been fetched.
+	SpotifyTrack *SpotifyTrack
+}
+
+// Artist is an artist as Spotify knows them.
+type Artist struct {
+	// Genres are the genres that Spotify puts the artist in. They're only
+	// known once the artist has been fetched from Spotify's artist endpoint
+	// rather than just seen credited on a track.
+	Genres []string
+
+	// Name is the artist's name according to Spotify.
+	Name string
+
+	// SpotifyID is the canonical ID of the artist according to Spotify.
+	SpotifyID string
+}
+
+// Names of pitch classes, indexed by their number.
+var pitchClasses = []string{
+	"C", "C♯", "D", "D♯", "E", "F", "F♯", "G", "G♯", "A", "A♯", "B",
+}
+
+// AudioFeatures is Spotify's analysis of how a track sounds.
+type AudioFeatures struct {
+	// Danceability is how suitable the track is for dancing from 0 to 1.
+	Danceability float64
+
+	// Energy is how intense and active the track feels from 0 to 1.
+	Energy float64
+
+	// Key is the key that the track is in as a pitch class from 0 (C) to 11
+	// (B), or -1 if no key was detected.
+	Key int
+
+	// Major is true if the track is in a major key and false if it's in a
+	// minor one.
+	Major bool
+
+	// Tempo is the track's tempo in beats per minute.
+	Tempo float64
+
+	// Valence is how cheerful the track sounds from 0 to 1.
+	Valence float64
+}
+
+// KeyName returns the name of the track's key like "C♯ minor", or an empty
+// string if no key was detected.
+func (f *AudioFeatures) KeyName() string {
+	if f.Key < 0 || f.Key >= len(pitchClasses) {
+		return ""
+	}
+
+	if f.Major {
+		return pitchClasses[f.Key] + " major"
+	}
+	return pitchClasses[f.Key] + " minor"
+}
+
+// SpotifyTrack is metadata on a Spotify track.
+type SpotifyTrack struct {
+	// AlbumArtURL is the URL of a small version of the cover of the album
+	// that the track is on. It's empty if the album doesn't have one.
+	AlbumArtURL string
+
+	// AlbumName is the name of the album that the track is on.
+	AlbumName string
+
+	// AlbumReleaseDate is when the album was released as given by Spotify,
+	// which may be just a year (`1981`), a month (`1981-12`), or a day
+	// (`1981-12-04`).
+	AlbumReleaseDate string
+
+	// Duration is the length of the track.
+	Duration time.Duration
+
+	// Explicit is whether the track has explicit lyrics.
+	Explicit bool
+
+	// ID is the canonical ID of the track according to Spotify.
+	ID string
+
+	// ISRC is the track's International Standard Recording Code. It's empty
+	// if Spotify doesn't know it.
+	ISRC string
+
+	// Name is the name of the track, which isn't necessarily written the
+	// same way as the title of the song that it was matched to.
+	Name string
+
+	// Popularity is Spotify's measure of how popular the track is from 0 to
+	// 100.
+	Popularity int
 }
 
 // ExitWithError prints the given error to stderr and exits with a status of 1.
@@ -7,6 +7,12 @@ import (
 	assert "github.com/stretchr/testify/require"
 )
 
+func TestAudioFeaturesKeyName(t *testing.T) {
+	assert.Equal(t, "C major", (&AudioFeatures{Key: 0, Major: true}).KeyName())
+	assert.Equal(t, "F♯ minor", (&AudioFeatures{Key: 6}).KeyName())
+	assert.Equal(t, "", (&AudioFeatures{Key: -1}).KeyName())
+}
+
 func TestPlaylistFormattedDay(t *testing.T) {
 	const longForm = "Jan 2, 2006 at 3:04pm (MST)"
 	day, err := time.Parse(longForm, "Feb 3, 2013 at 7:54pm (PST)")
@@ -15,3 +21,14 @@ func TestPlaylistFormattedDay(t *testing.T) {
 	p := Playlist{Day: day}
 	assert.Equal(t, "2013-02-03", p.FormattedDay())
 }
+
+func TestPlaylistRunningTime(t *testing.T) {
+	p := Playlist{
+		Songs: []*Song{
+			{SpotifyTrack: &SpotifyTrack{Duration: 4 * time.Minute}},
+			{},
+			{SpotifyTrack: &SpotifyTrack{Duration: 5*time.Minute + 30*time.Second}},
+		},
+	}
+	assert.Equal(t, 9*time.Minute+30*time.Second, p.RunningTime())
+}
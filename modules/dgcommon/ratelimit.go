@@ -0,0 +1,208 @@
+package dgcommon
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MaxBackoff is the longest that Backoff will have a caller wait between
+// retries.
+const MaxBackoff = 60 * time.Second
+
+// The longest that a limiter slowed down by Pause will space operations
+// out to, and the shortest that it will start at if it wasn't limiting at
+// all.
+const (
+	maxAdaptiveInterval = 10 * time.Second
+	minAdaptiveInterval = 100 * time.Millisecond
+)
+
+// Recover closes a slowed down limiter's gap to its configured rate by
+// 1/recoverySteps at a time, so it takes about that many successful
+// operations to recover most of the way. Once the gap is smaller than
+// minRecoveryGap it's closed entirely rather than shrinking forever.
+const (
+	recoverySteps  = 10
+	minRecoveryGap = time.Millisecond
+)
+
+// RateLimiter spaces out operations so that no more than a fixed number of
+// them start per second. It's safe to share between Goroutines, so a single
+// limiter can cap the total rate across all of a pool's workers.
+//
+// The rate can also adapt to a server that's telling us to slow down: Pause
+// holds all operations for a time and halves the rate, which then climbs back
+// up toward the configured one with every call to Recover.
+type RateLimiter struct {
+	// interval is the current time between operations. It's minInterval
+	// unless the limiter has been slowed down by Pause.
+	interval    time.Duration
+	minInterval time.Duration
+
+	mu          sync.Mutex
+	next        time.Time
+	pausedUntil time.Time
+
+	// numRateLimited counts the responses that a server rate limited. See
+	// NumRateLimited.
+	numRateLimited int
+
+	// sleep is swappable so that tests don't actually have to wait.
+	sleep func(time.Duration)
+}
+
+// NewRateLimiter returns a limiter allowing perSecond operations per second.
+// A value of zero or less disables limiting until the limiter is paused.
+func NewRateLimiter(perSecond float64) *RateLimiter {
+	var interval time.Duration
+	if perSecond > 0 {
+		interval = time.Duration(float64(time.Second) / perSecond)
+	}
+
+	return &RateLimiter{interval: interval, minInterval: interval, sleep: time.Sleep}
+}
+
+// Interval returns the current time between operations.
+func (l *RateLimiter) Interval() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.interval
+}
+
+// NumRateLimited returns the number of times that a RateLimitedTransport
+// using the limiter got back a rate limited response, including those that
+// were given up on instead of retried.
+func (l *RateLimiter) NumRateLimited() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.numRateLimited
+}
+
+// Pause holds up every operation for at least d and halves the rate from
+// then on. Pauses that come in while one is already in effect only extend
+// it, so a burst of workers being told to slow down at the same time slows
+// the limiter down once rather than once per worker.
+func (l *RateLimiter) Pause(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+
+	if !now.Before(l.pausedUntil) {
+		l.interval *= 2
+		if l.interval < minAdaptiveInterval {
+			l.interval = minAdaptiveInterval
+		}
+		if l.interval > maxAdaptiveInterval {
+			l.interval = maxAdaptiveInterval
+		}
+	}
+
+	if resume := now.Add(d); resume.After(l.pausedUntil) {
+		l.pausedUntil = resume
+	}
+}
+
+// Recover notes that an operation went through without being told to slow
+// down, bringing the rate a step back toward the configured one.
+func (l *RateLimiter) Recover() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	gap := l.interval - l.minInterval
+	if gap < minRecoveryGap {
+		l.interval = l.minInterval
+		return
+	}
+
+	l.interval -= gap / recoverySteps
+}
+
+// rateLimited notes that a server rate limited a request.
+func (l *RateLimiter) rateLimited() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.numRateLimited++
+}
+
+// Wait blocks until the caller is allowed to perform an operation.
+func (l *RateLimiter) Wait() {
+	for {
+		l.mu.Lock()
+
+		now := time.Now()
+		start := l.next
+		if start.Before(l.pausedUntil) {
+			start = l.pausedUntil
+		}
+		if start.Before(now) {
+			start = now
+		}
+		l.next = start.Add(l.interval)
+
+		l.mu.Unlock()
+
+		// Sleep outside the lock. Each caller has already reserved its own
+		// slot above, so there's no need to hold up the others while it
+		// waits.
+		if d := start.Sub(now); d > 0 {
+			l.sleep(d)
+		}
+
+		// If a pause started while we were waiting then our slot is no good
+		// anymore. Get in line for a new one.
+		l.mu.Lock()
+		paused := start.Before(l.pausedUntil)
+		l.mu.Unlock()
+
+		if !paused {
+			return
+		}
+	}
+}
+
+// Backoff returns how long to wait before retrying after the given
+// (0-indexed) attempt failed. It doubles with every attempt starting from
+// one second, with up to half again added as jitter so that workers that
+// failed together don't all retry together.
+func Backoff(attempt int) time.Duration {
+	d := time.Second << uint(attempt)
+	if d > MaxBackoff || d <= 0 {
+		d = MaxBackoff
+	}
+
+	return d + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// RetryAfter parses the value of a `Retry-After` header, which may be either
+// a number of seconds or an HTTP date. The boolean is false if the header was
+// empty or couldn't be parsed.
+func RetryAfter(header string, now time.Time) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	t, err := http.ParseTime(header)
+	if err != nil {
+		return 0, false
+	}
+
+	d := t.Sub(now)
+	if d < 0 {
+		d = 0
+	}
+	return d, true
+}
@@ -0,0 +1,130 @@
+package dgcommon
+
+import (
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var slept time.Duration
+
+	limiter := NewRateLimiter(2)
+	limiter.sleep = func(d time.Duration) { slept += d }
+
+	// The first operation goes right away, and each one after has to wait
+	// for the one before.
+	limiter.Wait()
+	assert.Equal(t, time.Duration(0), slept)
+
+	limiter.Wait()
+	limiter.Wait()
+	assert.InDelta(t, float64(1500*time.Millisecond), float64(slept),
+		float64(100*time.Millisecond))
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	var slept time.Duration
+
+	limiter := NewRateLimiter(0)
+	limiter.sleep = func(d time.Duration) { slept += d }
+
+	limiter.Wait()
+	limiter.Wait()
+	assert.Equal(t, time.Duration(0), slept)
+}
+
+func TestRateLimiterPause(t *testing.T) {
+	var slept time.Duration
+
+	limiter := NewRateLimiter(2)
+	limiter.sleep = func(d time.Duration) { slept += d }
+
+	// Operations wait out the pause, and the rate is halved once no matter
+	// how many pauses come in while it's in effect.
+	limiter.Pause(5 * time.Second)
+	limiter.Pause(3 * time.Second)
+	assert.Equal(t, 1*time.Second, limiter.Interval())
+
+	limiter.Wait()
+	assert.InDelta(t, float64(5*time.Second), float64(slept),
+		float64(100*time.Millisecond))
+
+	// Each success brings the rate a step back toward where it started.
+	limiter.Recover()
+	assert.Equal(t, 950*time.Millisecond, limiter.Interval())
+
+	for i := 0; i < 1000; i++ {
+		limiter.Recover()
+	}
+	assert.Equal(t, 500*time.Millisecond, limiter.Interval())
+
+	// A gap too small to be worth closing a step at a time is closed all at
+	// once.
+	limiter.interval = 500*time.Millisecond + minRecoveryGap*recoverySteps
+	limiter.Recover()
+	assert.Equal(t, 500*time.Millisecond+(minRecoveryGap*recoverySteps)*9/10,
+		limiter.Interval())
+
+	limiter.interval = 500*time.Millisecond + minRecoveryGap - 1
+	limiter.Recover()
+	assert.Equal(t, 500*time.Millisecond, limiter.Interval())
+}
+
+func TestRateLimiterPauseDisabled(t *testing.T) {
+	var slept time.Duration
+
+	limiter := NewRateLimiter(0)
+	limiter.sleep = func(d time.Duration) { slept += d }
+
+	// Even a limiter that wasn't limiting slows down when paused.
+	limiter.Pause(0)
+	assert.Equal(t, minAdaptiveInterval, limiter.Interval())
+
+	// And slowing down never goes past a ceiling.
+	for i := 0; i < 20; i++ {
+		limiter.pausedUntil = time.Time{}
+		limiter.Pause(0)
+	}
+	assert.Equal(t, maxAdaptiveInterval, limiter.Interval())
+
+	for i := 0; i < 1000; i++ {
+		limiter.Recover()
+	}
+	assert.Equal(t, time.Duration(0), limiter.Interval())
+}
+
+func TestBackoff(t *testing.T) {
+	d := Backoff(0)
+	assert.True(t, d >= 1*time.Second && d <= 1500*time.Millisecond)
+
+	d = Backoff(2)
+	assert.True(t, d >= 4*time.Second && d <= 6*time.Second)
+
+	d = Backoff(100)
+	assert.True(t, d >= MaxBackoff && d <= MaxBackoff*3/2)
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2018, 7, 20, 12, 0, 0, 0, time.UTC)
+
+	d, ok := RetryAfter("120", now)
+	assert.True(t, ok)
+	assert.Equal(t, 120*time.Second, d)
+
+	d, ok = RetryAfter("Fri, 20 Jul 2018 12:00:30 GMT", now)
+	assert.True(t, ok)
+	assert.Equal(t, 30*time.Second, d)
+
+	// A date in the past means go right away.
+	d, ok = RetryAfter("Fri, 20 Jul 2018 11:00:00 GMT", now)
+	assert.True(t, ok)
+	assert.Equal(t, time.Duration(0), d)
+
+	_, ok = RetryAfter("", now)
+	assert.False(t, ok)
+
+	_, ok = RetryAfter("soon", now)
+	assert.False(t, ok)
+}
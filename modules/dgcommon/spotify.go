@@ -1,10 +1,12 @@
 package dgcommon
 
 import (
+	"context"
 	"crypto/tls"
 	"net/http"
 	"time"
 
+	"github.com/brandur/modulir"
 	"github.com/zmb3/spotify"
 	"golang.org/x/oauth2"
 )
@@ -12,12 +14,39 @@ import (
 // GetSpotifyClient returns a client that should be immediately useful for
 // use. It takes advantage of the fact that we can just refresh right away to
 // get a valid access token.
-func GetSpotifyClient(clientID, clientSecret, refreshToken string) *spotify.Client {
-	// Disables HTTP/2 support. It seems that Spotify might think that it
-	// supports it, but we're unable to properly open a stream (as of January
-	// 2017). Kill it off for now with the possibility of re-enabling it later.
-	http.DefaultTransport.(*http.Transport).TLSNextProto =
-		map[string]func(authority string, c *tls.Conn) http.RoundTripper{}
+//
+// Every request that the client makes goes through a RateLimitedTransport
+// using the given limiter, so a single client can be shared by all of a
+// pool's workers and have them all back off together when Spotify tells us
+// to slow down.
+func GetSpotifyClient(clientID, clientSecret, refreshToken string,
+	limiter *RateLimiter, maxRetries int, log modulir.LoggerInterface) *SpotifyClient {
+
+	return NewSpotifyClient(GetSpotifyHTTPClient(
+		clientID, clientSecret, refreshToken, limiter, maxRetries, log),
+		SpotifyBaseURL)
+}
+
+// GetSpotifyHTTPClient returns the authenticated and rate limited HTTP client
+// that GetSpotifyClient is built on. It's for calling the Web API directly
+// where SpotifyClient doesn't support what we need.
+func GetSpotifyHTTPClient(clientID, clientSecret, refreshToken string,
+	limiter *RateLimiter, maxRetries int, log modulir.LoggerInterface) *http.Client {
+
+	transport := &RateLimitedTransport{
+		// Disables HTTP/2 support. It seems that Spotify might think that it
+		// supports it, but we're unable to properly open a stream (as of
+		// January 2017). Kill it off for now with the possibility of
+		// re-enabling it later.
+		Base: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			TLSNextProto: map[string]func(authority string,
+				c *tls.Conn) http.RoundTripper{},
+		},
+		Limiter:    limiter,
+		Log:        log,
+		MaxRetries: maxRetries,
+	}
 
 	// So as not to introduce a web flow into this program, we cheat a bit here
 	// by just using a refresh token and not an access token (because access
@@ -29,8 +58,82 @@ func GetSpotifyClient(clientID, clientSecret, refreshToken string) *spotify.Clie
 
 	// See comment above. We've already procured the first access/refresh token
 	// pair outside of this program, so no redirect URL is necessary.
-	authenticator := spotify.NewAuthenticator("no-redirect-url")
-	authenticator.SetAuthInfo(clientID, clientSecret)
-	client := authenticator.NewClient(token)
-	return &client
+	config := &oauth2.Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  spotify.AuthURL,
+			TokenURL: spotify.TokenURL,
+		},
+	}
+
+	// OAuth2 wraps the transport that it finds in the context, so both API
+	// calls and token refreshes are rate limited.
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient,
+		&http.Client{Transport: transport})
+
+	return config.Client(ctx, token)
+}
+
+// NewArtists extracts the artists credited on a track returned by the Spotify
+// API, in the order that they're credited.
+func NewArtists(artists []spotify.SimpleArtist) []*Artist {
+	converted := make([]*Artist, len(artists))
+	for i, artist := range artists {
+		converted[i] = &Artist{Name: artist.Name, SpotifyID: string(artist.ID)}
+	}
+	return converted
+}
+
+// NewAudioFeatures extracts the audio features that we keep on a track from
+// those returned by the Spotify API.
+func NewAudioFeatures(features *spotify.AudioFeatures) *AudioFeatures {
+	return &AudioFeatures{
+		Danceability: float64(features.Danceability),
+		Energy:       float64(features.Energy),
+		Key:          features.Key,
+		Major:        features.Mode == int(spotify.Major),
+		Tempo:        float64(features.Tempo),
+		Valence:      float64(features.Valence),
+	}
+}
+
+// The smallest album art that's still big enough to be shown next to a song.
+const minAlbumArtWidth = 64
+
+// NewSpotifyTrack extracts the metadata that we keep on a track from a track
+// returned by the Spotify API.
+func NewSpotifyTrack(track *spotify.FullTrack) *SpotifyTrack {
+	return &SpotifyTrack{
+		AlbumArtURL:      albumArtURL(track.Album.Images),
+		AlbumName:        track.Album.Name,
+		AlbumReleaseDate: track.Album.ReleaseDate,
+		Duration:         time.Duration(track.Duration) * time.Millisecond,
+		Explicit:         track.Explicit,
+		ID:               string(track.ID),
+		ISRC:             track.ExternalIDs["isrc"],
+		Name:             track.Name,
+		Popularity:       track.Popularity,
+	}
+}
+
+// albumArtURL picks the smallest of an album's images that's at least
+// minAlbumArtWidth wide, or the biggest one if none of them are.
+func albumArtURL(images []spotify.Image) string {
+	var best *spotify.Image
+	for i, image := range images {
+		switch {
+		case best == nil:
+			best = &images[i]
+		case best.Width < minAlbumArtWidth && image.Width > best.Width:
+			best = &images[i]
+		case image.Width >= minAlbumArtWidth && image.Width < best.Width:
+			best = &images[i]
+		}
+	}
+
+	if best == nil {
+		return ""
+	}
+	return best.URL
 }
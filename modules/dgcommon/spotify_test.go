@@ -1,3 +1,90 @@
 package dgcommon
 
-// Testing stub in case we add anything more significant to the file.
+import (
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+	"github.com/zmb3/spotify"
+)
+
+func TestNewArtists(t *testing.T) {
+	assert.Equal(t, []*Artist{
+		{Name: "Covenant", SpotifyID: "covenant-id"},
+		{Name: "Necro Facility", SpotifyID: "necro-facility-id"},
+	}, NewArtists([]spotify.SimpleArtist{
+		{Name: "Covenant", ID: "covenant-id"},
+		{Name: "Necro Facility", ID: "necro-facility-id"},
+	}))
+}
+
+func TestNewAudioFeatures(t *testing.T) {
+	features := NewAudioFeatures(&spotify.AudioFeatures{
+		Danceability: 0.5,
+		Energy:       0.75,
+		Key:          9,
+		Mode:         int(spotify.Minor),
+		Tempo:        128,
+		Valence:      0.25,
+	})
+
+	assert.Equal(t, &AudioFeatures{
+		Danceability: 0.5,
+		Energy:       0.75,
+		Key:          9,
+		Major:        false,
+		Tempo:        128,
+		Valence:      0.25,
+	}, features)
+	assert.Equal(t, "A minor", features.KeyName())
+}
+
+func TestNewSpotifyTrack(t *testing.T) {
+	track := &spotify.FullTrack{
+		SimpleTrack: spotify.SimpleTrack{
+			Duration: 354000,
+			Explicit: false,
+			ID:       "1JSLLcD4RKl8TZwBNhV5UX",
+			Name:     "A Forest",
+		},
+		Album: spotify.SimpleAlbum{
+			Name:        "Seventeen Seconds",
+			ReleaseDate: "1980-04-22",
+			Images: []spotify.Image{
+				{URL: "https://i.scdn.co/image/640", Width: 640},
+				{URL: "https://i.scdn.co/image/300", Width: 300},
+				{URL: "https://i.scdn.co/image/64", Width: 64},
+			},
+		},
+		ExternalIDs: map[string]string{"isrc": "GBAKW8000015"},
+		Popularity:  62,
+	}
+
+	assert.Equal(t, &SpotifyTrack{
+		AlbumArtURL:      "https://i.scdn.co/image/64",
+		AlbumName:        "Seventeen Seconds",
+		AlbumReleaseDate: "1980-04-22",
+		Duration:         5*time.Minute + 54*time.Second,
+		ID:               "1JSLLcD4RKl8TZwBNhV5UX",
+		ISRC:             "GBAKW8000015",
+		Name:             "A Forest",
+		Popularity:       62,
+	}, NewSpotifyTrack(track))
+}
+
+func TestAlbumArtURL(t *testing.T) {
+	assert.Equal(t, "", albumArtURL(nil))
+
+	// The smallest image that's big enough, whatever the order.
+	assert.Equal(t, "300", albumArtURL([]spotify.Image{
+		{URL: "32", Width: 32},
+		{URL: "300", Width: 300},
+		{URL: "640", Width: 640},
+	}))
+
+	// Or the biggest if none are.
+	assert.Equal(t, "48", albumArtURL([]spotify.Image{
+		{URL: "32", Width: 32},
+		{URL: "48", Width: 48},
+	}))
+}
@@ -0,0 +1,223 @@
+package dgcommon
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/zmb3/spotify"
+)
+
+// SpotifyBaseURL is the root of Spotify's Web API.
+const SpotifyBaseURL = "https://api.spotify.com/v1/"
+
+// SpotifyClient calls the parts of Spotify's Web API that we use and decodes
+// the responses into the Spotify library's types.
+//
+// The library's own client can only be built around an HTTP client of its
+// choosing, which would bypass the rate limited transport that all of our
+// requests to Spotify go through, so we make the calls ourselves instead.
+type SpotifyClient struct {
+	baseURL string
+	http    *http.Client
+}
+
+// NewSpotifyClient returns a client that makes its requests with httpClient,
+// which needs to take care of authentication, against the API at baseURL
+// (normally SpotifyBaseURL).
+func NewSpotifyClient(httpClient *http.Client, baseURL string) *SpotifyClient {
+	return &SpotifyClient{baseURL: baseURL, http: httpClient}
+}
+
+// CreatePlaylistForUser creates an empty playlist owned by the given user.
+func (c *SpotifyClient) CreatePlaylistForUser(userID, name, description string,
+	public bool) (*spotify.FullPlaylist, error) {
+
+	body, err := json.Marshal(struct {
+		Name        string `json:"name"`
+		Public      bool   `json:"public"`
+		Description string `json:"description"`
+	}{name, public, description})
+	if err != nil {
+		return nil, err
+	}
+
+	var playlist spotify.FullPlaylist
+	err = c.do("POST", "users/"+url.PathEscape(userID)+"/playlists",
+		bytes.NewReader(body), &playlist)
+	if err != nil {
+		return nil, err
+	}
+	return &playlist, nil
+}
+
+// CurrentUser gets the user that the client is authenticated as.
+func (c *SpotifyClient) CurrentUser() (*spotify.PrivateUser, error) {
+	var user spotify.PrivateUser
+	err := c.do("GET", "me", nil, &user)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// CurrentUsersPlaylistsOpt gets a page of the playlists owned or followed by
+// the user that the client is authenticated as. Only the options' Limit and
+// Offset are used.
+func (c *SpotifyClient) CurrentUsersPlaylistsOpt(
+	opt *spotify.Options) (*spotify.SimplePlaylistPage, error) {
+
+	query := url.Values{}
+	if opt != nil {
+		if opt.Limit != nil {
+			query.Set("limit", strconv.Itoa(*opt.Limit))
+		}
+		if opt.Offset != nil {
+			query.Set("offset", strconv.Itoa(*opt.Offset))
+		}
+	}
+
+	path := "me/playlists"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	var page spotify.SimplePlaylistPage
+	err := c.do("GET", path, nil, &page)
+	if err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// GetArtists gets up to 50 artists in the order asked for. Artists that
+// Spotify doesn't have are nil.
+func (c *SpotifyClient) GetArtists(ids ...spotify.ID) ([]*spotify.FullArtist, error) {
+	var body struct {
+		Artists []*spotify.FullArtist `json:"artists"`
+	}
+	err := c.do("GET", "artists?ids="+joinIDs(ids), nil, &body)
+	if err != nil {
+		return nil, err
+	}
+	return body.Artists, nil
+}
+
+// GetAudioFeatures gets the audio features of up to 100 tracks in the order
+// asked for. Tracks that Spotify has no features for are nil.
+func (c *SpotifyClient) GetAudioFeatures(ids ...spotify.ID) ([]*spotify.AudioFeatures, error) {
+	var body struct {
+		AudioFeatures []*spotify.AudioFeatures `json:"audio_features"`
+	}
+	err := c.do("GET", "audio-features?ids="+joinIDs(ids), nil, &body)
+	if err != nil {
+		return nil, err
+	}
+	return body.AudioFeatures, nil
+}
+
+// GetTracks gets up to 50 tracks in the order asked for. Tracks that Spotify
+// doesn't have are nil.
+func (c *SpotifyClient) GetTracks(ids ...spotify.ID) ([]*spotify.FullTrack, error) {
+	var body struct {
+		Tracks []*spotify.FullTrack `json:"tracks"`
+	}
+	err := c.do("GET", "tracks?ids="+joinIDs(ids), nil, &body)
+	if err != nil {
+		return nil, err
+	}
+	return body.Tracks, nil
+}
+
+// ReplacePlaylistTracks replaces everything on a playlist with up to 100
+// tracks.
+func (c *SpotifyClient) ReplacePlaylistTracks(playlistID spotify.ID,
+	trackIDs ...spotify.ID) error {
+
+	uris := make([]string, len(trackIDs))
+	for i, id := range trackIDs {
+		uris[i] = "spotify:track:" + string(id)
+	}
+
+	return c.do("PUT", "playlists/"+url.PathEscape(string(playlistID))+
+		"/tracks?uris="+strings.Join(uris, ","), nil, nil)
+}
+
+// SearchTracks searches for tracks. The query can use Spotify's field filters
+// like `artist:` and `track:`.
+func (c *SpotifyClient) SearchTracks(query string) (*spotify.SearchResult, error) {
+	params := url.Values{}
+	params.Set("q", query)
+	params.Set("type", "track")
+
+	var result spotify.SearchResult
+	err := c.do("GET", "search?"+params.Encode(), nil, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// do makes a request to the API path relative to the client's base URL and
+// decodes the response into result, unless it's nil or the response has no
+// content. An error response is returned as a spotify.Error.
+func (c *SpotifyClient) do(method, path string, body io.Reader, result interface{}) error {
+	req, err := http.NewRequest(method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return decodeSpotifyError(resp)
+	}
+
+	if result == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// decodeSpotifyError extracts the error that the API answered with, falling
+// back to the response's status if there isn't one in its body.
+func decodeSpotifyError(resp *http.Response) error {
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	var body struct {
+		Error spotify.Error `json:"error"`
+	}
+	if json.Unmarshal(data, &body) != nil || body.Error.Message == "" {
+		return spotify.Error{
+			Message: fmt.Sprintf("spotify: unexpected HTTP %v", resp.Status),
+			Status:  resp.StatusCode,
+		}
+	}
+
+	body.Error.Status = resp.StatusCode
+	return body.Error
+}
+
+func joinIDs(ids []spotify.ID) string {
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = string(id)
+	}
+	return strings.Join(strs, ",")
+}
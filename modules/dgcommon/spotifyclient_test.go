@@ -0,0 +1,106 @@
+package dgcommon
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+	"github.com/zmb3/spotify"
+)
+
+func TestSpotifyClientGetTracks(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/tracks", r.URL.Path)
+		assert.Equal(t, "forest-id,gone-id", r.URL.Query().Get("ids"))
+		w.Write([]byte(`{"tracks": [{"id": "forest-id", "name": "A Forest"}, null]}`))
+	}))
+	defer server.Close()
+
+	client := NewSpotifyClient(server.Client(), server.URL+"/v1/")
+
+	tracks, err := client.GetTracks("forest-id", "gone-id")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(tracks))
+	assert.Equal(t, spotify.ID("forest-id"), tracks[0].ID)
+	assert.Equal(t, "A Forest", tracks[0].Name)
+	assert.Nil(t, tracks[1])
+}
+
+func TestSpotifyClientReplacePlaylistTracks(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "PUT", r.Method)
+		assert.Equal(t, "/v1/playlists/playlist-id/tracks", r.URL.Path)
+		assert.Equal(t, "spotify:track:a,spotify:track:b", r.URL.Query().Get("uris"))
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"snapshot_id": "snapshot"}`))
+	}))
+	defer server.Close()
+
+	client := NewSpotifyClient(server.Client(), server.URL+"/v1/")
+	assert.NoError(t, client.ReplacePlaylistTracks("playlist-id", "a", "b"))
+}
+
+func TestSpotifyClientCreatePlaylistForUser(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "/v1/users/deathguild-playlists/playlists", r.URL.Path)
+
+		body, _ := ioutil.ReadAll(r.Body)
+		assert.JSONEq(t, `{"name": "Death Guild 2016-09-26", "public": true,
+			"description": "Songs played"}`, string(body))
+
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id": "playlist-id"}`))
+	}))
+	defer server.Close()
+
+	client := NewSpotifyClient(server.Client(), server.URL+"/v1/")
+
+	playlist, err := client.CreatePlaylistForUser("deathguild-playlists",
+		"Death Guild 2016-09-26", "Songs played", true)
+	assert.NoError(t, err)
+	assert.Equal(t, spotify.ID("playlist-id"), playlist.ID)
+}
+
+func TestSpotifyClientSearchTracks(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/search", r.URL.Path)
+		assert.Equal(t, `artist:"The Cure" track:"A Forest"`, r.URL.Query().Get("q"))
+		assert.Equal(t, "track", r.URL.Query().Get("type"))
+		w.Write([]byte(`{"tracks": {"items": [{"id": "forest-id"}]}}`))
+	}))
+	defer server.Close()
+
+	client := NewSpotifyClient(server.Client(), server.URL+"/v1/")
+
+	res, err := client.SearchTracks(`artist:"The Cure" track:"A Forest"`)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(res.Tracks.Tracks))
+	assert.Equal(t, spotify.ID("forest-id"), res.Tracks.Tracks[0].ID)
+}
+
+func TestSpotifyClientError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/me" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error": {"status": 401, "message": "Invalid access token"}}`))
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	client := NewSpotifyClient(server.Client(), server.URL+"/v1/")
+
+	_, err := client.CurrentUser()
+	assert.Equal(t, spotify.Error{Message: "Invalid access token", Status: 401}, err)
+
+	// Errors without a body fall back to the response's status.
+	_, err = client.GetArtists("covenant-id")
+	assert.Equal(t, spotify.Error{
+		Message: "spotify: unexpected HTTP 502 Bad Gateway",
+		Status:  http.StatusBadGateway,
+	}, err)
+}
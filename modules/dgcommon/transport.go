@@ -0,0 +1,137 @@
+package dgcommon
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/brandur/modulir"
+)
+
+// MaxRetryAfter is the longest `Retry-After` that's worth waiting out. If a
+// server asks for more than this, we're better off giving up and trying again
+// on a later run.
+const MaxRetryAfter = 5 * time.Minute
+
+// RateLimitedTransport is an http.RoundTripper that holds requests to the rate
+// of a RateLimiter and transparently retries those that are rate limited
+// (status 429 unless RetryStatuses says otherwise). Retries wait for however
+// long the server asks for with `Retry-After` (or back off exponentially if
+// it doesn't say), and every rate limited response slows the limiter down
+// for everyone sharing it, so a pool of workers sharing one transport settles
+// on a rate that the server is happy with.
+type RateLimitedTransport struct {
+	// Base is the transport that makes requests. http.DefaultTransport is
+	// used if it's nil.
+	Base http.RoundTripper
+
+	// Limiter paces requests. It should be shared by everything talking to
+	// the same server.
+	Limiter *RateLimiter
+
+	// Log is where retries are logged. It may be nil.
+	Log modulir.LoggerInterface
+
+	// MaxRetries is the number of times that a rate limited request is
+	// retried before its response is returned as is.
+	MaxRetries int
+
+	// RetryStatuses are the response statuses that mean that a request was
+	// rate limited. Only 429 does if it's empty, but some servers (like
+	// MusicBrainz) answer with a 503 instead.
+	RetryStatuses []int
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *RateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	for attempt := 0; ; attempt++ {
+		t.Limiter.Wait()
+
+		resp, err := base.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if !t.rateLimited(resp.StatusCode) {
+			t.Limiter.Recover()
+			return resp, nil
+		}
+
+		t.Limiter.rateLimited()
+
+		if attempt >= t.MaxRetries {
+			return resp, nil
+		}
+
+		wait := Backoff(attempt)
+		if retryAfter, ok := RetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			if retryAfter > MaxRetryAfter {
+				return resp, nil
+			}
+			wait = retryAfter
+		}
+
+		// A request with a body can only be retried if the body can be read
+		// again.
+		retry, err := rewindRequest(req)
+		if err != nil {
+			return resp, nil
+		}
+
+		// Drain the body so that the connection can be reused.
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+
+		if t.Log != nil {
+			t.Log.Infof("Rate limited requesting %v (attempt %v of %v); retrying in %v",
+				req.URL, attempt+1, t.MaxRetries+1, wait)
+		}
+
+		t.Limiter.Pause(wait)
+		req = retry
+	}
+}
+
+// rateLimited returns whether a response status means that the request was
+// rate limited.
+func (t *RateLimitedTransport) rateLimited(status int) bool {
+	if len(t.RetryStatuses) == 0 {
+		return status == http.StatusTooManyRequests
+	}
+
+	for _, retryStatus := range t.RetryStatuses {
+		if status == retryStatus {
+			return true
+		}
+	}
+	return false
+}
+
+// rewindRequest returns a copy of a request that can be sent again, with a
+// fresh body if it has one.
+func rewindRequest(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, nil
+	}
+
+	if req.GetBody == nil {
+		return nil, fmt.Errorf("request body can't be read again")
+	}
+
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+
+	retry := new(http.Request)
+	*retry = *req
+	retry.Body = body
+	return retry, nil
+}
@@ -0,0 +1,135 @@
+package dgcommon
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+// newTestTransport returns a transport whose limiter records how long it
+// would have slept instead of sleeping.
+func newTestTransport(maxRetries int, slept *[]time.Duration) *RateLimitedTransport {
+	limiter := NewRateLimiter(0)
+	limiter.sleep = func(d time.Duration) { *slept = append(*slept, d) }
+	return &RateLimitedTransport{Limiter: limiter, MaxRetries: maxRetries}
+}
+
+func TestRateLimitedTransportRetries(t *testing.T) {
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+
+		if len(bodies) < 3 {
+			w.Header().Set("Retry-After", "2")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	var slept []time.Duration
+	client := &http.Client{Transport: newTestTransport(3, &slept)}
+
+	resp, err := client.Post(server.URL, "text/plain", bytes.NewBufferString("tracks"))
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "ok", string(body))
+
+	// The body is sent again with every retry, and every retry waits about
+	// as long as the server asked.
+	assert.Equal(t, []string{"tracks", "tracks", "tracks"}, bodies)
+	assert.Equal(t, 2, len(slept))
+	for _, d := range slept {
+		assert.InDelta(t, float64(2*time.Second), float64(d), float64(100*time.Millisecond))
+	}
+}
+
+func TestRateLimitedTransportGivesUp(t *testing.T) {
+	var numRequests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		numRequests++
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	var slept []time.Duration
+	transport := newTestTransport(2, &slept)
+	client := &http.Client{Transport: transport}
+
+	resp, err := client.Get(server.URL)
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	// Out of retries, the rate limited response comes back as is.
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, 3, numRequests)
+
+	// And the limiter has slowed down.
+	assert.True(t, transport.Limiter.Interval() > 0)
+
+	// Every rate limited response is counted, including the last one.
+	assert.Equal(t, 3, transport.Limiter.NumRateLimited())
+}
+
+func TestRateLimitedTransportRetryStatuses(t *testing.T) {
+	var numRequests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		numRequests++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	var slept []time.Duration
+
+	// A 503 isn't a rate limit unless we say it is.
+	client := &http.Client{Transport: newTestTransport(1, &slept)}
+	resp, err := client.Get(server.URL)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 1, numRequests)
+
+	transport := newTestTransport(1, &slept)
+	transport.RetryStatuses = []int{http.StatusTooManyRequests, http.StatusServiceUnavailable}
+	client = &http.Client{Transport: transport}
+
+	numRequests = 0
+	resp, err = client.Get(server.URL)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, 2, numRequests)
+}
+
+func TestRateLimitedTransportLongRetryAfter(t *testing.T) {
+	var numRequests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		numRequests++
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	var slept []time.Duration
+	client := &http.Client{Transport: newTestTransport(5, &slept)}
+
+	resp, err := client.Get(server.URL)
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	// Waiting an hour isn't worth it, so the request isn't retried.
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, 1, numRequests)
+	assert.Equal(t, 0, len(slept))
+}
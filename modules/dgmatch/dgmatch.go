@@ -0,0 +1,210 @@
+package dgmatch
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/brandur/deathguild/modules/dgnormalize"
+)
+
+// Candidate is a track returned by a search that might be the song we're
+// looking for.
+type Candidate struct {
+	// Album is the name of the album that the track appears on.
+	Album string
+
+	// Artists are the names of all of the track's artists.
+	Artists []string
+
+	// Title is the track's title.
+	Title string
+}
+
+// Penalties for words that mark a track as a version of a song other than
+// the one that was played. A word is only penalized if it's in the
+// candidate's title, artists, or album but not in the song being matched, so
+// a live version that was actually played still matches.
+var penalties = []struct {
+	word   string
+	amount float64
+}{
+	{"karaoke", 0.5},
+	{"tribute", 0.4},
+	{"cover", 0.3},
+	{"live", 0.2},
+}
+
+// Matches a parenthesized or bracketed part of a title like "(Remix)" or a
+// suffix like " - 2006 Remaster" that Spotify tends to tack onto titles.
+var titleExtrasRegexp = regexp.MustCompile(`\s*(\([^)]*\)|\[[^\]]*\]|\s-\s.*$)`)
+
+// Best scores every candidate against a song and returns the index of the
+// best scoring one along with its score. The index is -1 if there weren't
+// any candidates. Earlier candidates win ties since search results come back
+// in order of relevance.
+func Best(artist, title string, candidates []*Candidate) (int, float64) {
+	best := -1
+	var bestScore float64
+
+	for i, candidate := range candidates {
+		score := Score(artist, title, candidate)
+		if best == -1 || score > bestScore {
+			best = i
+			bestScore = score
+		}
+	}
+
+	return best, bestScore
+}
+
+// Score rates how likely a candidate is to be the song with the given artist
+// and title from 0 (not at all) to 1 (an exact match). Artist and title are
+// weighted equally, and penalties are taken off for words that suggest a
+// karaoke version, tribute, or the like.
+func Score(artist, title string, candidate *Candidate) float64 {
+	score := 0.5*ArtistScore(artist, candidate.Artists) +
+		0.5*titleScore(title, candidate.Title)
+
+	local := words(artist + " " + title)
+	remote := words(strings.Join(candidate.Artists, " ") + " " +
+		candidate.Title + " " + candidate.Album)
+
+	for _, penalty := range penalties {
+		if remote[penalty.word] && !local[penalty.word] {
+			score -= penalty.amount
+		}
+	}
+
+	if score < 0 {
+		return 0
+	}
+	return score
+}
+
+// ArtistScore compares an artist to a track's artists. A track with several
+// artists gets the best of comparing against each one and against all of
+// them together (for a local artist like "Covenant & Necro Facility"), or
+// the share of the local artist's words that appear in them if that's higher.
+func ArtistScore(artist string, candidateArtists []string) float64 {
+	if len(candidateArtists) == 0 {
+		return 0
+	}
+
+	key := dgnormalize.ArtistKey(artist)
+
+	var keys []string
+	for _, candidateArtist := range candidateArtists {
+		keys = append(keys, dgnormalize.ArtistKey(candidateArtist))
+	}
+
+	var best float64
+	for _, candidateKey := range append(keys, strings.Join(keys, " & ")) {
+		if s := similarity(key, candidateKey); s > best {
+			best = s
+		}
+	}
+
+	if s := overlap(words(key), words(strings.Join(keys, " "))); s > best {
+		best = s
+	}
+
+	return best
+}
+
+// titleScore compares two titles. Titles that only match once extras like
+// "(Remix)" or " - Remastered" are taken off both of them score a little
+// lower than ones that match outright.
+func titleScore(title, candidateTitle string) float64 {
+	key := dgnormalize.TitleKey(title)
+	candidateKey := dgnormalize.TitleKey(candidateTitle)
+
+	best := similarity(key, candidateKey)
+
+	stripped := strings.TrimSpace(titleExtrasRegexp.ReplaceAllString(key, ""))
+	candidateStripped := strings.TrimSpace(titleExtrasRegexp.ReplaceAllString(candidateKey, ""))
+	if stripped != "" && candidateStripped != "" {
+		if s := 0.9 * similarity(stripped, candidateStripped); s > best {
+			best = s
+		}
+	}
+
+	return best
+}
+
+// similarity is one minus the edit distance between two strings as a share
+// of the longer one's length, so identical strings are 1 and strings with
+// nothing in common are 0.
+func similarity(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+
+	longest := len(ra)
+	if len(rb) > longest {
+		longest = len(rb)
+	}
+	if longest == 0 {
+		return 1
+	}
+
+	return 1 - float64(levenshtein(ra, rb))/float64(longest)
+}
+
+// levenshtein computes the edit distance between two strings.
+func levenshtein(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+
+			cur[j] = minInt(prev[j]+1, minInt(cur[j-1]+1, prev[j-1]+cost))
+		}
+		prev, cur = cur, prev
+	}
+
+	return prev[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// overlap is the share of the words in a that are also in b.
+func overlap(a, b map[string]bool) float64 {
+	if len(a) == 0 {
+		return 0
+	}
+
+	var shared int
+	for word := range a {
+		if b[word] {
+			shared++
+		}
+	}
+
+	return float64(shared) / float64(len(a))
+}
+
+// words splits a string into the set of its case folded words, ignoring
+// punctuation.
+func words(s string) map[string]bool {
+	set := make(map[string]bool)
+	for _, word := range strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}) {
+		set[word] = true
+	}
+	return set
+}
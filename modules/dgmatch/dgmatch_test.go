@@ -0,0 +1,66 @@
+package dgmatch
+
+import (
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestBest(t *testing.T) {
+	candidates := []*Candidate{
+		{Artists: []string{"Karaoke Hits Band"}, Title: "A Forest (Karaoke Version)"},
+		{Artists: []string{"Nouvelle Vague"}, Title: "A Forest"},
+		{Artists: []string{"The Cure"}, Title: "A Forest (Live)", Album: "Paris"},
+		{Artists: []string{"The Cure"}, Title: "A Forest - 2005 Remaster"},
+	}
+
+	i, score := Best("The Cure", "A Forest", candidates)
+	assert.Equal(t, 3, i)
+	assert.InDelta(t, 0.95, score, 0.001)
+
+	i, score = Best("The Cure", "A Forest", nil)
+	assert.Equal(t, -1, i)
+	assert.Equal(t, 0.0, score)
+}
+
+func TestScore(t *testing.T) {
+	// Exact matches, give or take spelling.
+	assert.Equal(t, 1.0, Score("The Cure", "A Forest",
+		&Candidate{Artists: []string{"The Cure"}, Title: "A Forest"}))
+	assert.Equal(t, 1.0, Score("Cure", "a forest",
+		&Candidate{Artists: []string{"The Cure"}, Title: "A Forest"}))
+
+	// Several artists credited separately on Spotify.
+	assert.Equal(t, 1.0, Score("Covenant & Necro Facility", "Lightbringer",
+		&Candidate{Artists: []string{"Covenant", "Necro Facility"}, Title: "Lightbringer"}))
+	assert.Equal(t, 1.0, Score("Covenant", "Lightbringer",
+		&Candidate{Artists: []string{"Covenant", "Necro Facility"}, Title: "Lightbringer"}))
+
+	// Same title from a different artist.
+	assert.True(t, Score("The Cure", "A Forest",
+		&Candidate{Artists: []string{"Nouvelle Vague"}, Title: "A Forest"}) < 0.7)
+
+	// A different song from the same artist.
+	assert.True(t, Score("The Cure", "A Forest",
+		&Candidate{Artists: []string{"The Cure"}, Title: "Lullaby"}) < 0.7)
+
+	// Karaoke and tributes are penalized wherever the word shows up.
+	assert.True(t, Score("The Cure", "A Forest",
+		&Candidate{Artists: []string{"Karaoke All Stars"}, Title: "A Forest"}) < 0.1)
+	assert.InDelta(t, 0.6, Score("The Cure", "A Forest",
+		&Candidate{Artists: []string{"The Cure"}, Title: "A Forest", Album: "A Tribute to The Cure"}),
+		0.001)
+
+	// But not if the song itself is a live version.
+	assert.Equal(t, 1.0, Score("The Cure", "A Forest (Live)",
+		&Candidate{Artists: []string{"The Cure"}, Title: "A Forest (Live)"}))
+	assert.InDelta(t, 0.75, Score("The Cure", "A Forest",
+		&Candidate{Artists: []string{"The Cure"}, Title: "A Forest (Live)"}), 0.001)
+}
+
+func TestSimilarity(t *testing.T) {
+	assert.Equal(t, 1.0, similarity("", ""))
+	assert.Equal(t, 1.0, similarity("forest", "forest"))
+	assert.Equal(t, 0.0, similarity("abc", "xyz"))
+	assert.InDelta(t, 0.5, similarity("abcd", "abxy"), 0.001)
+}
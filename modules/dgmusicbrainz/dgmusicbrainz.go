@@ -0,0 +1,194 @@
+package dgmusicbrainz
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/brandur/deathguild/modules/dgcommon"
+	"github.com/brandur/modulir"
+)
+
+// DefaultBaseURL is the base URL of MusicBrainz's web service.
+const DefaultBaseURL = "https://musicbrainz.org/ws/2"
+
+// RequestsPerSecond is the most requests that MusicBrainz allows a client to
+// make per second. Clients that go over it have all of their requests
+// refused for a while.
+const RequestsPerSecond = 1
+
+// Artist is an artist as MusicBrainz knows them.
+type Artist struct {
+	// ID is the artist's MusicBrainz identifier (MBID).
+	ID string `json:"id"`
+
+	// Name is the artist's name.
+	Name string `json:"name"`
+}
+
+// ArtistCredit is one of the artists credited on a recording.
+type ArtistCredit struct {
+	Artist *Artist `json:"artist"`
+
+	// JoinPhrase is put between this credit and the next one when they're
+	// written out together, like " feat. ".
+	JoinPhrase string `json:"joinphrase"`
+
+	// Name is the name that the artist is credited under, which may not be
+	// the name that they usually go by.
+	Name string `json:"name"`
+}
+
+// Recording is a distinct recording of a song as MusicBrainz knows it. The
+// same recording may appear on several releases.
+type Recording struct {
+	ArtistCredit []*ArtistCredit `json:"artist-credit"`
+
+	// ID is the recording's MusicBrainz identifier (MBID).
+	ID string `json:"id"`
+
+	// Releases are some of the releases that the recording appears on.
+	Releases []*Release `json:"releases"`
+
+	// Score is how well MusicBrainz thinks that the recording matches a
+	// search, out of 100.
+	Score int `json:"score"`
+
+	// Title is the recording's title.
+	Title string `json:"title"`
+}
+
+// Artist writes out the recording's artist credit the way that it would
+// appear on a release, like "Nouvelle Vague feat. Mélanie Pain".
+func (r *Recording) Artist() string {
+	var artist string
+	for _, credit := range r.ArtistCredit {
+		artist += credit.Name + credit.JoinPhrase
+	}
+	return artist
+}
+
+// ArtistIDs returns the MBIDs of the recording's artists in the order that
+// they're credited.
+func (r *Recording) ArtistIDs() []string {
+	ids := make([]string, 0, len(r.ArtistCredit))
+	for _, credit := range r.ArtistCredit {
+		if credit.Artist != nil {
+			ids = append(ids, credit.Artist.ID)
+		}
+	}
+	return ids
+}
+
+// ArtistNames returns the names that the recording's artists are credited
+// under in the order that they're credited.
+func (r *Recording) ArtistNames() []string {
+	names := make([]string, len(r.ArtistCredit))
+	for i, credit := range r.ArtistCredit {
+		names[i] = credit.Name
+	}
+	return names
+}
+
+// Release is a release that a recording appears on, like an album or single.
+type Release struct {
+	// ID is the release's MusicBrainz identifier (MBID).
+	ID string `json:"id"`
+
+	// Title is the release's title.
+	Title string `json:"title"`
+}
+
+// Client makes requests to MusicBrainz's web service.
+type Client struct {
+	// BaseURL is the base URL of the web service, which is DefaultBaseURL
+	// except in tests.
+	BaseURL string
+
+	// HTTPClient makes requests. It should be rate limited to
+	// RequestsPerSecond.
+	HTTPClient *http.Client
+
+	// UserAgent is sent with every request. MusicBrainz asks that it
+	// identify the application and a way to get in touch with its owner,
+	// and may block requests with one that doesn't.
+	UserAgent string
+}
+
+// NewClient returns a client for the web service at baseURL whose requests
+// are held to the rate of limiter. Requests that MusicBrainz refuses for
+// going over its rate limit are retried up to maxRetries times.
+func NewClient(baseURL, userAgent string, limiter *dgcommon.RateLimiter,
+	maxRetries int, log modulir.LoggerInterface) *Client {
+
+	return &Client{
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		HTTPClient: &http.Client{Transport: &dgcommon.RateLimitedTransport{
+			Limiter:    limiter,
+			Log:        log,
+			MaxRetries: maxRetries,
+
+			// MusicBrainz refuses requests over its rate limit with a 503
+			// rather than a 429.
+			RetryStatuses: []int{http.StatusTooManyRequests, http.StatusServiceUnavailable},
+		}},
+		UserAgent: userAgent,
+	}
+}
+
+// SearchRecordings searches for recordings matching a query in MusicBrainz's
+// search syntax (see RecordingQuery) and returns up to limit of them, best
+// match first.
+func (c *Client) SearchRecordings(query string, limit int) ([]*Recording, error) {
+	params := url.Values{}
+	params.Set("fmt", "json")
+	params.Set("limit", strconv.Itoa(limit))
+	params.Set("query", query)
+
+	req, err := http.NewRequest("GET", c.BaseURL+"/recording?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", c.UserAgent)
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Error searching MusicBrainz: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Error searching MusicBrainz: status %v", resp.StatusCode)
+	}
+
+	var res struct {
+		Recordings []*Recording `json:"recordings"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding MusicBrainz response: %v", err)
+	}
+
+	return res.Recordings, nil
+}
+
+// RecordingQuery builds a search for recordings with the given title, and
+// by the given artist unless it's empty.
+func RecordingQuery(artist, title string) string {
+	query := "recording:" + phrase(title)
+	if artist != "" {
+		query += " AND artist:" + phrase(artist)
+	}
+	return query
+}
+
+// phrase quotes a string as a phrase in MusicBrainz's search syntax.
+func phrase(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	return `"` + s + `"`
+}
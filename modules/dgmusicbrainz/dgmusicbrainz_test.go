@@ -0,0 +1,64 @@
+package dgmusicbrainz
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/brandur/deathguild/modules/dgcommon"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestSearchRecordings(t *testing.T) {
+	body, err := ioutil.ReadFile("../dgtesting/samples/musicbrainz-recordings.json")
+	assert.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/ws/2/recording", r.URL.Path)
+		assert.Equal(t, "json", r.URL.Query().Get("fmt"))
+		assert.Equal(t, "5", r.URL.Query().Get("limit"))
+		assert.Equal(t, `recording:"A Forest" AND artist:"The Cure"`, r.URL.Query().Get("query"))
+		assert.Equal(t, "test-agent", r.Header.Get("User-Agent"))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL+"/ws/2/", "test-agent", dgcommon.NewRateLimiter(0), 0, nil)
+
+	recordings, err := client.SearchRecordings(RecordingQuery("The Cure", "A Forest"), 5)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(recordings))
+
+	recording := recordings[1]
+	assert.Equal(t, "f3b4ac2d-7c3e-4a7a-9f1e-5e1b2a9d4c22", recording.ID)
+	assert.Equal(t, "A Forest", recording.Title)
+	assert.Equal(t, 100, recording.Score)
+	assert.Equal(t, "Seventeen Seconds", recording.Releases[0].Title)
+	assert.Equal(t, []string{"69ee3720-a7cb-4402-b48d-a02c366f2bcf"}, recording.ArtistIDs())
+
+	recording = recordings[2]
+	assert.Equal(t, "Nouvelle Vague feat. Mélanie Pain", recording.Artist())
+	assert.Equal(t, []string{"Nouvelle Vague", "Mélanie Pain"}, recording.ArtistNames())
+	assert.Equal(t, 2, len(recording.ArtistIDs()))
+}
+
+func TestSearchRecordingsError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, "test-agent", dgcommon.NewRateLimiter(0), 0, nil)
+
+	_, err := client.SearchRecordings(RecordingQuery("", "A Forest"), 5)
+	assert.Error(t, err)
+}
+
+func TestRecordingQuery(t *testing.T) {
+	assert.Equal(t, `recording:"A Forest"`, RecordingQuery("", "A Forest"))
+	assert.Equal(t, `recording:"\"Heroes\"" AND artist:"AC\\DC"`,
+		RecordingQuery(`AC\DC`, `"Heroes"`))
+}
@@ -0,0 +1,117 @@
+package dgnormalize
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Replacements for punctuation that's typed many different ways depending on
+// who wrote up the playlist and what they wrote it up with.
+var punctuation = map[rune]rune{
+	// Single quotes, apostrophes, and primes.
+	'‘': '\'',
+	'’': '\'',
+	'‚': '\'',
+	'‛': '\'',
+	'′': '\'',
+	'`': '\'',
+	'´': '\'',
+
+	// Double quotes.
+	'“': '"',
+	'”': '"',
+	'„': '"',
+	'‟': '"',
+	'″': '"',
+	'«': '"',
+	'»': '"',
+
+	// Hyphens, dashes, and minus signs.
+	'‐': '-',
+	'‑': '-',
+	'‒': '-',
+	'–': '-',
+	'—': '-',
+	'―': '-',
+	'−': '-',
+}
+
+// Text cleans up a piece of song text without changing what it says: it's
+// put into Unicode NFC, fancy quotes and dashes are replaced with plain ASCII
+// ones, runs of whitespace are collapsed into a single space, and whitespace
+// just inside of parentheses and brackets is removed.
+func Text(s string) string {
+	s = norm.NFC.String(s)
+
+	var b strings.Builder
+	b.Grow(len(s))
+
+	// Start as if we'd just written a space so that leading whitespace is
+	// dropped.
+	pendingSpace := false
+	lastWasSpace := true
+
+	for _, r := range s {
+		if replacement, ok := punctuation[r]; ok {
+			r = replacement
+		}
+
+		if unicode.IsSpace(r) {
+			pendingSpace = !lastWasSpace
+			continue
+		}
+
+		if pendingSpace && r != ')' && r != ']' {
+			b.WriteRune(' ')
+		}
+		pendingSpace = false
+
+		b.WriteRune(r)
+		lastWasSpace = r == '(' || r == '['
+	}
+
+	return b.String()
+}
+
+// SongKey produces a key for a song that's the same for all the ways that its
+// artist and title might be spelled. It's the artist's ArtistKey and the
+// title's TitleKey separated by a tab.
+//
+// Keys are only for matching songs up and aren't meant to be displayed.
+func SongKey(artist, title string) string {
+	return ArtistKey(artist) + "\t" + TitleKey(title)
+}
+
+// ArtistKey produces a key for an artist. On top of what Text does, the key
+// is case folded and a leading "The " (or trailing ", The") is dropped so
+// that "The Cure" and "Cure" are considered the same.
+func ArtistKey(artist string) string {
+	key := foldCase(Text(artist))
+
+	// Don't strip an artist that's only "The" down to nothing.
+	if strings.HasPrefix(key, "the ") && len(key) > len("the ") {
+		key = strings.TrimPrefix(key, "the ")
+	} else if strings.HasSuffix(key, ", the") && len(key) > len(", the") {
+		key = strings.TrimSuffix(key, ", the")
+	}
+
+	return key
+}
+
+// TitleKey produces a key for a song title. It's the title put through Text
+// and case folded.
+func TitleKey(title string) string {
+	return foldCase(Text(title))
+}
+
+// foldCase maps every rune to a single case so that strings that only differ
+// in case are equal. Going through upper case first means that runes like
+// the Kelvin sign or the long s fold together with the letters that they look
+// like.
+func foldCase(s string) string {
+	return strings.Map(func(r rune) rune {
+		return unicode.ToLower(unicode.ToUpper(r))
+	}, s)
+}
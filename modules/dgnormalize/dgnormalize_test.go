@@ -0,0 +1,54 @@
+package dgnormalize
+
+import (
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestText(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"Enjoy the Silence", "Enjoy the Silence"},
+		{"  Enjoy   the\tSilence ", "Enjoy the Silence"},
+		{"Headhunter ( Live )", "Headhunter (Live)"},
+		{"Tainted Love [ 12\" Mix]", "Tainted Love [12\" Mix]"},
+		{"Don’t You Want Me", "Don't You Want Me"},
+		{"“Heroes”", "\"Heroes\""},
+		{"Bizarre Love Triangle – Extended", "Bizarre Love Triangle - Extended"},
+
+		// "é" as "e" plus a combining acute accent composes into one rune.
+		{"Ame\u0301lie", "Am\u00e9lie"},
+	} {
+		assert.Equal(t, tc.want, Text(tc.in), tc.in)
+	}
+}
+
+func TestSongKey(t *testing.T) {
+	key := SongKey("The Cure", "A Forest")
+	assert.Equal(t, "cure\ta forest", key)
+
+	// Spellings that should all end up the same.
+	for _, song := range []struct{ artist, title string }{
+		{"Cure", "A Forest"},
+		{"the cure", "a forest"},
+		{"THE CURE", "A  FOREST"},
+		{"Cure, The", "A Forest "},
+		{" The  Cure", "A Forest"},
+	} {
+		assert.Equal(t, key, SongKey(song.artist, song.title), song)
+	}
+
+	// And ones that shouldn't.
+	assert.NotEqual(t, key, SongKey("The Cure", "A Forest (Live)"))
+	assert.NotEqual(t, key, SongKey("Theatre of Tragedy", "A Forest"))
+
+	// An artist that's only "The" isn't stripped to nothing.
+	assert.Equal(t, "the\tthe", SongKey("The", "The"))
+	assert.Equal(t, "the\tinfected", SongKey("The The", "Infected"))
+
+	// Runes that only look alike fold together too, like the Kelvin sign.
+	assert.Equal(t, SongKey("Kraftwerk", "Tour de France"),
+		SongKey("\u212araftwerk", "Tour de France"))
+}
@@ -2,8 +2,10 @@ package dgquery
 
 import (
 	"database/sql"
+	"sort"
 
 	"github.com/brandur/deathguild/modules/dgcommon"
+	"github.com/brandur/deathguild/modules/dgnormalize"
 	"github.com/lib/pq"
 )
 
@@ -23,14 +25,19 @@ type PlaylistYear struct {
 	Year      int
 }
 
-// PlaylistYears loads playlists and groups them by year.
-func PlaylistYears(txn *sql.Tx) ([]*PlaylistYear, error) {
+// PlaylistYears loads a source's published playlists and groups them by
+// year.
+func PlaylistYears(txn *sql.Tx, source string) ([]*PlaylistYear, error) {
 	rows, err := txn.Query(`
-		SELECT id, day, spotify_id
+		SELECT id, source, day, spotify_id
 		FROM playlists
-		WHERE spotify_id IS NOT NULL
+		WHERE source = $1
+			AND spotify_id IS NOT NULL
+			-- quarantined playlists are held back until reviewed
+			AND status = 'published'
 		-- create the most recent first
 		ORDER BY day DESC`,
+		source,
 	)
 	if err != nil {
 		return nil, err
@@ -44,6 +51,7 @@ func PlaylistYears(txn *sql.Tx) ([]*PlaylistYear, error) {
 		var playlist dgcommon.Playlist
 		err = rows.Scan(
 			&playlist.ID,
+			&playlist.Source,
 			&playlist.Day,
 			&playlist.SpotifyID,
 		)
@@ -66,27 +74,43 @@ func PlaylistYears(txn *sql.Tx) ([]*PlaylistYear, error) {
 type ArtistRanking struct {
 	Artist string
 	Count  int
+
+	// Genres are the artist's genres according to Spotify. It's empty for an
+	// artist that Spotify doesn't give any genres, or whose genres haven't
+	// been fetched yet.
+	Genres []string
+
+	// SpotifyID is the artist's Spotify ID. It's empty for an artist that's
+	// ranked by the name on songs that haven't been matched to a track on
+	// Spotify, and that no matched songs are spelled like.
+	SpotifyID string
 }
 
 // ArtistRankingsByPlays loads artist rankings by total number of their songs
-// played.
-func ArtistRankingsByPlays(txn *sql.Tx, years []int, limit int) ([]*ArtistRanking, error) {
-	rows, err := txn.Query(`
-		WITH year_songs AS (
-			SELECT artist, title, s.spotify_id AS song_spotify_id
-			FROM playlists p
-				INNER JOIN playlists_songs ps
-					ON p.id = ps.playlists_id
-				INNER JOIN songs s
-					ON s.id = ps.songs_id
-			WHERE date_part('year', p.day) = any($1)
-		)
-		SELECT artist, count(*)
-		FROM year_songs
-		GROUP BY artist
+// played. Every play counts, including a song that was played more than once
+// in the same night.
+//
+// Songs are credited to the artists on the Spotify track that they were
+// matched to, so a song with several artists counts toward each of them.
+// Songs that haven't been matched are credited to the artists that matched
+// songs by the same artist are (see artistAttributions), or to their artist
+// as it was written on the playlist if there aren't any.
+func ArtistRankingsByPlays(txn *sql.Tx, source string, years []int, limit int) ([]*ArtistRanking, error) {
+	attributedArtists, attributedIDs, err := artistAttributions(txn)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := txn.Query(artistRankingsCTE+`
+		SELECT artist, spotify_id, genres, count(*)
+		FROM year_artists
+		GROUP BY artists_id, artist, spotify_id, genres
 		ORDER BY count DESC, artist
-		LIMIT $2`,
+		LIMIT $5`,
+		source,
 		pq.Array(years),
+		pq.Array(attributedArtists),
+		pq.Array(attributedIDs),
 		limit,
 	)
 	if err != nil {
@@ -94,66 +118,105 @@ func ArtistRankingsByPlays(txn *sql.Tx, years []int, limit int) ([]*ArtistRankin
 	}
 	defer rows.Close()
 
-	var rankings []*ArtistRanking
+	return scanArtistRankings(rows)
+}
 
-	for rows.Next() {
-		var ranking ArtistRanking
-		err = rows.Scan(
-			&ranking.Artist,
-			&ranking.Count,
-		)
-		if err != nil {
-			return nil, err
-		}
+// ArtistRankingsBySongs loads artist rankings by the number of unique songs
+// from each artist that were played. Songs are credited to artists in the
+// same way as in ArtistRankingsByPlays.
+func ArtistRankingsBySongs(txn *sql.Tx, source string, years []int, limit int) ([]*ArtistRanking, error) {
+	attributedArtists, attributedIDs, err := artistAttributions(txn)
+	if err != nil {
+		return nil, err
+	}
 
-		rankings = append(rankings, &ranking)
+	rows, err := txn.Query(artistRankingsCTE+`
+		SELECT artist, spotify_id, genres, count(distinct(title))
+		FROM year_artists
+		GROUP BY artists_id, artist, spotify_id, genres
+		ORDER BY count DESC, artist
+		LIMIT $5`,
+		source,
+		pq.Array(years),
+		pq.Array(attributedArtists),
+		pq.Array(attributedIDs),
+		limit,
+	)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	return rankings, nil
+	return scanArtistRankings(rows)
 }
 
-// ArtistRankingsBySongs loads artist rankings by the number of unique songs
-// from each artist that were played.
-func ArtistRankingsBySongs(txn *sql.Tx, years []int, limit int) ([]*ArtistRanking, error) {
+// AudioFeaturesYear holds the average audio features of the songs played in
+// a year.
+type AudioFeaturesYear struct {
+	Year int
+
+	// Count is the number of plays of songs with audio features that the
+	// averages were taken over. Every play counts.
+	Count int
+
+	Danceability float64
+	Energy       float64
+	Tempo        float64
+	Valence      float64
+
+	// Major is the fraction of plays that were of songs in a major key.
+	Major float64
+}
+
+// AudioFeaturesByYear loads the average audio features of the songs played in
+// each of the given years, leaving out years in which no songs with audio
+// features were played.
+func AudioFeaturesByYear(txn *sql.Tx, source string, years []int) ([]*AudioFeaturesYear, error) {
 	rows, err := txn.Query(`
-		WITH year_songs AS (
-			SELECT artist, title, s.spotify_id AS song_spotify_id
-			FROM playlists p
-				INNER JOIN playlists_songs ps
-					ON p.id = ps.playlists_id
-				INNER JOIN songs s
-					ON s.id = ps.songs_id
-			WHERE date_part('year', p.day) = any($1)
-		)
-		SELECT artist, count(distinct(title))
-		FROM year_songs
-		GROUP BY artist
-		ORDER BY count DESC, artist
-		LIMIT $2`,
+		SELECT date_part('year', p.day)::int AS year, count(*),
+			avg(f.danceability), avg(f.energy), avg(f.tempo), avg(f.valence),
+			avg(f.mode)
+		FROM playlists p
+			INNER JOIN playlists_songs ps
+				ON p.id = ps.playlists_id
+			INNER JOIN songs s
+				ON s.id = ps.songs_id
+			INNER JOIN spotify_audio_features f
+				ON f.spotify_id = s.spotify_id
+		WHERE p.source = $1
+			AND p.status = 'published'
+			AND date_part('year', p.day) = any($2)
+		GROUP BY year
+		ORDER BY year`,
+		source,
 		pq.Array(years),
-		limit,
 	)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var rankings []*ArtistRanking
+	var averages []*AudioFeaturesYear
 
 	for rows.Next() {
-		var ranking ArtistRanking
+		var average AudioFeaturesYear
 		err = rows.Scan(
-			&ranking.Artist,
-			&ranking.Count,
+			&average.Year,
+			&average.Count,
+			&average.Danceability,
+			&average.Energy,
+			&average.Tempo,
+			&average.Valence,
+			&average.Major,
 		)
 		if err != nil {
 			return nil, err
 		}
 
-		rankings = append(rankings, &ranking)
+		averages = append(averages, &average)
 	}
 
-	return rankings, nil
+	return averages, nil
 }
 
 // SongRanking is a record that ranks an artist by plays.
@@ -164,8 +227,9 @@ type SongRanking struct {
 	Count     int
 }
 
-// SongRankings loads songs by the number of plays.
-func SongRankings(txn *sql.Tx, years []int, limit int, requireSpotifyID bool) ([]*SongRanking, error) {
+// SongRankings loads songs by the number of plays. Every play counts, so a
+// song that was played twice in one night gets two plays for it.
+func SongRankings(txn *sql.Tx, source string, years []int, limit int, requireSpotifyID bool) ([]*SongRanking, error) {
 	whereClause := ""
 	if requireSpotifyID {
 		whereClause = "WHERE song_spotify_id IS NOT NULL\n"
@@ -179,7 +243,9 @@ func SongRankings(txn *sql.Tx, years []int, limit int, requireSpotifyID bool) ([
 					ON p.id = ps.playlists_id
 				INNER JOIN songs s
 					ON s.id = ps.songs_id
-			WHERE date_part('year', p.day) = any($1)
+			WHERE p.source = $1
+				AND p.status = 'published'
+				AND date_part('year', p.day) = any($2)
 		)
 		SELECT artist, title, song_spotify_id, count(*)
 		FROM year_songs
@@ -187,7 +253,8 @@ func SongRankings(txn *sql.Tx, years []int, limit int, requireSpotifyID bool) ([
 		whereClause+
 		`GROUP BY artist, title, song_spotify_id
 		ORDER BY count DESC, artist, title
-		LIMIT $2`,
+		LIMIT $3`,
+		source,
 		pq.Array(years),
 		limit,
 	)
@@ -222,11 +289,12 @@ func SongRankings(txn *sql.Tx, years []int, limit int, requireSpotifyID bool) ([
 	return rankings, nil
 }
 
-// SpecialPlaylistSpotifyID retrieves the Spotify ID for a special playlist
-// like a top for year or top for all-time.
-func SpecialPlaylistSpotifyID(txn *sql.Tx, slug string) (*string, error) {
+// SpecialPlaylistSpotifyID retrieves the Spotify ID for a source's special
+// playlist like a top for year or top for all-time.
+func SpecialPlaylistSpotifyID(txn *sql.Tx, source, slug string) (*string, error) {
 	row := txn.QueryRow(
-		`SELECT spotify_id FROM special_playlists WHERE slug = $1`,
+		`SELECT spotify_id FROM special_playlists WHERE source = $1 AND slug = $2`,
+		source,
 		slug,
 	)
 
@@ -241,3 +309,185 @@ func SpecialPlaylistSpotifyID(txn *sql.Tx, slug string) (*string, error) {
 
 	return &spotifyID, nil
 }
+
+// artistRankingsCTE selects every play in a source's published playlists in
+// the given years, once for each artist that the song is credited to. Songs
+// that haven't been linked to artists are credited to the artists paired
+// with the song's artist in the attributions given as $3 and $4 (see
+// artistAttributions). `artists_id` is NULL for songs with neither, which are
+// credited to the artist written on the playlist instead.
+const artistRankingsCTE = `
+	WITH year_songs AS (
+		SELECT s.id, artist, title, s.spotify_id
+		FROM playlists p
+			INNER JOIN playlists_songs ps
+				ON p.id = ps.playlists_id
+			INNER JOIN songs s
+				ON s.id = ps.songs_id
+		WHERE p.source = $1
+			AND p.status = 'published'
+			AND date_part('year', p.day) = any($2)
+	),
+	attributions AS (
+		SELECT *
+		FROM unnest($3::text[], $4::bigint[]) AS t (artist, artists_id)
+	),
+	year_artists AS (
+		SELECT ys.title, a.id AS artists_id,
+			COALESCE(a.name, ys.artist) AS artist,
+			a.spotify_id, a.genres
+		FROM year_songs ys
+			-- links made from a track that the song is no longer matched to
+			-- don't count
+			LEFT JOIN songs_artists sa
+				ON sa.songs_id = ys.id
+				AND sa.spotify_id = ys.spotify_id
+			LEFT JOIN attributions attr
+				ON sa.id IS NULL
+				AND attr.artist = ys.artist
+			LEFT JOIN artists a
+				ON a.id = COALESCE(sa.artists_id, attr.artists_id)
+	)`
+
+// artistAttributions works out which artists to credit songs that haven't
+// been linked to artists with. It returns pairs of an artist as written on
+// songs and the ID of an artist to credit them to as two parallel slices,
+// which is how they're passed to artistRankingsCTE.
+//
+// An unlinked song goes to the artists that linked songs with the same artist
+// key (see dgnormalize.ArtistKey) are most often linked to. That's usually
+// just one, but songs credited to several artists together like "Covenant &
+// Necro Facility" are linked to all of them equally.
+func artistAttributions(txn *sql.Tx) ([]string, []int64, error) {
+	rows, err := txn.Query(`
+		SELECT s.artist, sa.artists_id, count(*)
+		FROM songs s
+			INNER JOIN songs_artists sa
+				ON sa.songs_id = s.id
+				AND sa.spotify_id = s.spotify_id
+		GROUP BY s.artist, sa.artists_id`,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	// Number of linked songs by artist key and then by artist ID.
+	numLinked := make(map[string]map[int64]int)
+
+	for rows.Next() {
+		var artist string
+		var artistID int64
+		var count int
+		err = rows.Scan(&artist, &artistID, &count)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		key := dgnormalize.ArtistKey(artist)
+		if numLinked[key] == nil {
+			numLinked[key] = make(map[int64]int)
+		}
+		numLinked[key][artistID] += count
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	attributedIDs := make(map[string][]int64)
+	for key, counts := range numLinked {
+		var most int
+		for _, count := range counts {
+			if count > most {
+				most = count
+			}
+		}
+
+		var ids []int64
+		for artistID, count := range counts {
+			if count == most {
+				ids = append(ids, artistID)
+			}
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+		attributedIDs[key] = ids
+	}
+
+	unlinkedArtists, err := queryStrings(txn, `
+		SELECT DISTINCT artist
+		FROM songs s
+		WHERE NOT EXISTS (
+			SELECT 1
+			FROM songs_artists sa
+			WHERE sa.songs_id = s.id
+				AND sa.spotify_id = s.spotify_id
+		)
+		ORDER BY artist`,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var artists []string
+	var artistIDs []int64
+
+	for _, artist := range unlinkedArtists {
+		for _, artistID := range attributedIDs[dgnormalize.ArtistKey(artist)] {
+			artists = append(artists, artist)
+			artistIDs = append(artistIDs, artistID)
+		}
+	}
+
+	return artists, artistIDs, nil
+}
+
+// queryStrings runs a query that returns a single column of strings.
+func queryStrings(txn *sql.Tx, query string, args ...interface{}) ([]string, error) {
+	rows, err := txn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var strs []string
+
+	for rows.Next() {
+		var str string
+		err = rows.Scan(&str)
+		if err != nil {
+			return nil, err
+		}
+		strs = append(strs, str)
+	}
+
+	return strs, rows.Err()
+}
+
+// scanArtistRankings reads the rows of an artist ranking query.
+func scanArtistRankings(rows *sql.Rows) ([]*ArtistRanking, error) {
+	var rankings []*ArtistRanking
+
+	for rows.Next() {
+		var ranking ArtistRanking
+		var spotifyID *string
+		err := rows.Scan(
+			&ranking.Artist,
+			&spotifyID,
+			pq.Array(&ranking.Genres),
+			&ranking.Count,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		if spotifyID != nil {
+			ranking.SpotifyID = *spotifyID
+		}
+
+		rankings = append(rankings, &ranking)
+	}
+
+	return rankings, nil
+}
@@ -0,0 +1,85 @@
+package dgquery
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/brandur/deathguild/modules/dgcommon"
+	"github.com/brandur/deathguild/modules/dgstore"
+	"github.com/brandur/deathguild/modules/dgtesting"
+	assert "github.com/stretchr/testify/require"
+)
+
+var db = dgtesting.DB
+
+func TestArtistRankingsUnmatchedSongs(t *testing.T) {
+	txn, err := db.Begin()
+	assert.NoError(t, err)
+	defer func() {
+		err := txn.Rollback()
+		assert.NoError(t, err)
+	}()
+
+	playlist := &dgcommon.Playlist{Day: time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)}
+	dgtesting.InsertPlaylist(t, txn, playlist)
+
+	songs := []*dgcommon.Song{
+		{Artist: "Covenant", Title: "Dead Stars", SpotifyID: "dead-stars-id"},
+		{Artist: "Covenant & Necro Facility", Title: "Phoenix", SpotifyID: "phoenix-id"},
+
+		// Not matched, but spelled like songs that were.
+		{Artist: "covenant", Title: "Bullet"},
+		{Artist: "Covenant & Necro Facility", Title: "Other"},
+
+		// Not matched and nothing to go on.
+		{Artist: "Ikon", Title: "Ghost"},
+	}
+	for i, song := range songs {
+		dgtesting.InsertSong(t, txn, song)
+
+		_, err = txn.Exec(`
+			INSERT INTO playlists_songs (playlists_id, songs_id, position)
+			VALUES ($1, $2, $3)`,
+			playlist.ID, song.ID, i,
+		)
+		assert.NoError(t, err)
+	}
+
+	covenant := &dgcommon.Artist{Name: "Covenant", SpotifyID: "covenant-id"}
+	necroFacility := &dgcommon.Artist{Name: "Necro Facility", SpotifyID: "necro-facility-id"}
+
+	err = dgstore.LinkSongArtists(txn, "dead-stars-id", []*dgcommon.Artist{covenant})
+	assert.NoError(t, err)
+
+	err = dgstore.LinkSongArtists(txn, "phoenix-id",
+		[]*dgcommon.Artist{covenant, necroFacility})
+	assert.NoError(t, err)
+
+	// Unmatched songs count toward the artists that their matched songs are
+	// linked to instead of being ranked under their own spelling.
+	rankings, err := ArtistRankingsByPlays(txn, "deathguild", []int{2016}, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"Covenant (covenant-id): 4",
+		"Necro Facility (necro-facility-id): 2",
+		"Ikon (): 1",
+	}, rankingStrings(rankings))
+
+	rankings, err = ArtistRankingsBySongs(txn, "deathguild", []int{2016}, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"Covenant (covenant-id): 4",
+		"Necro Facility (necro-facility-id): 2",
+		"Ikon (): 1",
+	}, rankingStrings(rankings))
+}
+
+func rankingStrings(rankings []*ArtistRanking) []string {
+	var strs []string
+	for _, ranking := range rankings {
+		strs = append(strs, ranking.Artist+" ("+ranking.SpotifyID+"): "+
+			strconv.Itoa(ranking.Count))
+	}
+	return strs
+}
@@ -0,0 +1,204 @@
+package dgsource
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/brandur/deathguild/modules/dgcommon"
+)
+
+const (
+	// Base URL of the site with playlist index and playlist information. It's
+	// sort of terrible to hardcode this, but we rate limit to make sure that
+	// the site isn't hit very hard, and only need to retrieve any given
+	// playlist one time.
+	deathGuildBaseURL = "http://www.deathguild.com"
+
+	// The location of the playlist index.
+	deathGuildIndexURL = deathGuildBaseURL + "/playdates"
+)
+
+// DeathGuild is the source for playlists of Death Guild, which are scraped
+// from its official site.
+var DeathGuild Source = &deathGuildSource{}
+
+type deathGuildSource struct{}
+
+func (s *deathGuildSource) Name() string {
+	return "deathguild"
+}
+
+func (s *deathGuildSource) Title() string {
+	return "Death Guild"
+}
+
+func (s *deathGuildSource) URL() string {
+	return deathGuildBaseURL
+}
+
+func (s *deathGuildSource) IndexURL() string {
+	return deathGuildIndexURL
+}
+
+func (s *deathGuildSource) ParseIndex(r io.Reader) ([]*PlaylistRef, error) {
+	doc, err := goquery.NewDocumentFromReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var outErr error
+	var refs []*PlaylistRef
+
+	doc.Find("#playlist table a").EachWithBreak(func(i int, s *goquery.Selection) bool {
+		link, ok := s.Attr("href")
+		if !ok {
+			outErr = fmt.Errorf("No href attribute for link: %v", s.Text())
+			return false
+		}
+
+		refs = append(refs, &PlaylistRef{
+			Day: extractDay(link),
+			URL: playlistURL(link),
+		})
+
+		return true
+	})
+	if outErr != nil {
+		return nil, outErr
+	}
+
+	return refs, nil
+}
+
+func (s *deathGuildSource) ParsePlaylist(r io.Reader) ([]*dgcommon.Song, error) {
+	doc, err := goquery.NewDocumentFromReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var outErr error
+	var songs []*dgcommon.Song
+
+	// Old style playlists
+	doc.Find("table.Normal tr").EachWithBreak(func(i int, s *goquery.Selection) bool {
+		artist := s.Find("td:nth-child(1)").Text()
+		title := s.Find("td:nth-child(2)").Text()
+
+		// Ignore headers
+		if artist == "Artist" && title == "Title" {
+			return true
+		}
+
+		songs = append(songs, &dgcommon.Song{Artist: artist, Title: title})
+		return true
+	})
+	if outErr != nil {
+		return nil, outErr
+	}
+
+	// New style playlists
+	doc.Find("div#playlist em").EachWithBreak(func(i int, s *goquery.Selection) bool {
+		artist := s.Text()
+
+		allContent, err := s.Parent().Html()
+		if err != nil {
+			outErr = err
+			return false
+		}
+
+		// Unfortunately we're trying to parse Very Bad HTML which carries no
+		// semantic data whatsoever, so rather than traverse the DOM, we need
+		// to depend on a regexp hack to get titles out of the document.
+		//
+		// Be careful to:
+		//
+		//     1. Escape any HTML specific characters in the string (the call
+		//        to `Text` above will have unescaped them).
+		//     2. Escape any characters that are meaningful to a regexp (e.g., `+`).
+		rx := regexp.MustCompile(fmt.Sprintf(`<em>%s</em> - (.*?)<`,
+			regexp.QuoteMeta(html.EscapeString(artist))))
+
+		matches := rx.FindStringSubmatch(allContent)
+
+		if len(matches) < 2 {
+			outErr = fmt.Errorf("Failed to find title match for: %s", artist)
+			return false
+		}
+
+		// First index is the entire match, the second is our capture group.
+		title := html.UnescapeString(matches[1])
+
+		songs = append(songs, &dgcommon.Song{Artist: artist, Title: title})
+		return true
+	})
+	if outErr != nil {
+		return nil, outErr
+	}
+
+	return songs, nil
+}
+
+// Matches the path of a playlist page like `/playlist/2016-09-26`.
+var deathGuildPlaylistPathRegexp = regexp.MustCompile(`^/playlist/(\d{4}-\d{2}-\d{2})/?$`)
+
+// Matches a Wayback Machine URL, capturing the original URL that it's a copy
+// of. The timestamp may be suffixed with a modifier like `id_`.
+var waybackURLRegexp = regexp.MustCompile(`^(?:https?://)?web\.archive\.org/web/\d+[a-z_]*/(.+)$`)
+
+func (s *deathGuildSource) PlaylistDay(rawURL string) (string, bool) {
+	if matches := waybackURLRegexp.FindStringSubmatch(rawURL); matches != nil {
+		rawURL = matches[1]
+	}
+
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "http://" + rawURL
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", false
+	}
+
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	if host != "deathguild.com" {
+		return "", false
+	}
+
+	// Today's pages look like `/playlist/2016-09-26`, but older versions of
+	// the site passed the date as a query parameter instead.
+	var day string
+	if matches := deathGuildPlaylistPathRegexp.FindStringSubmatch(u.Path); matches != nil {
+		day = matches[1]
+	} else {
+		day = u.Query().Get("date")
+	}
+
+	if _, err := time.Parse("2006-01-02", day); err != nil {
+		return "", false
+	}
+
+	return day, true
+}
+
+func extractDay(link string) string {
+	parts := strings.Split(link, "/")
+	return parts[len(parts)-1]
+}
+
+// playlistURL produces a fully qualified URL for a playlist link. The index
+// usually gives us links relative to the site's root, but older snapshots of
+// it use absolute URLs.
+func playlistURL(link string) string {
+	if strings.HasPrefix(link, "http://") ||
+		strings.HasPrefix(link, "https://") {
+		return link
+	}
+
+	return deathGuildBaseURL + link
+}
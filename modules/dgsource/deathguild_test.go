@@ -0,0 +1,109 @@
+package dgsource
+
+import (
+	"os"
+	"testing"
+
+	"github.com/brandur/deathguild/modules/dgcommon"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestDeathGuildParseIndex(t *testing.T) {
+	f, err := os.Open("../dgtesting/samples/playlists.html")
+	assert.NoError(t, err)
+	defer f.Close()
+
+	refs, err := DeathGuild.ParseIndex(f)
+	assert.NoError(t, err)
+
+	assert.Equal(t,
+		&PlaylistRef{
+			Day: "1995-10-16",
+			URL: "http://www.deathguild.com/playlist/1995-10-16",
+		},
+		refs[len(refs)-1],
+	)
+}
+
+func TestDeathGuildParsePlaylist(t *testing.T) {
+	// Old format
+	{
+		f, err := os.Open("../dgtesting/samples/2016-09-26.html")
+		assert.NoError(t, err)
+		defer f.Close()
+
+		songs, err := DeathGuild.ParsePlaylist(f)
+		assert.NoError(t, err)
+
+		assert.Equal(t,
+			&dgcommon.Song{Artist: "Panic Lift", Title: "The Path"},
+			songs[len(songs)-1],
+		)
+	}
+
+	// New format
+	{
+		f, err := os.Open("../dgtesting/samples/2018-07-16.html")
+		assert.NoError(t, err)
+		defer f.Close()
+
+		songs, err := DeathGuild.ParsePlaylist(f)
+		assert.NoError(t, err)
+
+		assert.Equal(t,
+			&dgcommon.Song{Artist: "BT", Title: "Godspeed"},
+			songs[len(songs)-1],
+		)
+
+		// Make sure HTML unescaping in artist names and titles works (I
+		// manually added the `&amp;` to the test data in the title here).
+		assert.Equal(t,
+			&dgcommon.Song{Artist: "Simon & Garfunkel", Title: "I Am A Rock &"},
+			songs[0],
+		)
+	}
+}
+
+func TestDeathGuildPlaylistDay(t *testing.T) {
+	for url, day := range map[string]string{
+		"http://www.deathguild.com/playlist/2016-09-26":                                              "2016-09-26",
+		"https://deathguild.com/playlist/2016-09-26/":                                                "2016-09-26",
+		"http://www.deathguild.com/playlist.php?date=2003-01-06":                                     "2003-01-06",
+		"http://web.archive.org/web/20050204083615/http://www.deathguild.com/playlist/2005-01-31":    "2005-01-31",
+		"https://web.archive.org/web/20030210id_/http://deathguild.com/playlist.php?date=2003-02-03": "2003-02-03",
+		"web.archive.org/web/20030210/www.deathguild.com/playlist.php?date=2003-02-03":               "2003-02-03",
+	} {
+		actual, ok := DeathGuild.PlaylistDay(url)
+		assert.True(t, ok, url)
+		assert.Equal(t, day, actual, url)
+	}
+
+	for _, url := range []string{
+		"http://www.deathguild.com/playdates",
+		"http://www.deathguild.com/playlist/last-monday",
+		"http://www.deathguild.com/playlist.php?date=2003-13-45",
+		"http://www.example.com/playlist/2016-09-26",
+		"http://web.archive.org/web/20050204083615/http://www.example.com/playlist/2005-01-31",
+	} {
+		_, ok := DeathGuild.PlaylistDay(url)
+		assert.False(t, ok, url)
+	}
+}
+
+func TestExtractDay(t *testing.T) {
+	assert.Equal(t,
+		"2015-12-21",
+		extractDay("http://www.deathguild.com//playlist/2015-12-21"),
+	)
+}
+
+func TestPlaylistURL(t *testing.T) {
+	assert.Equal(t,
+		"http://www.deathguild.com/playlist/2015-12-21",
+		playlistURL("/playlist/2015-12-21"),
+	)
+	assert.Equal(t,
+		"http://www.deathguild.com/playlist/2015-12-21",
+		playlistURL("http://www.deathguild.com/playlist/2015-12-21"),
+	)
+}
@@ -0,0 +1,82 @@
+package dgsource
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/brandur/deathguild/modules/dgcommon"
+)
+
+// PlaylistRef is a reference to a single night's playlist that was found in
+// a source's index.
+type PlaylistRef struct {
+	// Day is the date on which the playlist was played formatted as ISO8601
+	// (e.g. `2016-09-26`).
+	Day string
+
+	// URL is the location from which the playlist's contents can be
+	// retrieved.
+	URL string
+}
+
+// Source is a club night or feed from which playlists can be ingested.
+//
+// A source only knows how to find and interpret its own pages. Retrieving
+// them is left to the caller so that fetching, recording, and storage work
+// the same way regardless of where playlists are coming from.
+type Source interface {
+	// Name is a short, stable identifier for the source. It's what gets
+	// stored in `playlists.source`.
+	Name() string
+
+	// Title is a human-readable name for the source like "Death Guild".
+	Title() string
+
+	// URL is the location of the source's own site, which is linked to from
+	// the one that we build.
+	URL() string
+
+	// IndexURL is the location of the source's index of playlists.
+	IndexURL() string
+
+	// ParseIndex extracts references to every playlist found in the
+	// source's index.
+	ParseIndex(r io.Reader) ([]*PlaylistRef, error)
+
+	// ParsePlaylist extracts the songs of a single night's playlist in the
+	// order that they were played.
+	ParsePlaylist(r io.Reader) ([]*dgcommon.Song, error)
+
+	// PlaylistDay determines whether a URL is for one of the source's
+	// playlist pages, and if so, which night it's for. It recognizes the
+	// URLs of past versions of the site and of archived copies of them (like
+	// those on the Wayback Machine) so that playlists can be recovered from
+	// captures of the site.
+	PlaylistDay(rawURL string) (string, bool)
+}
+
+// Get returns the source with the given name.
+func Get(name string) (Source, error) {
+	source, ok := sources[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown source: '%v' (known sources: %v)",
+			name, Names())
+	}
+	return source, nil
+}
+
+// Names returns the names of all known sources in alphabetical order.
+func Names() []string {
+	var names []string
+	for name := range sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// All known sources keyed by name.
+var sources = map[string]Source{
+	DeathGuild.Name(): DeathGuild,
+}
@@ -0,0 +1,20 @@
+package dgsource
+
+import (
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestGet(t *testing.T) {
+	source, err := Get("deathguild")
+	assert.NoError(t, err)
+	assert.Equal(t, DeathGuild, source)
+
+	_, err = Get("not-a-source")
+	assert.Error(t, err)
+}
+
+func TestNames(t *testing.T) {
+	assert.Equal(t, []string{"deathguild"}, Names())
+}
@@ -0,0 +1,87 @@
+package dgstore
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/brandur/deathguild/modules/dgcommon"
+	"github.com/lib/pq"
+)
+
+// LinkSongArtists records the artists credited on a Spotify track as the
+// artists of every song matched to it, replacing any artists that those songs
+// were linked to before. Artists that haven't been seen before are stored
+// without genres.
+func LinkSongArtists(txn *sql.Tx, spotifyID string, artists []*dgcommon.Artist) error {
+	_, err := txn.Exec(`
+		DELETE FROM songs_artists
+		WHERE songs_id IN (
+			SELECT id
+			FROM songs
+			WHERE spotify_id = $1
+		)`,
+		spotifyID,
+	)
+	if err != nil {
+		return fmt.Errorf("Error deleting from `songs_artists`: %v", err)
+	}
+
+	for i, artist := range artists {
+		var artistID int
+		err := txn.QueryRow(`
+			INSERT INTO artists (spotify_id, name)
+			VALUES ($1, $2)
+			ON CONFLICT (spotify_id) DO UPDATE
+				SET name = excluded.name
+			RETURNING id`,
+			artist.SpotifyID,
+			artist.Name,
+		).Scan(&artistID)
+		if err != nil {
+			return fmt.Errorf("Error inserting into `artists`: %v", err)
+		}
+
+		// A track occasionally credits the same artist twice, in which case
+		// the first credit wins.
+		_, err = txn.Exec(`
+			INSERT INTO songs_artists (songs_id, artists_id, spotify_id, position)
+			SELECT id, $2, $1, $3
+			FROM songs
+			WHERE spotify_id = $1
+			ON CONFLICT (songs_id, artists_id) DO NOTHING`,
+			spotifyID,
+			artistID,
+			i,
+		)
+		if err != nil {
+			return fmt.Errorf("Error inserting into `songs_artists`: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// UpdateArtistGenres stores the name and genres of an artist fetched from
+// Spotify's artist endpoint so that it isn't fetched again.
+func UpdateArtistGenres(txn *sql.Tx, artist *dgcommon.Artist) error {
+	genres := artist.Genres
+	if genres == nil {
+		genres = []string{}
+	}
+
+	_, err := txn.Exec(`
+		UPDATE artists
+		SET name = $2,
+			genres = $3,
+			genres_fetched_at = NOW()
+		WHERE spotify_id = $1`,
+		artist.SpotifyID,
+		artist.Name,
+		pq.Array(genres),
+	)
+	if err != nil {
+		return fmt.Errorf("Error updating `artists`: %v", err)
+	}
+
+	return nil
+}
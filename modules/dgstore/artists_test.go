@@ -0,0 +1,91 @@
+package dgstore
+
+import (
+	"testing"
+
+	"github.com/brandur/deathguild/modules/dgcommon"
+	"github.com/lib/pq"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestLinkSongArtists(t *testing.T) {
+	txn, err := db.Begin()
+	assert.NoError(t, err)
+	defer func() {
+		err := txn.Rollback()
+		assert.NoError(t, err)
+	}()
+
+	_, err = UpsertPlaylistAndSongs(txn, "deathguild", "2016-01-01", []*dgcommon.Song{
+		{Artist: "Covenant & Necro Facility", Title: "Dead Stars"},
+		{Artist: "Covenant (SE)", Title: "Dead Stars (Remix)"},
+	})
+	assert.NoError(t, err)
+
+	for _, song := range []*dgcommon.Song{
+		{Artist: "Covenant & Necro Facility", Title: "Dead Stars"},
+		{Artist: "Covenant (SE)", Title: "Dead Stars (Remix)"},
+	} {
+		_, err = SetSongSpotifyID(txn, song.Artist, song.Title, "dead-stars-id")
+		assert.NoError(t, err)
+	}
+
+	covenant := &dgcommon.Artist{Name: "Covenant", SpotifyID: "covenant-id"}
+
+	err = LinkSongArtists(txn, "dead-stars-id", []*dgcommon.Artist{
+		{Name: "Necro Facility", SpotifyID: "necro-facility-id"},
+		covenant,
+	})
+	assert.NoError(t, err)
+
+	// Linking again replaces the links made before.
+	err = LinkSongArtists(txn, "dead-stars-id", []*dgcommon.Artist{
+		covenant,
+		{Name: "Necro Facility", SpotifyID: "necro-facility-id"},
+	})
+	assert.NoError(t, err)
+
+	rows, err := txn.Query(`
+		SELECT s.artist, a.name, sa.position
+		FROM songs_artists sa
+			INNER JOIN songs s
+				ON s.id = sa.songs_id
+			INNER JOIN artists a
+				ON a.id = sa.artists_id
+		ORDER BY s.artist, sa.position`,
+	)
+	assert.NoError(t, err)
+	defer rows.Close()
+
+	var links []string
+	for rows.Next() {
+		var songArtist, artistName string
+		var position int
+		err = rows.Scan(&songArtist, &artistName, &position)
+		assert.NoError(t, err)
+		links = append(links, songArtist+" → "+artistName)
+	}
+	assert.NoError(t, rows.Err())
+
+	assert.Equal(t, []string{
+		"Covenant & Necro Facility → Covenant",
+		"Covenant & Necro Facility → Necro Facility",
+		"Covenant (SE) → Covenant",
+		"Covenant (SE) → Necro Facility",
+	}, links)
+
+	covenant.Genres = []string{"ebm", "futurepop"}
+	err = UpdateArtistGenres(txn, covenant)
+	assert.NoError(t, err)
+
+	var genres []string
+	err = txn.QueryRow(`
+		SELECT genres
+		FROM artists
+		WHERE spotify_id = $1
+			AND genres_fetched_at IS NOT NULL`,
+		covenant.SpotifyID,
+	).Scan(pq.Array(&genres))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ebm", "futurepop"}, genres)
+}
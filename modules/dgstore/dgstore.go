@@ -0,0 +1,640 @@
+package dgstore
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/brandur/deathguild/modules/dgcommon"
+	"github.com/brandur/deathguild/modules/dgnormalize"
+	"github.com/brandur/deathguild/modules/dgvalidate"
+	"github.com/lib/pq"
+)
+
+// Possible values of `playlists.status`.
+const (
+	// PlaylistStatusPublished is the status of a playlist that shows up on
+	// the site and in Spotify.
+	PlaylistStatusPublished = "published"
+
+	// PlaylistStatusQuarantined is the status of a playlist that looked
+	// suspicious when it was stored and is being held back for review.
+	PlaylistStatusQuarantined = "quarantined"
+)
+
+// FlaggedPlaylist is a playlist that had issues when it was validated.
+type FlaggedPlaylist struct {
+	Day              string              `json:"day"`
+	Status           string              `json:"status"`
+	ValidationIssues []*dgvalidate.Issue `json:"issues"`
+	ValidationScore  int                 `json:"score"`
+}
+
+// StoredPlaylist is summary information on a playlist that's already been
+// stored.
+type StoredPlaylist struct {
+	// ID is the local database identifier of the playlist.
+	ID int
+
+	// SongsHash is a hash of the playlist's contents as produced by
+	// SongsHash.
+	SongsHash string
+}
+
+// FetchFlaggedPlaylists retrieves a source's playlists that are quarantined
+// along with their issues, highest scoring first. If includePublished is
+// set, published playlists with issues that weren't serious enough to
+// quarantine them (or that were published after review) are included too.
+func FetchFlaggedPlaylists(txn *sql.Tx, source string,
+	includePublished bool) ([]*FlaggedPlaylist, error) {
+
+	rows, err := txn.Query(`
+		SELECT day, status, validation_issues, validation_score
+		FROM playlists
+		WHERE source = $1
+			AND (status = $2
+				OR ($3 AND validation_score > 0))
+		ORDER BY validation_score DESC, day DESC`,
+		source,
+		PlaylistStatusQuarantined,
+		includePublished,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var playlists []*FlaggedPlaylist
+
+	for rows.Next() {
+		var playlist FlaggedPlaylist
+		var day time.Time
+		var issuesJSON []byte
+
+		err = rows.Scan(
+			&day,
+			&playlist.Status,
+			&issuesJSON,
+			&playlist.ValidationScore,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		playlist.Day = day.Format("2006-01-02")
+
+		err = json.Unmarshal(issuesJSON, &playlist.ValidationIssues)
+		if err != nil {
+			return nil, err
+		}
+
+		playlists = append(playlists, &playlist)
+	}
+
+	return playlists, rows.Err()
+}
+
+// FetchStoredSongs retrieves the songs currently stored for a playlist in the
+// order that they were played.
+func FetchStoredSongs(txn *sql.Tx, playlistID int) ([]*dgcommon.Song, error) {
+	rows, err := txn.Query(`
+		SELECT s.artist, s.title
+		FROM playlists_songs ps
+		INNER JOIN songs s ON ps.songs_id = s.id
+		WHERE ps.playlists_id = $1
+		ORDER BY ps.position`,
+		playlistID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var songs []*dgcommon.Song
+
+	for rows.Next() {
+		var song dgcommon.Song
+		err = rows.Scan(
+			&song.Artist,
+			&song.Title,
+		)
+		if err != nil {
+			return nil, err
+		}
+		songs = append(songs, &song)
+	}
+
+	return songs, rows.Err()
+}
+
+// LookupPlaylist finds a stored playlist for the given source and day. It
+// returns nil if there isn't one.
+func LookupPlaylist(txn *sql.Tx, source, day string) (*StoredPlaylist, error) {
+	var playlistID int
+	var songsHash *string
+	err := txn.QueryRow(`
+		SELECT id, songs_hash
+		FROM playlists
+		WHERE source = $1
+			AND day = $2`,
+		source,
+		day,
+	).Scan(&playlistID, &songsHash)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Playlists stored before we started storing hashes won't have one, so
+	// compute one from what's in the database instead.
+	if songsHash == nil {
+		storedSongs, err := FetchStoredSongs(txn, playlistID)
+		if err != nil {
+			return nil, err
+		}
+
+		hash := SongsHash(storedSongs)
+		songsHash = &hash
+	}
+
+	return &StoredPlaylist{ID: playlistID, SongsHash: *songsHash}, nil
+}
+
+// StoredDays returns the days of every playlist stored for a source.
+func StoredDays(txn *sql.Tx, source string) (map[string]bool, error) {
+	rows, err := txn.Query(`
+		SELECT day
+		FROM playlists
+		WHERE source = $1`,
+		source,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	days := make(map[string]bool)
+
+	for rows.Next() {
+		var day time.Time
+		err = rows.Scan(&day)
+		if err != nil {
+			return nil, err
+		}
+		days[day.Format("2006-01-02")] = true
+	}
+
+	return days, rows.Err()
+}
+
+// MarkPlaylistsForSync flags every playlist that any of the songs with the
+// given IDs were played in so that its Spotify playlist gets synced again.
+// Special playlists don't need to be flagged since `dg-create-playlists`
+// rebuilds all of them every time that it runs.
+func MarkPlaylistsForSync(txn *sql.Tx, songIDs []int) error {
+	if len(songIDs) == 0 {
+		return nil
+	}
+
+	_, err := txn.Exec(`
+		UPDATE playlists
+		SET spotify_needs_sync = true
+		WHERE id IN (
+			SELECT playlists_id
+			FROM playlists_songs
+			WHERE songs_id = any($1)
+		)`,
+		pq.Array(songIDs),
+	)
+	if err != nil {
+		return fmt.Errorf("Error updating `playlists`: %v", err)
+	}
+
+	return nil
+}
+
+// SetPlaylistProvenance records where a stored playlist came from.
+func SetPlaylistProvenance(txn *sql.Tx, source, day, provenance string) error {
+	_, err := txn.Exec(`
+		UPDATE playlists
+		SET provenance = $3
+		WHERE source = $1
+			AND day = $2`,
+		source,
+		day,
+		provenance,
+	)
+	if err != nil {
+		return fmt.Errorf("Error updating `playlists`: %v", err)
+	}
+
+	return nil
+}
+
+// SetPlaylistStatus changes the status of a stored playlist after it's been
+// reviewed. The playlist keeps the status from then on, even when it's stored
+// again. It returns false if there's no playlist for the day.
+func SetPlaylistStatus(txn *sql.Tx, source, day, status string) (bool, error) {
+	res, err := txn.Exec(`
+		UPDATE playlists
+		SET reviewed_at = NOW(),
+			status = $3
+		WHERE source = $1
+			AND day = $2`,
+		source,
+		day,
+		status,
+	)
+	if err != nil {
+		return false, fmt.Errorf("Error updating `playlists`: %v", err)
+	}
+
+	numRows, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return numRows > 0, nil
+}
+
+// SetSongSpotifyID sets the Spotify ID of the song with the given artist and
+// title (or a spelling of them with the same normalized key), marking it as
+// checked so that enrichment leaves it alone. IDs set this way don't have a
+// match score or strategy. Overrides made by hand win, so a song that's
+// pinned or not on Spotify, or that has the track rejected, isn't changed. It
+// returns the IDs of the songs that changed, which is none if they already
+// had that ID.
+func SetSongSpotifyID(txn *sql.Tx, artist, title, spotifyID string) ([]int, error) {
+	songIDs, err := queryIDs(txn, `
+		UPDATE songs
+		SET spotify_attempts = 0,
+			spotify_checked_at = NOW(),
+			spotify_enrichment_runs_id = NULL,
+			spotify_id = $2,
+			spotify_match_score = NULL,
+			spotify_match_strategy = NULL,
+			spotify_next_check_at = NULL
+		WHERE normalized_key = $1
+			AND spotify_id IS DISTINCT FROM $2
+			AND NOT EXISTS (
+				SELECT 1
+				FROM song_spotify_overrides o
+				WHERE o.normalized_key = $1
+					AND (o.kind IN ('not_on_spotify', 'pin')
+						OR (o.kind = 'reject' AND o.spotify_id = $2))
+			)
+		RETURNING id`,
+		dgnormalize.SongKey(artist, title),
+		spotifyID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("Error updating `songs`: %v", err)
+	}
+
+	return songIDs, nil
+}
+
+// SongsHash produces a hash of a playlist's contents that changes if any of
+// its songs are added, removed, edited, or reordered.
+func SongsHash(songs []*dgcommon.Song) string {
+	h := sha256.New()
+	for _, song := range songs {
+		fmt.Fprintf(h, "%s\t%s\n", song.Artist, song.Title)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// UpsertResult describes what UpsertPlaylistAndSongs changed.
+type UpsertResult struct {
+	// PlaylistCreated is true if the playlist didn't exist before and false
+	// if an existing one was rewritten.
+	PlaylistCreated bool
+
+	// SongsCreated are the songs that didn't exist before, in the order that
+	// they first appear in the playlist.
+	SongsCreated []*dgcommon.Song
+
+	// Status is the playlist's status after it was stored. It's not
+	// necessarily the one that Validation would give it (see
+	// UpsertPlaylistAndSongs).
+	Status string
+
+	// Validation is the result of validating the playlist's songs.
+	Validation *dgvalidate.Result
+}
+
+// UpsertPlaylistAndSongs stores a playlist and its songs. If the playlist
+// already exists its songs are rewritten to match the ones given and it's
+// flagged so that its Spotify playlist gets synced again.
+//
+// The songs are validated on the way in, and a playlist that looks like it
+// was scraped wrong is quarantined so that it's not published until somebody
+// reviews it. That applies to a playlist that was published before too, but
+// validation never publishes a playlist that was quarantined, and a playlist
+// that's been reviewed with SetPlaylistStatus keeps the status that it was
+// given no matter how its songs change.
+func UpsertPlaylistAndSongs(txn *sql.Tx, source, day string,
+	songs []*dgcommon.Song) (*UpsertResult, error) {
+
+	result := UpsertResult{Validation: dgvalidate.Validate(songs)}
+
+	status := PlaylistStatusPublished
+	if result.Validation.Quarantined() {
+		status = PlaylistStatusQuarantined
+	}
+
+	issues := result.Validation.Issues
+	if issues == nil {
+		issues = []*dgvalidate.Issue{}
+	}
+
+	issuesJSON, err := json.Marshal(issues)
+	if err != nil {
+		return nil, err
+	}
+
+	// `xmax` is only zero for a row version that was freshly inserted, which
+	// is how we tell an insert from an update when upserting.
+	var playlistID int
+	err = txn.QueryRow(`
+		INSERT INTO playlists
+			(source, day, songs_hash, status, validation_issues, validation_score)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (source, day) DO UPDATE
+			SET songs_hash = excluded.songs_hash,
+				spotify_needs_sync = true,
+				status = CASE
+					WHEN playlists.reviewed_at IS NULL AND excluded.status = $7
+						THEN excluded.status
+					ELSE playlists.status
+				END,
+				validation_issues = excluded.validation_issues,
+				validation_score = excluded.validation_score
+		RETURNING id, (xmax = 0), status`,
+		source,
+		day,
+		SongsHash(songs),
+		status,
+		string(issuesJSON),
+		result.Validation.Score,
+		PlaylistStatusQuarantined,
+	).Scan(&playlistID, &result.PlaylistCreated, &result.Status)
+	if err != nil {
+		return nil, fmt.Errorf("Error inserting into `playlists`: %v", err)
+	}
+
+	for i, song := range songs {
+		songID, songCreated, err := upsertSong(txn, song)
+		if err != nil {
+			return nil, err
+		}
+
+		// A song repeated later in the same playlist conflicts with the row
+		// inserted for its first play, so it's only reported once.
+		if songCreated {
+			result.SongsCreated = append(result.SongsCreated, song)
+		}
+
+		// Each position in the playlist gets its own row, so a song that was
+		// played more than once in a night appears once for every play.
+		_, err = txn.Exec(`
+			INSERT INTO playlists_songs (playlists_id, songs_id, position)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (playlists_id, position) DO UPDATE
+				SET songs_id = excluded.songs_id`,
+			playlistID,
+			songID,
+			i,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("Error inserting into `playlists_songs`: %v", err)
+		}
+	}
+
+	// If we're rewriting a playlist that got shorter, get rid of any
+	// positions beyond its new end.
+	_, err = txn.Exec(`
+		DELETE FROM playlists_songs
+		WHERE playlists_id = $1
+			AND position >= $2`,
+		playlistID,
+		len(songs),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("Error deleting from `playlists_songs`: %v", err)
+	}
+
+	return &result, nil
+}
+
+// upsertSong finds the stored song that matches the given one or creates it
+// if there isn't one. Songs are matched on their normalized key so that a
+// song spelled a little differently than it was the first time doesn't get
+// stored twice. The new spelling is recorded as an alias instead.
+func upsertSong(txn *sql.Tx, song *dgcommon.Song) (int, bool, error) {
+	key := dgnormalize.SongKey(song.Artist, song.Title)
+
+	// Prefer an exact match in case there are several songs with the same
+	// key that haven't been merged yet.
+	var songID int
+	var artist, title string
+	err := txn.QueryRow(`
+		SELECT id, artist, title
+		FROM songs
+		WHERE normalized_key = $1
+			OR (artist = $2 AND title = $3)
+		ORDER BY (artist = $2 AND title = $3) DESC, id
+		LIMIT 1`,
+		key,
+		song.Artist,
+		song.Title,
+	).Scan(&songID, &artist, &title)
+
+	if err == sql.ErrNoRows {
+		// Playlists are stored concurrently, so another transaction may be
+		// inserting the same new song right now. Upsert so that we wait for
+		// it and get its song back instead of violating `unique_songs`. The
+		// row was only created by us if it hasn't been updated (`xmax = 0`).
+		var created bool
+		err = txn.QueryRow(`
+			INSERT INTO songs (artist, title, normalized_key)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (artist, title) DO UPDATE
+				SET artist = excluded.artist
+			RETURNING id, (xmax = 0)`,
+			song.Artist,
+			song.Title,
+			key,
+		).Scan(&songID, &created)
+		if err != nil {
+			return 0, false, fmt.Errorf("Error inserting into `songs`: %v", err)
+		}
+
+		return songID, created, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	if artist != song.Artist || title != song.Title {
+		_, err = txn.Exec(`
+			INSERT INTO song_aliases (songs_id, artist, title)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (artist, title) DO NOTHING`,
+			songID,
+			song.Artist,
+			song.Title,
+		)
+		if err != nil {
+			return 0, false, fmt.Errorf("Error inserting into `song_aliases`: %v", err)
+		}
+	}
+
+	return songID, false, nil
+}
+
+// UpsertPlaylistPage archives the raw body of a playlist's page so that it
+// can be parsed again later without going back to the network. Only the
+// most recently fetched version of a page is kept.
+//
+// A page is usually cached in `http_cache` too, and since the two would be
+// the same, the cached body is dropped in favor of the archived one (see
+// LookupCachedResponse). A cached response that was relying on an archived
+// body that's now being replaced with something else is dropped entirely so
+// that the next request for it isn't conditional.
+func UpsertPlaylistPage(txn *sql.Tx, source, day, url string, body []byte) error {
+	_, err := txn.Exec(`
+		DELETE FROM http_cache
+		WHERE url = $1
+			AND body IS NULL
+			AND NOT EXISTS (
+				SELECT 1
+				FROM playlist_pages
+				WHERE url = $1
+					AND body = $2
+			)`,
+		url,
+		body,
+	)
+	if err != nil {
+		return fmt.Errorf("Error deleting from `http_cache`: %v", err)
+	}
+
+	_, err = txn.Exec(`
+		INSERT INTO playlist_pages (source, day, url, body, fetched_at)
+		VALUES ($1, $2, $3, $4, NOW())
+		ON CONFLICT (source, day) DO UPDATE
+			SET url = excluded.url,
+				body = excluded.body,
+				fetched_at = excluded.fetched_at`,
+		source,
+		day,
+		url,
+		body,
+	)
+	if err != nil {
+		return fmt.Errorf("Error inserting into `playlist_pages`: %v", err)
+	}
+
+	_, err = txn.Exec(`
+		UPDATE http_cache
+		SET body = NULL
+		WHERE url = $1
+			AND body = $2`,
+		url,
+		body,
+	)
+	if err != nil {
+		return fmt.Errorf("Error updating `http_cache`: %v", err)
+	}
+
+	return nil
+}
+
+// CachedResponse is the body of a previously fetched URL along with the
+// validators that the server sent with it. The validators are sent back on
+// the next request so that the server can answer with a 304 if nothing's
+// changed.
+type CachedResponse struct {
+	// Body is the body of the response.
+	Body []byte
+
+	// ETag is the value of the response's `ETag` header, if it had one.
+	ETag string
+
+	// LastModified is the value of the response's `Last-Modified` header,
+	// if it had one.
+	LastModified string
+}
+
+// LookupCachedResponse finds the cached response for a URL. The body of a
+// playlist page comes from its archived version in `playlist_pages` (see
+// UpsertPlaylistPage). It returns nil if there isn't a response.
+func LookupCachedResponse(txn *sql.Tx, url string) (*CachedResponse, error) {
+	var resp CachedResponse
+	var hasBody bool
+	err := txn.QueryRow(`
+		SELECT COALESCE(c.body, pp.body), COALESCE(c.body, pp.body) IS NOT NULL,
+			c.etag, c.last_modified
+		FROM http_cache c
+			LEFT JOIN LATERAL (
+				SELECT body
+				FROM playlist_pages
+				WHERE url = c.url
+				ORDER BY fetched_at DESC
+				LIMIT 1
+			) pp ON true
+		WHERE c.url = $1`,
+		url,
+	).Scan(&resp.Body, &hasBody, &resp.ETag, &resp.LastModified)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The page that the body was left to has gone missing, so the response
+	// can't be used.
+	if !hasBody {
+		return nil, nil
+	}
+
+	return &resp, nil
+}
+
+// UpsertCachedResponse stores the response for a URL, replacing any that was
+// cached before. The body isn't stored if it's already archived in
+// `playlist_pages`.
+func UpsertCachedResponse(txn *sql.Tx, url string, resp *CachedResponse) error {
+	_, err := txn.Exec(`
+		INSERT INTO http_cache (url, body, etag, last_modified, fetched_at)
+		VALUES ($1,
+			CASE WHEN EXISTS (
+				SELECT 1
+				FROM playlist_pages
+				WHERE url = $1
+					AND body = $2
+			) THEN NULL ELSE $2 END,
+			$3, $4, NOW())
+		ON CONFLICT (url) DO UPDATE
+			SET body = excluded.body,
+				etag = excluded.etag,
+				last_modified = excluded.last_modified,
+				fetched_at = excluded.fetched_at`,
+		url,
+		resp.Body,
+		resp.ETag,
+		resp.LastModified,
+	)
+	if err != nil {
+		return fmt.Errorf("Error inserting into `http_cache`: %v", err)
+	}
+
+	return nil
+}
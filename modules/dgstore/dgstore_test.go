@@ -0,0 +1,702 @@
+package dgstore
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/brandur/deathguild/modules/dgcommon"
+	"github.com/brandur/deathguild/modules/dgtesting"
+	assert "github.com/stretchr/testify/require"
+)
+
+var db = dgtesting.DB
+
+func TestSetPlaylistProvenance(t *testing.T) {
+	txn, err := db.Begin()
+	assert.NoError(t, err)
+	defer func() {
+		err := txn.Rollback()
+		assert.NoError(t, err)
+	}()
+
+	_, err = UpsertPlaylistAndSongs(txn, "deathguild", "2005-01-31", []*dgcommon.Song{
+		{Artist: "Depeche Mode", Title: "Two Minute Warning"},
+	})
+	assert.NoError(t, err)
+
+	err = SetPlaylistProvenance(txn, "deathguild", "2005-01-31", "warc:captures.warc.gz")
+	assert.NoError(t, err)
+
+	var provenance string
+	err = txn.QueryRow(`
+		SELECT provenance
+		FROM playlists
+		WHERE source = $1
+			AND day = $2`,
+		"deathguild",
+		"2005-01-31",
+	).Scan(&provenance)
+	assert.NoError(t, err)
+	assert.Equal(t, "warc:captures.warc.gz", provenance)
+}
+
+func TestSetSongSpotifyID(t *testing.T) {
+	txn, err := db.Begin()
+	assert.NoError(t, err)
+	defer func() {
+		err := txn.Rollback()
+		assert.NoError(t, err)
+	}()
+
+	_, err = UpsertPlaylistAndSongs(txn, "deathguild", "2016-01-01", []*dgcommon.Song{
+		{Artist: "Depeche Mode", Title: "Two Minute Warning"},
+	})
+	assert.NoError(t, err)
+
+	updated, err := SetSongSpotifyID(txn, "Depeche Mode", "Two Minute Warning",
+		"6TwdTfAn4YNGYhkWPhgQ6C")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(updated))
+
+	// Setting the same ID again is a no-op.
+	updated, err = SetSongSpotifyID(txn, "Depeche Mode", "Two Minute Warning",
+		"6TwdTfAn4YNGYhkWPhgQ6C")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(updated))
+
+	var spotifyID string
+	err = txn.QueryRow(`
+		SELECT spotify_id
+		FROM songs
+		WHERE artist = $1
+			AND title = $2
+			AND spotify_checked_at IS NOT NULL`,
+		"Depeche Mode",
+		"Two Minute Warning",
+	).Scan(&spotifyID)
+	assert.NoError(t, err)
+	assert.Equal(t, "6TwdTfAn4YNGYhkWPhgQ6C", spotifyID)
+
+	// Overrides made by hand win.
+	err = UpsertSpotifyOverride(txn, &SpotifyOverride{
+		Kind:      OverrideReject,
+		Artist:    "Depeche Mode",
+		Title:     "Two Minute Warning",
+		SpotifyID: "rejected-id",
+	})
+	assert.NoError(t, err)
+
+	updated, err = SetSongSpotifyID(txn, "Depeche Mode", "Two Minute Warning", "rejected-id")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(updated))
+
+	err = UpsertSpotifyOverride(txn, &SpotifyOverride{
+		Kind:      OverridePin,
+		Artist:    "Depeche Mode",
+		Title:     "Two Minute Warning",
+		SpotifyID: "pinned-id",
+	})
+	assert.NoError(t, err)
+
+	updated, err = SetSongSpotifyID(txn, "Depeche Mode", "Two Minute Warning", "other-id")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(updated))
+}
+
+func TestSongsHash(t *testing.T) {
+	songs := []*dgcommon.Song{
+		{Artist: "Depeche Mode", Title: "Two Minute Warning"},
+		{Artist: "Imperative Reaction", Title: "You Remain"},
+	}
+
+	// Stable across calls and unaffected by fields other than artist/title.
+	assert.Equal(t, SongsHash(songs), SongsHash([]*dgcommon.Song{
+		{Artist: "Depeche Mode", Title: "Two Minute Warning", SpotifyID: "spotify-id"},
+		{Artist: "Imperative Reaction", Title: "You Remain"},
+	}))
+
+	// Reordered
+	assert.NotEqual(t, SongsHash(songs), SongsHash([]*dgcommon.Song{
+		songs[1], songs[0],
+	}))
+
+	// Removed
+	assert.NotEqual(t, SongsHash(songs), SongsHash(songs[0:1]))
+
+	// Edited
+	assert.NotEqual(t, SongsHash(songs), SongsHash([]*dgcommon.Song{
+		songs[0],
+		{Artist: "Imperative Reaction", Title: "You Remain (Remix)"},
+	}))
+}
+
+func TestStoredDays(t *testing.T) {
+	txn, err := db.Begin()
+	assert.NoError(t, err)
+	defer func() {
+		err := txn.Rollback()
+		assert.NoError(t, err)
+	}()
+
+	songs := []*dgcommon.Song{
+		{Artist: "Depeche Mode", Title: "Two Minute Warning"},
+	}
+
+	_, err = UpsertPlaylistAndSongs(txn, "deathguild", "2016-01-01", songs)
+	assert.NoError(t, err)
+	_, err = UpsertPlaylistAndSongs(txn, "deathguild", "2016-01-04", songs)
+	assert.NoError(t, err)
+	_, err = UpsertPlaylistAndSongs(txn, "other", "2016-01-02", songs)
+	assert.NoError(t, err)
+
+	days, err := StoredDays(txn, "deathguild")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"2016-01-01": true, "2016-01-04": true}, days)
+}
+
+func TestUpsertPlaylistAndSongs(t *testing.T) {
+	txn, err := db.Begin()
+	assert.NoError(t, err)
+	defer func() {
+		err := txn.Rollback()
+		assert.NoError(t, err)
+	}()
+
+	day := "2016-01-01"
+	songs := []*dgcommon.Song{
+		{Artist: "Depeche Mode", Title: "Two Minute Warning"},
+		{Artist: "Imperative Reaction", Title: "You Remain"},
+	}
+
+	result, err := UpsertPlaylistAndSongs(txn, "deathguild", day, songs)
+	assert.NoError(t, err)
+	assert.True(t, result.PlaylistCreated)
+	assert.Equal(t, songs, result.SongsCreated)
+
+	var playlistID string
+	err = txn.QueryRow(`
+		SELECT id
+		FROM playlists
+		WHERE source = $1
+			AND day = $2`,
+		"deathguild",
+		day,
+	).Scan(&playlistID)
+	assert.NoError(t, err)
+
+	assert.NotEqual(t, 0, playlistID)
+
+	for _, song := range songs {
+		var songID string
+		err = txn.QueryRow(`
+			SELECT id
+			FROM songs
+			WHERE artist = $1 AND title = $2`,
+			song.Artist, song.Title,
+		).Scan(&songID)
+		assert.NoError(t, err)
+
+		assert.NotEqual(t, 0, songID)
+
+		var playlistSongID string
+		err = txn.QueryRow(`
+			SELECT id
+			FROM playlists_songs
+			WHERE playlists_id = $1 AND songs_id = $2`,
+			playlistID, songID,
+		).Scan(&playlistSongID)
+		assert.NoError(t, err)
+
+		assert.NotEqual(t, 0, songID)
+	}
+}
+
+func TestUpsertPlaylistAndSongsRewrite(t *testing.T) {
+	txn, err := db.Begin()
+	assert.NoError(t, err)
+	defer func() {
+		err := txn.Rollback()
+		assert.NoError(t, err)
+	}()
+
+	day := "2016-01-01"
+
+	_, err = UpsertPlaylistAndSongs(txn, "deathguild", day, []*dgcommon.Song{
+		{Artist: "Depeche Mode", Title: "Two Minute Warning"},
+		{Artist: "Imperative Reaction", Title: "You Remain"},
+		{Artist: "Panic Lift", Title: "The Path"},
+	})
+	assert.NoError(t, err)
+
+	var playlistID int
+	err = txn.QueryRow(`
+		SELECT id
+		FROM playlists
+		WHERE source = $1
+			AND day = $2`,
+		"deathguild",
+		day,
+	).Scan(&playlistID)
+	assert.NoError(t, err)
+
+	_, err = txn.Exec(`
+		UPDATE playlists
+		SET spotify_id = 'spotify-id'
+		WHERE id = $1`,
+		playlistID,
+	)
+	assert.NoError(t, err)
+
+	// The fixed tracklist swaps two songs around and drops the last one.
+	songs := []*dgcommon.Song{
+		{Artist: "Imperative Reaction", Title: "You Remain"},
+		{Artist: "Depeche Mode", Title: "Two Minute Warning"},
+	}
+
+	result, err := UpsertPlaylistAndSongs(txn, "deathguild", day, songs)
+	assert.NoError(t, err)
+	assert.False(t, result.PlaylistCreated)
+	assert.Empty(t, result.SongsCreated)
+
+	storedSongs, err := FetchStoredSongs(txn, playlistID)
+	assert.NoError(t, err)
+	assert.Equal(t, songs, storedSongs)
+
+	var songsHashValue string
+	var spotifyNeedsSync bool
+	err = txn.QueryRow(`
+		SELECT songs_hash, spotify_needs_sync
+		FROM playlists
+		WHERE id = $1`,
+		playlistID,
+	).Scan(&songsHashValue, &spotifyNeedsSync)
+	assert.NoError(t, err)
+
+	assert.Equal(t, SongsHash(songs), songsHashValue)
+	assert.True(t, spotifyNeedsSync)
+}
+
+func TestUpsertPlaylistAndSongsRepeats(t *testing.T) {
+	txn, err := db.Begin()
+	assert.NoError(t, err)
+	defer func() {
+		err := txn.Rollback()
+		assert.NoError(t, err)
+	}()
+
+	day := "2016-01-01"
+	songs := []*dgcommon.Song{
+		{Artist: "Depeche Mode", Title: "Two Minute Warning"},
+		{Artist: "Imperative Reaction", Title: "You Remain"},
+		{Artist: "Depeche Mode", Title: "Two Minute Warning"},
+	}
+
+	result, err := UpsertPlaylistAndSongs(txn, "deathguild", day, songs)
+	assert.NoError(t, err)
+
+	// The repeated song was only created once.
+	assert.Equal(t, songs[0:2], result.SongsCreated)
+
+	var playlistID int
+	err = txn.QueryRow(`
+		SELECT id
+		FROM playlists
+		WHERE source = $1
+			AND day = $2`,
+		"deathguild",
+		day,
+	).Scan(&playlistID)
+	assert.NoError(t, err)
+
+	// Both plays of the repeated song should have kept their positions.
+	storedSongs, err := FetchStoredSongs(txn, playlistID)
+	assert.NoError(t, err)
+	assert.Equal(t, songs, storedSongs)
+
+	// Only two distinct songs though.
+	var numSongs int
+	err = txn.QueryRow(`
+		SELECT count(distinct(songs_id))
+		FROM playlists_songs
+		WHERE playlists_id = $1`,
+		playlistID,
+	).Scan(&numSongs)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, numSongs)
+}
+
+func TestUpsertSongConcurrently(t *testing.T) {
+	song := &dgcommon.Song{Artist: "Haujobb", Title: "Let's Drop Bombs"}
+
+	txn1, err := db.Begin()
+	assert.NoError(t, err)
+
+	songID, created, err := upsertSong(txn1, song)
+	assert.NoError(t, err)
+	assert.True(t, created)
+
+	// A second transaction storing the same new song waits for the first
+	// one instead of failing on `unique_songs`, and gets its song back.
+	type upsertResult struct {
+		songID  int
+		created bool
+		err     error
+	}
+	results := make(chan upsertResult)
+
+	txn2, err := db.Begin()
+	assert.NoError(t, err)
+
+	go func() {
+		songID, created, err := upsertSong(txn2, song)
+		results <- upsertResult{songID, created, err}
+	}()
+
+	err = txn1.Commit()
+	assert.NoError(t, err)
+
+	result := <-results
+	assert.NoError(t, result.err)
+	assert.Equal(t, songID, result.songID)
+	assert.False(t, result.created)
+
+	// The first transaction's song was committed, so it has to be cleaned
+	// up by hand.
+	err = txn2.Rollback()
+	assert.NoError(t, err)
+	_, err = db.Exec(`DELETE FROM songs WHERE id = $1`, songID)
+	assert.NoError(t, err)
+}
+
+func TestUpsertPlaylistAndSongsSpellings(t *testing.T) {
+	txn, err := db.Begin()
+	assert.NoError(t, err)
+	defer func() {
+		err := txn.Rollback()
+		assert.NoError(t, err)
+	}()
+
+	_, err = UpsertPlaylistAndSongs(txn, "deathguild", "2016-01-01", []*dgcommon.Song{
+		{Artist: "The Cure", Title: "A Forest"},
+	})
+	assert.NoError(t, err)
+
+	// A different spelling of the same song matches the one already stored.
+	result, err := UpsertPlaylistAndSongs(txn, "deathguild", "2016-01-04", []*dgcommon.Song{
+		{Artist: "Cure", Title: "A  FOREST"},
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, result.SongsCreated)
+
+	var numSongs int
+	err = txn.QueryRow(`
+		SELECT count(*)
+		FROM songs`,
+	).Scan(&numSongs)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, numSongs)
+
+	// The new spelling is kept as an alias.
+	var artist, title string
+	err = txn.QueryRow(`
+		SELECT a.artist, a.title
+		FROM song_aliases a
+			INNER JOIN songs s
+				ON s.id = a.songs_id
+		WHERE s.artist = $1
+			AND s.title = $2`,
+		"The Cure",
+		"A Forest",
+	).Scan(&artist, &title)
+	assert.NoError(t, err)
+	assert.Equal(t, "Cure", artist)
+	assert.Equal(t, "A  FOREST", title)
+
+	// Setting a Spotify ID works from any spelling.
+	updated, err := SetSongSpotifyID(txn, "cure, the", "a forest", "1JSLLcD4RKl8TZwBNhV5UX")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(updated))
+}
+
+func TestLookupPlaylist(t *testing.T) {
+	txn, err := db.Begin()
+	assert.NoError(t, err)
+	defer func() {
+		err := txn.Rollback()
+		assert.NoError(t, err)
+	}()
+
+	day := "2016-01-01"
+	songs := []*dgcommon.Song{
+		{Artist: "Depeche Mode", Title: "Two Minute Warning"},
+		{Artist: "Imperative Reaction", Title: "You Remain"},
+	}
+
+	playlist, err := LookupPlaylist(txn, "deathguild", day)
+	assert.NoError(t, err)
+	assert.Nil(t, playlist)
+
+	_, err = UpsertPlaylistAndSongs(txn, "deathguild", day, songs)
+	assert.NoError(t, err)
+
+	playlist, err = LookupPlaylist(txn, "deathguild", day)
+	assert.NoError(t, err)
+	assert.NotEqual(t, 0, playlist.ID)
+	assert.Equal(t, SongsHash(songs), playlist.SongsHash)
+
+	// Playlists stored without a hash get one computed from their songs.
+	_, err = txn.Exec(`
+		UPDATE playlists
+		SET songs_hash = NULL
+		WHERE id = $1`,
+		playlist.ID,
+	)
+	assert.NoError(t, err)
+
+	playlist, err = LookupPlaylist(txn, "deathguild", day)
+	assert.NoError(t, err)
+	assert.Equal(t, SongsHash(songs), playlist.SongsHash)
+
+	// Other sources are kept separate.
+	playlist, err = LookupPlaylist(txn, "other", day)
+	assert.NoError(t, err)
+	assert.Nil(t, playlist)
+}
+
+func TestUpsertPlaylistPage(t *testing.T) {
+	txn, err := db.Begin()
+	assert.NoError(t, err)
+	defer func() {
+		err := txn.Rollback()
+		assert.NoError(t, err)
+	}()
+
+	day := "2016-01-01"
+	url := "http://www.deathguild.com/playlist/2016-01-01"
+
+	err = UpsertPlaylistPage(txn, "deathguild", day, url, []byte("first"))
+	assert.NoError(t, err)
+
+	// A page fetched again replaces the old version.
+	err = UpsertPlaylistPage(txn, "deathguild", day, url, []byte("second"))
+	assert.NoError(t, err)
+
+	var body []byte
+	err = txn.QueryRow(`
+		SELECT body
+		FROM playlist_pages
+		WHERE source = $1
+			AND day = $2`,
+		"deathguild",
+		day,
+	).Scan(&body)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("second"), body)
+}
+
+func TestUpsertCachedResponse(t *testing.T) {
+	txn, err := db.Begin()
+	assert.NoError(t, err)
+	defer func() {
+		err := txn.Rollback()
+		assert.NoError(t, err)
+	}()
+
+	url := "http://www.deathguild.com/playdates"
+
+	resp, err := LookupCachedResponse(txn, url)
+	assert.NoError(t, err)
+	assert.Nil(t, resp)
+
+	err = UpsertCachedResponse(txn, url, &CachedResponse{
+		Body: []byte("first"),
+		ETag: `"abc"`,
+	})
+	assert.NoError(t, err)
+
+	// A newer response replaces the old one.
+	err = UpsertCachedResponse(txn, url, &CachedResponse{
+		Body:         []byte("second"),
+		LastModified: "Fri, 20 Jul 2018 12:00:00 GMT",
+	})
+	assert.NoError(t, err)
+
+	resp, err = LookupCachedResponse(txn, url)
+	assert.NoError(t, err)
+	assert.Equal(t, &CachedResponse{
+		Body:         []byte("second"),
+		LastModified: "Fri, 20 Jul 2018 12:00:00 GMT",
+	}, resp)
+}
+
+func TestUpsertCachedResponsePlaylistPage(t *testing.T) {
+	txn, err := db.Begin()
+	assert.NoError(t, err)
+	defer func() {
+		err := txn.Rollback()
+		assert.NoError(t, err)
+	}()
+
+	day := "2016-01-01"
+	url := "http://www.deathguild.com/playlist/2016-01-01"
+
+	cachedBody := func() []byte {
+		var body []byte
+		err := txn.QueryRow(`
+			SELECT body
+			FROM http_cache
+			WHERE url = $1`,
+			url,
+		).Scan(&body)
+		assert.NoError(t, err)
+		return body
+	}
+
+	err = UpsertCachedResponse(txn, url, &CachedResponse{
+		Body: []byte("first"),
+		ETag: `"abc"`,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("first"), cachedBody())
+
+	// Once the page is archived, its body is only stored there.
+	err = UpsertPlaylistPage(txn, "deathguild", day, url, []byte("first"))
+	assert.NoError(t, err)
+	assert.Nil(t, cachedBody())
+
+	resp, err := LookupCachedResponse(txn, url)
+	assert.NoError(t, err)
+	assert.Equal(t, &CachedResponse{
+		Body: []byte("first"),
+		ETag: `"abc"`,
+	}, resp)
+
+	// The same goes for a response cached after the page was archived.
+	err = UpsertCachedResponse(txn, url, &CachedResponse{
+		Body: []byte("first"),
+		ETag: `"def"`,
+	})
+	assert.NoError(t, err)
+	assert.Nil(t, cachedBody())
+
+	// Archiving a different body leaves the cached response without one, so
+	// it's dropped.
+	err = UpsertPlaylistPage(txn, "deathguild", day, url, []byte("second"))
+	assert.NoError(t, err)
+
+	resp, err = LookupCachedResponse(txn, url)
+	assert.NoError(t, err)
+	assert.Nil(t, resp)
+}
+
+func TestUpsertPlaylistAndSongsQuarantine(t *testing.T) {
+	txn, err := db.Begin()
+	assert.NoError(t, err)
+	defer func() {
+		err := txn.Rollback()
+		assert.NoError(t, err)
+	}()
+
+	day := "2016-01-01"
+
+	// A header row slipped through.
+	songs := validSongs(20)
+	songs[0] = &dgcommon.Song{Artist: "Artist", Title: "Title"}
+
+	result, err := UpsertPlaylistAndSongs(txn, "deathguild", day, songs)
+	assert.NoError(t, err)
+	assert.True(t, result.Validation.Quarantined())
+	assert.Equal(t, PlaylistStatusQuarantined, result.Status)
+
+	flagged, err := FetchFlaggedPlaylists(txn, "deathguild", false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(flagged))
+	assert.Equal(t, day, flagged[0].Day)
+	assert.Equal(t, PlaylistStatusQuarantined, flagged[0].Status)
+	assert.Equal(t, result.Validation.Issues, flagged[0].ValidationIssues)
+	assert.Equal(t, result.Validation.Score, flagged[0].ValidationScore)
+
+	// Fixing it isn't enough to publish it. That takes a review.
+	result, err = UpsertPlaylistAndSongs(txn, "deathguild", day, validSongs(20))
+	assert.NoError(t, err)
+	assert.False(t, result.Validation.Quarantined())
+	assert.Equal(t, PlaylistStatusQuarantined, result.Status)
+
+	flagged, err = FetchFlaggedPlaylists(txn, "deathguild", false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(flagged))
+	assert.Equal(t, 0, flagged[0].ValidationScore)
+
+	// A playlist that was published is quarantined when it goes bad.
+	day = "2016-01-08"
+
+	result, err = UpsertPlaylistAndSongs(txn, "deathguild", day, validSongs(20))
+	assert.NoError(t, err)
+	assert.Equal(t, PlaylistStatusPublished, result.Status)
+
+	result, err = UpsertPlaylistAndSongs(txn, "deathguild", day, songs)
+	assert.NoError(t, err)
+	assert.Equal(t, PlaylistStatusQuarantined, result.Status)
+}
+
+func TestSetPlaylistStatus(t *testing.T) {
+	txn, err := db.Begin()
+	assert.NoError(t, err)
+	defer func() {
+		err := txn.Rollback()
+		assert.NoError(t, err)
+	}()
+
+	day := "2016-01-01"
+
+	// Short enough to be quarantined.
+	_, err = UpsertPlaylistAndSongs(txn, "deathguild", day, validSongs(2))
+	assert.NoError(t, err)
+
+	updated, err := SetPlaylistStatus(txn, "deathguild", day, PlaylistStatusPublished)
+	assert.NoError(t, err)
+	assert.True(t, updated)
+
+	// Published after review, it only shows up when asking for everything.
+	flagged, err := FetchFlaggedPlaylists(txn, "deathguild", false)
+	assert.NoError(t, err)
+	assert.Empty(t, flagged)
+
+	flagged, err = FetchFlaggedPlaylists(txn, "deathguild", true)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(flagged))
+	assert.Equal(t, PlaylistStatusPublished, flagged[0].Status)
+
+	// The review sticks when the playlist is stored again, even though it
+	// would be quarantined otherwise.
+	result, err := UpsertPlaylistAndSongs(txn, "deathguild", day, validSongs(2))
+	assert.NoError(t, err)
+	assert.True(t, result.Validation.Quarantined())
+	assert.Equal(t, PlaylistStatusPublished, result.Status)
+
+	// And so does quarantining one by hand.
+	updated, err = SetPlaylistStatus(txn, "deathguild", day, PlaylistStatusQuarantined)
+	assert.NoError(t, err)
+	assert.True(t, updated)
+
+	result, err = UpsertPlaylistAndSongs(txn, "deathguild", day, validSongs(20))
+	assert.NoError(t, err)
+	assert.False(t, result.Validation.Quarantined())
+	assert.Equal(t, PlaylistStatusQuarantined, result.Status)
+
+	updated, err = SetPlaylistStatus(txn, "deathguild", "2016-01-04", PlaylistStatusPublished)
+	assert.NoError(t, err)
+	assert.False(t, updated)
+}
+
+// validSongs makes a playlist of n distinct songs that passes validation.
+func validSongs(n int) []*dgcommon.Song {
+	var songs []*dgcommon.Song
+	for i := 0; i < n; i++ {
+		songs = append(songs, &dgcommon.Song{
+			Artist: fmt.Sprintf("Artist %v", i),
+			Title:  fmt.Sprintf("Title %v", i),
+		})
+	}
+	return songs
+}
@@ -0,0 +1,33 @@
+package dgstore
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/brandur/deathguild/modules/dgmusicbrainz"
+	"github.com/lib/pq"
+)
+
+// UpsertMusicBrainzRecording stores a MusicBrainz recording, replacing
+// whatever was stored for it before.
+func UpsertMusicBrainzRecording(txn *sql.Tx, recording *dgmusicbrainz.Recording) error {
+	_, err := txn.Exec(`
+		INSERT INTO musicbrainz_recordings
+			(musicbrainz_id, title, artist, artist_ids, fetched_at)
+		VALUES ($1, $2, $3, $4, NOW())
+		ON CONFLICT (musicbrainz_id) DO UPDATE
+			SET title = excluded.title,
+				artist = excluded.artist,
+				artist_ids = excluded.artist_ids,
+				fetched_at = excluded.fetched_at`,
+		recording.ID,
+		recording.Title,
+		recording.Artist(),
+		pq.Array(recording.ArtistIDs()),
+	)
+	if err != nil {
+		return fmt.Errorf("Error inserting into `musicbrainz_recordings`: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,55 @@
+package dgstore
+
+import (
+	"testing"
+
+	"github.com/brandur/deathguild/modules/dgmusicbrainz"
+	"github.com/lib/pq"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestUpsertMusicBrainzRecording(t *testing.T) {
+	txn, err := db.Begin()
+	assert.NoError(t, err)
+	defer func() {
+		err := txn.Rollback()
+		assert.NoError(t, err)
+	}()
+
+	recording := &dgmusicbrainz.Recording{
+		ArtistCredit: []*dgmusicbrainz.ArtistCredit{
+			{
+				Artist:     &dgmusicbrainz.Artist{ID: "nouvelle-vague-id", Name: "Nouvelle Vague"},
+				JoinPhrase: " feat. ",
+				Name:       "Nouvelle Vague",
+			},
+		},
+		ID:    "forest-id",
+		Title: "A Forest",
+	}
+
+	err = UpsertMusicBrainzRecording(txn, recording)
+	assert.NoError(t, err)
+
+	// Storing the same recording again replaces what was there.
+	recording.ArtistCredit = append(recording.ArtistCredit, &dgmusicbrainz.ArtistCredit{
+		Artist: &dgmusicbrainz.Artist{ID: "melanie-pain-id", Name: "Mélanie Pain"},
+		Name:   "Mélanie Pain",
+	})
+	err = UpsertMusicBrainzRecording(txn, recording)
+	assert.NoError(t, err)
+
+	var artist string
+	var artistIDs []string
+	var numRecordings int
+	err = txn.QueryRow(`
+		SELECT artist, artist_ids, (SELECT count(*) FROM musicbrainz_recordings)
+		FROM musicbrainz_recordings
+		WHERE musicbrainz_id = $1`,
+		recording.ID,
+	).Scan(&artist, pq.Array(&artistIDs), &numRecordings)
+	assert.NoError(t, err)
+	assert.Equal(t, "Nouvelle Vague feat. Mélanie Pain", artist)
+	assert.Equal(t, []string{"nouvelle-vague-id", "melanie-pain-id"}, artistIDs)
+	assert.Equal(t, 1, numRecordings)
+}
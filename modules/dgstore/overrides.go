@@ -0,0 +1,339 @@
+package dgstore
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/brandur/deathguild/modules/dgnormalize"
+)
+
+// Possible values of `song_spotify_overrides.kind`.
+const (
+	// OverrideNotOnSpotify marks a song as not being on Spotify at all so
+	// that enrichment stops looking for it.
+	OverrideNotOnSpotify = "not_on_spotify"
+
+	// OverridePin pins a song to a Spotify track picked by hand.
+	OverridePin = "pin"
+
+	// OverrideReject keeps a Spotify track from ever being used for a song.
+	OverrideReject = "reject"
+)
+
+// SpotifyOverride is a decision made by hand about which Spotify track a song
+// should (or shouldn't) get.
+type SpotifyOverride struct {
+	// Kind is one of OverrideNotOnSpotify, OverridePin, or OverrideReject.
+	Kind string
+
+	// Artist and Title are the song's as they were given when the override
+	// was made. Overrides apply to every spelling of the song with the same
+	// normalized key.
+	Artist string
+	Title  string
+
+	// SpotifyID is the track that's pinned or rejected. It's empty for
+	// OverrideNotOnSpotify.
+	SpotifyID string
+
+	// Note is an optional explanation of why the override was made.
+	Note string
+}
+
+// Validate checks that an override is well-formed.
+func (o *SpotifyOverride) Validate() error {
+	switch o.Kind {
+	case OverrideNotOnSpotify:
+		if o.SpotifyID != "" {
+			return fmt.Errorf("%v override can't have a Spotify ID", o.Kind)
+		}
+	case OverridePin, OverrideReject:
+		if o.SpotifyID == "" {
+			return fmt.Errorf("%v override needs a Spotify ID", o.Kind)
+		}
+	default:
+		return fmt.Errorf("unknown override kind %q", o.Kind)
+	}
+
+	if o.Artist == "" || o.Title == "" {
+		return fmt.Errorf("override needs an artist and a title")
+	}
+
+	return nil
+}
+
+// ApplySpotifyOverrides brings songs in line with their overrides: pinned
+// songs get their pinned track (with a match strategy of `override`), songs
+// that aren't on Spotify lose any track that they had, and songs with a
+// rejected track lose it and are queued to be searched for again. Playlists
+// containing songs that changed are flagged to be synced. It returns the
+// number of songs that changed.
+func ApplySpotifyOverrides(txn *sql.Tx) (int, error) {
+	var songIDs []int
+
+	for _, query := range []string{
+		`
+		UPDATE songs s
+		SET spotify_attempts = 0,
+			spotify_checked_at = NOW(),
+			spotify_enrichment_runs_id = NULL,
+			spotify_id = o.spotify_id,
+			spotify_match_score = NULL,
+			spotify_match_strategy = 'override',
+			spotify_next_check_at = NULL
+		FROM song_spotify_overrides o
+		WHERE o.normalized_key = s.normalized_key
+			AND o.kind = 'pin'
+			AND s.spotify_id IS DISTINCT FROM o.spotify_id
+		RETURNING s.id`,
+		`
+		UPDATE songs s
+		SET spotify_checked_at = NOW(),
+			spotify_enrichment_runs_id = NULL,
+			spotify_id = NULL,
+			spotify_match_score = NULL,
+			spotify_match_strategy = NULL
+		FROM song_spotify_overrides o
+		WHERE o.normalized_key = s.normalized_key
+			AND o.kind = 'not_on_spotify'
+			AND s.spotify_id IS NOT NULL
+		RETURNING s.id`,
+		`
+		UPDATE songs s
+		SET spotify_attempts = 0,
+			spotify_checked_at = NULL,
+			spotify_enrichment_runs_id = NULL,
+			spotify_id = NULL,
+			spotify_match_score = NULL,
+			spotify_match_strategy = NULL,
+			spotify_next_check_at = NULL
+		FROM song_spotify_overrides o
+		WHERE o.normalized_key = s.normalized_key
+			AND o.kind = 'reject'
+			AND s.spotify_id = o.spotify_id
+		RETURNING s.id`,
+	} {
+		ids, err := queryIDs(txn, query)
+		if err != nil {
+			return 0, fmt.Errorf("Error updating `songs`: %v", err)
+		}
+		songIDs = append(songIDs, ids...)
+	}
+
+	if len(songIDs) == 0 {
+		return 0, nil
+	}
+
+	err := MarkPlaylistsForSync(txn, songIDs)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(songIDs), nil
+}
+
+// DeleteSpotifyOverrides removes the overrides for a song. If spotifyID is
+// set, only overrides for that track are removed. It returns the number that
+// were.
+func DeleteSpotifyOverrides(txn *sql.Tx, artist, title, spotifyID string) (int, error) {
+	res, err := txn.Exec(`
+		DELETE FROM song_spotify_overrides
+		WHERE normalized_key = $1
+			AND ($2 = '' OR spotify_id = $2)`,
+		dgnormalize.SongKey(artist, title),
+		spotifyID,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("Error deleting from `song_spotify_overrides`: %v", err)
+	}
+
+	numRows, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(numRows), nil
+}
+
+// FetchSpotifyOverrides retrieves every override ordered by song.
+func FetchSpotifyOverrides(txn *sql.Tx) ([]*SpotifyOverride, error) {
+	rows, err := txn.Query(`
+		SELECT kind, artist, title, COALESCE(spotify_id, ''), note
+		FROM song_spotify_overrides
+		ORDER BY normalized_key, kind, spotify_id`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var overrides []*SpotifyOverride
+
+	for rows.Next() {
+		var override SpotifyOverride
+		err = rows.Scan(
+			&override.Kind,
+			&override.Artist,
+			&override.Title,
+			&override.SpotifyID,
+			&override.Note,
+		)
+		if err != nil {
+			return nil, err
+		}
+		overrides = append(overrides, &override)
+	}
+
+	return overrides, rows.Err()
+}
+
+// RejectedSpotifyIDs returns the Spotify tracks that have been rejected for
+// the song with the given ID, either by hand or because the song used to
+// have them and they became unavailable.
+func RejectedSpotifyIDs(txn *sql.Tx, songID int) (map[string]bool, error) {
+	rows, err := txn.Query(`
+		SELECT o.spotify_id
+		FROM song_spotify_overrides o
+			INNER JOIN songs s
+				ON s.normalized_key = o.normalized_key
+		WHERE s.id = $1
+			AND o.kind = $2
+		UNION
+		SELECT spotify_id
+		FROM song_spotify_id_history
+		WHERE songs_id = $1
+			AND reason = $3`,
+		songID,
+		OverrideReject,
+		SpotifyIDUnavailable,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rejected := make(map[string]bool)
+
+	for rows.Next() {
+		var spotifyID string
+		err = rows.Scan(&spotifyID)
+		if err != nil {
+			return nil, err
+		}
+		rejected[spotifyID] = true
+	}
+
+	return rejected, rows.Err()
+}
+
+// UpsertSpotifyOverride stores an override. A song can only be pinned or
+// marked as not on Spotify one way at a time, so either of those replaces
+// any pin or not on Spotify override that the song already had. Rejections
+// add up, but a song can't reject the track that it's pinned to.
+func UpsertSpotifyOverride(txn *sql.Tx, override *SpotifyOverride) error {
+	err := override.Validate()
+	if err != nil {
+		return err
+	}
+
+	key := dgnormalize.SongKey(override.Artist, override.Title)
+
+	var spotifyID *string
+	if override.SpotifyID != "" {
+		spotifyID = &override.SpotifyID
+	}
+
+	if override.Kind == OverrideReject {
+		var numPinned int
+		err = txn.QueryRow(`
+			SELECT count(*)
+			FROM song_spotify_overrides
+			WHERE normalized_key = $1
+				AND kind = $2
+				AND spotify_id = $3`,
+			key,
+			OverridePin,
+			override.SpotifyID,
+		).Scan(&numPinned)
+		if err != nil {
+			return err
+		}
+
+		if numPinned > 0 {
+			return fmt.Errorf("%v - %v is pinned to %v; remove the pin first",
+				override.Artist, override.Title, override.SpotifyID)
+		}
+
+		_, err = txn.Exec(`
+			INSERT INTO song_spotify_overrides
+				(normalized_key, kind, artist, title, spotify_id, note)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (normalized_key, spotify_id) WHERE kind = 'reject' DO UPDATE
+				SET note = excluded.note`,
+			key,
+			override.Kind,
+			override.Artist,
+			override.Title,
+			spotifyID,
+			override.Note,
+		)
+		if err != nil {
+			return fmt.Errorf("Error inserting into `song_spotify_overrides`: %v", err)
+		}
+
+		return nil
+	}
+
+	// Pinning a track that was rejected before means it's not rejected
+	// anymore.
+	_, err = txn.Exec(`
+		DELETE FROM song_spotify_overrides
+		WHERE normalized_key = $1
+			AND (kind <> $2 OR spotify_id = $3)`,
+		key,
+		OverrideReject,
+		spotifyID,
+	)
+	if err != nil {
+		return fmt.Errorf("Error deleting from `song_spotify_overrides`: %v", err)
+	}
+
+	_, err = txn.Exec(`
+		INSERT INTO song_spotify_overrides
+			(normalized_key, kind, artist, title, spotify_id, note)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		key,
+		override.Kind,
+		override.Artist,
+		override.Title,
+		spotifyID,
+		override.Note,
+	)
+	if err != nil {
+		return fmt.Errorf("Error inserting into `song_spotify_overrides`: %v", err)
+	}
+
+	return nil
+}
+
+// queryIDs runs a query that returns a single column of IDs.
+func queryIDs(txn *sql.Tx, query string, args ...interface{}) ([]int, error) {
+	rows, err := txn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+
+	for rows.Next() {
+		var id int
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
@@ -0,0 +1,136 @@
+package dgstore
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/brandur/deathguild/modules/dgcommon"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestApplySpotifyOverrides(t *testing.T) {
+	txn, err := db.Begin()
+	assert.NoError(t, err)
+	defer func() {
+		err := txn.Rollback()
+		assert.NoError(t, err)
+	}()
+
+	_, err = UpsertPlaylistAndSongs(txn, "deathguild", "2016-01-01", []*dgcommon.Song{
+		{Artist: "The Cure", Title: "A Forest"},
+		{Artist: "Ikon", Title: "Ghost"},
+		{Artist: "Covenant", Title: "Dead Stars"},
+	})
+	assert.NoError(t, err)
+
+	for _, song := range []struct{ artist, title, spotifyID string }{
+		{"The Cure", "A Forest", "wrong-id"},
+		{"Ikon", "Ghost", "some-id"},
+		{"Covenant", "Dead Stars", "rejected-id"},
+	} {
+		_, err = SetSongSpotifyID(txn, song.artist, song.title, song.spotifyID)
+		assert.NoError(t, err)
+	}
+
+	// Overrides apply to any spelling of a song.
+	for _, override := range []*SpotifyOverride{
+		{Kind: OverridePin, Artist: "Cure", Title: "A Forest", SpotifyID: "pinned-id"},
+		{Kind: OverrideNotOnSpotify, Artist: "Ikon", Title: "Ghost"},
+		{Kind: OverrideReject, Artist: "Covenant", Title: "Dead Stars", SpotifyID: "rejected-id"},
+	} {
+		err = UpsertSpotifyOverride(txn, override)
+		assert.NoError(t, err)
+	}
+
+	numChanged, err := ApplySpotifyOverrides(txn)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, numChanged)
+
+	spotifyID := func(artist, title string) (sql.NullString, sql.NullString) {
+		var spotifyID, strategy sql.NullString
+		err := txn.QueryRow(`
+			SELECT spotify_id, spotify_match_strategy
+			FROM songs
+			WHERE artist = $1
+				AND title = $2`,
+			artist,
+			title,
+		).Scan(&spotifyID, &strategy)
+		assert.NoError(t, err)
+		return spotifyID, strategy
+	}
+
+	id, strategy := spotifyID("The Cure", "A Forest")
+	assert.Equal(t, "pinned-id", id.String)
+	assert.Equal(t, "override", strategy.String)
+
+	id, _ = spotifyID("Ikon", "Ghost")
+	assert.False(t, id.Valid)
+
+	id, _ = spotifyID("Covenant", "Dead Stars")
+	assert.False(t, id.Valid)
+
+	// Applying again doesn't change anything.
+	numChanged, err = ApplySpotifyOverrides(txn)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, numChanged)
+
+	var needsSync bool
+	err = txn.QueryRow(`
+		SELECT spotify_needs_sync
+		FROM playlists
+		WHERE day = $1`,
+		"2016-01-01",
+	).Scan(&needsSync)
+	assert.NoError(t, err)
+	assert.True(t, needsSync)
+}
+
+func TestUpsertSpotifyOverride(t *testing.T) {
+	txn, err := db.Begin()
+	assert.NoError(t, err)
+	defer func() {
+		err := txn.Rollback()
+		assert.NoError(t, err)
+	}()
+
+	for _, override := range []*SpotifyOverride{
+		{Kind: OverrideReject, Artist: "The Cure", Title: "A Forest", SpotifyID: "karaoke-id"},
+		{Kind: OverrideReject, Artist: "The Cure", Title: "A Forest", SpotifyID: "live-id"},
+		{Kind: OverrideNotOnSpotify, Artist: "The Cure", Title: "A Forest"},
+
+		// Replaces the not on Spotify override and the rejection of the
+		// same track.
+		{Kind: OverridePin, Artist: "The Cure", Title: "A Forest", SpotifyID: "live-id"},
+	} {
+		err = UpsertSpotifyOverride(txn, override)
+		assert.NoError(t, err)
+	}
+
+	overrides, err := FetchSpotifyOverrides(txn)
+	assert.NoError(t, err)
+	assert.Equal(t, []*SpotifyOverride{
+		{Kind: OverridePin, Artist: "The Cure", Title: "A Forest", SpotifyID: "live-id"},
+		{Kind: OverrideReject, Artist: "The Cure", Title: "A Forest", SpotifyID: "karaoke-id"},
+	}, overrides)
+
+	// A pinned track can't be rejected.
+	err = UpsertSpotifyOverride(txn, &SpotifyOverride{
+		Kind: OverrideReject, Artist: "The Cure", Title: "A Forest", SpotifyID: "live-id",
+	})
+	assert.Error(t, err)
+
+	// Bad overrides are refused.
+	err = UpsertSpotifyOverride(txn, &SpotifyOverride{
+		Kind: OverridePin, Artist: "The Cure", Title: "A Forest",
+	})
+	assert.Error(t, err)
+
+	numRemoved, err := DeleteSpotifyOverrides(txn, "The Cure", "A Forest", "karaoke-id")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, numRemoved)
+
+	numRemoved, err = DeleteSpotifyOverrides(txn, "the cure", "a forest", "")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, numRemoved)
+}
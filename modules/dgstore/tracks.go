@@ -0,0 +1,89 @@
+package dgstore
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/brandur/deathguild/modules/dgcommon"
+)
+
+// UpsertSpotifyTrack stores metadata on a Spotify track, replacing whatever
+// was stored for it before.
+func UpsertSpotifyTrack(txn *sql.Tx, track *dgcommon.SpotifyTrack) error {
+	// We want a NULL in these fields if Spotify didn't have them.
+	var albumArtURL, isrc *string
+	if track.AlbumArtURL != "" {
+		albumArtURL = &track.AlbumArtURL
+	}
+	if track.ISRC != "" {
+		isrc = &track.ISRC
+	}
+
+	_, err := txn.Exec(`
+		INSERT INTO spotify_tracks
+			(spotify_id, name, album_name, album_release_date, album_art_url,
+				duration_ms, explicit, isrc, popularity, fetched_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, NOW())
+		ON CONFLICT (spotify_id) DO UPDATE
+			SET name = excluded.name,
+				album_name = excluded.album_name,
+				album_release_date = excluded.album_release_date,
+				album_art_url = excluded.album_art_url,
+				duration_ms = excluded.duration_ms,
+				explicit = excluded.explicit,
+				isrc = excluded.isrc,
+				popularity = excluded.popularity,
+				fetched_at = excluded.fetched_at`,
+		track.ID,
+		track.Name,
+		track.AlbumName,
+		track.AlbumReleaseDate,
+		albumArtURL,
+		int(track.Duration/time.Millisecond),
+		track.Explicit,
+		isrc,
+		track.Popularity,
+	)
+	if err != nil {
+		return fmt.Errorf("Error inserting into `spotify_tracks`: %v", err)
+	}
+
+	return nil
+}
+
+// UpsertAudioFeatures stores the audio features of the Spotify track with the
+// given ID, replacing whatever was stored for it before.
+func UpsertAudioFeatures(txn *sql.Tx, spotifyID string, features *dgcommon.AudioFeatures) error {
+	var mode int
+	if features.Major {
+		mode = 1
+	}
+
+	_, err := txn.Exec(`
+		INSERT INTO spotify_audio_features
+			(spotify_id, tempo, energy, danceability, valence, key, mode,
+				fetched_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NOW())
+		ON CONFLICT (spotify_id) DO UPDATE
+			SET tempo = excluded.tempo,
+				energy = excluded.energy,
+				danceability = excluded.danceability,
+				valence = excluded.valence,
+				key = excluded.key,
+				mode = excluded.mode,
+				fetched_at = excluded.fetched_at`,
+		spotifyID,
+		features.Tempo,
+		features.Energy,
+		features.Danceability,
+		features.Valence,
+		features.Key,
+		mode,
+	)
+	if err != nil {
+		return fmt.Errorf("Error inserting into `spotify_audio_features`: %v", err)
+	}
+
+	return nil
+}
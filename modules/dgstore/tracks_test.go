@@ -0,0 +1,89 @@
+package dgstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/brandur/deathguild/modules/dgcommon"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestUpsertSpotifyTrack(t *testing.T) {
+	txn, err := db.Begin()
+	assert.NoError(t, err)
+	defer func() {
+		err := txn.Rollback()
+		assert.NoError(t, err)
+	}()
+
+	track := &dgcommon.SpotifyTrack{
+		AlbumName:        "Seventeen Seconds",
+		AlbumReleaseDate: "1980",
+		Duration:         5*time.Minute + 54*time.Second,
+		ID:               "1JSLLcD4RKl8TZwBNhV5UX",
+		Name:             "A Forest",
+		Popularity:       62,
+	}
+
+	err = UpsertSpotifyTrack(txn, track)
+	assert.NoError(t, err)
+
+	// Storing the same track again replaces what was there.
+	track.AlbumArtURL = "https://i.scdn.co/image/64"
+	track.AlbumReleaseDate = "1980-04-22"
+	err = UpsertSpotifyTrack(txn, track)
+	assert.NoError(t, err)
+
+	var albumArtURL, albumReleaseDate string
+	var durationMS, numTracks int
+	err = txn.QueryRow(`
+		SELECT album_art_url, album_release_date, duration_ms,
+			(SELECT count(*) FROM spotify_tracks)
+		FROM spotify_tracks
+		WHERE spotify_id = $1`,
+		track.ID,
+	).Scan(&albumArtURL, &albumReleaseDate, &durationMS, &numTracks)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://i.scdn.co/image/64", albumArtURL)
+	assert.Equal(t, "1980-04-22", albumReleaseDate)
+	assert.Equal(t, 354000, durationMS)
+	assert.Equal(t, 1, numTracks)
+}
+
+func TestUpsertAudioFeatures(t *testing.T) {
+	txn, err := db.Begin()
+	assert.NoError(t, err)
+	defer func() {
+		err := txn.Rollback()
+		assert.NoError(t, err)
+	}()
+
+	features := &dgcommon.AudioFeatures{
+		Danceability: 0.5,
+		Energy:       0.75,
+		Key:          9,
+		Tempo:        128,
+		Valence:      0.25,
+	}
+
+	err = UpsertAudioFeatures(txn, "spotify-id", features)
+	assert.NoError(t, err)
+
+	// Storing the same track's features again replaces what was there.
+	features.Major = true
+	features.Tempo = 130
+	err = UpsertAudioFeatures(txn, "spotify-id", features)
+	assert.NoError(t, err)
+
+	var mode int
+	var tempo float64
+	err = txn.QueryRow(`
+		SELECT mode, tempo
+		FROM spotify_audio_features
+		WHERE spotify_id = $1`,
+		"spotify-id",
+	).Scan(&mode, &tempo)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, mode)
+	assert.Equal(t, 130.0, tempo)
+}
@@ -0,0 +1,153 @@
+package dgstore
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// Possible values of `song_spotify_id_history.reason`.
+const (
+	// SpotifyIDMismatched means that an audit found that a song's track
+	// didn't match it well enough, so the song lost its ID.
+	SpotifyIDMismatched = "mismatched"
+
+	// SpotifyIDRelinked means that Spotify relinked a song's track to
+	// another one, which the song was moved over to.
+	SpotifyIDRelinked = "relinked"
+
+	// SpotifyIDUnavailable means that a song's track was no longer
+	// available, so the song lost its ID.
+	SpotifyIDUnavailable = "unavailable"
+)
+
+// MarkSpotifyIDsVerified records that the tracks with the given IDs were
+// just found to still be available on Spotify.
+func MarkSpotifyIDsVerified(txn *sql.Tx, spotifyIDs []string) error {
+	_, err := txn.Exec(`
+		UPDATE songs
+		SET spotify_verified_at = NOW()
+		WHERE spotify_id = any($1)`,
+		pq.Array(spotifyIDs),
+	)
+	if err != nil {
+		return fmt.Errorf("Error updating `songs`: %v", err)
+	}
+
+	return nil
+}
+
+// RelinkSpotifyID moves every song with the Spotify ID oldID over to newID,
+// the track that Spotify relinked it to, and records the old ID in each
+// song's history. Songs pinned to oldID by hand are left alone. It returns
+// the IDs of the songs that were moved.
+func RelinkSpotifyID(txn *sql.Tx, oldID, newID string) ([]int, error) {
+	songIDs, err := queryIDs(txn, `
+		WITH relinked AS (
+			UPDATE songs s
+			SET spotify_id = $2,
+				spotify_verified_at = NOW()
+			WHERE s.spotify_id = $1
+				AND NOT EXISTS (
+					SELECT 1
+					FROM song_spotify_overrides o
+					WHERE o.normalized_key = s.normalized_key
+						AND o.kind = 'pin'
+				)
+			RETURNING s.id
+		), history AS (
+			INSERT INTO song_spotify_id_history
+				(songs_id, spotify_id, replaced_by, reason)
+			SELECT id, $1, $2, $3
+			FROM relinked
+		)
+		SELECT id
+		FROM relinked`,
+		oldID,
+		newID,
+		SpotifyIDRelinked,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("Error updating `songs`: %v", err)
+	}
+
+	return songIDs, nil
+}
+
+// RequeueMismatchedSongs takes the Spotify IDs away from songs because their
+// tracks turned out not to match them, records the old IDs in each song's
+// history, and queues the songs to be searched for again. spotifyIDs maps the
+// ID of each song to the Spotify ID that was found not to match, and a song
+// that has been matched to another track since is left alone. Unlike
+// unavailable tracks, the old tracks can be picked again if a search scores
+// them well enough. Songs pinned to a track by hand are left alone too. It
+// returns the IDs of the songs that were requeued.
+func RequeueMismatchedSongs(txn *sql.Tx, spotifyIDs map[int]string) ([]int, error) {
+	var songIDs []int
+	var songSpotifyIDs []string
+	for songID, spotifyID := range spotifyIDs {
+		songIDs = append(songIDs, songID)
+		songSpotifyIDs = append(songSpotifyIDs, spotifyID)
+	}
+
+	return requeueSongs(txn, SpotifyIDMismatched,
+		`(id, spotify_id) IN (SELECT * FROM unnest($2::bigint[], $3::text[]))`,
+		pq.Array(songIDs), pq.Array(songSpotifyIDs))
+}
+
+// RequeueSpotifyID takes the Spotify ID spotifyID away from every song that
+// has it because its track is no longer available, records it in each song's
+// history, and queues the songs to be searched for again. The track is never
+// picked for them again (see RejectedSpotifyIDs). Songs pinned to it by hand
+// are left alone. It returns the IDs of the songs that were requeued.
+func RequeueSpotifyID(txn *sql.Tx, spotifyID string) ([]int, error) {
+	return requeueSongs(txn, SpotifyIDUnavailable, `spotify_id = $2`, spotifyID)
+}
+
+// requeueSongs clears the Spotify IDs of songs matching condition, a
+// condition on `songs` taking args from `$2` on, and records their old IDs
+// in their history with the given reason.
+func requeueSongs(txn *sql.Tx, reason, condition string, args ...interface{}) ([]int, error) {
+	songIDs, err := queryIDs(txn, `
+		WITH requeued AS (
+			UPDATE songs s
+			SET spotify_attempts = 0,
+				spotify_checked_at = NULL,
+				spotify_enrichment_runs_id = NULL,
+				spotify_id = NULL,
+				spotify_match_score = NULL,
+				spotify_match_strategy = NULL,
+				spotify_next_check_at = NULL,
+				spotify_verified_at = NULL
+			FROM (
+				SELECT id, spotify_id
+				FROM songs
+				WHERE `+condition+`
+					AND spotify_id IS NOT NULL
+				FOR UPDATE
+			) old
+			WHERE s.id = old.id
+				AND NOT EXISTS (
+					SELECT 1
+					FROM song_spotify_overrides o
+					WHERE o.normalized_key = s.normalized_key
+						AND o.kind = 'pin'
+				)
+			RETURNING s.id, old.spotify_id
+		), history AS (
+			INSERT INTO song_spotify_id_history
+				(songs_id, spotify_id, reason)
+			SELECT id, spotify_id, $1
+			FROM requeued
+		)
+		SELECT id
+		FROM requeued`,
+		append([]interface{}{reason}, args...)...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("Error updating `songs`: %v", err)
+	}
+
+	return songIDs, nil
+}
@@ -0,0 +1,219 @@
+package dgstore
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/brandur/deathguild/modules/dgcommon"
+	"github.com/brandur/deathguild/modules/dgtesting"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestMarkPlaylistsForSync(t *testing.T) {
+	txn, err := db.Begin()
+	assert.NoError(t, err)
+	defer func() {
+		err := txn.Rollback()
+		assert.NoError(t, err)
+	}()
+
+	for _, day := range []string{"2015-01-01", "2016-01-01"} {
+		_, err = UpsertPlaylistAndSongs(txn, "deathguild", day, []*dgcommon.Song{
+			{Artist: "The Cure", Title: day},
+		})
+		assert.NoError(t, err)
+	}
+
+	_, err = txn.Exec(`
+		UPDATE playlists
+		SET spotify_needs_sync = false`,
+	)
+	assert.NoError(t, err)
+
+	var songID int
+	err = txn.QueryRow(`
+		SELECT id
+		FROM songs
+		WHERE title = '2016-01-01'`,
+	).Scan(&songID)
+	assert.NoError(t, err)
+
+	err = MarkPlaylistsForSync(txn, []int{songID})
+	assert.NoError(t, err)
+
+	// Only the night that the song was played needs to be synced.
+	var needsSync []string
+	rows, err := txn.Query(`
+		SELECT day::text
+		FROM playlists
+		WHERE spotify_needs_sync
+		ORDER BY 1`,
+	)
+	assert.NoError(t, err)
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		assert.NoError(t, err)
+		needsSync = append(needsSync, name)
+	}
+	assert.NoError(t, rows.Err())
+	assert.Equal(t, []string{"2016-01-01"}, needsSync)
+}
+
+func TestRelinkSpotifyID(t *testing.T) {
+	txn, err := db.Begin()
+	assert.NoError(t, err)
+	defer func() {
+		err := txn.Rollback()
+		assert.NoError(t, err)
+	}()
+
+	songs := []*dgcommon.Song{
+		{Artist: "The Cure", Title: "A Forest", SpotifyID: "old-id"},
+		{Artist: "Ikon", Title: "Ghost", SpotifyID: "old-id"},
+	}
+	for _, song := range songs {
+		dgtesting.InsertSong(t, txn, song)
+	}
+
+	// Songs pinned to a track by hand keep it.
+	err = UpsertSpotifyOverride(txn, &SpotifyOverride{
+		Kind:      OverridePin,
+		Artist:    "Ikon",
+		Title:     "Ghost",
+		SpotifyID: "old-id",
+	})
+	assert.NoError(t, err)
+
+	songIDs, err := RelinkSpotifyID(txn, "old-id", "new-id")
+	assert.NoError(t, err)
+	assert.Equal(t, []int{songs[0].ID}, songIDs)
+
+	var spotifyID string
+	var verifiedAt sql.NullString
+	err = txn.QueryRow(`
+		SELECT spotify_id, spotify_verified_at
+		FROM songs
+		WHERE id = $1`,
+		songs[0].ID,
+	).Scan(&spotifyID, &verifiedAt)
+	assert.NoError(t, err)
+	assert.Equal(t, "new-id", spotifyID)
+	assert.True(t, verifiedAt.Valid)
+
+	var oldID, replacedBy, reason string
+	err = txn.QueryRow(`
+		SELECT spotify_id, replaced_by, reason
+		FROM song_spotify_id_history
+		WHERE songs_id = $1`,
+		songs[0].ID,
+	).Scan(&oldID, &replacedBy, &reason)
+	assert.NoError(t, err)
+	assert.Equal(t, "old-id", oldID)
+	assert.Equal(t, "new-id", replacedBy)
+	assert.Equal(t, SpotifyIDRelinked, reason)
+
+	// A relinked track isn't rejected.
+	rejected, err := RejectedSpotifyIDs(txn, songs[0].ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(rejected))
+}
+
+func TestRequeueSpotifyID(t *testing.T) {
+	txn, err := db.Begin()
+	assert.NoError(t, err)
+	defer func() {
+		err := txn.Rollback()
+		assert.NoError(t, err)
+	}()
+
+	song := &dgcommon.Song{Artist: "The Cure", Title: "A Forest", SpotifyID: "gone-id"}
+	dgtesting.InsertSong(t, txn, song)
+
+	songIDs, err := RequeueSpotifyID(txn, "gone-id")
+	assert.NoError(t, err)
+	assert.Equal(t, []int{song.ID}, songIDs)
+
+	// The song is due to be searched for again, and the old track won't be
+	// picked for it.
+	var spotifyID, checkedAt, nextCheckAt sql.NullString
+	err = txn.QueryRow(`
+		SELECT spotify_id, spotify_checked_at, spotify_next_check_at
+		FROM songs
+		WHERE id = $1`,
+		song.ID,
+	).Scan(&spotifyID, &checkedAt, &nextCheckAt)
+	assert.NoError(t, err)
+	assert.False(t, spotifyID.Valid)
+	assert.False(t, checkedAt.Valid)
+	assert.False(t, nextCheckAt.Valid)
+
+	rejected, err := RejectedSpotifyIDs(txn, song.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"gone-id": true}, rejected)
+}
+
+func TestRequeueMismatchedSongs(t *testing.T) {
+	txn, err := db.Begin()
+	assert.NoError(t, err)
+	defer func() {
+		err := txn.Rollback()
+		assert.NoError(t, err)
+	}()
+
+	songs := []*dgcommon.Song{
+		{Artist: "The Cure", Title: "A Forest", SpotifyID: "cover-id"},
+		{Artist: "Ikon", Title: "Ghost", SpotifyID: "ghost-id"},
+		{Artist: "Covenant", Title: "Dead Stars", SpotifyID: "dead-stars-id"},
+	}
+	for _, song := range songs {
+		dgtesting.InsertSong(t, txn, song)
+	}
+
+	// Songs pinned to a track by hand keep it.
+	err = UpsertSpotifyOverride(txn, &SpotifyOverride{
+		Kind:      OverridePin,
+		Artist:    "Ikon",
+		Title:     "Ghost",
+		SpotifyID: "ghost-id",
+	})
+	assert.NoError(t, err)
+
+	// Songs matched to another track since they were audited are left alone
+	// too.
+	songIDs, err := RequeueMismatchedSongs(txn, map[int]string{
+		songs[0].ID: "cover-id",
+		songs[1].ID: "ghost-id",
+		songs[2].ID: "old-dead-stars-id",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{songs[0].ID}, songIDs)
+
+	var spotifyID sql.NullString
+	err = txn.QueryRow(`
+		SELECT spotify_id
+		FROM songs
+		WHERE id = $1`,
+		songs[0].ID,
+	).Scan(&spotifyID)
+	assert.NoError(t, err)
+	assert.False(t, spotifyID.Valid)
+
+	var oldID, reason string
+	err = txn.QueryRow(`
+		SELECT spotify_id, reason
+		FROM song_spotify_id_history
+		WHERE songs_id = $1`,
+		songs[0].ID,
+	).Scan(&oldID, &reason)
+	assert.NoError(t, err)
+	assert.Equal(t, "cover-id", oldID)
+	assert.Equal(t, SpotifyIDMismatched, reason)
+
+	// Unlike an unavailable track, a mismatched one can be found again.
+	rejected, err := RejectedSpotifyIDs(txn, songs[0].ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(rejected))
+}
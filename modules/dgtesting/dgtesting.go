@@ -5,6 +5,8 @@ import (
 	"testing"
 
 	"github.com/brandur/deathguild/modules/dgcommon"
+	"github.com/brandur/deathguild/modules/dgnormalize"
+	"github.com/brandur/deathguild/modules/dgsource"
 	"github.com/brandur/modulir"
 	"github.com/joeshaw/envdecode"
 	assert "github.com/stretchr/testify/require"
@@ -24,9 +26,21 @@ type Conf struct {
 }
 
 var tablesToTruncate = []string{
+	"artists",
+	"enrichment_runs",
+	"http_cache",
+	"musicbrainz_recordings",
+	"playlist_pages",
 	"playlists",
 	"playlists_songs",
+	"song_aliases",
+	"song_spotify_id_history",
+	"song_spotify_overrides",
 	"songs",
+	"songs_artists",
+	"special_playlists",
+	"spotify_audio_features",
+	"spotify_tracks",
 }
 
 var conf Conf
@@ -52,17 +66,23 @@ func init() {
 	truncateTestDB(DB)
 }
 
-// InsertPlaylist puts a playlist into the database.
+// InsertPlaylist puts a playlist into the database. Its source defaults to
+// Death Guild if one wasn't set.
 func InsertPlaylist(t *testing.T, txn *sql.Tx, playlist *dgcommon.Playlist) {
 	var spotifyID *string
 	if playlist.SpotifyID != "" {
 		spotifyID = &playlist.SpotifyID
 	}
 
+	if playlist.Source == "" {
+		playlist.Source = dgsource.DeathGuild.Name()
+	}
+
 	err := txn.QueryRow(`
-		INSERT INTO playlists (day, spotify_id)
-		VALUES ($1, $2)
+		INSERT INTO playlists (source, day, spotify_id)
+		VALUES ($1, $2, $3)
 		RETURNING id`,
+		playlist.Source,
 		playlist.Day,
 		spotifyID,
 	).Scan(&playlist.ID)
@@ -77,11 +97,12 @@ func InsertSong(t *testing.T, txn *sql.Tx, song *dgcommon.Song) {
 	}
 
 	err := txn.QueryRow(`
-		INSERT INTO songs (artist, title, spotify_id)
-		VALUES ($1, $2, $3)
+		INSERT INTO songs (artist, title, normalized_key, spotify_id)
+		VALUES ($1, $2, $3, $4)
 		RETURNING id`,
 		song.Artist,
 		song.Title,
+		dgnormalize.SongKey(song.Artist, song.Title),
 		spotifyID,
 	).Scan(&song.ID)
 	assert.NoError(t, err)
@@ -0,0 +1,134 @@
+package dgvalidate
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/brandur/deathguild/modules/dgcommon"
+)
+
+const (
+	// MaxSongs is the number of songs above which a night is suspiciously
+	// long. A typical Death Guild plays somewhere between 70 and 160.
+	MaxSongs = 300
+
+	// MinSongs is the number of songs below which a night is suspiciously
+	// short.
+	MinSongs = 10
+
+	// QuarantineScore is the score at or above which a playlist is
+	// quarantined instead of being published.
+	QuarantineScore = 10
+)
+
+// Weights of issues. An issue with a weight of QuarantineScore or more is
+// enough on its own to quarantine a playlist, while lesser ones need to add
+// up.
+const (
+	weightSevere  = QuarantineScore
+	weightWarning = 3
+)
+
+// Issue is a single problem found with a playlist.
+type Issue struct {
+	// Check is a short, stable identifier of the check that found the issue
+	// like `html` or `empty_artist`.
+	Check string `json:"check"`
+
+	// Message describes the issue in a human-readable way.
+	Message string `json:"message"`
+
+	// Position is the 1-indexed position of the song that the issue was
+	// found in, or zero if it applies to the whole playlist.
+	Position int `json:"position,omitempty"`
+
+	// Weight is how much the issue counts towards the playlist's score.
+	Weight int `json:"weight"`
+}
+
+// Result is the outcome of validating a playlist.
+type Result struct {
+	// Issues are all the issues found, in the order of the songs that they
+	// were found in.
+	Issues []*Issue
+
+	// Score is the sum of the weights of all issues.
+	Score int
+}
+
+// Quarantined returns whether the playlist is suspicious enough that it
+// should be held for review instead of being published.
+func (r *Result) Quarantined() bool {
+	return r.Score >= QuarantineScore
+}
+
+// Matches what looks like an HTML tag or an HTML entity that wasn't
+// unescaped.
+var htmlRegexp = regexp.MustCompile(`</?[a-zA-Z][^>]*>|&(?:[a-zA-Z]+|#\d+|#x[0-9a-fA-F]+);`)
+
+// Validate scores a playlist's songs against a set of heuristics for things
+// that tend to go wrong when scraping.
+func Validate(songs []*dgcommon.Song) *Result {
+	result := &Result{}
+
+	add := func(check string, position, weight int, format string, args ...interface{}) {
+		result.Issues = append(result.Issues, &Issue{
+			Check:    check,
+			Message:  fmt.Sprintf(format, args...),
+			Position: position,
+			Weight:   weight,
+		})
+		result.Score += weight
+	}
+
+	if len(songs) < MinSongs {
+		add("too_short", 0, weightSevere,
+			"only %v song(s); fewer than %v is suspicious", len(songs), MinSongs)
+	}
+
+	if len(songs) > MaxSongs {
+		add("too_long", 0, weightSevere,
+			"%v songs; more than %v is suspicious", len(songs), MaxSongs)
+	}
+
+	for i, song := range songs {
+		position := i + 1
+
+		if strings.TrimSpace(song.Artist) == "" {
+			add("empty_artist", position, weightSevere, "empty artist")
+		}
+
+		if strings.TrimSpace(song.Title) == "" {
+			add("empty_title", position, weightSevere, "empty title")
+		}
+
+		if strings.EqualFold(strings.TrimSpace(song.Artist), "artist") &&
+			strings.EqualFold(strings.TrimSpace(song.Title), "title") {
+			add("header_row", position, weightSevere, "looks like a table header")
+		}
+
+		for _, field := range []struct{ name, value string }{
+			{"artist", song.Artist},
+			{"title", song.Title},
+		} {
+			if htmlRegexp.MatchString(field.value) {
+				add("html", position, weightSevere,
+					"%v contains leftover HTML: %q", field.name, field.value)
+			}
+
+			if strings.IndexFunc(field.value, unicode.IsControl) != -1 {
+				add("control_characters", position, weightWarning,
+					"%v contains control characters: %q", field.name, field.value)
+			}
+		}
+
+		if i > 0 && song.Artist == songs[i-1].Artist && song.Title == songs[i-1].Title {
+			add("repeated", position, weightWarning,
+				"same song as the one before it: %v - %v", song.Artist, song.Title)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,101 @@
+package dgvalidate
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/brandur/deathguild/modules/dgcommon"
+	"github.com/brandur/deathguild/modules/dgsource"
+	assert "github.com/stretchr/testify/require"
+)
+
+// playlist makes a plausible playlist of n distinct songs.
+func playlist(n int) []*dgcommon.Song {
+	var songs []*dgcommon.Song
+	for i := 0; i < n; i++ {
+		songs = append(songs, &dgcommon.Song{
+			Artist: fmt.Sprintf("Artist %v", i),
+			Title:  fmt.Sprintf("Title %v", i),
+		})
+	}
+	return songs
+}
+
+func checks(result *Result) []string {
+	var checks []string
+	for _, issue := range result.Issues {
+		checks = append(checks, fmt.Sprintf("%v@%v", issue.Check, issue.Position))
+	}
+	return checks
+}
+
+func TestValidate(t *testing.T) {
+	result := Validate(playlist(50))
+	assert.Empty(t, result.Issues)
+	assert.Equal(t, 0, result.Score)
+	assert.False(t, result.Quarantined())
+}
+
+func TestValidateSamples(t *testing.T) {
+	// Real playlists should come through clean.
+	for _, sample := range []string{"2016-09-26", "2018-07-16"} {
+		f, err := os.Open("../dgtesting/samples/" + sample + ".html")
+		assert.NoError(t, err)
+		defer f.Close()
+
+		songs, err := dgsource.DeathGuild.ParsePlaylist(f)
+		assert.NoError(t, err)
+
+		result := Validate(songs)
+		assert.Empty(t, result.Issues, sample)
+	}
+}
+
+func TestValidateLength(t *testing.T) {
+	result := Validate(playlist(3))
+	assert.Equal(t, []string{"too_short@0"}, checks(result))
+	assert.True(t, result.Quarantined())
+
+	result = Validate(playlist(MaxSongs + 1))
+	assert.Equal(t, []string{"too_long@0"}, checks(result))
+	assert.True(t, result.Quarantined())
+}
+
+func TestValidateSongs(t *testing.T) {
+	songs := playlist(20)
+	songs[0] = &dgcommon.Song{Artist: "Artist", Title: "Title"}
+	songs[1] = &dgcommon.Song{Artist: " ", Title: "You Remain"}
+	songs[2] = &dgcommon.Song{Artist: "Panic Lift", Title: ""}
+	songs[3] = &dgcommon.Song{Artist: "Simon &amp; Garfunkel", Title: "I Am A Rock"}
+	songs[4] = &dgcommon.Song{Artist: "BT", Title: "Godspeed</td>"}
+
+	result := Validate(songs)
+	assert.Equal(t, []string{
+		"header_row@1",
+		"empty_artist@2",
+		"empty_title@3",
+		"html@4",
+		"html@5",
+	}, checks(result))
+	assert.Equal(t, 5*QuarantineScore, result.Score)
+	assert.True(t, result.Quarantined())
+}
+
+func TestValidateWarnings(t *testing.T) {
+	songs := playlist(20)
+	songs[5] = songs[4]
+	songs[10] = &dgcommon.Song{Artist: "Covenant", Title: "Dead\tStars"}
+
+	// Each of these alone isn't enough to quarantine.
+	result := Validate(songs)
+	assert.Equal(t, []string{"repeated@6", "control_characters@11"}, checks(result))
+	assert.Equal(t, 2*weightWarning, result.Score)
+	assert.False(t, result.Quarantined())
+
+	// But enough of them are.
+	songs[15] = songs[14]
+	songs[17] = songs[16]
+	result = Validate(songs)
+	assert.True(t, result.Quarantined())
+}
@@ -0,0 +1,163 @@
+package dgwarc
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reader reads records out of a WARC (Web ARChive) file like the ones produced
+// by the Wayback Machine, wget, and other crawlers one at a time. Files may be
+// plain or gzipped, including the usual layout where every record is
+// compressed as its own gzip member.
+//
+// Only as much of the format is implemented as is needed to pull captured
+// pages back out of an archive.
+type Reader struct {
+	r *textproto.Reader
+}
+
+// NewReader returns a reader for the WARC content in r. Whether it's gzipped
+// is detected automatically.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+
+	magic, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		// gzip.Reader reads through concatenated members by default, so a
+		// file compressed record by record comes out as one stream.
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		br = bufio.NewReader(gz)
+	}
+
+	return &Reader{r: textproto.NewReader(br)}, nil
+}
+
+// Next returns the next record in the file. It returns io.EOF when there are
+// no more.
+func (r *Reader) Next() (*Record, error) {
+	// Records are separated by blank lines, and there may be a few extra of
+	// them kicking around.
+	var version string
+	for {
+		line, err := r.r.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+
+		if line != "" {
+			version = line
+			break
+		}
+	}
+
+	if !strings.HasPrefix(version, "WARC/") {
+		return nil, fmt.Errorf("expected WARC version line but got: %q", version)
+	}
+
+	header, err := r.r.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	length, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad Content-Length in record %v: %v",
+			header.Get("WARC-Record-ID"), err)
+	}
+
+	content := make([]byte, length)
+	_, err = io.ReadFull(r.r.R, content)
+	if err != nil {
+		return nil, fmt.Errorf("truncated record %v: %v",
+			header.Get("WARC-Record-ID"), err)
+	}
+
+	return &Record{Header: header, Content: content}, nil
+}
+
+// Record is a single record from a WARC file.
+type Record struct {
+	// Header contains the record's WARC headers like `WARC-Type` and
+	// `WARC-Target-URI`.
+	Header textproto.MIMEHeader
+
+	// Content is the record's raw content block. For a response record
+	// that's a full HTTP response including its status line and headers.
+	Content []byte
+}
+
+// Date returns the time that the record's content was captured.
+func (r *Record) Date() (time.Time, error) {
+	return time.Parse(time.RFC3339, r.Header.Get("WARC-Date"))
+}
+
+// ID returns the record's unique identifier.
+func (r *Record) ID() string {
+	return r.Header.Get("WARC-Record-ID")
+}
+
+// TargetURI returns the URI of the content that the record captured.
+func (r *Record) TargetURI() string {
+	// Some writers wrap the URI in angle brackets as an early draft of the
+	// spec said to.
+	return strings.Trim(r.Header.Get("WARC-Target-URI"), "<>")
+}
+
+// Type returns the record's type like `response` or `warcinfo`.
+func (r *Record) Type() string {
+	return r.Header.Get("WARC-Type")
+}
+
+// Payload returns the status code and body of the page that the record
+// captured. Response records contain a full HTTP response which is parsed
+// (and decompressed if it was sent gzipped), while resource records contain
+// the page's body directly. Other types of record don't have a payload.
+func (r *Record) Payload() (int, []byte, error) {
+	switch r.Type() {
+	case "resource":
+		return http.StatusOK, r.Content, nil
+
+	case "response":
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(r.Content)), nil)
+		if err != nil {
+			return 0, nil, err
+		}
+		defer resp.Body.Close()
+
+		var body io.Reader = resp.Body
+		if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+			gz, err := gzip.NewReader(resp.Body)
+			if err != nil {
+				return 0, nil, err
+			}
+			defer gz.Close()
+			body = gz
+		}
+
+		content, err := ioutil.ReadAll(body)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		return resp.StatusCode, content, nil
+
+	default:
+		return 0, nil, fmt.Errorf("record of type %q has no payload", r.Type())
+	}
+}
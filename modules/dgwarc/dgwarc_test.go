@@ -0,0 +1,158 @@
+package dgwarc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+// warcRecord renders a single WARC record.
+func warcRecord(warcType, uri, content string) string {
+	return fmt.Sprintf("WARC/1.0\r\n"+
+		"WARC-Type: %v\r\n"+
+		"WARC-Record-ID: <urn:uuid:%v>\r\n"+
+		"WARC-Date: 2005-02-04T08:36:15Z\r\n"+
+		"WARC-Target-URI: %v\r\n"+
+		"Content-Length: %v\r\n"+
+		"\r\n"+
+		"%v\r\n\r\n",
+		warcType, uri, uri, len(content), content)
+}
+
+// gzipMember compresses a string as a standalone gzip member.
+func gzipMember(t *testing.T, s string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write([]byte(s))
+	assert.NoError(t, err)
+	assert.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+func readAll(t *testing.T, r io.Reader) []*Record {
+	reader, err := NewReader(r)
+	assert.NoError(t, err)
+
+	var records []*Record
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		records = append(records, record)
+	}
+	return records
+}
+
+var testRecords = []string{
+	warcRecord("warcinfo", "", "software: test"),
+	warcRecord("response", "http://www.deathguild.com/playlist/2005-01-31",
+		"HTTP/1.1 200 OK\r\nContent-Type: text/html\r\n\r\n<html>playlist</html>"),
+	warcRecord("resource", "<http://www.deathguild.com/playdates>", "<html>index</html>"),
+}
+
+func TestReader(t *testing.T) {
+	var buf bytes.Buffer
+	for _, record := range testRecords {
+		buf.WriteString(record)
+	}
+
+	records := readAll(t, &buf)
+	assert.Equal(t, 3, len(records))
+
+	assert.Equal(t, "warcinfo", records[0].Type())
+
+	record := records[1]
+	assert.Equal(t, "response", record.Type())
+	assert.Equal(t, "http://www.deathguild.com/playlist/2005-01-31", record.TargetURI())
+	assert.Equal(t, "<urn:uuid:http://www.deathguild.com/playlist/2005-01-31>", record.ID())
+
+	date, err := record.Date()
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2005, 2, 4, 8, 36, 15, 0, time.UTC), date)
+
+	status, body, err := record.Payload()
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "<html>playlist</html>", string(body))
+
+	// Angle brackets are stripped from URIs.
+	record = records[2]
+	assert.Equal(t, "http://www.deathguild.com/playdates", record.TargetURI())
+
+	status, body, err = record.Payload()
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "<html>index</html>", string(body))
+
+	_, _, err = records[0].Payload()
+	assert.Error(t, err)
+}
+
+func TestReaderGzipped(t *testing.T) {
+	// Compressed record by record like most WARC files are.
+	var buf bytes.Buffer
+	for _, record := range testRecords {
+		buf.Write(gzipMember(t, record))
+	}
+
+	records := readAll(t, &buf)
+	assert.Equal(t, 3, len(records))
+	assert.Equal(t, "http://www.deathguild.com/playdates", records[2].TargetURI())
+}
+
+func TestReaderEmpty(t *testing.T) {
+	assert.Empty(t, readAll(t, &bytes.Buffer{}))
+}
+
+func TestReaderMalformed(t *testing.T) {
+	reader, err := NewReader(bytes.NewBufferString("not a warc\r\n"))
+	assert.NoError(t, err)
+	_, err = reader.Next()
+	assert.Error(t, err)
+
+	// Content that ends before its declared length.
+	reader, err = NewReader(bytes.NewBufferString(
+		"WARC/1.0\r\nWARC-Type: resource\r\nContent-Length: 100\r\n\r\nshort"))
+	assert.NoError(t, err)
+	_, err = reader.Next()
+	assert.Error(t, err)
+}
+
+func TestRecordPayloadGzipped(t *testing.T) {
+	content := "HTTP/1.1 200 OK\r\nContent-Encoding: gzip\r\n\r\n" +
+		string(gzipMember(t, "<html>playlist</html>"))
+
+	var buf bytes.Buffer
+	buf.WriteString(warcRecord("response", "http://www.deathguild.com/playlist/2005-01-31", content))
+
+	records := readAll(t, &buf)
+	assert.Equal(t, 1, len(records))
+
+	status, body, err := records[0].Payload()
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "<html>playlist</html>", string(body))
+}
+
+func TestRecordPayloadChunked(t *testing.T) {
+	content := "HTTP/1.1 404 Not Found\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"5\r\ngone!\r\n0\r\n\r\n"
+
+	var buf bytes.Buffer
+	buf.WriteString(warcRecord("response", "http://www.deathguild.com/playlist/2005-01-31", content))
+
+	records := readAll(t, &buf)
+
+	status, body, err := records[0].Payload()
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Equal(t, "gone!", string(body))
+}